@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// maxBlockNotifications caps the desktop notifications shown per heartbeat;
+// further blocks are summarized in one notification.
+const maxBlockNotifications = 3
+
+// blockNotifier shows the blocks returned in heartbeat responses. It sends the
+// last block_seq back so each block is reported once.
+type blockNotifier struct {
+	seq    uint64
+	primed bool // blocks from before the agent started are only logged
+	notify func(title, content string)
+}
+
+func (n *blockNotifier) handle(logMgr *agentui.LogManager, cfg agentui.Config, resp heartbeatResponse) {
+	if resp.BlockSeq < n.seq {
+		// Proxy restarted: its sequence starts over.
+		n.seq = 0
+		return
+	}
+	n.seq = resp.BlockSeq
+
+	shown := 0
+	for _, b := range resp.Blocks {
+		logMgr.Add(agentui.BlockLogLine(b))
+		if !n.primed || cfg.MuteBlocks || n.notify == nil {
+			continue
+		}
+		if shown < maxBlockNotifications {
+			n.notify("Site bloqueado", agentui.BlockMessage(b))
+		}
+		shown++
+	}
+	if extra := shown - maxBlockNotifications; extra > 0 {
+		n.notify("Sites bloqueados", fmt.Sprintf("Mais %d sites bloqueados (veja os logs do ZID Agent)", extra))
+	}
+	n.primed = true
+}
@@ -4,30 +4,73 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/guilherme/zid-proxy/internal/agentauth"
 	"github.com/guilherme/zid-proxy/internal/agentui"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
 	"github.com/guilherme/zid-proxy/internal/gateway"
 )
 
 const (
 	heartbeatTimeout = 5 * time.Second
 	heartbeatPath    = "/api/v1/agent/heartbeat"
+	logoutPath       = "/api/v1/agent/logout"
+	// logoutTimeout bounds the logout sent while the session or system is ending.
+	logoutTimeout = 3 * time.Second
+	// maxResponseSize bounds the proxy responses read by the agent.
+	maxResponseSize = 64 * 1024
 )
 
 type heartbeatPayload struct {
+	AgentID  string `json:"agent_id,omitempty"`
 	Hostname string `json:"hostname"`
 	Username string `json:"username"`
 	Version  string `json:"agent_version,omitempty"`
+	OS       string `json:"os,omitempty"`
+	// Sessions is only sent with ReportSessions (terminal servers).
+	Sessions []sessionPayload `json:"sessions,omitempty"`
+	// BlocksSince acknowledges the blocks already shown (see blockNotifier).
+	BlocksSince uint64 `json:"blocks_since,omitempty"`
+	// ConfigRevision is the revision of the firewall-managed config applied.
+	ConfigRevision string `json:"config_revision,omitempty"`
+}
+
+type heartbeatResponse struct {
+	OK        bool             `json:"ok"`
+	Blocks    []blocklog.Block `json:"blocks"`
+	BlockSeq  uint64           `json:"block_seq"`
+	Config    json.RawMessage  `json:"config"`
+	ConfigSig string           `json:"config_sig"`
+}
+
+type sessionPayload struct {
+	Username string `json:"username"`
+	PortLow  int    `json:"port_low,omitempty"`
+	PortHigh int    `json:"port_high,omitempty"`
+}
+
+type logoutPayload struct {
+	AgentID  string `json:"agent_id,omitempty"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
 }
 
 // runHeartbeat runs the heartbeat loop, sending periodic updates to the pfSense server.
-// It respects context cancellation for graceful shutdown.
-func runHeartbeat(ctx context.Context, logMgr *agentui.LogManager, statusMgr *agentui.StatusManager, cfgMgr *agentui.ConfigManager, version string) {
+// Session events (see sessionwatch_*.go) log the user out of the proxy; when
+// ctx is cancelled (agent quit) a final logout is sent before returning.
+// Blocks reported by the proxy are shown with notify.
+func runHeartbeat(ctx context.Context, logMgr *agentui.LogManager, statusMgr *agentui.StatusManager, cfgMgr *agentui.ConfigManager, version string, events <-chan sessionEvent, notify func(title, content string)) {
 	hostname, _ := os.Hostname()
 	username := os.Getenv("USERNAME")
 	if username == "" {
@@ -36,20 +79,26 @@ func runHeartbeat(ctx context.Context, logMgr *agentui.LogManager, statusMgr *ag
 
 	logMgr.Addf("Heartbeat service started (hostname: %s, user: %s)", hostname, username)
 
-	client := &http.Client{Timeout: heartbeatTimeout}
 	cfgCh := cfgMgr.Subscribe()
 	defer cfgMgr.Unsubscribe(cfgCh)
 
+	blocks := &blockNotifier{notify: notify}
+
 	// Send first heartbeat immediately
-	sendHeartbeat(ctx, client, logMgr, statusMgr, hostname, username, cfgMgr.Get(), version)
+	sendHeartbeat(ctx, logMgr, statusMgr, cfgMgr, blocks, hostname, username, version)
 
 	timer := time.NewTimer(nextInterval(cfgMgr.Get()))
 	defer timer.Stop()
 
+	// paused is set while logged out (screen locked, session ending).
+	paused := false
+
 	for {
 		select {
 		case <-timer.C:
-			sendHeartbeat(ctx, client, logMgr, statusMgr, hostname, username, cfgMgr.Get(), version)
+			if !paused {
+				sendHeartbeat(ctx, logMgr, statusMgr, cfgMgr, blocks, hostname, username, version)
+			}
 			timer.Reset(nextInterval(cfgMgr.Get()))
 		case <-cfgCh:
 			if !timer.Stop() {
@@ -59,14 +108,41 @@ func runHeartbeat(ctx context.Context, logMgr *agentui.LogManager, statusMgr *ag
 				}
 			}
 			timer.Reset(nextInterval(cfgMgr.Get()))
+		case ev := <-events:
+			cfg := cfgMgr.Get()
+			switch ev.kind {
+			case eventLock:
+				if cfg.LogoutOnLock && !cfg.ReportSessions && !paused {
+					sendLogout(logMgr, cfg, hostname, username, "lock")
+					paused = true
+				}
+			case eventUnlock:
+				if paused {
+					paused = false
+					sendHeartbeat(ctx, logMgr, statusMgr, cfgMgr, blocks, hostname, username, version)
+				}
+			case eventLogoff, eventShutdown:
+				if !paused {
+					sendLogout(logMgr, cfg, hostname, username, string(ev.kind))
+					paused = true
+				}
+			}
+			if ev.done != nil {
+				close(ev.done)
+			}
 		case <-ctx.Done():
+			if !paused {
+				sendLogout(logMgr, cfgMgr.Get(), hostname, username, "quit")
+			}
 			logMgr.Add("Heartbeat service stopped")
 			return
 		}
 	}
 }
 
-func sendHeartbeat(ctx context.Context, client *http.Client, logMgr *agentui.LogManager, statusMgr *agentui.StatusManager, hostname, username string, cfg agentui.Config, version string) {
+// sendHeartbeat tries each target in turn until one accepts the heartbeat.
+func sendHeartbeat(ctx context.Context, logMgr *agentui.LogManager, statusMgr *agentui.StatusManager, cfgMgr *agentui.ConfigManager, blocks *blockNotifier, hostname, username, version string) {
+	cfg := cfgMgr.Get()
 	targets := discoverTargets(cfg)
 	if len(targets) == 0 {
 		logMgr.Add("Heartbeat failed: no pfSense targets available")
@@ -79,9 +155,25 @@ func sendHeartbeat(ctx context.Context, client *http.Client, logMgr *agentui.Log
 	}
 
 	payload := heartbeatPayload{
+		AgentID:  cfg.AgentID,
 		Hostname: hostname,
 		Username: username,
 		Version:  version,
+		OS:       runtime.GOOS + "/" + runtime.GOARCH,
+
+		BlocksSince: blocks.seq,
+	}
+	if cfg.Managed != nil {
+		payload.ConfigRevision = cfg.Managed.Revision
+	}
+
+	if cfg.ReportSessions {
+		sessions, err := collectSessions(cfg)
+		if err != nil {
+			logMgr.Addf("Could not list sessions: %v (reporting %s only)", err, username)
+		} else {
+			payload.Sessions = sessions
+		}
 	}
 
 	body, err := json.Marshal(payload)
@@ -90,21 +182,18 @@ func sendHeartbeat(ctx context.Context, client *http.Client, logMgr *agentui.Log
 		return
 	}
 
-	for _, url := range targets {
+	for _, host := range targets {
 		if ctx.Err() != nil {
 			return // context cancelled
 		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
-		if err != nil {
-			continue
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
+		res, err := deliver(ctx, cfg, host, heartbeatPath, body)
 		if err != nil {
-			host := extractHost(url)
-			logMgr.Addf("Heartbeat failed: %s: %v", host, err)
+			if errors.Is(err, agentauth.ErrPinMismatch) {
+				logMgr.Addf("Heartbeat failed: %s: certificate does not match the pinned fingerprint (clear it in Settings if the proxy certificate was replaced)", host)
+			} else {
+				logMgr.Addf("Heartbeat failed: %s: %v", host, err)
+			}
 			statusMgr.Set(agentui.HeartbeatStatus{
 				State:     agentui.HeartbeatFail,
 				Target:    host,
@@ -113,59 +202,205 @@ func sendHeartbeat(ctx context.Context, client *http.Client, logMgr *agentui.Log
 			})
 			continue
 		}
-		_ = resp.Body.Close()
+		status := res.status
 
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			host := extractHost(url)
-			logMgr.Addf("Heartbeat OK: %s", host)
+		if status >= 200 && status < 300 {
+			if !res.plain && cfg.PinnedCert == "" && res.cert != "" {
+				pinCertificate(logMgr, cfgMgr, res.cert)
+			}
+			msg := "ok"
+			if status == http.StatusAccepted {
+				msg = "awaiting approval"
+			}
+			if res.plain {
+				logMgr.Addf("Heartbeat OK: %s (plain HTTP, %s)", host, msg)
+			} else {
+				logMgr.Addf("Heartbeat OK: %s (%s)", host, msg)
+			}
 			statusMgr.Set(agentui.HeartbeatStatus{
 				State:     agentui.HeartbeatOK,
 				Target:    host,
-				Message:   "ok",
+				Message:   msg,
 				Timestamp: time.Now(),
 			})
+			var resp heartbeatResponse
+			if status == http.StatusOK && json.Unmarshal(res.body, &resp) == nil {
+				blocks.handle(logMgr, cfg, resp)
+				if resp.Config != nil {
+					applyManagedConfig(logMgr, cfgMgr, version, resp)
+				}
+			}
 			return
 		}
 
-		host := extractHost(url)
-		logMgr.Addf("Heartbeat rejected: %s: status %d", host, resp.StatusCode)
+		switch status {
+		case http.StatusUnauthorized:
+			logMgr.Addf("Heartbeat rejected: %s: agent key not accepted (check Key ID / Key in Settings)", host)
+		case http.StatusForbidden:
+			logMgr.Addf("Heartbeat rejected: %s: agent %s is revoked or not enrolled", host, cfg.AgentID)
+		default:
+			logMgr.Addf("Heartbeat rejected: %s: status %d", host, status)
+		}
 		statusMgr.Set(agentui.HeartbeatStatus{
 			State:     agentui.HeartbeatFail,
 			Target:    host,
-			Message:   fmt.Sprintf("status %d", resp.StatusCode),
+			Message:   fmt.Sprintf("status %d", status),
 			Timestamp: time.Now(),
 		})
 	}
 }
 
-// discoverTargets returns a list of URLs to try for heartbeat, in order of preference.
+// deliverResult describes a request that reached the proxy.
+type deliverResult struct {
+	status int
+	plain  bool   // sent over plain HTTP
+	cert   string // fingerprint of the proxy certificate (HTTPS)
+	body   []byte
+}
+
+// deliver posts body to path on host over HTTPS. Plain HTTP is only used for
+// proxies without TLS, and never once a certificate is pinned or RequireTLS
+// is set, so a rogue gateway cannot downgrade the agent.
+func deliver(ctx context.Context, cfg agentui.Config, host, path string, body []byte) (deliverResult, error) {
+	var res deliverResult
+	httpsClient := &http.Client{
+		Timeout: heartbeatTimeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   agentauth.PinnedTLSConfig(cfg.PinnedCert, func(fp string) { res.cert = fp }),
+			DisableKeepAlives: true,
+		},
+	}
+	status, respBody, err := postSigned(ctx, httpsClient, "https://"+host+path, body, cfg)
+	allowPlain := !cfg.RequireTLS && cfg.PinnedCert == ""
+	if err != nil && allowPlain && !errors.Is(err, agentauth.ErrPinMismatch) {
+		res.plain = true
+		res.cert = ""
+		status, respBody, err = postSigned(ctx, &http.Client{Timeout: heartbeatTimeout}, "http://"+host+path, body, cfg)
+	}
+	res.status = status
+	res.body = respBody
+	return res, err
+}
+
+// sendLogout tells the proxy to drop this user's identity right away.
+func sendLogout(logMgr *agentui.LogManager, cfg agentui.Config, hostname, username, reason string) {
+	if cfg.ReportSessions {
+		username = "" // the host agent speaks for every session on the IP
+	}
+	body, err := json.Marshal(logoutPayload{
+		AgentID:  cfg.AgentID,
+		Hostname: hostname,
+		Username: username,
+		Reason:   reason,
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	for _, host := range discoverTargets(cfg) {
+		res, err := deliver(ctx, cfg, host, logoutPath, body)
+		if err == nil && res.status >= 200 && res.status < 300 {
+			logMgr.Addf("Logout sent: %s (%s)", host, reason)
+			return
+		}
+		if err != nil {
+			logMgr.Addf("Logout failed: %s: %v", host, err)
+		} else {
+			logMgr.Addf("Logout rejected: %s: status %d", host, res.status)
+		}
+	}
+}
+
+// collectSessions lists the users logged in on the host with their configured
+// source-port ranges.
+func collectSessions(cfg agentui.Config) ([]sessionPayload, error) {
+	users, err := listSessions()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]sessionPayload, 0, len(users))
+	for _, u := range users {
+		s := sessionPayload{Username: u}
+		if ports, ok := cfg.SessionPorts[u]; ok {
+			// Validated when the config was loaded.
+			s.PortLow, s.PortHigh, _ = agentui.ParsePortRange(ports)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// postSigned sends one (optionally signed) request and returns the HTTP
+// status and response body.
+func postSigned(ctx context.Context, client *http.Client, url string, body []byte, cfg agentui.Config) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Key != "" {
+		if err := agentauth.Sign(req, cfg.KeyID, cfg.Key, body, time.Now()); err != nil {
+			return 0, nil, fmt.Errorf("sign: %w", err)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	return resp.StatusCode, respBody, nil
+}
+
+// pinCertificate records the proxy certificate seen on the first successful
+// HTTPS heartbeat (trust on first use).
+func pinCertificate(logMgr *agentui.LogManager, cfgMgr *agentui.ConfigManager, fingerprint string) {
+	cfg := cfgMgr.Get()
+	if cfg.PinnedCert != "" {
+		return
+	}
+	cfg.PinnedCert = fingerprint
+	if err := cfgMgr.Set(cfg); err != nil {
+		logMgr.Addf("Could not pin proxy certificate: %v", err)
+		return
+	}
+	if err := cfgMgr.SaveToDisk(); err != nil {
+		logMgr.Addf("Pinned proxy certificate sha256=%s (not saved: %v)", fingerprint, err)
+		return
+	}
+	logMgr.Addf("Pinned proxy certificate sha256=%s", fingerprint)
+}
+
+// discoverTargets returns the proxy host:port pairs to try, in order of preference.
 func discoverTargets(cfg agentui.Config) []string {
 	var targets []string
+	port := strconv.Itoa(cfg.Port)
 
 	// Try gateway first
 	if gw, err := gateway.Default(); err == nil && gw != nil {
-		url := fmt.Sprintf("http://%s:%d%s", gw.String(), cfg.Port, heartbeatPath)
-		targets = append(targets, url)
+		targets = append(targets, net.JoinHostPort(gw.String(), port))
 	}
 
 	// DNS fallback
 	if strings.TrimSpace(cfg.DNSFallback) != "" {
-		url := fmt.Sprintf("http://%s:%d%s", cfg.DNSFallback, cfg.Port, heartbeatPath)
-		targets = append(targets, url)
+		targets = append(targets, net.JoinHostPort(strings.TrimSpace(cfg.DNSFallback), port))
 	}
 
-	return targets
-}
-
-// extractHost extracts the host portion from a URL for logging.
-func extractHost(url string) string {
-	// Simple extraction: remove http:// and everything after the port
-	url = strings.TrimPrefix(url, "http://")
-	url = strings.TrimPrefix(url, "https://")
-	if idx := strings.Index(url, "/"); idx > 0 {
-		url = url[:idx]
+	// Extra targets pushed by the firewall
+	if cfg.Managed != nil {
+		for _, t := range cfg.Managed.Targets {
+			if _, _, err := net.SplitHostPort(t); err != nil {
+				t = net.JoinHostPort(t, port)
+			}
+			targets = append(targets, t)
+		}
 	}
-	return url
+
+	return targets
 }
 
 func nextInterval(cfg agentui.Config) time.Duration {
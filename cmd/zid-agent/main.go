@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/driver/desktop"
 	"github.com/guilherme/zid-proxy/internal/agentui"
@@ -58,6 +60,21 @@ func main() {
 		}
 	}
 
+	// Stable agent ID for the proxy's agent inventory, generated on first run
+	if c := cfgMgr.Get(); c.AgentID == "" {
+		if id, err := agentui.NewAgentID(); err != nil {
+			logMgr.Addf("Warning: could not generate agent ID: %v", err)
+		} else {
+			c.AgentID = id
+			if err := cfgMgr.Set(c); err == nil && cfgPath != "" {
+				if err := cfgMgr.SaveToDisk(); err != nil {
+					logMgr.Addf("Warning: could not save agent ID: %v", err)
+				}
+			}
+		}
+	}
+	logMgr.Addf("Agent ID: %s", cfgMgr.Get().AgentID)
+
 	// Persist logs to ~/.zid-agent/logs.txt with rotation (max 1MB)
 	if logPath, err := agentui.DefaultLogPath(); err == nil {
 		logMgr.AddSink(agentui.NewFileLogSink(logPath, agentui.DefaultMaxLogBytes))
@@ -88,9 +105,30 @@ func main() {
 		showLogsWindow(fyneApp, logMgr)
 	}
 
+	// Session events (lock, logoff, shutdown) log the user out of the proxy
+	events := make(chan sessionEvent, 4)
+	watchSession(ctx, logMgr, events)
+	watchSignals(fyneApp, events)
+
 	// Start heartbeat goroutine
-	go runHeartbeat(ctx, logMgr, statusMgr, cfgMgr, Version)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		runHeartbeat(ctx, logMgr, statusMgr, cfgMgr, Version, events, func(title, content string) {
+			fyneApp.SendNotification(fyne.NewNotification(title, content))
+		})
+	}()
+
+	// Install releases published by the firewall (signed manifests)
+	go runUpdateChecks(ctx, fyneApp, logMgr, cfgMgr, Version)
 
 	// Run Fyne event loop (blocks until quit)
 	fyneApp.Run()
+
+	// Let the final logout reach the proxy before exiting
+	cancel()
+	select {
+	case <-heartbeatDone:
+	case <-time.After(sessionEventWait):
+	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/guilherme/zid-proxy/internal/agentauth"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// applyManagedConfig applies the configuration pushed in a heartbeat response
+// after checking its signature with the agent key, then saves it.
+func applyManagedConfig(logMgr *agentui.LogManager, cfgMgr *agentui.ConfigManager, version string, resp heartbeatResponse) {
+	cfg := cfgMgr.Get()
+	if cfg.Key == "" || !agentauth.VerifyDocument(cfg.Key, resp.Config, resp.ConfigSig) {
+		logMgr.Add("Ignored managed config: invalid signature")
+		return
+	}
+	p, err := agentpolicy.Parse(resp.Config)
+	if err != nil {
+		logMgr.Addf("Ignored managed config: %v", err)
+		return
+	}
+
+	changed, err := cfgMgr.ApplyPolicy(p)
+	if err != nil {
+		logMgr.Addf("Ignored managed config revision %s: %v", p.Revision, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if p.Unmanaged {
+		logMgr.Add("The firewall no longer manages this agent's config; all settings are unlocked")
+	} else {
+		logMgr.Addf("Applied managed config revision %s (interval=%ds, %d extra targets, update channel %q, locked %v)",
+			p.Revision, cfgMgr.Get().IntervalSeconds, len(p.Targets), p.UpdateChannel, p.Locked)
+	}
+	if err := cfgMgr.SaveToDisk(); err != nil {
+		logMgr.Addf("Warning: could not save managed config: %v", err)
+	}
+	if agentpolicy.VersionLess(version, p.MinAgentVersion) {
+		logMgr.Addf("Warning: agent version %s is older than the minimum %s required by the firewall; please update", version, p.MinAgentVersion)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// listSessions returns the users logged in on this host (utmp, via "who").
+func listSessions() ([]string, error) {
+	out, err := exec.Command("who").Output()
+	if err != nil {
+		return nil, err
+	}
+	return agentui.ParseWho(string(out)), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+// listSessions is not implemented on this platform.
+func listSessions() ([]string, error) {
+	return nil, errors.New("session listing not supported on this platform")
+}
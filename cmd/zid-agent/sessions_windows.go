@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// listSessions returns the users with a session on this host (RDS), via "quser".
+func listSessions() ([]string, error) {
+	cmd := exec.Command("quser")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	// quser exits with status 1 when there is no session; the output is still valid.
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return agentui.ParseQuser(string(out)), nil
+}
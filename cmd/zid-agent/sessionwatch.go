@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+// sessionEventKind is a change of the desktop session that affects which
+// user the proxy should see on this machine.
+type sessionEventKind string
+
+const (
+	eventLock     sessionEventKind = "lock"
+	eventUnlock   sessionEventKind = "unlock"
+	eventLogoff   sessionEventKind = "logoff"
+	eventShutdown sessionEventKind = "shutdown"
+)
+
+// sessionEvent is delivered to runHeartbeat. When done is non-nil the sender
+// waits for it to be closed (the logout was sent) before letting the session
+// or the system go down.
+type sessionEvent struct {
+	kind sessionEventKind
+	done chan struct{}
+}
+
+// sessionEventWait bounds how long a session or system shutdown is held
+// back while the logout is sent.
+const sessionEventWait = logoutTimeout + time.Second
+
+// sendSessionEvent delivers a lock/unlock event; nothing waits for it.
+func sendSessionEvent(ctx context.Context, events chan<- sessionEvent, kind sessionEventKind) {
+	select {
+	case events <- sessionEvent{kind: kind}:
+	case <-ctx.Done():
+	}
+}
+
+// notifySession delivers ev to runHeartbeat and waits until it was handled.
+func notifySession(events chan<- sessionEvent, kind sessionEventKind) {
+	ev := sessionEvent{kind: kind, done: make(chan struct{})}
+	select {
+	case events <- ev:
+	case <-time.After(sessionEventWait):
+		return
+	}
+	select {
+	case <-ev.done:
+	case <-time.After(sessionEventWait):
+	}
+}
+
+// watchSignals logs the user out when the agent is terminated by the session
+// (SIGHUP on logoff) or the system (SIGTERM on shutdown), then quits the app.
+func watchSignals(fyneApp fyne.App, events chan<- sessionEvent) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigCh
+		switch sig {
+		case syscall.SIGHUP:
+			notifySession(events, eventLogoff)
+		case syscall.SIGTERM:
+			notifySession(events, eventShutdown)
+		}
+		// On Interrupt the logout is sent by runHeartbeat as "quit".
+		fyneApp.Quit()
+	}()
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// watchSession follows the screen saver on the session bus (lock/unlock) and
+// logind on the system bus (shutdown). Logoff ends the agent with SIGHUP or
+// SIGTERM, handled by watchSignals. Missing buses are not an error: the agent
+// then relies on signals and the proxy's TTL.
+func watchSession(ctx context.Context, logMgr *agentui.LogManager, events chan<- sessionEvent) {
+	if conn, err := dbus.ConnectSessionBus(); err == nil {
+		for _, iface := range []string{"org.freedesktop.ScreenSaver", "org.gnome.ScreenSaver"} {
+			_ = conn.AddMatchSignal(dbus.WithMatchInterface(iface), dbus.WithMatchMember("ActiveChanged"))
+		}
+		signals := make(chan *dbus.Signal, 8)
+		conn.Signal(signals)
+		go func() {
+			defer conn.Close()
+			for {
+				select {
+				case sig := <-signals:
+					if sig == nil || len(sig.Body) == 0 {
+						continue
+					}
+					if active, ok := sig.Body[0].(bool); ok {
+						kind := eventUnlock
+						if active {
+							kind = eventLock
+						}
+						sendSessionEvent(ctx, events, kind)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	} else {
+		logMgr.Addf("Screen lock detection unavailable: %v", err)
+	}
+
+	sys, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return
+	}
+	// A delay inhibitor gives the agent time to send the logout before shutdown.
+	login1 := sys.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	var fd dbus.UnixFD
+	if err := login1.Call("org.freedesktop.login1.Manager.Inhibit", 0, "shutdown", "zid-agent", "Log out from zid-proxy", "delay").Store(&fd); err != nil {
+		fd = -1
+	}
+	_ = sys.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.login1.Manager"), dbus.WithMatchMember("PrepareForShutdown"))
+	signals := make(chan *dbus.Signal, 4)
+	sys.Signal(signals)
+	go func() {
+		defer sys.Close()
+		for {
+			select {
+			case sig := <-signals:
+				if sig == nil || len(sig.Body) == 0 {
+					continue
+				}
+				if starting, ok := sig.Body[0].(bool); ok && starting {
+					notifySession(events, eventShutdown)
+					if fd >= 0 {
+						_ = syscall.Close(int(fd))
+						fd = -1
+					}
+				}
+			case <-ctx.Done():
+				if fd >= 0 {
+					_ = syscall.Close(int(fd))
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/guilherme/zid-proxy/internal/agentui"
+)
+
+// watchSession is not implemented on this platform; logout happens on quit
+// and on termination signals only.
+func watchSession(ctx context.Context, logMgr *agentui.LogManager, events chan<- sessionEvent) {
+}
@@ -0,0 +1,149 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"unsafe"
+
+	"github.com/guilherme/zid-proxy/internal/agentui"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	wmQueryEndSession  = 0x0011
+	wmEndSession       = 0x0016
+	wmDestroy          = 0x0002
+	wmClose            = 0x0010
+	wmWTSSessionChange = 0x02B1
+
+	wtsSessionLogoff = 0x6
+	wtsSessionLock   = 0x7
+	wtsSessionUnlock = 0x8
+
+	endSessionLogoff = 0x80000000
+
+	notifyForThisSession = 0
+)
+
+var (
+	user32   = windows.NewLazySystemDLL("user32.dll")
+	wtsapi32 = windows.NewLazySystemDLL("wtsapi32.dll")
+
+	procRegisterClassExW  = user32.NewProc("RegisterClassExW")
+	procCreateWindowExW   = user32.NewProc("CreateWindowExW")
+	procDefWindowProcW    = user32.NewProc("DefWindowProcW")
+	procGetMessageW       = user32.NewProc("GetMessageW")
+	procTranslateMessage  = user32.NewProc("TranslateMessage")
+	procDispatchMessageW  = user32.NewProc("DispatchMessageW")
+	procPostMessageW      = user32.NewProc("PostMessageW")
+	procDestroyWindow     = user32.NewProc("DestroyWindow")
+	procPostQuitMessage   = user32.NewProc("PostQuitMessage")
+	procWTSRegisterNotify = wtsapi32.NewProc("WTSRegisterSessionNotification")
+)
+
+type wndClassEx struct {
+	size       uint32
+	style      uint32
+	wndProc    uintptr
+	clsExtra   int32
+	wndExtra   int32
+	instance   windows.Handle
+	icon       windows.Handle
+	cursor     windows.Handle
+	background windows.Handle
+	menuName   *uint16
+	className  *uint16
+	iconSm     windows.Handle
+}
+
+type winMsg struct {
+	hwnd    windows.HWND
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	ptX     int32
+	ptY     int32
+}
+
+// watchSession creates a hidden top-level window: Windows sends it
+// WM_QUERYENDSESSION/WM_ENDSESSION on logoff and shutdown, and
+// WM_WTSSESSION_CHANGE on lock, unlock and logoff once registered.
+func watchSession(ctx context.Context, logMgr *agentui.LogManager, events chan<- sessionEvent) {
+	go func() {
+		// The window and its message loop must stay on one OS thread.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		wndProc := windows.NewCallback(func(hwnd, msg, wParam, lParam uintptr) uintptr {
+			switch msg {
+			case wmQueryEndSession:
+				return 1 // allow the session to end
+			case wmEndSession:
+				if wParam != 0 {
+					kind := eventShutdown
+					if lParam&endSessionLogoff != 0 {
+						kind = eventLogoff
+					}
+					notifySession(events, kind)
+				}
+				return 0
+			case wmWTSSessionChange:
+				switch wParam {
+				case wtsSessionLock:
+					sendSessionEvent(ctx, events, eventLock)
+				case wtsSessionUnlock:
+					sendSessionEvent(ctx, events, eventUnlock)
+				case wtsSessionLogoff:
+					notifySession(events, eventLogoff)
+				}
+				return 0
+			case wmClose:
+				procDestroyWindow.Call(hwnd)
+				return 0
+			case wmDestroy:
+				procPostQuitMessage.Call(0)
+				return 0
+			}
+			r, _, _ := procDefWindowProcW.Call(hwnd, msg, wParam, lParam)
+			return r
+		})
+
+		className, _ := windows.UTF16PtrFromString("ZidAgentSessionWatch")
+		wc := wndClassEx{
+			wndProc:   wndProc,
+			className: className,
+		}
+		wc.size = uint32(unsafe.Sizeof(wc))
+		if r, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&wc))); r == 0 {
+			logMgr.Addf("Session watch unavailable: RegisterClassEx: %v", err)
+			return
+		}
+		hwnd, _, err := procCreateWindowExW.Call(0, uintptr(unsafe.Pointer(className)), uintptr(unsafe.Pointer(className)),
+			0, 0, 0, 0, 0, 0, 0, 0, 0)
+		if hwnd == 0 {
+			logMgr.Addf("Session watch unavailable: CreateWindowEx: %v", err)
+			return
+		}
+		if r, _, err := procWTSRegisterNotify.Call(hwnd, notifyForThisSession); r == 0 {
+			logMgr.Addf("Screen lock detection unavailable: WTSRegisterSessionNotification: %v", err)
+		}
+
+		go func() {
+			<-ctx.Done()
+			procPostMessageW.Call(hwnd, wmClose, 0, 0)
+		}()
+
+		var m winMsg
+		for {
+			r, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&m)), 0, 0, 0)
+			if int32(r) <= 0 {
+				return
+			}
+			procTranslateMessage.Call(uintptr(unsafe.Pointer(&m)))
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&m)))
+		}
+	}()
+}
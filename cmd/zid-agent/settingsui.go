@@ -9,6 +9,8 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
+	"github.com/guilherme/zid-proxy/internal/agentauth"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
 	"github.com/guilherme/zid-proxy/internal/agentui"
 )
 
@@ -28,7 +30,7 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 	}
 
 	settingsWindow = fyneApp.NewWindow("ZID Agent - Settings")
-	settingsWindow.Resize(fyne.NewSize(520, 280))
+	settingsWindow.Resize(fyne.NewSize(560, 560))
 
 	cfg := cfgMgr.Get()
 
@@ -41,6 +43,43 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 	entryInterval := widget.NewEntry()
 	entryInterval.SetText(strconv.Itoa(cfg.IntervalSeconds))
 
+	entryKeyID := widget.NewEntry()
+	entryKeyID.SetText(cfg.KeyID)
+	entryKeyID.SetPlaceHolder("(unsigned)")
+
+	entryKey := widget.NewPasswordEntry()
+	entryKey.SetText(cfg.Key)
+
+	checkRequireTLS := widget.NewCheck("Refuse plain HTTP", nil)
+	checkRequireTLS.SetChecked(cfg.RequireTLS)
+
+	checkSessions := widget.NewCheck("Report all logged-in users (terminal server)", nil)
+	checkSessions.SetChecked(cfg.ReportSessions)
+
+	checkLock := widget.NewCheck("Log out from the proxy while the screen is locked", nil)
+	checkLock.SetChecked(cfg.LogoutOnLock)
+
+	checkBlocks := widget.NewCheck("Notify when the proxy blocks a site", nil)
+	checkBlocks.SetChecked(!cfg.MuteBlocks)
+
+	// Settings locked by the firewall's managed config cannot be edited here.
+	if cfg.Locked(agentpolicy.SettingInterval) {
+		entryInterval.Disable()
+	}
+	if cfg.Locked(agentpolicy.SettingRequireTLS) {
+		checkRequireTLS.Disable()
+	}
+	if cfg.Locked(agentpolicy.SettingLogoutOnLock) {
+		checkLock.Disable()
+	}
+	if cfg.Locked(agentpolicy.SettingMuteBlocks) {
+		checkBlocks.Disable()
+	}
+
+	entryPin := widget.NewEntry()
+	entryPin.SetText(cfg.PinnedCert)
+	entryPin.SetPlaceHolder("(pinned on first HTTPS heartbeat)")
+
 	errorLabel := widget.NewLabel("")
 
 	form := &widget.Form{
@@ -48,6 +87,13 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 			{Text: "Port", Widget: entryPort},
 			{Text: "DNS fallback", Widget: entryDNS},
 			{Text: "Interval (seconds)", Widget: entryInterval},
+			{Text: "Key ID", Widget: entryKeyID, HintText: "From the pfSense agent keys list"},
+			{Text: "Key", Widget: entryKey},
+			{Text: "HTTPS", Widget: checkRequireTLS},
+			{Text: "Sessions", Widget: checkSessions},
+			{Text: "Screen lock", Widget: checkLock},
+			{Text: "Blocked sites", Widget: checkBlocks},
+			{Text: "Certificate SHA-256", Widget: entryPin, HintText: "Clear to re-pin after replacing the proxy certificate"},
 		},
 		OnSubmit: func() {
 			port, err := strconv.Atoi(strings.TrimSpace(entryPort.Text))
@@ -61,10 +107,28 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 				return
 			}
 
+			// The heartbeat may have pinned a certificate while this window was
+			// open; only an edit of the field replaces the current pin.
+			pin := agentauth.NormalizeFingerprint(entryPin.Text)
+			if pin == cfg.PinnedCert {
+				pin = cfgMgr.Get().PinnedCert
+			}
+
 			newCfg := agentui.Config{
+				AgentID:         cfgMgr.Get().AgentID,
 				Port:            port,
 				DNSFallback:     strings.TrimSpace(entryDNS.Text),
 				IntervalSeconds: intervalSeconds,
+				KeyID:           strings.TrimSpace(entryKeyID.Text),
+				Key:             strings.TrimSpace(entryKey.Text),
+				RequireTLS:      checkRequireTLS.Checked,
+				PinnedCert:      pin,
+				ReportSessions:  checkSessions.Checked,
+				LogoutOnLock:    checkLock.Checked,
+				MuteBlocks:      !checkBlocks.Checked,
+				// Port ranges are only edited in config.json.
+				SessionPorts: cfgMgr.Get().SessionPorts,
+				Managed:      cfgMgr.Get().Managed,
 			}
 
 			if err := cfgMgr.Set(newCfg); err != nil {
@@ -77,7 +141,7 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 			}
 
 			errorLabel.SetText("Saved")
-			logMgr.Addf("Settings saved: port=%d dns=%s interval=%ds", newCfg.Port, newCfg.DNSFallback, newCfg.IntervalSeconds)
+			logMgr.Addf("Settings saved: port=%d dns=%s interval=%ds key_id=%q require_tls=%v pinned=%v", newCfg.Port, newCfg.DNSFallback, newCfg.IntervalSeconds, newCfg.KeyID, newCfg.RequireTLS, newCfg.PinnedCert != "")
 		},
 		SubmitText: "Save",
 		OnCancel: func() {
@@ -92,8 +156,9 @@ func showSettingsWindow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *ag
 	} else {
 		pathLabel.SetText("Config: (unavailable)")
 	}
+	idLabel := widget.NewLabel("Agent ID: " + cfg.AgentID)
 
-	content := container.NewVBox(pathLabel, form, errorLabel)
+	content := container.NewVBox(pathLabel, idLabel, form, errorLabel)
 	settingsWindow.SetContent(content)
 
 	settingsWindow.SetCloseIntercept(func() { settingsWindow.Hide() })
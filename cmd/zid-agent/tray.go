@@ -29,7 +29,7 @@ func setupSystemTray(deskApp desktop.App, fyneApp fyne.App, logMgr *agentui.LogM
 
 	updateItem := fyne.NewMenuItem("Update", func() {
 		logMgr.Add("Starting update flow...")
-		startUpdateFlow(fyneApp, logMgr, version)
+		startUpdateFlow(fyneApp, logMgr, cfgMgr, version)
 	})
 
 	aboutItem := fyne.NewMenuItem("About", func() {
@@ -2,24 +2,40 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
 	"github.com/guilherme/zid-proxy/internal/agentui"
 	"github.com/guilherme/zid-proxy/internal/agentupdate"
 )
 
 const (
-	updateURLLinuxGUI   = "https://s3.soulsolucoes.com.br/soul/portal/zid-agent-linux-gui-latest.tar.gz"
-	updateURLWindowsGUI = "https://s3.soulsolucoes.com.br/soul/portal/zid-agent-windows-gui-latest.tar.gz"
+	updatePath = "/api/v1/agent/update"
+	// updateFirstCheck and updateCheckInterval schedule the automatic checks.
+	updateFirstCheck    = 2 * time.Minute
+	updateCheckInterval = 6 * time.Hour
 )
 
-func startUpdateFlow(fyneApp fyne.App, logMgr *agentui.LogManager, currentVersion string) {
+// updateMu keeps the manual and automatic updates from running together.
+var updateMu sync.Mutex
+
+type updateRequest struct {
+	AgentID string `json:"agent_id,omitempty"`
+	Channel string `json:"channel"`
+	Version string `json:"agent_version"`
+}
+
+func startUpdateFlow(fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *agentui.ConfigManager, currentVersion string) {
 	parent := ensureDialogParent(fyneApp)
 
 	dialog.NewConfirm("ZID Agent - Update", "Baixar e instalar a versão mais recente agora?\nO agente será reiniciado.", func(ok bool) {
@@ -34,7 +50,7 @@ func startUpdateFlow(fyneApp fyne.App, logMgr *agentui.LogManager, currentVersio
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 			defer cancel()
 
-			err := runUpdate(ctx, fyneApp, logMgr, currentVersion)
+			err := runUpdate(ctx, fyneApp, logMgr, cfgMgr, currentVersion, true)
 			fyneApp.Driver().DoFromGoroutine(func() {
 				progress.Hide()
 				if err != nil {
@@ -46,30 +62,84 @@ func startUpdateFlow(fyneApp fyne.App, logMgr *agentui.LogManager, currentVersio
 	}, parent).Show()
 }
 
-func runUpdate(ctx context.Context, fyneApp fyne.App, logMgr *agentui.LogManager, currentVersion string) error {
-	url, expectedBinaryName, targetPath, err := updatePlatformConfig()
+// runUpdateChecks installs the releases published by the firewall, once the
+// agent falls within the rollout percentage (or below the minimum version).
+// Builds without a release key skip the periodic checks.
+func runUpdateChecks(ctx context.Context, fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *agentui.ConfigManager, currentVersion string) {
+	if _, err := agentupdate.ReleaseKey(); err != nil {
+		logMgr.Addf("Automatic updates disabled: %v", err)
+		return
+	}
+
+	timer := time.NewTimer(updateFirstCheck)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		if err := runUpdate(checkCtx, fyneApp, logMgr, cfgMgr, currentVersion, false); err != nil {
+			logMgr.Addf("Update check failed: %v", err)
+		}
+		cancel()
+		timer.Reset(updateCheckInterval)
+	}
+}
+
+// runUpdate fetches the signed manifest of the agent's update channel and
+// installs its release if it is newer. Manual updates ignore the rollout.
+func runUpdate(ctx context.Context, fyneApp fyne.App, logMgr *agentui.LogManager, cfgMgr *agentui.ConfigManager, currentVersion string, manual bool) error {
+	if !updateMu.TryLock() {
+		return errors.New("an update is already running")
+	}
+	defer updateMu.Unlock()
+
+	expectedBinaryName, targetPath, err := updatePlatformConfig()
 	if err != nil {
 		return err
 	}
 
-	logMgr.Addf("Update: downloading %s", url)
-
-	pu, err := agentupdate.PrepareFromURL(ctx, agentupdate.Downloader{}, url, expectedBinaryName)
+	cfg := cfgMgr.Get()
+	m, err := fetchManifest(ctx, cfg, currentVersion)
 	if err != nil {
 		return err
 	}
-	defer pu.Cleanup()
 
-	logMgr.Addf("Update: bundle version %s", pu.Version)
+	if m == nil || !agentpolicy.VersionLess(currentVersion, m.Version) {
+		if manual {
+			msg := fmt.Sprintf("Você já está na versão mais recente (%s).", currentVersion)
+			if m == nil {
+				msg = "Nenhuma atualização publicada pelo firewall."
+			}
+			fyneApp.Driver().DoFromGoroutine(func() {
+				parent := ensureDialogParent(fyneApp)
+				dialog.ShowInformation("ZID Agent - Update", msg, parent)
+			}, false)
+		}
+		return nil
+	}
 
-	if pu.Version == currentVersion {
-		fyneApp.Driver().DoFromGoroutine(func() {
-			parent := ensureDialogParent(fyneApp)
-			dialog.ShowInformation("ZID Agent - Update", fmt.Sprintf("Você já está na versão mais recente (%s).", currentVersion), parent)
-		}, false)
+	required := cfg.Managed != nil && agentpolicy.VersionLess(currentVersion, cfg.Managed.MinAgentVersion)
+	if !manual && !required && !agentupdate.InRollout(cfg.AgentID, *m) {
+		logMgr.Addf("Update: version %s published (%d%% rollout), not yet offered to this agent", m.Version, m.RolloutPercent)
 		return nil
 	}
 
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	logMgr.Addf("Update: downloading version %s for %s", m.Version, platform)
+
+	pu, err := agentupdate.PrepareFromManifest(ctx, agentupdate.Downloader{}, *m, platform, expectedBinaryName)
+	if err != nil {
+		return err
+	}
+	defer pu.Cleanup()
+
+	logMgr.Addf("Update: bundle version %s verified (signature and sha256)", pu.Version)
+
 	switch runtime.GOOS {
 	case "windows":
 		return applyUpdateWindows(fyneApp, logMgr, targetPath, pu.BinaryPath)
@@ -78,27 +148,74 @@ func runUpdate(ctx context.Context, fyneApp fyne.App, logMgr *agentui.LogManager
 	}
 }
 
-func updatePlatformConfig() (url, expectedBinaryName, targetPath string, err error) {
+// fetchManifest asks the proxy for the manifest of the agent's update channel
+// and checks it against the built-in release key. It returns nil when no
+// release is published.
+func fetchManifest(ctx context.Context, cfg agentui.Config, currentVersion string) (*agentupdate.Manifest, error) {
+	key, err := agentupdate.ReleaseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	channel := agentupdate.DefaultChannel
+	if cfg.Managed != nil && cfg.Managed.UpdateChannel != "" {
+		channel = cfg.Managed.UpdateChannel
+	}
+	body, err := json.Marshal(updateRequest{AgentID: cfg.AgentID, Channel: channel, Version: currentVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, host := range discoverTargets(cfg) {
+		res, err := deliver(ctx, cfg, host, updatePath, body)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", host, err)
+			continue
+		}
+		switch res.status {
+		case http.StatusNoContent:
+			return nil, nil
+		case http.StatusOK:
+		default:
+			lastErr = fmt.Errorf("%s: status %d", host, res.status)
+			continue
+		}
+
+		var sm agentupdate.SignedManifest
+		if err := json.Unmarshal(res.body, &sm); err != nil {
+			return nil, fmt.Errorf("%s: invalid manifest: %w", host, err)
+		}
+		m, err := agentupdate.VerifyManifest(key, sm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		if m.Channel != channel {
+			return nil, fmt.Errorf("%s: manifest is for channel %s, expected %s", host, m.Channel, channel)
+		}
+		return &m, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no pfSense targets available")
+	}
+	return nil, lastErr
+}
+
+func updatePlatformConfig() (expectedBinaryName, targetPath string, err error) {
 	switch runtime.GOOS {
 	case "windows":
-		url = updateURLWindowsGUI
 		expectedBinaryName = "zid-agent-windows-gui.exe"
 		targetPath = defaultWindowsInstallPath()
-		if targetPath == "" {
-			return "", "", "", fmt.Errorf("could not resolve install path")
-		}
-		return url, expectedBinaryName, targetPath, nil
 	case "linux":
-		url = updateURLLinuxGUI
 		expectedBinaryName = "zid-agent-linux-gui"
 		targetPath = defaultLinuxInstallPath()
-		if targetPath == "" {
-			return "", "", "", fmt.Errorf("could not resolve install path")
-		}
-		return url, expectedBinaryName, targetPath, nil
 	default:
-		return "", "", "", fmt.Errorf("update not supported on %s", runtime.GOOS)
+		return "", "", fmt.Errorf("update not supported on %s", runtime.GOOS)
+	}
+	if targetPath == "" {
+		return "", "", fmt.Errorf("could not resolve install path")
 	}
+	return expectedBinaryName, targetPath, nil
 }
 
 func defaultLinuxInstallPath() string {
@@ -0,0 +1,120 @@
+// zid-appid-usage reports the daily application usage per user (else
+// client IP) kept by zid-appid (-usage-file): connection time and bytes
+// per app.
+//
+//	zid-appid-usage -identity alice -app youtube
+//	zid-appid-usage -from 2026-10-01 -to 2026-10-31 -format csv
+//	zid-appid-usage -file /var/db/zid-proxy/appid_usage.json
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+)
+
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
+type usageOutput struct {
+	From     string              `json:"from"`
+	To       string              `json:"to"`
+	Identity string              `json:"identity,omitempty"`
+	App      string              `json:"app,omitempty"`
+	Records  []appid.UsageRecord `json:"records"`
+}
+
+func main() {
+	socket := flag.String("socket", "/var/run/zid-appid.sock", "zid-appid Unix socket")
+	file := flag.String("file", "", "Read the usage file saved by zid-appid (-usage-file) instead of asking the daemon")
+	from := flag.String("from", "", "First day, YYYY-MM-DD (default: today)")
+	to := flag.String("to", "", "Last day, YYYY-MM-DD (default: -from)")
+	identity := flag.String("identity", "", "Only this user or client IP")
+	app := flag.String("app", "", "Only this app (e.g. youtube, unknown)")
+	format := flag.String("format", "json", "Output format: json or csv")
+	showVersion := flag.Bool("version", false, "Show version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("zid-appid-usage version %s (built %s)\n", Version, BuildTime)
+		os.Exit(0)
+	}
+
+	if *from == "" {
+		*from = time.Now().Format(appid.UsageDayFormat)
+	}
+	if *to == "" {
+		*to = *from
+	}
+	if !appid.ValidUsageDay(*from) || !appid.ValidUsageDay(*to) {
+		fatalf("invalid -from/-to (expected YYYY-MM-DD)")
+	}
+	if *format != "json" && *format != "csv" {
+		fatalf("invalid -format %q (expected json or csv)", *format)
+	}
+
+	q := appid.UsageQuery{From: *from, To: *to, Identity: *identity, App: *app}
+	var records []appid.UsageRecord
+	if *file != "" {
+		store := appid.NewUsageStore(appid.UsageOptions{})
+		if err := store.Load(*file); err != nil {
+			fatalf("%s: %v", *file, err)
+		}
+		records = store.Query(q)
+	} else {
+		client := appid.NewClient(*socket, 5*time.Second)
+		defer client.Close()
+		var err error
+		if records, err = client.Usage(q); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	var err error
+	if *format == "csv" {
+		err = writeCSV(os.Stdout, records)
+	} else {
+		err = writeJSON(os.Stdout, usageOutput{From: *from, To: *to, Identity: *identity, App: *app, Records: records})
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(v)
+}
+
+func writeCSV(w io.Writer, records []appid.UsageRecord) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"day", "identity", "app", "category", "seconds", "bytes_in", "bytes_out", "conns"})
+	for _, r := range records {
+		_ = cw.Write([]string{
+			r.Day,
+			r.Identity,
+			r.App,
+			r.Category,
+			strconv.FormatUint(r.Seconds, 10),
+			strconv.FormatUint(r.BytesIn, 10),
+			strconv.FormatUint(r.BytesOut, 10),
+			strconv.FormatUint(r.Conns, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+	os.Exit(2)
+}
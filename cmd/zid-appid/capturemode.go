@@ -0,0 +1,51 @@
+package main
+
+// This file contains the packet-capture detection mode.
+// Packets are read from a live interface (AF_PACKET on Linux, BPF on
+// FreeBSD) or from a pcap file, their flows are tracked in the flow cache
+// with real byte and packet counts, and the app of each flow is named from
+// its TLS SNI, HTTP Host, QUIC SNI or the DNS answers seen before it.
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/capture"
+)
+
+// startCapture opens the capture source and feeds flowCache from it in the
+// background until ctx is cancelled. A pcap file is read once; the flows it
+// produced stay queryable until they expire. The DNS answers seen are
+// recorded in dnsCache, shared with the socket server.
+func startCapture(ctx context.Context, iface, pcapFile string, flowCache *appid.FlowCache, dnsCache *appid.DNSCache, detector *appid.Detector) error {
+	var src capture.Source
+	var err error
+	name := iface
+	switch {
+	case pcapFile != "":
+		src, err = capture.OpenPcap(pcapFile)
+		name = pcapFile
+	case iface != "":
+		src, err = capture.OpenLive(iface)
+	default:
+		return fmt.Errorf("capture mode needs -interface or -pcap")
+	}
+	if err != nil {
+		return err
+	}
+
+	tracker := capture.NewTracker(flowCache, detector, dnsCache)
+	log.Printf("Capturing packets from %s", name)
+	go func() {
+		defer src.Close()
+		if err := tracker.Run(ctx, src); err != nil {
+			log.Printf("Capture from %s stopped: %v", name, err)
+		} else if pcapFile != "" {
+			log.Printf("Finished reading %s", pcapFile)
+		}
+		tracker.LogStats()
+	}()
+	return nil
+}
@@ -20,9 +20,14 @@ const (
 	defaultSocketPath    = "/var/run/zid-appid.sock"
 	defaultPidFile       = "/var/run/zid-appid.pid"
 	defaultRulesFile     = "/usr/local/etc/zid-proxy/appid_rules.txt"
+	defaultAccessRules   = "/usr/local/etc/zid-proxy/access_rules.txt"
+	defaultSignatures    = "/usr/local/share/zid-proxy/appid_signatures.json"
 	defaultMaxFlows      = 10000
+	defaultMaxDNS        = 100000
 	defaultFlowTTL       = 5 * time.Minute
 	defaultGCInterval    = 30 * time.Second
+	defaultUsageFile     = "/var/db/zid-proxy/appid_usage.json"
+	defaultUsageSave     = 5 * time.Minute
 )
 
 var (
@@ -34,9 +39,18 @@ func main() {
 	socketPath := flag.String("socket", defaultSocketPath, "Unix socket path")
 	pidFile := flag.String("pid", defaultPidFile, "PID file path")
 	rulesFile := flag.String("rules", defaultRulesFile, "AppID rules file path")
+	accessRules := flag.String("access-rules", defaultAccessRules, "zid-proxy access rules file (group membership)")
+	signatures := flag.String("signatures", defaultSignatures, "Application signature database (JSON), merged over the built-ins")
 	maxFlows := flag.Int("max-flows", defaultMaxFlows, "Maximum number of flows to track")
+	maxDNS := flag.Int("max-dns", defaultMaxDNS, "Maximum number of DNS answers remembered to classify flows without SNI")
 	flowTTL := flag.Duration("flow-ttl", defaultFlowTTL, "Flow TTL (idle timeout)")
 	gcInterval := flag.Duration("gc-interval", defaultGCInterval, "Garbage collection interval")
+	usageFile := flag.String("usage-file", defaultUsageFile, "Daily app usage per user/IP (see zid-appid-usage). Empty disables.")
+	usageDays := flag.Int("usage-days", appid.DefaultUsageRetentionDays, "Days of app usage to keep")
+	usageSave := flag.Duration("usage-save-interval", defaultUsageSave, "How often the app usage is saved to -usage-file")
+	mode := flag.String("mode", "sni", "Detection mode: sni (hostname lookups from zid-proxy) or capture (packet capture)")
+	iface := flag.String("interface", "", "Interface to capture from in capture mode (AF_PACKET on Linux, BPF on FreeBSD)")
+	pcapFile := flag.String("pcap", "", "Read packets from a pcap file instead of an interface in capture mode")
 	showVersion := flag.Bool("version", false, "Show version and exit")
 
 	flag.Parse()
@@ -45,6 +59,9 @@ func main() {
 		fmt.Printf("zid-appid version %s\n", version)
 		os.Exit(0)
 	}
+	if *mode != "sni" && *mode != "capture" {
+		log.Fatalf("Invalid -mode %q (expected sni or capture)", *mode)
+	}
 
 	log.Printf("zid-appid %s starting...", version)
 
@@ -56,7 +73,22 @@ func main() {
 
 	// Initialize components
 	flowCache := appid.NewFlowCache(*maxFlows, *flowTTL)
+	var usage *appid.UsageStore
+	if *usageFile != "" {
+		// Flows are counted when they leave the cache
+		usage = appid.NewUsageStore(appid.UsageOptions{RetentionDays: *usageDays})
+		if err := usage.Load(*usageFile); err != nil {
+			log.Printf("Warning: failed to load app usage from %s: %v", *usageFile, err)
+		}
+		flowCache.SetEvictHandler(usage.Record)
+		usage.SetLiveFlows(flowCache)
+	}
+	dnsCache := appid.NewDNSCache(*maxDNS)
 	detector := appid.NewDetector()
+	if err := detector.LoadSignatures(*signatures); err != nil {
+		log.Printf("Warning: failed to load signatures: %v", err)
+	}
+	logSignatures(detector)
 	ruleSet := appid.NewAppRuleSet(*rulesFile)
 
 	// Load rules (optional - file may not exist yet)
@@ -65,9 +97,18 @@ func main() {
 	} else {
 		log.Printf("Loaded %d AppID rules", ruleSet.Count())
 	}
+	loadGroups(ruleSet, *accessRules)
 
 	// Start Unix socket server
 	server := appid.NewServer(*socketPath, flowCache, detector)
+	server.SetDNSCache(dnsCache)
+	if usage != nil {
+		server.SetUsageStore(usage)
+	}
+	if *mode == "sni" {
+		// In capture mode the flows and their bytes come from the packets
+		server.SetFlowHandler(NewSNIHandler(flowCache, detector))
+	}
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -75,7 +116,17 @@ func main() {
 
 	// Start garbage collection goroutine
 	ctx, cancel := context.WithCancel(context.Background())
-	go gcLoop(ctx, flowCache, *gcInterval)
+	gcDone := make(chan struct{})
+	go func() {
+		defer close(gcDone)
+		gcLoop(ctx, flowCache, dnsCache, *gcInterval, usage, *usageFile, *usageSave)
+	}()
+
+	if *mode == "capture" {
+		if err := startCapture(ctx, *iface, *pcapFile, flowCache, dnsCache, detector); err != nil {
+			log.Fatalf("Failed to start capture: %v", err)
+		}
+	}
 
 	// Log app detection stats
 	log.Printf("Application detector initialized with %d app definitions", len(detector.ListApps()))
@@ -95,37 +146,82 @@ func main() {
 			} else {
 				log.Printf("Reloaded %d AppID rules", ruleSet.Count())
 			}
+			loadGroups(ruleSet, *accessRules)
+			if err := detector.ReloadSignatures(); err != nil {
+				log.Printf("Failed to reload signatures: %v", err)
+			} else {
+				logSignatures(detector)
+			}
 
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Println("Shutting down...")
 			cancel()
 			server.Stop()
+			<-gcDone
 			log.Println("zid-appid stopped")
 			return
 		}
 	}
 }
 
+// loadGroups loads the group membership from the zid-proxy access rules, so
+// rules select the same group as zid-proxy does.
+func loadGroups(ruleSet *appid.AppRuleSet, accessRules string) {
+	if err := ruleSet.LoadGroups(accessRules); err != nil {
+		log.Printf("Warning: failed to load groups from %s: %v", accessRules, err)
+		return
+	}
+	log.Printf("Loaded %d groups from %s", ruleSet.GroupCount(), accessRules)
+}
+
+// logSignatures logs the version of the loaded signature database.
+func logSignatures(detector *appid.Detector) {
+	if version, n := detector.SignaturesVersion(); version != "" {
+		log.Printf("Loaded signatures version %s (%d apps)", version, n)
+	}
+}
+
 // writePidFile writes the current process ID to a file.
 func writePidFile(path string) error {
 	pid := os.Getpid()
 	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", pid)), 0644)
 }
 
-// gcLoop periodically runs garbage collection on the flow cache.
-func gcLoop(ctx context.Context, cache *appid.FlowCache, interval time.Duration) {
+// saveUsage writes the app usage to path.
+func saveUsage(usage *appid.UsageStore, path string) {
+	if err := usage.Save(path); err != nil {
+		log.Printf("Warning: failed to save app usage: %v", err)
+	}
+}
+
+// gcLoop periodically runs garbage collection on the flow and DNS caches,
+// and saves the app usage (nil if disabled) every saveInterval. When ctx is
+// done, the flows still open are counted and the usage saved.
+func gcLoop(ctx context.Context, cache *appid.FlowCache, dns *appid.DNSCache, interval time.Duration,
+	usage *appid.UsageStore, usageFile string, saveInterval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	lastSave := time.Now()
 
 	for {
 		select {
 		case <-ctx.Done():
+			if usage != nil {
+				cache.Flush()
+				saveUsage(usage, usageFile)
+			}
 			return
 		case <-ticker.C:
 			removed := cache.GC(time.Now())
 			if removed > 0 {
 				log.Printf("GC: removed %d expired flows", removed)
 			}
+			dns.GC(time.Now())
+			if now := time.Now(); usage != nil && now.Sub(lastSave) >= saveInterval {
+				usage.GC(now)
+				saveUsage(usage, usageFile)
+				lastSave = now
+			}
 		}
 	}
 }
@@ -2,18 +2,17 @@ package main
 
 // This file contains the SNI-based detection mode.
 // This is a fallback mode that uses hostname matching instead of full DPI.
-// For full DPI with nDPI library, see the bridge mode implementation.
+// For packet-level detection, see the capture mode in capturemode.go.
 
 import (
-	"log"
-	"net"
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/appid"
 )
 
 // SNIHandler handles SNI-based detection requests.
-// It registers detected apps in the flow cache based on hostname lookups.
+// It registers the connections reported by zid-proxy in the flow cache,
+// with the app of their hostname (see appid.FlowHandler).
 type SNIHandler struct {
 	flowCache *appid.FlowCache
 	detector  *appid.Detector
@@ -28,59 +27,42 @@ func NewSNIHandler(flowCache *appid.FlowCache, detector *appid.Detector) *SNIHan
 }
 
 // RegisterFlow registers a flow with detected app based on hostname.
-// This is called by zid-proxy when it extracts SNI from a connection.
-func (h *SNIHandler) RegisterFlow(srcIP, dstIP net.IP, srcPort, dstPort uint16, hostname string) string {
+// This is called by zid-proxy (REGISTER_FLOW) for each connection it relays,
+// so flows of unknown apps are registered too and count in the usage.
+func (h *SNIHandler) RegisterFlow(key appid.FlowKey, hostname, user string) (*appid.AppDefinition, float32) {
 	// Detect app by hostname
 	app, confidence := h.detector.DetectByHostname(hostname)
 	if app == nil {
-		return ""
+		h.flowCache.Register(key, hostname, user, "", "", 0, "", time.Now())
+		return nil, 0
 	}
 
-	now := time.Now()
-
-	// Create flow key
-	key := appid.FlowKey{
-		SrcIP:    srcIP.String(),
-		DstIP:    dstIP.String(),
-		SrcPort:  srcPort,
-		DstPort:  dstPort,
-		Protocol: 6, // TCP
-	}
-
-	// Register in cache
-	flow := &appid.FlowInfo{
-		Key:         key,
-		AppName:     app.Name,
-		AppCategory: string(app.Category),
-		Confidence:  confidence,
-		FirstSeen:   now,
-		LastSeen:    now,
-	}
-
-	h.flowCache.Set(flow)
+	h.flowCache.Register(key, hostname, user, app.Name, string(app.Category), confidence, appid.SourceSNI, time.Now())
+	return app, confidence
+}
 
-	log.Printf("Detected app: %s (%.0f%%) for %s -> %s:%d",
-		app.Name, confidence*100, srcIP, hostname, dstPort)
+// UpdateFlow records the bytes relayed so far on a registered flow.
+func (h *SNIHandler) UpdateFlow(key appid.FlowKey, bytesIn, bytesOut uint64) bool {
+	return h.flowCache.SetBytes(key, bytesIn, bytesOut, false, time.Now())
+}
 
-	return app.Name
+// CloseFlow records the final byte counts of a registered flow. The flow
+// stays in the cache, for LOOKUP_IP and STATS, until it expires.
+func (h *SNIHandler) CloseFlow(key appid.FlowKey, bytesIn, bytesOut uint64) bool {
+	return h.flowCache.SetBytes(key, bytesIn, bytesOut, true, time.Now())
 }
 
-// Note: In a full implementation, there would be additional modes:
-//
-// 1. Bridge Mode (inline DPI):
-//    - Uses libpcap or AF_PACKET to capture traffic
-//    - Runs nDPI on packet payloads
-//    - Can detect apps even without SNI (encrypted traffic analysis)
+// Note: Other detection modes:
 //
-// 2. Mirror Mode (passive DPI):
-//    - Receives mirrored traffic from a switch SPAN port
-//    - Non-intrusive, doesn't affect traffic flow
-//    - Uses nDPI for detection
+// 1. Capture Mode (-mode capture, see capturemode.go):
+//    - Reads packets from AF_PACKET (Linux), BPF (FreeBSD) or a pcap file
+//    - Works inline (bridge) or on mirrored traffic from a switch SPAN port
+//    - Names apps from TLS/QUIC SNI, HTTP Host and DNS answers
 //
-// 3. Netfilter Queue Mode:
+// 2. Netfilter Queue Mode (not implemented):
 //    - Uses NFQUEUE to receive packets from iptables
 //    - Can make allow/block decisions inline
 //    - Requires kernel support
 //
-// For now, we use SNI mode which works with the existing zid-proxy
-// by matching hostnames to known app patterns.
+// SNI mode (the default) works with the existing zid-proxy by matching the
+// hostnames it reports to known app patterns.
@@ -0,0 +1,167 @@
+// zid-proxy-stats queries the traffic history written by zid-proxy
+// (-history-dir) for the GUI charts.
+//
+//	zid-proxy-stats -dim ip -key 192.168.1.10 -range 24h
+//	zid-proxy-stats -dim domain -top 20 -range 7d -format csv
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/tsdb"
+)
+
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
+type seriesOutput struct {
+	Dimension  string       `json:"dimension"`
+	Key        string       `json:"key"`
+	Resolution string       `json:"resolution"`
+	From       string       `json:"from"`
+	To         string       `json:"to"`
+	Points     []tsdb.Point `json:"points"`
+}
+
+type topOutput struct {
+	Dimension  string       `json:"dimension"`
+	Resolution string       `json:"resolution"`
+	From       string       `json:"from"`
+	To         string       `json:"to"`
+	Top        []tsdb.Total `json:"top"`
+}
+
+func main() {
+	dir := flag.String("dir", "/var/db/zid-proxy/history", "Traffic history directory (zid-proxy -history-dir)")
+	dim := flag.String("dim", "ip", "Dimension: ip, user, group or domain")
+	key := flag.String("key", "", "Series key (IP, username, group or domain). Empty lists the top keys.")
+	rangeStr := flag.String("range", "24h", "Time range ending now (e.g. 24h, 7d, 30d)")
+	resName := flag.String("resolution", "", "Bucket size: 5m or 1h (default: finest that covers -range)")
+	top := flag.Int("top", 20, "Number of keys to list when -key is empty (0 = all)")
+	format := flag.String("format", "json", "Output format: json or csv")
+	showVersion := flag.Bool("version", false, "Show version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("zid-proxy-stats version %s (built %s)\n", Version, BuildTime)
+		os.Exit(0)
+	}
+
+	d := tsdb.Dimension(*dim)
+	if !validDimension(d) {
+		fatalf("invalid -dim %q (expected ip, user, group or domain)", *dim)
+	}
+	span, err := tsdb.ParseRange(*rangeStr)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	res := tsdb.ResolutionFor(span)
+	if *resName != "" {
+		r, ok := tsdb.ResolutionByName(*resName)
+		if !ok {
+			fatalf("invalid -resolution %q (expected 5m or 1h)", *resName)
+		}
+		res = r
+	}
+	if *format != "json" && *format != "csv" {
+		fatalf("invalid -format %q (expected json or csv)", *format)
+	}
+
+	store, err := tsdb.Open(tsdb.Options{Dir: *dir})
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	to := time.Now()
+	from := to.Add(-span)
+
+	if *key != "" {
+		out := seriesOutput{
+			Dimension:  string(d),
+			Key:        *key,
+			Resolution: res.Name,
+			From:       from.UTC().Format(time.RFC3339),
+			To:         to.UTC().Format(time.RFC3339),
+			Points:     store.Query(d, *key, res, from, to),
+		}
+		if *format == "csv" {
+			err = writeSeriesCSV(os.Stdout, out.Points)
+		} else {
+			err = writeJSON(os.Stdout, out)
+		}
+	} else {
+		out := topOutput{
+			Dimension:  string(d),
+			Resolution: res.Name,
+			From:       from.UTC().Format(time.RFC3339),
+			To:         to.UTC().Format(time.RFC3339),
+			Top:        store.Top(d, res, from, to, *top),
+		}
+		if *format == "csv" {
+			err = writeTopCSV(os.Stdout, out.Top)
+		} else {
+			err = writeJSON(os.Stdout, out)
+		}
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func validDimension(d tsdb.Dimension) bool {
+	for _, known := range tsdb.Dimensions {
+		if d == known {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(v)
+}
+
+func writeSeriesCSV(w io.Writer, points []tsdb.Point) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"time", "bytes_in", "bytes_out", "conns"})
+	for _, p := range points {
+		_ = cw.Write([]string{
+			time.Unix(p.Start, 0).UTC().Format(time.RFC3339),
+			strconv.FormatUint(p.BytesIn, 10),
+			strconv.FormatUint(p.BytesOut, 10),
+			strconv.FormatUint(p.Conns, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeTopCSV(w io.Writer, totals []tsdb.Total) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"key", "bytes_in", "bytes_out", "conns"})
+	for _, t := range totals {
+		_ = cw.Write([]string{
+			t.Key,
+			strconv.FormatUint(t.BytesIn, 10),
+			strconv.FormatUint(t.BytesOut, 10),
+			strconv.FormatUint(t.Conns, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+	os.Exit(2)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,12 +14,20 @@ import (
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/activeips"
+	"github.com/guilherme/zid-proxy/internal/adminhttp"
 	"github.com/guilherme/zid-proxy/internal/agent"
+	"github.com/guilherme/zid-proxy/internal/agentauth"
 	"github.com/guilherme/zid-proxy/internal/agenthttp"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
 	"github.com/guilherme/zid-proxy/internal/config"
+	"github.com/guilherme/zid-proxy/internal/inventory"
 	"github.com/guilherme/zid-proxy/internal/logger"
 	"github.com/guilherme/zid-proxy/internal/proxy"
+	"github.com/guilherme/zid-proxy/internal/quota"
 	"github.com/guilherme/zid-proxy/internal/rules"
+	"github.com/guilherme/zid-proxy/internal/tsdb"
 )
 
 var (
@@ -37,8 +47,36 @@ func main() {
 	activeIPsIntervalSec := flag.Int("active-ips-interval-seconds", int(cfg.ActiveIPsInterval.Seconds()), "How often to write active IPs snapshot (seconds)")
 	activeIPsTimeoutSec := flag.Int("active-ips-timeout-seconds", int(cfg.ActiveIPsTimeout.Seconds()), "Idle timeout to drop IPs from snapshot (seconds)")
 	flag.IntVar(&cfg.ActiveIPsMax, "active-ips-max", cfg.ActiveIPsMax, "Maximum number of tracked IPs")
+	flag.StringVar(&cfg.ActiveIPsStateFile, "active-ips-state", cfg.ActiveIPsStateFile, "Active IPs state file restored at startup (keeps byte counters across restarts). Empty disables.")
 	flag.StringVar(&cfg.AgentListenAddr, "agent-listen", cfg.AgentListenAddr, "Agent HTTP API listen address (e.g., 192.168.1.1:18443). Empty disables.")
 	agentTTLSeconds := flag.Int("agent-ttl-seconds", int(cfg.AgentTTL.Seconds()), "Agent entry TTL (seconds)")
+	flag.StringVar(&cfg.AgentAuthMode, "agent-auth", cfg.AgentAuthMode, "Agent heartbeat signatures: off, flag (unsigned agents marked unverified) or require")
+	flag.StringVar(&cfg.AgentKeysFile, "agent-keys", cfg.AgentKeysFile, "Agent HMAC keys file (KEY_ID;SECRET per line), reloaded on SIGHUP")
+	flag.StringVar(&cfg.AgentTLSMode, "agent-tls", cfg.AgentTLSMode, "Agent API TLS: off, on (HTTPS and plain HTTP on the same port) or require")
+	flag.StringVar(&cfg.AgentTLSCertFile, "agent-tls-cert", cfg.AgentTLSCertFile, "Agent API certificate (self-signed one generated if cert and key are missing)")
+	flag.StringVar(&cfg.AgentTLSKeyFile, "agent-tls-key", cfg.AgentTLSKeyFile, "Agent API private key")
+	flag.StringVar(&cfg.AgentInventoryFile, "agent-inventory", cfg.AgentInventoryFile, "Agent inventory file (enrollment state, versions, IP history). Empty keeps it in memory only.")
+	flag.StringVar(&cfg.AgentEnroll, "agent-enroll", cfg.AgentEnroll, "Agent enrollment: auto (new agents with a verified signature approved) or manual (pending until approved in the admin API)")
+	flag.IntVar(&cfg.AgentInventoryMax, "agent-inventory-max", cfg.AgentInventoryMax, "Maximum agents in the inventory (the oldest unsigned pending agent makes room)")
+	flag.StringVar(&cfg.AgentConfigFile, "agent-config", cfg.AgentConfigFile, "Agent configuration pushed to signed agents in heartbeat responses (JSON), reloaded on SIGHUP")
+	flag.StringVar(&cfg.AgentUpdateDir, "agent-update-dir", cfg.AgentUpdateDir, "Signed agent update manifests (<channel>.json, see zid-update-sign). Empty disables.")
+	agentStaleDays := flag.Int("agent-stale-days", int(cfg.AgentStaleAfter/(24*time.Hour)), "Report agents without a heartbeat for this many days as stale")
+	flag.StringVar(&cfg.ConnectionsFile, "connections", cfg.ConnectionsFile, "Live connections JSON snapshot output path")
+	flag.BoolVar(&cfg.RevokeOnReload, "revoke-on-reload", cfg.RevokeOnReload, "On rules reload, re-check live connections and close the ones now blocked (logged as REVOKED)")
+	flag.StringVar(&cfg.AdminListenAddr, "admin-listen", cfg.AdminListenAddr, "Local admin HTTP API listen address; must be loopback (127.0.0.1, ::1, localhost), as requests are not authenticated. Empty disables.")
+	flag.StringVar(&cfg.QuotaFile, "quota-file", cfg.QuotaFile, "Data quota counters state file (persisted across restarts). Empty keeps counters in memory only.")
+	flag.StringVar(&cfg.HistoryDir, "history-dir", cfg.HistoryDir, "Traffic history directory (5m/hourly buckets per IP, user, group, domain). Empty disables.")
+	flag.IntVar(&cfg.HistoryMaxSeries, "history-max-series", cfg.HistoryMaxSeries, "Maximum traffic history keys per dimension")
+	flag.IntVar(&cfg.MaxConns, "max-conns", cfg.MaxConns, "Maximum in-flight connections across all clients (0 = unlimited)")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "Maximum concurrent connections per source IP (0 = unlimited)")
+	flag.IntVar(&cfg.MaxConnRatePerIP, "max-conn-rate-per-ip", cfg.MaxConnRatePerIP, "Maximum new connections per second per source IP (0 = unlimited)")
+	flag.StringVar(&cfg.AppIDMode, "appid", cfg.AppIDMode, "Application identification: off, local (built-in hostname signatures) or daemon (zid-appid socket)")
+	flag.StringVar(&cfg.AppIDSocket, "appid-socket", cfg.AppIDSocket, "zid-appid Unix socket (daemon mode)")
+	appIDTimeoutMs := flag.Int("appid-timeout-ms", int(cfg.AppIDTimeout/time.Millisecond), "zid-appid lookup timeout (milliseconds)")
+	flag.BoolVar(&cfg.AppIDFailOpen, "appid-fail-open", cfg.AppIDFailOpen, "Allow connections when zid-appid does not answer (false blocks groups with app rules)")
+	flag.BoolVar(&cfg.AppIDReportFlows, "appid-report-flows", cfg.AppIDReportFlows, "Report relayed connections and their bytes to zid-appid (daemon mode) for per-IP app usage")
+	flag.StringVar(&cfg.AppIDSignaturesFile, "appid-signatures", cfg.AppIDSignaturesFile, "Application signature database (JSON) merged over the built-ins in local mode, reloaded on SIGHUP")
+	flag.StringVar(&cfg.AppIDRulesFile, "appid-rules", cfg.AppIDRulesFile, "ALLOW_APP/BLOCK_APP rules file (TYPE;GROUP;APP per line), reloaded on SIGHUP")
 	showVersion := flag.Bool("version", false, "Show version and exit")
 	flag.Parse()
 
@@ -58,6 +96,34 @@ func main() {
 		*agentTTLSeconds = 600
 	}
 	cfg.AgentTTL = time.Duration(*agentTTLSeconds) * time.Second
+	if *agentStaleDays < 1 {
+		*agentStaleDays = 1
+	}
+	cfg.AgentStaleAfter = time.Duration(*agentStaleDays) * 24 * time.Hour
+	if *appIDTimeoutMs < 10 {
+		*appIDTimeoutMs = 10
+	}
+	cfg.AppIDTimeout = time.Duration(*appIDTimeoutMs) * time.Millisecond
+
+	agentAuthMode, err := agentauth.ParseMode(cfg.AgentAuthMode)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	agentTLSMode, err := agenthttp.ParseTLSMode(cfg.AgentTLSMode)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.AgentEnroll != "auto" && cfg.AgentEnroll != "manual" {
+		log.Fatalf("invalid agent enrollment mode %q (expected auto or manual)", cfg.AgentEnroll)
+	}
+	if cfg.AdminListenAddr != "" {
+		if err := adminhttp.CheckListenAddr(cfg.AdminListenAddr); err != nil {
+			log.Fatalf("invalid -admin-listen: %v", err)
+		}
+	}
+	if cfg.AppIDMode != "off" && cfg.AppIDMode != "local" && cfg.AppIDMode != "daemon" {
+		log.Fatalf("invalid appid mode %q (expected off, local or daemon)", cfg.AppIDMode)
+	}
 
 	if *showVersion {
 		fmt.Printf("zid-proxy version %s (built %s)\n", Version, BuildTime)
@@ -65,7 +131,8 @@ func main() {
 	}
 
 	log.Printf("zid-proxy version %s starting...", Version)
-	log.Printf("Configuration: listen=%s rules=%s log=%s agent_listen=%s", cfg.ListenAddr, cfg.RulesFile, cfg.LogFile, cfg.AgentListenAddr)
+	log.Printf("Configuration: listen=%s rules=%s log=%s agent_listen=%s admin_listen=%s", cfg.ListenAddr, cfg.RulesFile, cfg.LogFile, cfg.AgentListenAddr, cfg.AdminListenAddr)
+	log.Printf("Connection limits: max_conns=%d max_conns_per_ip=%d max_conn_rate_per_ip=%d/s", cfg.MaxConns, cfg.MaxConnsPerIP, cfg.MaxConnRatePerIP)
 
 	// Write PID file
 	if err := writePidFile(cfg.PidFile); err != nil {
@@ -96,45 +163,261 @@ func main() {
 		MaxIPs:      cfg.ActiveIPsMax,
 		IdentityTTL: cfg.AgentTTL,
 	})
+	if cfg.ActiveIPsStateFile != "" {
+		snap, err := activeips.ReadSnapshot(cfg.ActiveIPsStateFile)
+		switch {
+		case err == nil:
+			n := activeTracker.Restore(snap, time.Now())
+			log.Printf("[ACTIVEIPS] Restored %d IPs from %s", n, cfg.ActiveIPsStateFile)
+		case !os.IsNotExist(err):
+			log.Printf("Warning: failed to restore active IPs state from %s: %v", cfg.ActiveIPsStateFile, err)
+		}
+	}
 
 	agentRegistry := agent.NewRegistry(cfg.AgentTTL)
 
+	// Agent inventory: enrollment state and history per agent ID
+	agentInventory, err := inventory.Open(inventory.Options{
+		Path:        cfg.AgentInventoryFile,
+		AutoApprove: cfg.AgentEnroll == "auto",
+		StaleAfter:  cfg.AgentStaleAfter,
+		MaxRecords:  cfg.AgentInventoryMax,
+	})
+	if err != nil {
+		log.Printf("Warning: failed to load agent inventory from %s: %v", cfg.AgentInventoryFile, err)
+	}
+	saveInventory := func() {
+		if err := agentInventory.SaveIfDirty(); err != nil {
+			log.Printf("Warning: failed to save agent inventory: %v", err)
+		}
+	}
+
+	agentVerifier := agentauth.NewVerifier(agentauth.DefaultMaxSkew)
+	loadAgentKeys := func() {
+		if agentAuthMode == agentauth.ModeOff {
+			return
+		}
+		keys, err := agentauth.LoadKeys(cfg.AgentKeysFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to load agent keys from %s: %v", cfg.AgentKeysFile, err)
+			return
+		}
+		agentVerifier.SetKeys(keys)
+		log.Printf("[AGENT] Auth mode %s, %d agent keys loaded", agentAuthMode, len(keys))
+	}
+	loadAgentKeys()
+
+	// Data quotas: counters survive restarts through the state file
+	quotaStore := quota.New(nil)
+	if cfg.QuotaFile != "" {
+		if err := quotaStore.Load(cfg.QuotaFile); err != nil {
+			log.Printf("Warning: failed to load quota state from %s: %v", cfg.QuotaFile, err)
+		}
+	}
+	saveQuotas := func() {
+		if cfg.QuotaFile == "" {
+			return
+		}
+		if err := quotaStore.Save(cfg.QuotaFile); err != nil {
+			log.Printf("Warning: failed to save quota state: %v", err)
+		}
+	}
+
+	// Traffic history for the GUI charts (see zid-proxy-stats)
+	var history *tsdb.Store
+	if cfg.HistoryDir != "" {
+		history, err = tsdb.Open(tsdb.Options{Dir: cfg.HistoryDir, MaxSeries: cfg.HistoryMaxSeries})
+		if err != nil {
+			log.Printf("Warning: failed to load traffic history from %s: %v", cfg.HistoryDir, err)
+		}
+	}
+	saveHistory := func() {
+		if history == nil {
+			return
+		}
+		if err := history.Save(); err != nil {
+			log.Printf("Warning: failed to save traffic history: %v", err)
+		}
+	}
+
+	// Recent blocks per IP, returned to agents in heartbeat responses
+	blockLog := blocklog.New(blocklog.DefaultMaxAge)
+
+	// Application identification and the ALLOW_APP/BLOCK_APP rules
+	var appResolver proxy.AppResolver
+	var flowReporter *proxy.ClientFlowReporter
+	var appRules *appid.AppRuleSet
+	var appDetector *appid.Detector
+	loadAppSignatures := func(load func() error) {
+		if err := load(); err != nil {
+			log.Printf("Warning: failed to load app signatures: %v", err)
+			return
+		}
+		if version, n := appDetector.SignaturesVersion(); version != "" {
+			log.Printf("App signatures version %s loaded (%d apps)", version, n)
+		}
+	}
+	switch cfg.AppIDMode {
+	case "local":
+		appDetector = appid.NewDetector()
+		if cfg.AppIDSignaturesFile != "" {
+			loadAppSignatures(func() error { return appDetector.LoadSignatures(cfg.AppIDSignaturesFile) })
+		}
+		appResolver = proxy.NewDetectorResolver(appDetector)
+	case "daemon":
+		appResolver = proxy.NewClientResolver(cfg.AppIDSocket, cfg.AppIDTimeout)
+		if cfg.AppIDReportFlows {
+			flowReporter = proxy.NewClientFlowReporter(cfg.AppIDSocket, cfg.AppIDTimeout)
+		}
+	}
+	if appResolver != nil && cfg.AppIDRulesFile != "" {
+		appRules = appid.NewAppRuleSet(cfg.AppIDRulesFile)
+		if err := appRules.Load(); err != nil {
+			log.Fatalf("Failed to load app rules: %v", err)
+		}
+		log.Printf("AppID mode %s, loaded %d app rules from %s", cfg.AppIDMode, appRules.Count(), cfg.AppIDRulesFile)
+	}
+
+	// Create proxy server
+	proxyCfg := proxy.Config{
+		ListenAddr:       cfg.ListenAddr,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+		ActiveIPs:        activeTracker,
+		Agents:           agentRegistry,
+		RevokeOnReload:   cfg.RevokeOnReload,
+		MaxConns:         cfg.MaxConns,
+		MaxConnsPerIP:    cfg.MaxConnsPerIP,
+		MaxConnRatePerIP: cfg.MaxConnRatePerIP,
+		Quotas:           quotaStore,
+		History:          history,
+		Blocks:           blockLog,
+		Apps:             appResolver,
+		AppRules:         appRules,
+		AppFailOpen:      cfg.AppIDFailOpen,
+	}
+	if flowReporter != nil {
+		proxyCfg.Flows = flowReporter
+	}
+	server := proxy.New(proxyCfg, ruleSet, accessLogger)
+
 	// Periodically write snapshot to JSON (and GC idle entries)
+	writeActiveState := func(snap activeips.Snapshot) {
+		if cfg.ActiveIPsStateFile == "" {
+			return
+		}
+		if err := activeips.WriteSnapshotAtomic(cfg.ActiveIPsStateFile, snap); err != nil {
+			log.Printf("Warning: failed to write active IPs state: %v", err)
+		}
+	}
 	activeDone := make(chan struct{})
+	activeStopped := make(chan struct{})
 	go func() {
+		defer close(activeStopped)
 		ticker := time.NewTicker(cfg.ActiveIPsInterval)
 		defer ticker.Stop()
+		lastQuotaSave := time.Now()
+		lastHistorySave := time.Now()
 		for {
 			select {
 			case <-ticker.C:
 				now := time.Now()
 				activeTracker.GC(now)
 				agentRegistry.GC(now)
+				blockLog.GC(now)
 				snap := activeTracker.Snapshot(now)
 				if err := activeips.WriteSnapshotAtomic(cfg.ActiveIPsFile, snap); err != nil {
 					log.Printf("Warning: failed to write active IPs snapshot: %v", err)
 				}
+				writeActiveState(snap)
+				if cfg.ConnectionsFile != "" {
+					if err := proxy.WriteConnectionsAtomic(cfg.ConnectionsFile, server.Connections(now)); err != nil {
+						log.Printf("Warning: failed to write connections snapshot: %v", err)
+					}
+				}
+				if history != nil && now.Sub(lastHistorySave) >= cfg.HistorySaveInterval {
+					history.GC(now)
+					saveHistory()
+					lastHistorySave = now
+				}
+				if now.Sub(lastQuotaSave) >= cfg.QuotaSaveInterval {
+					quotaStore.GC(now)
+					saveQuotas()
+					saveInventory()
+					lastQuotaSave = now
+				}
 			case <-activeDone:
+				// Final state after all connections are closed
+				writeActiveState(activeTracker.Snapshot(time.Now()))
 				return
 			}
 		}
 	}()
-	defer close(activeDone)
 
 	var agentSrv *http.Server
+	var agentAPI *agenthttp.Server
+	loadAgentPolicy := func() {
+		if agentAPI == nil || cfg.AgentConfigFile == "" {
+			return
+		}
+		p, err := agentpolicy.Load(cfg.AgentConfigFile)
+		switch {
+		case os.IsNotExist(err):
+			// Release the agents managed by a removed policy.
+			p = agentpolicy.Unmanaged()
+		case err != nil:
+			log.Printf("Warning: failed to load agent config from %s: %v", cfg.AgentConfigFile, err)
+			agentAPI.SetPolicy(agentpolicy.Policy{})
+			return
+		}
+		p, err = agentpolicy.Publish(p, cfg.AgentConfigFile+".serial")
+		if err != nil {
+			log.Printf("Warning: failed to save the agent config serial: %v", err)
+		}
+		agentAPI.SetPolicy(p)
+		log.Printf("[AGENT] Agent config revision %s (serial %d) published from %s", p.Revision, p.Serial, cfg.AgentConfigFile)
+	}
 	agentHTTPDone := make(chan struct{})
 	if cfg.AgentListenAddr != "" {
+		agentAPI = agenthttp.New(agentRegistry, func(srcIP, machine, username string, verified bool) {
+			activeTracker.SetIdentity(srcIP, machine, username, verified, time.Now())
+		})
+		agentAPI.SetAuth(agentAuthMode, agentVerifier)
+		agentAPI.SetInventory(agentInventory)
+		agentAPI.SetBlocks(blockLog)
+		agentAPI.SetUpdateDir(cfg.AgentUpdateDir)
+		agentAPI.SetOnLogout(func(srcIP string) {
+			activeTracker.ClearIdentity(srcIP)
+		})
+		loadAgentPolicy()
 		agentSrv = &http.Server{
-			Addr: cfg.AgentListenAddr,
-			Handler: agenthttp.New(agentRegistry, func(srcIP, machine, username string) {
-				activeTracker.SetIdentity(srcIP, machine, username, time.Now())
-			}).Handler(),
+			Addr:              cfg.AgentListenAddr,
+			Handler:           agentAPI.Handler(),
 			ReadHeaderTimeout: 5 * time.Second,
 		}
+		var agentTLS *tls.Config
+		if agentTLSMode != agenthttp.TLSOff {
+			cert, err := agenthttp.LoadOrCreateCert(cfg.AgentTLSCertFile, cfg.AgentTLSKeyFile)
+			if err != nil {
+				if agentTLSMode == agenthttp.TLSRequire {
+					log.Fatalf("Failed to load agent TLS certificate: %v", err)
+				}
+				log.Printf("Warning: failed to load agent TLS certificate, serving plain HTTP only: %v", err)
+				agentTLSMode = agenthttp.TLSOff
+			} else {
+				agentTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+				log.Printf("[AGENT] TLS %s, certificate sha256=%s", agentTLSMode, agentauth.CertFingerprint(cert.Certificate[0]))
+			}
+		}
 		go func() {
 			defer close(agentHTTPDone)
-			log.Printf("Agent HTTP API listening on %s", cfg.AgentListenAddr)
-			if err := agentSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			ln, err := net.Listen("tcp", cfg.AgentListenAddr)
+			if err != nil {
+				log.Printf("Agent HTTP API error: %v", err)
+				return
+			}
+			log.Printf("Agent HTTP API listening on %s (tls=%s)", cfg.AgentListenAddr, agentTLSMode)
+			if err := agentSrv.Serve(agenthttp.NewListener(ln, agentTLS, agentTLSMode)); err != nil && err != http.ErrServerClosed {
 				log.Printf("Agent HTTP API error: %v", err)
 			}
 		}()
@@ -142,15 +425,24 @@ func main() {
 		close(agentHTTPDone)
 	}
 
-	// Create proxy server
-	proxyCfg := proxy.Config{
-		ListenAddr:   cfg.ListenAddr,
-		ReadTimeout:  cfg.ReadTimeout,
-		WriteTimeout: cfg.WriteTimeout,
-		ActiveIPs:    activeTracker,
-		Agents:       agentRegistry,
+	var adminSrv *http.Server
+	adminHTTPDone := make(chan struct{})
+	if cfg.AdminListenAddr != "" {
+		adminSrv = &http.Server{
+			Addr:              cfg.AdminListenAddr,
+			Handler:           adminhttp.New(server, quotaStore, agentInventory).Handler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			defer close(adminHTTPDone)
+			log.Printf("Admin HTTP API listening on %s", cfg.AdminListenAddr)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin HTTP API error: %v", err)
+			}
+		}()
+	} else {
+		close(adminHTTPDone)
 	}
-	server := proxy.New(proxyCfg, ruleSet, accessLogger)
 
 	// Start server
 	if err := server.Start(); err != nil {
@@ -169,6 +461,11 @@ func main() {
 			if err := server.Reload(); err != nil {
 				log.Printf("Failed to reload rules: %v", err)
 			}
+			if appDetector != nil && cfg.AppIDSignaturesFile != "" {
+				loadAppSignatures(appDetector.ReloadSignatures)
+			}
+			loadAgentKeys()
+			loadAgentPolicy()
 			if err := accessLogger.Reopen(); err != nil {
 				log.Printf("Failed to reopen log file: %v", err)
 			}
@@ -177,12 +474,26 @@ func main() {
 			if err := server.Stop(); err != nil {
 				log.Printf("Error during shutdown: %v", err)
 			}
+			if flowReporter != nil {
+				flowReporter.Close()
+			}
+			saveQuotas()
+			saveHistory()
+			saveInventory()
+			close(activeDone)
+			<-activeStopped
 			if agentSrv != nil {
 				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 				_ = agentSrv.Shutdown(ctx)
 				cancel()
 			}
+			if adminSrv != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				_ = adminSrv.Shutdown(ctx)
+				cancel()
+			}
 			<-agentHTTPDone
+			<-adminHTTPDone
 			log.Println("Goodbye!")
 			return
 		}
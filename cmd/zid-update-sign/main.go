@@ -0,0 +1,109 @@
+// zid-update-sign creates the release key pair and signs the zid-agent update
+// manifests published by zid-proxy (-agent-update-dir).
+//
+//	zid-update-sign -keygen -key release.key
+//	zid-update-sign -key release.key -in manifest.json -out stable.json
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/guilherme/zid-proxy/internal/agentupdate"
+)
+
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
+func main() {
+	keyFile := flag.String("key", "release.key", "Release private key file (base64 ed25519 seed)")
+	keygen := flag.Bool("keygen", false, "Generate a new key pair in -key and print the public key for internal/agentupdate/release_key.pub")
+	in := flag.String("in", "", "Unsigned manifest (JSON: version, channel, rollout_percent, platforms)")
+	out := flag.String("out", "", "Signed manifest output (default stdout)")
+	showVersion := flag.Bool("version", false, "Show version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("zid-update-sign version %s (built %s)\n", Version, BuildTime)
+		os.Exit(0)
+	}
+
+	if *keygen {
+		if err := generateKey(*keyFile); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *in == "" {
+		fatal(errors.New("-in is required"))
+	}
+	if err := sign(*keyFile, *in, *out); err != nil {
+		fatal(err)
+	}
+}
+
+func generateKey(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	seed := base64.StdEncoding.EncodeToString(priv.Seed()) + "\n"
+	if err := os.WriteFile(path, []byte(seed), 0o600); err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+func sign(keyFile, in, out string) error {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("%s: invalid ed25519 seed", keyFile)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+
+	b, err = os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	var m agentupdate.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	sm, err := agentupdate.SignManifest(priv, m)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	data, err := json.MarshalIndent(sm, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(out, data, 0o644)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "zid-update-sign: %v\n", err)
+	os.Exit(1)
+}
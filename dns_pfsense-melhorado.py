@@ -6,6 +6,7 @@ from pyrad.dictionary import Dictionary
 from pyrad.packet import AccessRequest, AccessAccept, AccessReject
 from flask import Flask, render_template, request, jsonify, Response, session, flash, redirect, url_for
 from scapy.all import *
+import queue
 from scapy.layers.dns import DNSQR
 import subprocess
 import flask
@@ -171,7 +172,7 @@ def dns_resolver(pkt, sock):
                                     rrname=qname,
                                     type="AAAA",
                                     rclass="IN",
-                                    ttl=300,
+                                    ttl=ttl_resposta,
                                     rdata=hostname
                                 ),
                                 ar=DNSRROPT(rclass=4096)
@@ -180,6 +181,7 @@ def dns_resolver(pkt, sock):
 
                     sock_out.sendto(bytes(dns_reply[DNS]), (src_host, src_port))
                     add_log(src_host, qname, bloqueado)
+                    add_appid(src_host, qname, hostname, ttl_resposta, bloqueado)
 
                 else:
 
@@ -207,7 +209,7 @@ def dns_resolver(pkt, sock):
                                         rrname=qname,
                                         type="AAAA",
                                         rclass="IN",
-                                        ttl=300,
+                                        ttl=ttl_resposta,
                                         rdata=hostname
                                     ),
                                     ar=DNSRROPT(rclass=4096)
@@ -217,6 +219,7 @@ def dns_resolver(pkt, sock):
                         sock_out.sendto(bytes(dns_reply[DNS]), (src_host, src_port))
                         add_log(src_host, qname, bloqueado)
                         add_cachev6(qname, hostname)
+                        add_appid(src_host, qname, hostname, ttl_resposta, bloqueado)
 
 
                     else:
@@ -313,7 +316,7 @@ def dns_resolver(pkt, sock):
                                 rd=1,
                                 ra=1,
                                 qd=pkt[DNS].qd,
-                                an=DNSRR(rrname=qname, ttl=300, rdata=hostname),
+                                an=DNSRR(rrname=qname, ttl=ttl_resposta, rdata=hostname),
                                 ar=DNSRROPT(rclass=4096)
                             )
                     )
@@ -322,6 +325,7 @@ def dns_resolver(pkt, sock):
                     print(f"cache: {cache_dns}")
                     add_cache(qname, hostname)
                     add_log(src_host, qname, bloqueado)
+                    add_appid(src_host, qname, hostname, ttl_resposta, bloqueado)
 
 
                 else:
@@ -362,6 +366,46 @@ def add_log(src_host, qname, bloqueado):
                 file.write(msg)
 
 
+def add_appid(src_host, qname, hostname, ttl, bloqueado=False):
+    """Informa a resposta ao zid-appid para que ele identifique os fluxos
+    sem SNI (chamadas, jogos) pelo nome consultado. ttl e o TTL da resposta
+    enviada ao cliente, o tempo que ele pode usar o endereco. Nomes bloqueados e
+    apontamentos manuais nao sao informados: o IP respondido nao e o do
+    aplicativo. O envio e feito pela thread appid_worker; com a fila cheia
+    a resposta e descartada."""
+    if bloqueado or qname.strip('.') in apontamentos:
+        return
+    try:
+        appid_fila.put_nowait(f"DNS {src_host} {qname} {ttl} {hostname}\n")
+    except queue.Full:
+        pass
+
+
+def appid_worker():
+    """Envia as respostas da fila ao zid-appid por uma unica conexao,
+    reconectando apos falhas. Falhas sao ignoradas: o zid-appid pode nao
+    estar rodando."""
+    conn = None
+    arquivo = None
+    while True:
+        linha = appid_fila.get()
+        try:
+            if conn is None:
+                conn = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+                conn.settimeout(0.5)
+                conn.connect(appid_socket)
+                arquivo = conn.makefile('rb')
+            conn.sendall(linha.encode())
+            arquivo.readline()
+        except OSError:
+            if arquivo is not None:
+                arquivo.close()
+            if conn is not None:
+                conn.close()
+            arquivo = None
+            conn = None
+
+
 def add_cache(qname, hostname):
     with lock:
         if qname in cache_dns:
@@ -639,6 +683,12 @@ def reload_config():
 reload_config()
 # print(sites_drop)
 # USA TTLCACHE PARA FAZER O CONTROLE DO CACHE DEFININDO O MAXIMO DE ENTRADAS E O TEMPO LIMITE
+# Socket do zid-appid (correlacao DNS -> aplicativo)
+appid_socket = "/var/run/zid-appid.sock"
+appid_fila = queue.Queue(maxsize=1000)
+# TTL das respostas A/AAAA enviadas aos clientes (tambem informado ao zid-appid)
+ttl_resposta = 300
+threading.Thread(target=appid_worker, daemon=True).start()
 cache_dns = TTLCache(maxsize=300, ttl=300)
 cache_dnsv6 = TTLCache(maxsize=300, ttl=300)
 # apontamentos = {}
@@ -2,6 +2,8 @@ package activeips
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -30,12 +32,23 @@ type ipStats struct {
 	LastActivity time.Time
 	BytesIn      uint64
 	BytesOut     uint64
+	ThrottledIn  uint64
+	ThrottledOut uint64
 	ActiveConns  int
+	Rejected     uint64
 	Machine      string
 	Username     string
 	IdentitySeen time.Time
+	Verified     bool
+
+	// New-connection rate window (see TryConnStart)
+	rateWindow time.Time
+	rateCount  int
 }
 
+// SnapshotVersion is the schema version of Snapshot, also used by the state file.
+const SnapshotVersion = 1
+
 type Snapshot struct {
 	Version        int          `json:"version"`
 	GeneratedAt    string       `json:"generated_at"`
@@ -52,12 +65,27 @@ type IPSnapshot struct {
 	IdentitySeen     string `json:"identity_seen,omitempty"`
 	IdleSeconds      int    `json:"idle_seconds"`
 	IdentityIdleSecs int    `json:"identity_idle_seconds,omitempty"`
+	IdentityVerified bool   `json:"identity_verified,omitempty"`
 	BytesIn          uint64 `json:"bytes_in"`
 	BytesOut         uint64 `json:"bytes_out"`
 	BytesTotal       uint64 `json:"bytes_total"`
+	ThrottledIn      uint64 `json:"throttled_bytes_in,omitempty"`
+	ThrottledOut     uint64 `json:"throttled_bytes_out,omitempty"`
 	ActiveConns      int    `json:"active_conns"`
+	RejectedConns    uint64 `json:"rejected_conns,omitempty"`
 }
 
+// ConnLimits bounds the connections a single source IP may open (0 = unlimited).
+type ConnLimits struct {
+	MaxConns  int // concurrent connections
+	MaxPerSec int // new connections per second
+}
+
+var (
+	ErrTooManyConns = errors.New("too many concurrent connections")
+	ErrConnRate     = errors.New("connection rate exceeded")
+)
+
 func New(opts Options) *Tracker {
 	if opts.IdleTimeout <= 0 {
 		opts.IdleTimeout = 120 * time.Second
@@ -100,9 +128,16 @@ func sanitizeIdentityField(s string) string {
 }
 
 func (t *Tracker) ConnStart(srcIP string, now time.Time) {
+	_ = t.TryConnStart(srcIP, ConnLimits{}, now)
+}
+
+// TryConnStart counts a new connection from srcIP unless it would exceed lim.
+// A rejected connection is not counted as active; callers must only call
+// ConnEnd for connections that were admitted.
+func (t *Tracker) TryConnStart(srcIP string, lim ConnLimits, now time.Time) error {
 	srcIP = normalizeSrcIP(srcIP)
 	if srcIP == "" {
-		return
+		return nil
 	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -116,10 +151,26 @@ func (t *Tracker) ConnStart(srcIP string, now time.Time) {
 		}
 		t.ips[srcIP] = s
 	}
+
+	if now.Sub(s.rateWindow) >= time.Second || now.Before(s.rateWindow) {
+		s.rateWindow = now
+		s.rateCount = 0
+	}
+	if lim.MaxConns > 0 && s.ActiveConns >= lim.MaxConns {
+		s.Rejected++
+		return ErrTooManyConns
+	}
+	if lim.MaxPerSec > 0 && s.rateCount >= lim.MaxPerSec {
+		s.Rejected++
+		return ErrConnRate
+	}
+
+	s.rateCount++
 	s.ActiveConns++
 	if now.After(s.LastActivity) {
 		s.LastActivity = now
 	}
+	return nil
 }
 
 func (t *Tracker) ConnEnd(srcIP string, now time.Time) {
@@ -166,9 +217,33 @@ func (t *Tracker) AddBytes(srcIP string, bytesIn, bytesOut uint64, now time.Time
 	}
 }
 
-// SetIdentity updates machine/user for an already-tracked IP.
+// AddThrottled records bytes that were delayed by the bandwidth shaper.
+// bytesIn/bytesOut follow the same direction convention as AddBytes.
+func (t *Tracker) AddThrottled(srcIP string, bytesIn, bytesOut uint64, now time.Time) {
+	srcIP = normalizeSrcIP(srcIP)
+	if srcIP == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.ips[srcIP]
+	if s == nil {
+		s = &ipStats{
+			SrcIP:        srcIP,
+			FirstSeen:    now,
+			LastActivity: now,
+		}
+		t.ips[srcIP] = s
+	}
+	s.ThrottledIn += bytesIn
+	s.ThrottledOut += bytesOut
+}
+
+// SetIdentity updates machine/user for an already-tracked IP; verified reports
+// whether the heartbeat was signed with a known agent key.
 // It intentionally does not create a new tracked IP entry (Active IPs list is traffic-based).
-func (t *Tracker) SetIdentity(srcIP, machine, username string, now time.Time) {
+func (t *Tracker) SetIdentity(srcIP, machine, username string, verified bool, now time.Time) {
 	srcIP = normalizeSrcIP(srcIP)
 	if srcIP == "" {
 		return
@@ -193,7 +268,29 @@ func (t *Tracker) SetIdentity(srcIP, machine, username string, now time.Time) {
 	if !now.IsZero() {
 		s.IdentitySeen = now
 	}
-	log.Printf("[ACTIVEIPS] Identity set for IP %s: machine=%q username=%q", srcIP, machine, username)
+	s.Verified = verified
+	log.Printf("[ACTIVEIPS] Identity set for IP %s: machine=%q username=%q verified=%v", srcIP, machine, username, verified)
+}
+
+// ClearIdentity removes the agent identity of srcIP right away (agent logout).
+func (t *Tracker) ClearIdentity(srcIP string) {
+	srcIP = normalizeSrcIP(srcIP)
+	if srcIP == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.ips[srcIP]
+	if s == nil {
+		return
+	}
+	s.Machine = ""
+	s.Username = ""
+	s.Verified = false
+	s.IdentitySeen = time.Time{}
+	log.Printf("[ACTIVEIPS] Identity cleared for IP %s (agent logout)", srcIP)
 }
 
 func (t *Tracker) GC(now time.Time) {
@@ -233,7 +330,7 @@ func (t *Tracker) Snapshot(now time.Time) Snapshot {
 	defer t.mu.Unlock()
 
 	out := Snapshot{
-		Version:        1,
+		Version:        SnapshotVersion,
 		GeneratedAt:    now.UTC().Format(time.RFC3339),
 		IdleTimeoutSec: int(t.opts.IdleTimeout.Seconds()),
 		IPs:            make([]IPSnapshot, 0, len(t.ips)),
@@ -246,6 +343,7 @@ func (t *Tracker) Snapshot(now time.Time) Snapshot {
 				}
 				s.Machine = ""
 				s.Username = ""
+				s.Verified = false
 			}
 		}
 
@@ -256,16 +354,19 @@ func (t *Tracker) Snapshot(now time.Time) Snapshot {
 		total := s.BytesIn + s.BytesOut
 
 		snap := IPSnapshot{
-			SrcIP:        s.SrcIP,
-			Machine:      s.Machine,
-			Username:     s.Username,
-			FirstSeen:    s.FirstSeen.UTC().Format(time.RFC3339),
-			LastActivity: s.LastActivity.UTC().Format(time.RFC3339),
-			IdleSeconds:  idle,
-			BytesIn:      s.BytesIn,
-			BytesOut:     s.BytesOut,
-			BytesTotal:   total,
-			ActiveConns:  s.ActiveConns,
+			SrcIP:         s.SrcIP,
+			Machine:       s.Machine,
+			Username:      s.Username,
+			FirstSeen:     s.FirstSeen.UTC().Format(time.RFC3339),
+			LastActivity:  s.LastActivity.UTC().Format(time.RFC3339),
+			IdleSeconds:   idle,
+			BytesIn:       s.BytesIn,
+			BytesOut:      s.BytesOut,
+			BytesTotal:    total,
+			ThrottledIn:   s.ThrottledIn,
+			ThrottledOut:  s.ThrottledOut,
+			ActiveConns:   s.ActiveConns,
+			RejectedConns: s.Rejected,
 		}
 
 		// Add identity timestamp and idle if available
@@ -276,6 +377,7 @@ func (t *Tracker) Snapshot(now time.Time) Snapshot {
 				identityIdle = 0
 			}
 			snap.IdentityIdleSecs = identityIdle
+			snap.IdentityVerified = s.Verified && (s.Machine != "" || s.Username != "")
 		}
 
 		out.IPs = append(out.IPs, snap)
@@ -292,6 +394,75 @@ func (t *Tracker) Snapshot(now time.Time) Snapshot {
 	return out
 }
 
+// Restore loads the per-IP counters and identities of a snapshot previously
+// written as a state file, then applies the idle-timeout GC. Active connection
+// counts are not restored (those connections died with the old process), and
+// IPs already tracked are left untouched. It returns the number of IPs kept.
+func (t *Tracker) Restore(snap Snapshot, now time.Time) int {
+	t.mu.Lock()
+	for _, ip := range snap.IPs {
+		srcIP := normalizeSrcIP(ip.SrcIP)
+		if srcIP == "" {
+			continue
+		}
+		if _, exists := t.ips[srcIP]; exists {
+			continue
+		}
+		firstSeen, err := time.Parse(time.RFC3339, ip.FirstSeen)
+		if err != nil {
+			continue
+		}
+		lastActivity, err := time.Parse(time.RFC3339, ip.LastActivity)
+		if err != nil {
+			continue
+		}
+
+		s := &ipStats{
+			SrcIP:        srcIP,
+			FirstSeen:    firstSeen,
+			LastActivity: lastActivity,
+			BytesIn:      ip.BytesIn,
+			BytesOut:     ip.BytesOut,
+			ThrottledIn:  ip.ThrottledIn,
+			ThrottledOut: ip.ThrottledOut,
+			Rejected:     ip.RejectedConns,
+			Machine:      sanitizeIdentityField(ip.Machine),
+			Username:     sanitizeIdentityField(ip.Username),
+			Verified:     ip.IdentityVerified,
+		}
+		if ip.IdentitySeen != "" {
+			if seen, err := time.Parse(time.RFC3339, ip.IdentitySeen); err == nil {
+				s.IdentitySeen = seen
+			}
+		}
+		t.ips[srcIP] = s
+	}
+	t.mu.Unlock()
+
+	t.GC(now)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.ips)
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshotAtomic.
+// Snapshots with a different schema version are rejected.
+func ReadSnapshot(path string) (Snapshot, error) {
+	var snap Snapshot
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != SnapshotVersion {
+		return snap, fmt.Errorf("unsupported snapshot version %d (want %d)", snap.Version, SnapshotVersion)
+	}
+	return snap, nil
+}
+
 func WriteSnapshotAtomic(path string, snap Snapshot) error {
 	b, err := json.Marshal(snap)
 	if err != nil {
@@ -1,6 +1,8 @@
 package activeips
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -49,7 +51,7 @@ func TestTracker_SetIdentity_PersistsInSnapshot(t *testing.T) {
 	now := time.Unix(1000, 0).UTC()
 
 	tr.AddBytes("192.168.1.10", 1, 1, now)
-	tr.SetIdentity("192.168.1.10", "pc-01", "alice", now)
+	tr.SetIdentity("192.168.1.10", "pc-01", "alice", false, now)
 
 	snap := tr.Snapshot(now.Add(1 * time.Second))
 	if len(snap.IPs) != 1 {
@@ -65,7 +67,7 @@ func TestTracker_IdentityTTL_ClearsAfterTimeout(t *testing.T) {
 	now := time.Unix(1000, 0).UTC()
 
 	tr.AddBytes("192.168.1.10", 1, 1, now)
-	tr.SetIdentity("192.168.1.10", "pc-01", "alice", now)
+	tr.SetIdentity("192.168.1.10", "pc-01", "alice", false, now)
 
 	snap := tr.Snapshot(now.Add(3 * time.Second))
 	if len(snap.IPs) != 1 {
@@ -75,3 +77,137 @@ func TestTracker_IdentityTTL_ClearsAfterTimeout(t *testing.T) {
 		t.Fatalf("expected identity cleared, got %q/%q", snap.IPs[0].Machine, snap.IPs[0].Username)
 	}
 }
+
+func TestTracker_ClearIdentity(t *testing.T) {
+	tr := New(Options{IdleTimeout: 10 * time.Second, MaxIPs: 100, IdentityTTL: time.Minute})
+	now := time.Unix(1000, 0).UTC()
+
+	tr.AddBytes("192.168.1.10", 1, 1, now)
+	tr.SetIdentity("192.168.1.10", "pc-01", "alice", true, now)
+	tr.ClearIdentity("192.168.1.10")
+
+	snap := tr.Snapshot(now.Add(time.Second))
+	if len(snap.IPs) != 1 {
+		t.Fatalf("got %d ips, want 1", len(snap.IPs))
+	}
+	ip := snap.IPs[0]
+	if ip.Machine != "" || ip.Username != "" || ip.IdentityVerified || ip.IdentitySeen != "" || ip.BytesTotal != 2 {
+		t.Fatalf("after logout: %+v", ip)
+	}
+}
+
+func TestTracker_AddThrottled_InSnapshot(t *testing.T) {
+	tr := New(Options{IdleTimeout: 10 * time.Second, MaxIPs: 100})
+	now := time.Unix(1000, 0).UTC()
+
+	tr.AddBytes("192.168.1.10", 100, 10, now)
+	tr.AddThrottled("192.168.1.10", 64, 0, now)
+	tr.AddThrottled("192.168.1.10", 32, 8, now)
+
+	snap := tr.Snapshot(now.Add(1 * time.Second))
+	if len(snap.IPs) != 1 {
+		t.Fatalf("got %d ips, want 1", len(snap.IPs))
+	}
+	if snap.IPs[0].ThrottledIn != 96 || snap.IPs[0].ThrottledOut != 8 {
+		t.Fatalf("throttled in/out=%d/%d", snap.IPs[0].ThrottledIn, snap.IPs[0].ThrottledOut)
+	}
+	if snap.IPs[0].BytesTotal != 110 {
+		t.Fatalf("throttled bytes must not change totals, got %d", snap.IPs[0].BytesTotal)
+	}
+}
+
+func TestTracker_TryConnStart_Limits(t *testing.T) {
+	tr := New(Options{IdleTimeout: 10 * time.Second, MaxIPs: 100})
+	now := time.Unix(1000, 0).UTC()
+
+	// Concurrent limit
+	lim := ConnLimits{MaxConns: 2}
+	for i := 0; i < 2; i++ {
+		if err := tr.TryConnStart("192.168.1.10", lim, now); err != nil {
+			t.Fatalf("conn %d: unexpected error: %v", i, err)
+		}
+	}
+	if err := tr.TryConnStart("192.168.1.10", lim, now); err != ErrTooManyConns {
+		t.Fatalf("got %v, want ErrTooManyConns", err)
+	}
+	tr.ConnEnd("192.168.1.10", now)
+	if err := tr.TryConnStart("192.168.1.10", lim, now); err != nil {
+		t.Fatalf("after ConnEnd: unexpected error: %v", err)
+	}
+
+	// Rate limit: window resets after one second
+	lim = ConnLimits{MaxPerSec: 3}
+	for i := 0; i < 3; i++ {
+		if err := tr.TryConnStart("192.168.1.20", lim, now); err != nil {
+			t.Fatalf("conn %d: unexpected error: %v", i, err)
+		}
+	}
+	if err := tr.TryConnStart("192.168.1.20", lim, now.Add(500*time.Millisecond)); err != ErrConnRate {
+		t.Fatalf("got %v, want ErrConnRate", err)
+	}
+	if err := tr.TryConnStart("192.168.1.20", lim, now.Add(1*time.Second)); err != nil {
+		t.Fatalf("next window: unexpected error: %v", err)
+	}
+
+	snap := tr.Snapshot(now.Add(1 * time.Second))
+	for _, ip := range snap.IPs {
+		switch ip.SrcIP {
+		case "192.168.1.10":
+			if ip.ActiveConns != 2 || ip.RejectedConns != 1 {
+				t.Fatalf("%s: active=%d rejected=%d", ip.SrcIP, ip.ActiveConns, ip.RejectedConns)
+			}
+		case "192.168.1.20":
+			if ip.ActiveConns != 4 || ip.RejectedConns != 1 {
+				t.Fatalf("%s: active=%d rejected=%d", ip.SrcIP, ip.ActiveConns, ip.RejectedConns)
+			}
+		}
+	}
+}
+
+func TestTracker_StateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db", "active_ips.state.json")
+	now := time.Unix(1000, 0).UTC()
+
+	tr := New(Options{IdleTimeout: 60 * time.Second, MaxIPs: 100})
+	tr.ConnStart("192.168.1.10", now)
+	tr.AddBytes("192.168.1.10", 1000, 200, now)
+	tr.SetIdentity("192.168.1.10", "PC-01", "maria", true, now)
+	tr.AddBytes("192.168.1.20", 50, 5, now.Add(-2*time.Minute)) // idle, dropped on restore
+	if err := WriteSnapshotAtomic(path, tr.Snapshot(now)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	snap, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	restored := New(Options{IdleTimeout: 60 * time.Second, MaxIPs: 100})
+	if n := restored.Restore(snap, now.Add(10*time.Second)); n != 1 {
+		t.Fatalf("restored %d IPs, want 1", n)
+	}
+
+	got := restored.Snapshot(now.Add(10 * time.Second))
+	if len(got.IPs) != 1 {
+		t.Fatalf("got %d ips, want 1", len(got.IPs))
+	}
+	ip := got.IPs[0]
+	if ip.SrcIP != "192.168.1.10" || ip.BytesIn != 1000 || ip.BytesOut != 200 {
+		t.Fatalf("unexpected counters: %+v", ip)
+	}
+	if ip.Machine != "PC-01" || ip.Username != "maria" || !ip.IdentityVerified {
+		t.Fatalf("unexpected identity: %+v", ip)
+	}
+	if ip.ActiveConns != 0 {
+		t.Fatalf("active conns must not be restored, got %d", ip.ActiveConns)
+	}
+}
+
+func TestReadSnapshot_RejectsOtherVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"version":99,"ips":[]}`), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := ReadSnapshot(path); err == nil {
+		t.Fatal("expected version error")
+	}
+}
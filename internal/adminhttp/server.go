@@ -0,0 +1,265 @@
+package adminhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/inventory"
+	"github.com/guilherme/zid-proxy/internal/proxy"
+	"github.com/guilherme/zid-proxy/internal/quota"
+)
+
+// ConnController is implemented by proxy.Server.
+type ConnController interface {
+	Connections(now time.Time) proxy.ConnectionsSnapshot
+	KillConn(id uint64) bool
+	KillIP(srcIP string) int
+	Metrics() proxy.Metrics
+}
+
+// QuotaReporter is implemented by quota.Store.
+type QuotaReporter interface {
+	Snapshot(now time.Time) quota.Snapshot
+}
+
+// AgentInventory is implemented by inventory.Store.
+type AgentInventory interface {
+	Snapshot(now time.Time, state inventory.State, staleOnly bool) inventory.Snapshot
+	SetState(id string, state inventory.State) error
+	Delete(id string) error
+}
+
+// Server exposes local administration endpoints (pfSense GUI, CLI).
+// It must only be bound to loopback: requests are not authenticated.
+type Server struct {
+	conns  ConnController
+	quotas QuotaReporter
+	agents AgentInventory
+}
+
+// CheckListenAddr returns an error unless addr only binds loopback
+// addresses, since the API is not authenticated.
+func CheckListenAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin API must listen on a loopback address, not %q", addr)
+}
+
+// New creates the admin API. quotas and agents may be nil when the
+// corresponding feature is disabled.
+func New(conns ConnController, quotas QuotaReporter, agents AgentInventory) *Server {
+	return &Server{conns: conns, quotas: quotas, agents: agents}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/api/v1/connections", s.connections)
+	mux.HandleFunc("/api/v1/connections/kill", s.kill)
+	mux.HandleFunc("/api/v1/metrics", s.metrics)
+	mux.HandleFunc("/api/v1/quotas", s.quotaUsage)
+	mux.HandleFunc("/api/v1/agents", s.agentList)
+	mux.HandleFunc("/api/v1/agents/approve", s.agentAction(inventory.StateApproved))
+	mux.HandleFunc("/api/v1/agents/revoke", s.agentAction(inventory.StateRevoked))
+	mux.HandleFunc("/api/v1/agents/delete", s.agentAction(""))
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.conns.Connections(time.Now()))
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.conns.Metrics())
+}
+
+func (s *Server) quotaUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.quotas == nil {
+		http.Error(w, "quotas disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.quotas.Snapshot(time.Now()))
+}
+
+func (s *Server) agentList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.agents == nil {
+		http.Error(w, "agent inventory disabled", http.StatusNotFound)
+		return
+	}
+
+	var state inventory.State
+	if v := r.URL.Query().Get("state"); v != "" {
+		st, err := inventory.ParseState(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state = st
+	}
+	staleOnly := r.URL.Query().Get("stale") == "1"
+	writeJSON(w, http.StatusOK, s.agents.Snapshot(time.Now(), state, staleOnly))
+}
+
+type agentRequest struct {
+	ID string `json:"id"`
+}
+
+type agentResponse struct {
+	OK    bool            `json:"ok"`
+	ID    string          `json:"id"`
+	State inventory.State `json:"state,omitempty"`
+}
+
+// agentAction approves or revokes an agent; an empty state deletes it.
+func (s *Server) agentAction(state inventory.State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.agents == nil {
+			http.Error(w, "agent inventory disabled", http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 8*1024))
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		_ = r.Body.Close()
+
+		var req agentRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		req.ID = strings.TrimSpace(req.ID)
+		if req.ID == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if state == "" {
+			err = s.agents.Delete(req.ID)
+		} else {
+			err = s.agents.SetState(req.ID, state)
+		}
+		switch {
+		case errors.Is(err, inventory.ErrNotFound):
+			http.Error(w, "agent not found", http.StatusNotFound)
+			return
+		case err != nil:
+			// The change is applied in memory; only persisting it failed.
+			log.Printf("[ADMIN] Agent %s: failed to save inventory: %v", req.ID, err)
+		}
+
+		action := string(state)
+		if state == "" {
+			action = "deleted"
+		}
+		log.Printf("[ADMIN] Agent %s %s", req.ID, action)
+		writeJSON(w, http.StatusOK, agentResponse{OK: true, ID: req.ID, State: state})
+	}
+}
+
+type killRequest struct {
+	ID    uint64 `json:"id"`
+	SrcIP string `json:"src_ip"`
+}
+
+type killResponse struct {
+	OK     bool `json:"ok"`
+	Killed int  `json:"killed"`
+}
+
+func (s *Server) kill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8*1024))
+	if err != nil {
+		http.Error(w, "read body failed", http.StatusBadRequest)
+		return
+	}
+	_ = r.Body.Close()
+
+	var req killRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.SrcIP = strings.TrimSpace(req.SrcIP)
+
+	killed := 0
+	switch {
+	case req.ID != 0:
+		if s.conns.KillConn(req.ID) {
+			killed = 1
+		}
+	case req.SrcIP != "":
+		killed = s.conns.KillIP(req.SrcIP)
+	default:
+		http.Error(w, "id or src_ip is required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[ADMIN] Kill request: id=%d src_ip=%q killed=%d", req.ID, req.SrcIP, killed)
+	writeJSON(w, http.StatusOK, killResponse{OK: true, Killed: killed})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "marshal failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
@@ -0,0 +1,223 @@
+package adminhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/inventory"
+	"github.com/guilherme/zid-proxy/internal/proxy"
+	"github.com/guilherme/zid-proxy/internal/quota"
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+type fakeConns struct {
+	killedID uint64
+	killedIP string
+}
+
+func (f *fakeConns) Connections(now time.Time) proxy.ConnectionsSnapshot {
+	return proxy.ConnectionsSnapshot{
+		Version:     1,
+		Connections: []proxy.ConnSnapshot{{ID: 7, SrcIP: "192.168.1.10", SNI: "www.example.com"}},
+	}
+}
+
+func (f *fakeConns) KillConn(id uint64) bool {
+	f.killedID = id
+	return id == 7
+}
+
+func (f *fakeConns) KillIP(srcIP string) int {
+	f.killedIP = srcIP
+	return 3
+}
+
+func (f *fakeConns) Metrics() proxy.Metrics {
+	m := proxy.Metrics{ActiveConnections: 1}
+	m.ThrottledBytesIn = 1024
+	return m
+}
+
+func TestMetrics_ReportsThrottledBytes(t *testing.T) {
+	s := New(&fakeConns{}, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/v1/metrics", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if got["active_connections"] != float64(1) || got["throttled_bytes_in"] != float64(1024) {
+		t.Fatalf("metrics=%v", got)
+	}
+}
+
+func TestConnections_ListsSnapshot(t *testing.T) {
+	s := New(&fakeConns{}, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/v1/connections", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var snap proxy.ConnectionsSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(snap.Connections) != 1 || snap.Connections[0].ID != 7 {
+		t.Fatalf("connections=%+v", snap.Connections)
+	}
+}
+
+func TestKill_ByIDAndByIP(t *testing.T) {
+	fc := &fakeConns{}
+	s := New(fc, nil, nil)
+
+	tests := []struct {
+		body       string
+		wantStatus int
+		wantKilled int
+	}{
+		{`{"id":7}`, http.StatusOK, 1},
+		{`{"id":8}`, http.StatusOK, 0},
+		{`{"src_ip":"192.168.1.10"}`, http.StatusOK, 3},
+		{`{}`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1/api/v1/connections/kill", bytes.NewBufferString(tt.body))
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Fatalf("body=%s status=%d want %d", tt.body, rr.Code, tt.wantStatus)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var resp killResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if resp.Killed != tt.wantKilled {
+			t.Fatalf("body=%s killed=%d want %d", tt.body, resp.Killed, tt.wantKilled)
+		}
+	}
+	if fc.killedIP != "192.168.1.10" {
+		t.Fatalf("KillIP called with %q", fc.killedIP)
+	}
+}
+
+func TestQuotas_ReportsRemaining(t *testing.T) {
+	store := quota.New(time.UTC)
+	now := time.Now()
+	store.Check("maria", "visitantes", []rules.Quota{{Period: rules.QuotaDaily, Bytes: 1000}}, now)
+	store.Add("maria", 400, now)
+	s := New(&fakeConns{}, store, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/v1/quotas", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var snap quota.Snapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(snap.Entries) != 1 || snap.Entries[0].Identity != "maria" || snap.Entries[0].RemainingBytes != 600 {
+		t.Fatalf("entries=%+v", snap.Entries)
+	}
+}
+
+func TestQuotas_DisabledReturnsNotFound(t *testing.T) {
+	s := New(&fakeConns{}, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/v1/quotas", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("status=%d, want 404", rr.Code)
+	}
+}
+
+func TestAgents_ListApproveRevokeDelete(t *testing.T) {
+	inv, _ := inventory.Open(inventory.Options{StaleAfter: time.Hour})
+	now := time.Now()
+	inv.Seen(inventory.Heartbeat{ID: "a1", Hostname: "pc-01", IP: "192.168.1.10"}, now)
+	inv.Seen(inventory.Heartbeat{ID: "b2", Hostname: "pc-02", IP: "192.168.1.11"}, now.Add(-2*time.Hour))
+	s := New(&fakeConns{}, nil, inv)
+
+	post := func(path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1"+path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	list := func(query string) inventory.Snapshot {
+		req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/v1/agents"+query, nil)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("list %q: status=%d", query, rr.Code)
+		}
+		var snap inventory.Snapshot
+		if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return snap
+	}
+
+	if code := post("/api/v1/agents/approve", `{"id":"a1"}`); code != http.StatusOK {
+		t.Fatalf("approve: status=%d", code)
+	}
+	if code := post("/api/v1/agents/revoke", `{"id":"b2"}`); code != http.StatusOK {
+		t.Fatalf("revoke: status=%d", code)
+	}
+	if code := post("/api/v1/agents/approve", `{"id":"zz"}`); code != http.StatusNotFound {
+		t.Fatalf("approve missing: status=%d", code)
+	}
+
+	if snap := list("?state=approved"); len(snap.Agents) != 1 || snap.Agents[0].ID != "a1" {
+		t.Fatalf("approved: %+v", snap.Agents)
+	}
+	if snap := list("?stale=1"); len(snap.Agents) != 1 || snap.Agents[0].ID != "b2" || snap.Agents[0].State != inventory.StateRevoked {
+		t.Fatalf("stale: %+v", snap.Agents)
+	}
+
+	if code := post("/api/v1/agents/delete", `{"id":"b2"}`); code != http.StatusOK {
+		t.Fatalf("delete: status=%d", code)
+	}
+	if snap := list(""); len(snap.Agents) != 1 {
+		t.Fatalf("after delete: %+v", snap.Agents)
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:18444": true,
+		"[::1]:18444":     true,
+		"localhost:18444": true,
+		"0.0.0.0:18444":   false,
+		":18444":          false,
+		"192.168.1.1:80":  false,
+		"127.0.0.1":       false,
+	} {
+		if err := CheckListenAddr(addr); (err == nil) != ok {
+			t.Errorf("CheckListenAddr(%q) = %v", addr, err)
+		}
+	}
+}
@@ -2,21 +2,53 @@ package agent
 
 import (
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Info struct {
-	Machine  string
+	Machine string
+	// Username is the user of the connection: the only live session, or the
+	// session whose port range contains the source port. It is empty when
+	// several users share the IP and none can be picked.
 	Username string
 	LastSeen time.Time
+	// Verified is true when the session of Username was reported by a signed
+	// heartbeat; without a Username, when every session was.
+	Verified bool
+	// Sessions lists every live user session on the IP (terminal servers).
+	Sessions []Session
+}
+
+// Session is one logged-in user on an IP. PortLow/PortHigh optionally give
+// the source-port range the host assigns to the session (0 = unknown).
+type Session struct {
+	Username string
+	PortLow  int
+	PortHigh int
+	LastSeen time.Time
+	// Verified is true when the heartbeat reporting the session was signed.
+	Verified bool
+	// agentID is the agent that reported the session.
+	agentID string
+}
+
+func (s Session) hasPort(port int) bool {
+	return s.PortLow > 0 && port >= s.PortLow && port <= s.PortHigh
+}
+
+type entry struct {
+	machine  string
+	lastSeen time.Time
+	sessions map[string]Session // by username
 }
 
 type Registry struct {
 	mu  sync.Mutex
 	ttl time.Duration
-	ips map[string]Info
+	ips map[string]*entry
 }
 
 func NewRegistry(ttl time.Duration) *Registry {
@@ -25,7 +57,7 @@ func NewRegistry(ttl time.Duration) *Registry {
 	}
 	return &Registry{
 		ttl: ttl,
-		ips: make(map[string]Info),
+		ips: make(map[string]*entry),
 	}
 }
 
@@ -52,41 +84,165 @@ func sanitizeField(s string) string {
 	return s
 }
 
-func (r *Registry) Update(srcIP, machine, username string, now time.Time) {
+// Update records a heartbeat reporting one user. It replaces the sessions
+// previously reported by the same agent (agentID, or every agent without an
+// ID when empty), so heartbeats from other agents on the IP (one agent per RDS
+// session) add up to several sessions.
+func (r *Registry) Update(srcIP, machine, agentID, username string, verified bool, now time.Time) {
+	var sessions []Session
+	if u := sanitizeField(username); u != "" {
+		sessions = []Session{{Username: u}}
+	}
+	r.update(srcIP, machine, agentID, sessions, false, verified, now)
+}
+
+// UpdateSessions records a heartbeat listing every session on the host; it
+// replaces the sessions previously known for the IP.
+func (r *Registry) UpdateSessions(srcIP, machine, agentID string, sessions []Session, verified bool, now time.Time) {
+	r.update(srcIP, machine, agentID, sessions, true, verified, now)
+}
+
+func (r *Registry) update(srcIP, machine, agentID string, sessions []Session, replace, verified bool, now time.Time) {
 	srcIP = normalizeIP(srcIP)
 	if srcIP == "" {
 		return
 	}
+	agentID = sanitizeField(agentID)
 
-	info := Info{
-		Machine:  sanitizeField(machine),
-		Username: sanitizeField(username),
-		LastSeen: now,
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.ips[srcIP]
+	if e == nil || replace {
+		e = &entry{sessions: make(map[string]Session)}
+		r.ips[srcIP] = e
+	}
+	for u, s := range e.sessions {
+		if s.agentID == agentID {
+			delete(e.sessions, u)
+		}
+	}
+	e.machine = sanitizeField(machine)
+	e.lastSeen = now
+	for _, s := range sessions {
+		s.Username = sanitizeField(s.Username)
+		if s.Username == "" {
+			continue
+		}
+		if s.PortLow <= 0 || s.PortHigh < s.PortLow || s.PortHigh > 65535 {
+			s.PortLow, s.PortHigh = 0, 0
+		}
+		s.LastSeen = now
+		s.Verified = verified
+		s.agentID = agentID
+		e.sessions[s.Username] = s
+	}
+}
+
+// Logout removes the sessions agentID reported on srcIP: username's, or all
+// of them when username is empty. Sessions reported by a signed heartbeat
+// are only removed by a verified logout. It reports whether the IP still has
+// an identity afterwards.
+func (r *Registry) Logout(srcIP, agentID, username string, verified bool) (remaining bool) {
+	srcIP = normalizeIP(srcIP)
+	if srcIP == "" {
+		return false
 	}
+	agentID = sanitizeField(agentID)
+	username = sanitizeField(username)
 
 	r.mu.Lock()
-	r.ips[srcIP] = info
-	r.mu.Unlock()
+	defer r.mu.Unlock()
+
+	e := r.ips[srcIP]
+	if e == nil {
+		return false
+	}
+	for u, s := range e.sessions {
+		if s.agentID != agentID || (username != "" && u != username) || (s.Verified && !verified) {
+			continue
+		}
+		delete(e.sessions, u)
+	}
+	if len(e.sessions) > 0 {
+		return true
+	}
+	delete(r.ips, srcIP)
+	return false
 }
 
 func (r *Registry) Lookup(srcIP string, now time.Time) (machine, username string, ok bool) {
+	info, ok := r.LookupInfo(srcIP, now)
+	return info.Machine, info.Username, ok
+}
+
+// LookupInfo is Lookup including the verification state and sessions.
+func (r *Registry) LookupInfo(srcIP string, now time.Time) (Info, bool) {
+	return r.LookupConn(srcIP, 0, now)
+}
+
+// LookupConn returns the identity of a connection from srcIP:srcPort. With
+// several sessions on the IP, the user is the one whose port range contains
+// srcPort; without a match the username is left empty rather than guessed.
+func (r *Registry) LookupConn(srcIP string, srcPort int, now time.Time) (Info, bool) {
 	srcIP = normalizeIP(srcIP)
 	if srcIP == "" {
-		return "", "", false
+		return Info{}, false
 	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	info, exists := r.ips[srcIP]
+	e, exists := r.ips[srcIP]
 	if !exists {
-		return "", "", false
+		return Info{}, false
+	}
+	if r.expire(srcIP, e, now) {
+		return Info{}, false
+	}
+
+	info := Info{Machine: e.machine, LastSeen: e.lastSeen}
+	for _, s := range e.sessions {
+		info.Sessions = append(info.Sessions, s)
 	}
-	if r.ttl > 0 && now.Sub(info.LastSeen) > r.ttl {
+	sort.Slice(info.Sessions, func(i, j int) bool { return info.Sessions[i].Username < info.Sessions[j].Username })
+
+	switch {
+	case len(info.Sessions) == 1:
+		info.Username = info.Sessions[0].Username
+	case srcPort > 0:
+		for _, s := range info.Sessions {
+			if s.hasPort(srcPort) {
+				info.Username = s.Username
+				break
+			}
+		}
+	}
+	info.Verified = len(info.Sessions) > 0
+	for _, s := range info.Sessions {
+		if info.Username == "" || s.Username == info.Username {
+			info.Verified = info.Verified && s.Verified
+		}
+	}
+	return info, true
+}
+
+// expire drops the sessions of e idle for longer than the TTL, and e itself
+// when the IP sent no heartbeat within the TTL. Caller must hold r.mu.
+func (r *Registry) expire(srcIP string, e *entry, now time.Time) bool {
+	if r.ttl <= 0 {
+		return false
+	}
+	if now.Sub(e.lastSeen) > r.ttl {
 		delete(r.ips, srcIP)
-		return "", "", false
+		return true
 	}
-	return info.Machine, info.Username, true
+	for u, s := range e.sessions {
+		if now.Sub(s.LastSeen) > r.ttl {
+			delete(e.sessions, u)
+		}
+	}
+	return false
 }
 
 func (r *Registry) GC(now time.Time) {
@@ -95,9 +251,7 @@ func (r *Registry) GC(now time.Time) {
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for ip, info := range r.ips {
-		if now.Sub(info.LastSeen) > r.ttl {
-			delete(r.ips, ip)
-		}
+	for ip, e := range r.ips {
+		r.expire(ip, e, now)
 	}
 }
@@ -9,7 +9,7 @@ func TestRegistry_UpdateLookupAndTTL(t *testing.T) {
 	r := NewRegistry(2 * time.Second)
 	now := time.Unix(1000, 0).UTC()
 
-	r.Update("192.168.1.10", "pc-01", "alice", now)
+	r.Update("192.168.1.10", "pc-01", "", "alice", false, now)
 	m, u, ok := r.Lookup("192.168.1.10", now.Add(500*time.Millisecond))
 	if !ok || m != "pc-01" || u != "alice" {
 		t.Fatalf("lookup=%v machine=%q user=%q", ok, m, u)
@@ -20,3 +20,111 @@ func TestRegistry_UpdateLookupAndTTL(t *testing.T) {
 		t.Fatalf("expected entry to expire")
 	}
 }
+
+func TestRegistry_SeveralUsersPerIP(t *testing.T) {
+	r := NewRegistry(60 * time.Second)
+	now := time.Unix(1000, 0).UTC()
+
+	// One agent per RDS session: heartbeats add up instead of overwriting.
+	r.Update("10.0.0.5", "rds-01", "agent-a", "alice", true, now)
+	r.Update("10.0.0.5", "rds-01", "agent-b", "bob", false, now.Add(10*time.Second))
+
+	info, ok := r.LookupInfo("10.0.0.5", now.Add(20*time.Second))
+	if !ok || len(info.Sessions) != 2 || info.Username != "" || info.Verified {
+		t.Fatalf("two sessions: ok=%v info=%+v", ok, info)
+	}
+	if !info.Sessions[0].Verified || info.Sessions[1].Verified {
+		t.Fatalf("verified per session: %+v", info.Sessions)
+	}
+
+	// alice's session expires; bob is now the only user.
+	info, _ = r.LookupInfo("10.0.0.5", now.Add(65*time.Second))
+	if len(info.Sessions) != 1 || info.Username != "bob" || info.Verified {
+		t.Fatalf("after expiry: %+v", info)
+	}
+}
+
+func TestRegistry_UpdateReplacesAgentSessions(t *testing.T) {
+	r := NewRegistry(time.Minute)
+	now := time.Unix(1000, 0).UTC()
+
+	// A user switch on the same agent replaces the previous user.
+	r.Update("10.0.0.5", "pc-01", "agent-a", "alice", true, now)
+	r.Update("10.0.0.5", "pc-01", "agent-a", "bob", true, now)
+	if info, _ := r.LookupInfo("10.0.0.5", now); len(info.Sessions) != 1 || info.Username != "bob" || !info.Verified {
+		t.Fatalf("same agent: %+v", info)
+	}
+
+	// So does an agent without an ID, and an unsigned heartbeat cannot keep
+	// the verified flag of the previous one.
+	r.Update("10.0.0.6", "pc-02", "", "alice", true, now)
+	r.Update("10.0.0.6", "pc-02", "", "mallory", false, now)
+	if info, _ := r.LookupInfo("10.0.0.6", now); len(info.Sessions) != 1 || info.Username != "mallory" || info.Verified {
+		t.Fatalf("no agent id: %+v", info)
+	}
+}
+
+func TestRegistry_SessionPortRanges(t *testing.T) {
+	r := NewRegistry(60 * time.Second)
+	now := time.Unix(1000, 0).UTC()
+
+	r.UpdateSessions("10.0.0.6", "ts-linux", "ts-agent", []Session{
+		{Username: "alice", PortLow: 20000, PortHigh: 20999},
+		{Username: "bob", PortLow: 21000, PortHigh: 21999},
+		{Username: "carol"},
+		{Username: "bad", PortLow: 30000, PortHigh: 29000},
+	}, true, now)
+
+	tests := []struct {
+		port int
+		want string
+	}{
+		{20000, "alice"},
+		{20999, "alice"},
+		{21500, "bob"},
+		{40000, ""}, // no range matches: not attributed to anyone
+		{29500, ""}, // invalid range was dropped
+		{0, ""},
+	}
+	for _, tt := range tests {
+		info, ok := r.LookupConn("10.0.0.6", tt.port, now)
+		if !ok || info.Username != tt.want || !info.Verified || len(info.Sessions) != 4 {
+			t.Fatalf("port %d: ok=%v user=%q want %q (sessions=%d)", tt.port, ok, info.Username, tt.want, len(info.Sessions))
+		}
+	}
+
+	// A full report replaces the previous session list.
+	r.UpdateSessions("10.0.0.6", "ts-linux", "ts-agent", []Session{{Username: "bob", PortLow: 21000, PortHigh: 21999}}, true, now.Add(time.Second))
+	if info, _ := r.LookupConn("10.0.0.6", 20500, now.Add(time.Second)); info.Username != "bob" || len(info.Sessions) != 1 {
+		t.Fatalf("after replace: %+v", info)
+	}
+}
+
+func TestRegistry_Logout(t *testing.T) {
+	r := NewRegistry(time.Minute)
+	now := time.Unix(1000, 0).UTC()
+
+	r.Update("10.0.0.5", "rds-01", "agent-a", "alice", false, now)
+	r.Update("10.0.0.5", "rds-01", "agent-b", "bob", true, now)
+	// An agent only logs out the sessions it reported.
+	if !r.Logout("10.0.0.5", "agent-a", "bob", false) {
+		t.Fatal("bob should remain")
+	}
+	if !r.Logout("10.0.0.5", "agent-a", "alice", false) {
+		t.Fatal("bob should remain")
+	}
+	if _, u, _ := r.Lookup("10.0.0.5", now); u != "bob" {
+		t.Fatalf("user=%q", u)
+	}
+	// A signed session needs a verified logout.
+	if !r.Logout("10.0.0.5", "agent-b", "", false) {
+		t.Fatal("unverified logout removed a signed session")
+	}
+	// Empty username logs out every session of the agent.
+	if r.Logout("10.0.0.5", "agent-b", "", true) {
+		t.Fatal("nothing should remain")
+	}
+	if _, _, ok := r.Lookup("10.0.0.5", now); ok {
+		t.Fatal("entry should be gone")
+	}
+}
@@ -0,0 +1,241 @@
+// Package agentauth signs and verifies agent API requests with HMAC-SHA256.
+//
+// The agent signs the method, path, a timestamp, a random nonce and the body
+// hash with its key; the proxy looks the key up by ID, checks the signature,
+// rejects timestamps outside MaxSkew and nonces it has already seen.
+package agentauth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderKeyID     = "X-Zid-Key-Id"
+	HeaderTimestamp = "X-Zid-Timestamp"
+	HeaderNonce     = "X-Zid-Nonce"
+	HeaderSignature = "X-Zid-Signature"
+
+	// DefaultMaxSkew is how far a request timestamp may be from the server clock.
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrUnknownKey   = errors.New("unknown key id")
+	ErrBadSignature = errors.New("invalid signature")
+	ErrStale        = errors.New("timestamp outside allowed skew")
+	ErrReplay       = errors.New("nonce already used")
+)
+
+// Mode selects how the proxy treats agent requests.
+type Mode string
+
+const (
+	ModeOff     Mode = "off"     // signatures are ignored
+	ModeFlag    Mode = "flag"    // unsigned/unknown agents are accepted but marked unverified
+	ModeRequire Mode = "require" // only verified agents are accepted
+)
+
+// ParseMode parses an -agent-auth value.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case ModeOff, ModeFlag, ModeRequire:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid agent auth mode %q (expected off, flag or require)", s)
+}
+
+// message builds the signed string.
+func message(method, path, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:]))
+}
+
+func mac(key []byte, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// Sign adds the authentication headers to req for body.
+func Sign(req *http.Request, keyID, key string, body []byte, now time.Time) error {
+	var n [16]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(n[:])
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	sig := mac([]byte(key), message(req.Method, req.URL.Path, ts, nonce, body))
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+	return nil
+}
+
+// Verifier checks signed requests against a set of agent keys.
+type Verifier struct {
+	mu      sync.Mutex
+	keys    map[string][]byte
+	maxSkew time.Duration
+	seen    map[string]time.Time // nonce -> expiry
+	pruned  time.Time
+}
+
+// NewVerifier creates a Verifier with no keys.
+func NewVerifier(maxSkew time.Duration) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	return &Verifier{
+		keys:    make(map[string][]byte),
+		maxSkew: maxSkew,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// SetKeys replaces the known keys (key ID -> secret).
+func (v *Verifier) SetKeys(keys map[string]string) {
+	m := make(map[string][]byte, len(keys))
+	for id, secret := range keys {
+		m[id] = []byte(secret)
+	}
+	v.mu.Lock()
+	v.keys = m
+	v.mu.Unlock()
+}
+
+// KeyCount returns the number of known keys.
+func (v *Verifier) KeyCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.keys)
+}
+
+// Verify checks the signature headers of r for body and returns the key ID.
+// ErrUnsigned means the request carries no signature at all.
+func (v *Verifier) Verify(r *http.Request, body []byte, now time.Time) (string, error) {
+	keyID := r.Header.Get(HeaderKeyID)
+	ts := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	sigHex := r.Header.Get(HeaderSignature)
+	if keyID == "" && sigHex == "" {
+		return "", ErrUnsigned
+	}
+	if keyID == "" || ts == "" || nonce == "" || sigHex == "" || len(nonce) > 64 {
+		return keyID, ErrBadSignature
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[keyID]
+	if !ok {
+		return keyID, ErrUnknownKey
+	}
+
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || !hmac.Equal(sig, mac(key, message(r.Method, r.URL.Path, ts, nonce, body))) {
+		return keyID, ErrBadSignature
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return keyID, ErrBadSignature
+	}
+	t := time.Unix(sec, 0)
+	if t.Before(now.Add(-v.maxSkew)) || t.After(now.Add(v.maxSkew)) {
+		return keyID, ErrStale
+	}
+
+	// Nonces only need to be remembered while their timestamp is acceptable.
+	if now.Sub(v.pruned) >= time.Minute {
+		for n, exp := range v.seen {
+			if now.After(exp) {
+				delete(v.seen, n)
+			}
+		}
+		v.pruned = now
+	}
+	seenKey := keyID + "/" + nonce
+	if _, dup := v.seen[seenKey]; dup {
+		return keyID, ErrReplay
+	}
+	v.seen[seenKey] = t.Add(v.maxSkew)
+	return keyID, nil
+}
+
+// LoadKeys reads a keys file with one "KEY_ID;SECRET" per line.
+// Empty lines and lines starting with # are ignored.
+func LoadKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ";", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected KEY_ID;SECRET", lineNum)
+		}
+		id := strings.TrimSpace(parts[0])
+		secret := strings.TrimSpace(parts[1])
+		if id == "" || len(secret) < 16 {
+			return nil, fmt.Errorf("line %d: key id is empty or secret shorter than 16 characters", lineNum)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key id: %s", lineNum, id)
+		}
+		keys[id] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// documentMessage builds the signed string of a document pushed to agents.
+func documentMessage(doc []byte) []byte {
+	sum := sha256.Sum256(doc)
+	return []byte("document\n" + hex.EncodeToString(sum[:]))
+}
+
+// SignDocument signs doc with the secret of keyID, for agents to check with
+// VerifyDocument. ok is false for an unknown key.
+func (v *Verifier) SignDocument(keyID string, doc []byte) (sig string, ok bool) {
+	v.mu.Lock()
+	key, ok := v.keys[keyID]
+	v.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	return hex.EncodeToString(mac(key, documentMessage(doc))), true
+}
+
+// VerifyDocument reports whether sig is the signature of doc by key.
+func VerifyDocument(key string, doc []byte, sig string) bool {
+	b, err := hex.DecodeString(sig)
+	return err == nil && hmac.Equal(b, mac([]byte(key), documentMessage(doc)))
+}
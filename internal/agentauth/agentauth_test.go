@@ -0,0 +1,130 @@
+package agentauth
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func signedRequest(t *testing.T, keyID, key string, body []byte, now time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "http://proxy/api/v1/agent/heartbeat", bytes.NewReader(body))
+	if err := Sign(req, keyID, key, body, now); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"hostname":"pc","username":"diretor"}`)
+
+	v := NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": testSecret})
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		want error
+	}{
+		{"valid", func() *http.Request { return signedRequest(t, "pc-01", testSecret, body, now) }, nil},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "http://proxy/api/v1/agent/heartbeat", nil)
+		}, ErrUnsigned},
+		{"unknown key", func() *http.Request { return signedRequest(t, "pc-99", testSecret, body, now) }, ErrUnknownKey},
+		{"wrong secret", func() *http.Request { return signedRequest(t, "pc-01", "ffffffffffffffffffffffff", body, now) }, ErrBadSignature},
+		{"tampered body", func() *http.Request {
+			return signedRequest(t, "pc-01", testSecret, []byte(`{"hostname":"pc","username":"bob"}`), now)
+		}, ErrBadSignature},
+		{"stale", func() *http.Request { return signedRequest(t, "pc-01", testSecret, body, now.Add(-10*time.Minute)) }, ErrStale},
+		{"future", func() *http.Request { return signedRequest(t, "pc-01", testSecret, body, now.Add(10*time.Minute)) }, ErrStale},
+	}
+
+	for _, tt := range tests {
+		if _, err := v.Verify(tt.req(), body, now); err != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerify_RejectsReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{}`)
+
+	v := NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": testSecret})
+
+	req := signedRequest(t, "pc-01", testSecret, body, now)
+	if _, err := v.Verify(req, body, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := v.Verify(req, body, now.Add(time.Second)); err != ErrReplay {
+		t.Fatalf("replay: got %v, want ErrReplay", err)
+	}
+	// Once the nonce's timestamp is outside the skew, the replay fails as stale.
+	if _, err := v.Verify(req, body, now.Add(DefaultMaxSkew+2*time.Minute)); err != ErrStale {
+		t.Fatalf("late replay: got %v, want ErrStale", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(good, []byte("# agents\npc-01;"+testSecret+"\n\ndefault ; "+testSecret+"\n"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	keys, err := LoadKeys(good)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(keys) != 2 || keys["pc-01"] != testSecret || keys["default"] != testSecret {
+		t.Fatalf("keys=%v", keys)
+	}
+
+	for _, content := range []string{"pc-01\n", "pc-01;short\n", "a;" + testSecret + "\na;" + testSecret + "\n"} {
+		bad := filepath.Join(dir, "bad.txt")
+		if err := os.WriteFile(bad, []byte(content), 0600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := LoadKeys(bad); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, s := range []string{"off", "flag", "REQUIRE"} {
+		if _, err := ParseMode(s); err != nil {
+			t.Fatalf("ParseMode(%q): %v", s, err)
+		}
+	}
+	if _, err := ParseMode("strict"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestSignDocument(t *testing.T) {
+	v := NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": testSecret})
+	doc := []byte(`{"revision":"abc","interval_seconds":60}`)
+
+	sig, ok := v.SignDocument("pc-01", doc)
+	if !ok || !VerifyDocument(testSecret, doc, sig) {
+		t.Fatalf("signature %q not accepted", sig)
+	}
+	if VerifyDocument(testSecret, []byte(`{"revision":"abc","interval_seconds":5}`), sig) {
+		t.Fatal("tampered document accepted")
+	}
+	if VerifyDocument("another-secret-0123456789", doc, sig) {
+		t.Fatal("signature accepted with another key")
+	}
+	if _, ok := v.SignDocument("unknown", doc); ok {
+		t.Fatal("unknown key signed")
+	}
+}
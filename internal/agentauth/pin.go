@@ -0,0 +1,52 @@
+package agentauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrPinMismatch is returned by the TLS handshake when the proxy presents a
+// certificate other than the pinned one.
+var ErrPinMismatch = errors.New("server certificate does not match the pinned fingerprint")
+
+// CertFingerprint returns the hex SHA-256 of a DER-encoded certificate.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint accepts fingerprints pasted as "AB:CD:..." or with spaces.
+func NormalizeFingerprint(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.ReplaceAll(s, ":", "")
+	return strings.ReplaceAll(s, " ", "")
+}
+
+// PinnedTLSConfig returns a client TLS config that only accepts the certificate
+// whose fingerprint is pin. With an empty pin any certificate is accepted
+// (trust on first use); seen receives the fingerprint of the accepted one.
+func PinnedTLSConfig(pin string, seen func(fingerprint string)) *tls.Config {
+	pin = NormalizeFingerprint(pin)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The proxy certificate is self-signed; the fingerprint check below
+		// replaces chain and hostname verification.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrPinMismatch
+			}
+			fp := CertFingerprint(cs.PeerCertificates[0].Raw)
+			if pin != "" && fp != pin {
+				return ErrPinMismatch
+			}
+			if seen != nil {
+				seen(fp)
+			}
+			return nil
+		},
+	}
+}
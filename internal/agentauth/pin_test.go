@@ -0,0 +1,52 @@
+package agentauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPinnedTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	want := CertFingerprint(srv.Certificate().Raw)
+
+	get := func(pin string) (string, error) {
+		var seen string
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: PinnedTLSConfig(pin, func(fp string) { seen = fp })}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return seen, err
+		}
+		_ = resp.Body.Close()
+		return seen, nil
+	}
+
+	// Trust on first use: no pin accepts the certificate and reports it.
+	seen, err := get("")
+	if err != nil || seen != want {
+		t.Fatalf("tofu: seen=%q err=%v want %q", seen, err, want)
+	}
+
+	// Matching pin, also when pasted in colon-separated upper case.
+	colons := ""
+	for i := 0; i < len(want); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += want[i : i+2]
+	}
+	if _, err := get(strings.ToUpper(colons)); err != nil {
+		t.Fatalf("pinned: %v", err)
+	}
+
+	// Different pin: the handshake fails.
+	other := CertFingerprint([]byte("another certificate"))
+	if _, err := get(other); !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("mismatch: got %v, want ErrPinMismatch", err)
+	}
+}
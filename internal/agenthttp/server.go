@@ -7,25 +7,104 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/agent"
+	"github.com/guilherme/zid-proxy/internal/agentauth"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
+	"github.com/guilherme/zid-proxy/internal/agentupdate"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+	"github.com/guilherme/zid-proxy/internal/inventory"
 )
 
 type Server struct {
-	registry *agent.Registry
-	onBeat   func(srcIP, machine, username string)
+	registry  *agent.Registry
+	onBeat    func(srcIP, machine, username string, verified bool)
+	authMode  agentauth.Mode
+	verifier  *agentauth.Verifier
+	inventory *inventory.Store
+	onLogout  func(srcIP string)
+	blocks    *blocklog.Log
+
+	updateDir string
+
+	policyMu sync.RWMutex
+	policy   agentpolicy.Policy
+}
+
+func New(registry *agent.Registry, onBeat func(srcIP, machine, username string, verified bool)) *Server {
+	return &Server{registry: registry, onBeat: onBeat, authMode: agentauth.ModeOff}
+}
+
+// SetAuth enables heartbeat signature checks (see agentauth.Mode).
+func (s *Server) SetAuth(mode agentauth.Mode, verifier *agentauth.Verifier) {
+	s.authMode = mode
+	s.verifier = verifier
 }
 
-func New(registry *agent.Registry, onBeat func(srcIP, machine, username string)) *Server {
-	return &Server{registry: registry, onBeat: onBeat}
+// SetInventory records every heartbeat in inv and enforces its enrollment
+// states: only approved agents get their identity applied.
+func (s *Server) SetInventory(inv *inventory.Store) {
+	s.inventory = inv
+}
+
+// SetOnLogout sets the callback run when the last user of an IP logs out.
+func (s *Server) SetOnLogout(fn func(srcIP string)) {
+	s.onLogout = fn
+}
+
+// SetBlocks returns the recent blocks of the agent's IP in heartbeat
+// responses so the agent can notify its user.
+func (s *Server) SetBlocks(blocks *blocklog.Log) {
+	s.blocks = blocks
+}
+
+// SetPolicy publishes the agent configuration (see agentpolicy.Publish); a
+// policy without revision stops pushing configuration. Agents get a copy
+// addressed to their ID and signed with their key until they report its
+// revision.
+func (s *Server) SetPolicy(p agentpolicy.Policy) {
+	s.policyMu.Lock()
+	s.policy = p
+	s.policyMu.Unlock()
+}
+
+// SetUpdateDir serves the signed update manifests in dir ("<channel>.json",
+// written by zid-update-sign) to agents.
+func (s *Server) SetUpdateDir(dir string) {
+	s.updateDir = dir
+}
+
+// authenticate reports whether the request is signed by a known agent key.
+// ok is false when the request must be rejected.
+func (s *Server) authenticate(r *http.Request, body []byte, srcIP string) (keyID string, verified, ok bool) {
+	if s.authMode == agentauth.ModeOff || s.verifier == nil {
+		return "", false, true
+	}
+
+	keyID, err := s.verifier.Verify(r, body, time.Now())
+	switch {
+	case err == nil:
+		return keyID, true, true
+	case s.authMode == agentauth.ModeFlag && (err == agentauth.ErrUnsigned || err == agentauth.ErrUnknownKey):
+		log.Printf("[AGENT] Unverified heartbeat from %s (key_id=%q): %v", srcIP, keyID, err)
+		return "", false, true
+	default:
+		log.Printf("[AGENT] Rejected heartbeat from %s (key_id=%q): %v", srcIP, keyID, err)
+		return "", false, false
+	}
 }
 
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", s.healthz)
 	mux.HandleFunc("/api/v1/agent/heartbeat", s.heartbeat)
+	mux.HandleFunc("/api/v1/agent/logout", s.logout)
+	mux.HandleFunc("/api/v1/agent/update", s.update)
 	return mux
 }
 
@@ -40,8 +119,36 @@ type heartbeatRequest struct {
 	Machine  string `json:"machine"`
 	Username string `json:"username"`
 	User     string `json:"user"`
+	AgentID  string `json:"agent_id"`
+	Version  string `json:"agent_version"`
+	OS       string `json:"os"`
+	// Sessions, when present, lists every user logged in on the host
+	// (terminal servers) and replaces Username.
+	Sessions []sessionRequest `json:"sessions"`
+	// BlocksSince is the block_seq of the previous response (0 = all recent blocks).
+	BlocksSince uint64 `json:"blocks_since"`
+	// ConfigRevision is the revision of the pushed configuration the agent applied.
+	ConfigRevision string `json:"config_revision"`
+}
+
+type heartbeatResponse struct {
+	OK       bool             `json:"ok"`
+	Blocks   []blocklog.Block `json:"blocks,omitempty"`
+	BlockSeq uint64           `json:"block_seq,omitempty"`
+	// Config is the pushed agent configuration, signed with the agent's key.
+	Config    json.RawMessage `json:"config,omitempty"`
+	ConfigSig string          `json:"config_sig,omitempty"`
 }
 
+type sessionRequest struct {
+	Username string `json:"username"`
+	PortLow  int    `json:"port_low"`
+	PortHigh int    `json:"port_high"`
+}
+
+// maxSessions caps the sessions accepted from one heartbeat.
+const maxSessions = 1024
+
 func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
@@ -49,7 +156,8 @@ func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, 8*1024))
+	// Terminal servers report one entry per session, hence the larger limit.
+	body, err := io.ReadAll(io.LimitReader(r.Body, 128*1024))
 	if err != nil {
 		http.Error(w, "read body failed", http.StatusBadRequest)
 		return
@@ -70,6 +178,22 @@ func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
 	if username == "" {
 		username = strings.TrimSpace(req.User)
 	}
+	if len(req.Sessions) > maxSessions {
+		req.Sessions = req.Sessions[:maxSessions]
+	}
+	var sessions []agent.Session
+	if len(req.Sessions) > 0 {
+		users := make([]string, 0, len(req.Sessions))
+		for _, rs := range req.Sessions {
+			u := strings.TrimSpace(rs.Username)
+			if u == "" {
+				continue
+			}
+			sessions = append(sessions, agent.Session{Username: u, PortLow: rs.PortLow, PortHigh: rs.PortHigh})
+			users = append(users, u)
+		}
+		username = strings.Join(users, ",")
+	}
 
 	srcIP, err := remoteIP(r.RemoteAddr)
 	if err != nil {
@@ -77,25 +201,335 @@ func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keyID, verified, ok := s.authenticate(r, body, srcIP)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	now := time.Now()
 
+	if s.inventory != nil {
+		state, status := s.enroll(req, srcIP, machine, username, keyID, verified, now)
+		if status != http.StatusOK {
+			writeState(w, status, state)
+			return
+		}
+	}
+
 	// Log heartbeat reception with detailed info
-	log.Printf("[AGENT] Heartbeat received: ip=%s machine=%q username=%q", srcIP, machine, username)
+	log.Printf("[AGENT] Heartbeat received: ip=%s machine=%q username=%q sessions=%d verified=%v tls=%v", srcIP, machine, username, len(sessions), verified, r.TLS != nil)
 
 	if s.registry != nil {
-		s.registry.Update(srcIP, machine, username, now)
+		agentID := strings.TrimSpace(req.AgentID)
+		if req.Sessions != nil {
+			s.registry.UpdateSessions(srcIP, machine, agentID, sessions, verified, now)
+		} else {
+			s.registry.Update(srcIP, machine, agentID, username, verified, now)
+		}
 		log.Printf("[AGENT] Registry updated for IP: %s", srcIP)
 	}
 	if s.onBeat != nil {
-		s.onBeat(srcIP, machine, username)
+		// Show every user still logged in on the IP, not only the last reporter.
+		display := username
+		if s.registry != nil {
+			if info, ok := s.registry.LookupInfo(srcIP, now); ok && len(info.Sessions) > 1 {
+				display = sessionUsers(info)
+			}
+		}
+		s.onBeat(srcIP, machine, display, verified)
 		log.Printf("[AGENT] Active IPs tracker notified for IP: %s", srcIP)
 	}
 
+	resp := heartbeatResponse{OK: true}
+	if s.blocks != nil {
+		// A host agent reporting every session sees the blocks of all its users.
+		blockUser := username
+		if req.Sessions != nil {
+			blockUser = ""
+		}
+		resp.Blocks, resp.BlockSeq = s.blocks.Since(srcIP, blockUser, req.BlocksSince, now)
+	}
+	s.attachPolicy(&resp, strings.TrimSpace(req.AgentID), req.ConfigRevision, keyID, verified, srcIP)
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(append(b, '\n'))
+}
+
+// attachPolicy adds the pushed configuration to resp when the agent does not
+// have the current revision yet. Only verified agents with an ID can check the
+// document, and agents that were never managed do not need the unmanaged one.
+func (s *Server) attachPolicy(resp *heartbeatResponse, agentID, revision, keyID string, verified bool, srcIP string) {
+	s.policyMu.RLock()
+	p := s.policy
+	s.policyMu.RUnlock()
+	if p.Revision == "" || revision == p.Revision || (p.Unmanaged && revision == "") {
+		return
+	}
+	if !verified || s.verifier == nil || agentID == "" {
+		return
+	}
+	doc, err := p.Document(agentID)
+	if err != nil {
+		return
+	}
+	sig, ok := s.verifier.SignDocument(keyID, doc)
+	if !ok {
+		return
+	}
+	resp.Config = doc
+	resp.ConfigSig = sig
+	log.Printf("[AGENT] Pushing agent config revision %s (serial %d) to %s (had %q)", p.Revision, p.Serial, srcIP, revision)
+}
+
+type logoutRequest struct {
+	AgentID  string `json:"agent_id"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	// Reason is informational: logoff, lock, shutdown or quit.
+	Reason string `json:"reason"`
+}
+
+// logout clears the identity reported by an agent right away instead of
+// waiting for the TTL (session logoff, screen lock, shutdown, agent quit).
+// It is authenticated like the heartbeat, and an agent only logs out the
+// sessions it reported.
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8*1024))
+	if err != nil {
+		http.Error(w, "read body failed", http.StatusBadRequest)
+		return
+	}
+	_ = r.Body.Close()
+
+	var req logoutRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	srcIP, err := remoteIP(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote addr", http.StatusBadRequest)
+		return
+	}
+
+	keyID, verified, ok := s.authenticate(r, body, srcIP)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.inventory != nil {
+		if state, status := s.enrolled(req.AgentID, keyID, verified); status != http.StatusOK {
+			log.Printf("[AGENT] Refused logout from %s: agent_id=%q state=%q", srcIP, req.AgentID, state)
+			writeState(w, status, state)
+			return
+		}
+	}
+
+	username := strings.TrimSpace(req.Username)
+	reason := strings.TrimSpace(req.Reason)
+	if len(reason) > 32 {
+		reason = reason[:32]
+	}
+	log.Printf("[AGENT] Logout received: ip=%s agent_id=%q machine=%q username=%q reason=%q", srcIP, req.AgentID, req.Hostname, username, reason)
+
+	remaining := false
+	if s.registry != nil {
+		remaining = s.registry.Logout(srcIP, strings.TrimSpace(req.AgentID), username, verified)
+	}
+	if remaining {
+		if info, ok := s.registry.LookupInfo(srcIP, time.Now()); ok && s.onBeat != nil {
+			s.onBeat(srcIP, info.Machine, sessionUsers(info), info.Verified)
+		}
+	} else if s.onLogout != nil {
+		s.onLogout(srcIP)
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(`{"ok":true}` + "\n"))
 }
 
+type updateRequest struct {
+	AgentID string `json:"agent_id"`
+	Channel string `json:"channel"`
+	Version string `json:"agent_version"`
+}
+
+// maxManifestSize bounds the update manifest files served to agents.
+const maxManifestSize = 64 * 1024
+
+// update returns the signed update manifest of the agent's channel, or 204
+// when none is published. Agents check the signature themselves.
+func (s *Server) update(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8*1024))
+	if err != nil {
+		http.Error(w, "read body failed", http.StatusBadRequest)
+		return
+	}
+	_ = r.Body.Close()
+
+	var req updateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	channel := strings.TrimSpace(req.Channel)
+	if channel == "" {
+		channel = agentupdate.DefaultChannel
+	}
+	if !agentupdate.ValidChannel(channel) {
+		http.Error(w, "invalid channel", http.StatusBadRequest)
+		return
+	}
+
+	srcIP, err := remoteIP(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote addr", http.StatusBadRequest)
+		return
+	}
+	keyID, verified, ok := s.authenticate(r, body, srcIP)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.inventory != nil {
+		if state, status := s.enrolled(req.AgentID, keyID, verified); status != http.StatusOK {
+			log.Printf("[AGENT] Refused update check from %s: agent_id=%q state=%q", srcIP, req.AgentID, state)
+			writeState(w, status, state)
+			return
+		}
+	}
+
+	if s.updateDir == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.updateDir, channel+".json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[AGENT] Update manifest for channel %s unavailable: %v", channel, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	defer f.Close()
+	manifest, err := io.ReadAll(io.LimitReader(f, maxManifestSize))
+	if err != nil {
+		http.Error(w, "read manifest failed", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[AGENT] Update check: ip=%s agent_id=%q version=%q channel=%s", srcIP, req.AgentID, req.Version, channel)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(manifest)
+}
+
+// sessionUsers joins the users of every session on the IP.
+func sessionUsers(info agent.Info) string {
+	users := make([]string, 0, len(info.Sessions))
+	for _, sess := range info.Sessions {
+		users = append(users, sess.Username)
+	}
+	return strings.Join(users, ",")
+}
+
+// enroll records the heartbeat in the inventory and returns the HTTP status for
+// the agent's enrollment state. Agents without an ID predate the inventory and
+// are only accepted while new agents are approved automatically, and only
+// when their heartbeat is verified.
+func (s *Server) enroll(req heartbeatRequest, srcIP, machine, username, keyID string, verified bool, now time.Time) (inventory.State, int) {
+	id := strings.TrimSpace(req.AgentID)
+	if id == "" {
+		if s.inventory.AutoApprove() && verified {
+			return inventory.StateApproved, http.StatusOK
+		}
+		log.Printf("[AGENT] Rejected heartbeat from %s: no agent_id (enrollment requires a newer agent)", srcIP)
+		return "", http.StatusForbidden
+	}
+
+	rec, err := s.inventory.Seen(inventory.Heartbeat{
+		ID:       id,
+		Hostname: machine,
+		Username: username,
+		Version:  strings.TrimSpace(req.Version),
+		OS:       strings.TrimSpace(req.OS),
+		IP:       srcIP,
+		KeyID:    keyID,
+		Verified: verified,
+	}, now)
+	switch {
+	case errors.Is(err, inventory.ErrKeyMismatch):
+		log.Printf("[AGENT] Rejected heartbeat for agent %s from %s: not signed with the agent's key %q", id, srcIP, rec.KeyID)
+		return "", http.StatusForbidden
+	case errors.Is(err, inventory.ErrFull):
+		log.Printf("[AGENT] Rejected heartbeat from new agent %s (ip=%s): %v", id, srcIP, err)
+		return "", http.StatusServiceUnavailable
+	case err != nil:
+		return "", http.StatusBadRequest
+	}
+
+	switch rec.State {
+	case inventory.StateApproved:
+		return rec.State, http.StatusOK
+	case inventory.StatePending:
+		log.Printf("[AGENT] Heartbeat from pending agent %s (ip=%s machine=%q); identity not applied until approved", id, srcIP, machine)
+		return rec.State, http.StatusAccepted
+	default:
+		log.Printf("[AGENT] Rejected heartbeat from revoked agent %s (ip=%s machine=%q)", id, srcIP, machine)
+		return rec.State, http.StatusForbidden
+	}
+}
+
+// enrolled is enroll for requests that do not record a heartbeat: only
+// approved agents, signed with the agent's key once it is bound, get a 200.
+func (s *Server) enrolled(agentID, keyID string, verified bool) (inventory.State, int) {
+	id := strings.TrimSpace(agentID)
+	if id == "" {
+		if s.inventory.AutoApprove() && verified {
+			return inventory.StateApproved, http.StatusOK
+		}
+		return "", http.StatusForbidden
+	}
+	rec, ok := s.inventory.Get(id)
+	switch {
+	case !ok:
+		return "", http.StatusForbidden
+	case rec.KeyID != "" && (!verified || keyID != rec.KeyID):
+		return "", http.StatusForbidden
+	case rec.State != inventory.StateApproved:
+		return rec.State, http.StatusForbidden
+	}
+	return rec.State, http.StatusOK
+}
+
+type stateResponse struct {
+	OK    bool            `json:"ok"`
+	State inventory.State `json:"state,omitempty"`
+}
+
+func writeState(w http.ResponseWriter, status int, state inventory.State) {
+	b, _ := json.Marshal(stateResponse{OK: status == http.StatusOK, State: state})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
+
 func remoteIP(remoteAddr string) (string, error) {
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -2,19 +2,26 @@ package agenthttp
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/agent"
+	"github.com/guilherme/zid-proxy/internal/agentauth"
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+	"github.com/guilherme/zid-proxy/internal/inventory"
 )
 
 func TestHeartbeat_UsesRemoteAddrIP(t *testing.T) {
 	reg := agent.NewRegistry(10 * time.Second)
 	var called bool
 	var gotIP, gotMachine, gotUser string
-	s := New(reg, func(srcIP, machine, username string) {
+	s := New(reg, func(srcIP, machine, username string, verified bool) {
 		called = true
 		gotIP = srcIP
 		gotMachine = machine
@@ -38,3 +45,355 @@ func TestHeartbeat_UsesRemoteAddrIP(t *testing.T) {
 		t.Fatalf("callback called=%v ip=%q machine=%q user=%q", called, gotIP, gotMachine, gotUser)
 	}
 }
+
+func postHeartbeat(t *testing.T, s *Server, body string, sign func(*http.Request, []byte)) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "http://example/api/v1/agent/heartbeat", bytes.NewBufferString(body))
+	req.RemoteAddr = "192.168.1.55:12345"
+	if sign != nil {
+		sign(req, []byte(body))
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHeartbeat_AuthModes(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	body := `{"hostname":"pc","username":"diretor"}`
+	signWith := func(keyID, key string) func(*http.Request, []byte) {
+		return func(req *http.Request, b []byte) {
+			if err := agentauth.Sign(req, keyID, key, b, time.Now()); err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name         string
+		mode         agentauth.Mode
+		sign         func(*http.Request, []byte)
+		wantStatus   int
+		wantVerified bool
+	}{
+		{"off ignores signatures", agentauth.ModeOff, nil, http.StatusOK, false},
+		{"flag accepts unsigned", agentauth.ModeFlag, nil, http.StatusOK, false},
+		{"flag accepts unknown key", agentauth.ModeFlag, signWith("pc-99", secret), http.StatusOK, false},
+		{"flag verifies known key", agentauth.ModeFlag, signWith("pc-01", secret), http.StatusOK, true},
+		{"flag rejects bad signature", agentauth.ModeFlag, signWith("pc-01", "wrong-secret-wrong-secret"), http.StatusUnauthorized, false},
+		{"require rejects unsigned", agentauth.ModeRequire, nil, http.StatusUnauthorized, false},
+		{"require rejects unknown key", agentauth.ModeRequire, signWith("pc-99", secret), http.StatusUnauthorized, false},
+		{"require verifies known key", agentauth.ModeRequire, signWith("pc-01", secret), http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		reg := agent.NewRegistry(10 * time.Second)
+		var gotVerified bool
+		s := New(reg, func(_, _, _ string, verified bool) { gotVerified = verified })
+		v := agentauth.NewVerifier(0)
+		v.SetKeys(map[string]string{"pc-01": secret})
+		s.SetAuth(tt.mode, v)
+
+		rr := postHeartbeat(t, s, body, tt.sign)
+		if rr.Code != tt.wantStatus {
+			t.Fatalf("%s: status=%d want %d", tt.name, rr.Code, tt.wantStatus)
+		}
+		info, ok := reg.LookupInfo("192.168.1.55", time.Now())
+		if tt.wantStatus != http.StatusOK {
+			if ok {
+				t.Fatalf("%s: rejected heartbeat must not update the registry", tt.name)
+			}
+			continue
+		}
+		if !ok || info.Username != "diretor" || info.Verified != tt.wantVerified || gotVerified != tt.wantVerified {
+			t.Fatalf("%s: info=%+v ok=%v callback verified=%v", tt.name, info, ok, gotVerified)
+		}
+	}
+}
+
+func TestHeartbeat_Enrollment(t *testing.T) {
+	reg := agent.NewRegistry(10 * time.Second)
+	s := New(reg, nil)
+	inv, _ := inventory.Open(inventory.Options{})
+	s.SetInventory(inv)
+
+	body := `{"agent_id":"a1b2c3","hostname":"pc","username":"diretor","agent_version":"1.4.0","os":"windows/amd64"}`
+	if rr := postHeartbeat(t, s, body, nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("pending: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if _, ok := reg.LookupInfo("192.168.1.55", time.Now()); ok {
+		t.Fatal("pending agent identity must not be applied")
+	}
+	rec, ok := inv.Get("a1b2c3")
+	if !ok || rec.Version != "1.4.0" || rec.OS != "windows/amd64" || rec.LastIP != "192.168.1.55" {
+		t.Fatalf("inventory record: %+v ok=%v", rec, ok)
+	}
+
+	_ = inv.SetState("a1b2c3", inventory.StateApproved)
+	if rr := postHeartbeat(t, s, body, nil); rr.Code != http.StatusOK {
+		t.Fatalf("approved: status=%d", rr.Code)
+	}
+	if info, ok := reg.LookupInfo("192.168.1.55", time.Now()); !ok || info.Username != "diretor" {
+		t.Fatalf("approved agent identity: %+v ok=%v", info, ok)
+	}
+
+	_ = inv.SetState("a1b2c3", inventory.StateRevoked)
+	if rr := postHeartbeat(t, s, body, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("revoked: status=%d", rr.Code)
+	}
+
+	// Agents without an ID are refused unless new agents are approved
+	// automatically and the heartbeat is signed.
+	legacy := `{"hostname":"old","username":"u"}`
+	if rr := postHeartbeat(t, s, legacy, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("legacy manual: status=%d", rr.Code)
+	}
+	auto, _ := inventory.Open(inventory.Options{AutoApprove: true})
+	s.SetInventory(auto)
+	if rr := postHeartbeat(t, s, legacy, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("legacy auto unsigned: status=%d", rr.Code)
+	}
+	const secret = "0123456789abcdef0123456789abcdef"
+	v := agentauth.NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": secret})
+	s.SetAuth(agentauth.ModeFlag, v)
+	sign := func(req *http.Request, b []byte) {
+		if err := agentauth.Sign(req, "pc-01", secret, b, time.Now()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	}
+	if rr := postHeartbeat(t, s, legacy, sign); rr.Code != http.StatusOK {
+		t.Fatalf("legacy auto signed: status=%d", rr.Code)
+	}
+
+	// Once signed, an agent ID only accepts heartbeats signed with its key.
+	if rr := postHeartbeat(t, s, body, sign); rr.Code != http.StatusOK {
+		t.Fatalf("signed auto: status=%d", rr.Code)
+	}
+	if rr := postHeartbeat(t, s, body, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("unsigned heartbeat for a bound agent: status=%d", rr.Code)
+	}
+}
+
+func TestHeartbeat_SessionsList(t *testing.T) {
+	reg := agent.NewRegistry(10 * time.Second)
+	var gotUser string
+	s := New(reg, func(_, _, username string, _ bool) { gotUser = username })
+
+	body := `{"hostname":"ts-01","sessions":[{"username":"alice","port_low":20000,"port_high":20999},{"username":"bob","port_low":21000,"port_high":21999}]}`
+	if rr := postHeartbeat(t, s, body, nil); rr.Code != http.StatusOK {
+		t.Fatalf("status=%d", rr.Code)
+	}
+	if gotUser != "alice,bob" {
+		t.Fatalf("callback username=%q", gotUser)
+	}
+	info, ok := reg.LookupConn("192.168.1.55", 21001, time.Now())
+	if !ok || info.Username != "bob" || info.Machine != "ts-01" {
+		t.Fatalf("lookup: ok=%v info=%+v", ok, info)
+	}
+}
+
+func TestHeartbeat_ReturnsRecentBlocks(t *testing.T) {
+	blocks := blocklog.New(0)
+	now := time.Now()
+	blocks.Record("192.168.1.55", blocklog.Block{Time: now, Hostname: "www.tiktok.com", Group: "alunos", Username: "joao", Reason: blocklog.ReasonRule})
+	blocks.Record("192.168.1.55", blocklog.Block{Time: now, Hostname: "game.example", Username: "maria", Reason: blocklog.ReasonRule})
+	blocks.Record("192.168.1.99", blocklog.Block{Time: now, Hostname: "other.example", Reason: blocklog.ReasonRule})
+
+	s := New(agent.NewRegistry(time.Minute), nil)
+	s.SetBlocks(blocks)
+
+	var resp heartbeatResponse
+	rr := postHeartbeat(t, s, `{"hostname":"pc","username":"joao"}`, nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s err=%v", rr.Code, rr.Body, err)
+	}
+	if !resp.OK || len(resp.Blocks) != 1 || resp.Blocks[0].Hostname != "www.tiktok.com" || resp.BlockSeq != 3 {
+		t.Fatalf("resp=%+v", resp)
+	}
+
+	// Blocks already delivered are not repeated.
+	rr = postHeartbeat(t, s, `{"hostname":"pc","username":"joao","blocks_since":3}`, nil)
+	resp = heartbeatResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.Blocks) != 0 || resp.BlockSeq != 3 {
+		t.Fatalf("second resp=%+v err=%v", resp, err)
+	}
+}
+
+func TestHeartbeat_PushesSignedConfig(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	v := agentauth.NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": secret})
+	s := New(agent.NewRegistry(time.Minute), nil)
+	s.SetAuth(agentauth.ModeFlag, v)
+	p := agentpolicy.Policy{Revision: "r1", Serial: 7, IntervalSeconds: 60}
+	s.SetPolicy(p)
+
+	sign := func(req *http.Request, b []byte) {
+		if err := agentauth.Sign(req, "pc-01", secret, b, time.Now()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	}
+	decode := func(rr *httptest.ResponseRecorder) heartbeatResponse {
+		t.Helper()
+		var resp heartbeatResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("body=%s: %v", rr.Body, err)
+		}
+		return resp
+	}
+
+	resp := decode(postHeartbeat(t, s, `{"agent_id":"a1","hostname":"pc","username":"joao"}`, sign))
+	if !agentauth.VerifyDocument(secret, resp.Config, resp.ConfigSig) {
+		t.Fatalf("config=%s sig=%q", resp.Config, resp.ConfigSig)
+	}
+	if got, err := agentpolicy.Parse(resp.Config); err != nil || got.AgentID != "a1" || got.Serial != 7 || got.IntervalSeconds != 60 {
+		t.Fatalf("pushed %+v err=%v", got, err)
+	}
+
+	// Up-to-date, unsigned and anonymous agents get no config.
+	for _, body := range []string{
+		`{"agent_id":"a1","hostname":"pc","username":"joao","config_revision":"r1"}`,
+		`{"hostname":"pc","username":"joao"}`,
+	} {
+		if resp := decode(postHeartbeat(t, s, body, sign)); resp.Config != nil {
+			t.Fatalf("%s got config %s", body, resp.Config)
+		}
+	}
+	if resp := decode(postHeartbeat(t, s, `{"agent_id":"a1","hostname":"pc","username":"joao"}`, nil)); resp.Config != nil {
+		t.Fatalf("unsigned agent got config %s", resp.Config)
+	}
+
+	// After the policy is removed, only managed agents are released.
+	release := agentpolicy.Unmanaged()
+	release.Serial = 8
+	s.SetPolicy(release)
+	if resp := decode(postHeartbeat(t, s, `{"agent_id":"a1","hostname":"pc","username":"joao"}`, sign)); resp.Config != nil {
+		t.Fatalf("unmanaged agent got config %s", resp.Config)
+	}
+	resp = decode(postHeartbeat(t, s, `{"agent_id":"a1","hostname":"pc","username":"joao","config_revision":"r1"}`, sign))
+	if got, err := agentpolicy.Parse(resp.Config); err != nil || !got.Unmanaged || got.Serial != 8 {
+		t.Fatalf("release %+v err=%v", got, err)
+	}
+}
+
+func TestUpdate_ServesChannelManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `{"manifest":{"version":"1.2.3"},"signature":"c2ln"}`
+	if err := os.WriteFile(filepath.Join(dir, "beta.json"), []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := New(agent.NewRegistry(time.Minute), nil)
+	s.SetUpdateDir(dir)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://example/api/v1/agent/update", bytes.NewBufferString(body))
+		req.RemoteAddr = "192.168.1.55:12345"
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post(`{"channel":"beta","agent_version":"1.2.0"}`); rr.Code != http.StatusOK || rr.Body.String() != manifest {
+		t.Fatalf("beta: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if rr := post(`{"agent_version":"1.2.0"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("stable (unpublished): status=%d", rr.Code)
+	}
+	if rr := post(`{"channel":"../beta"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("path traversal: status=%d", rr.Code)
+	}
+
+	// With an inventory, only approved agents get manifests.
+	inv, _ := inventory.Open(inventory.Options{})
+	inv.Seen(inventory.Heartbeat{ID: "a1"}, time.Now())
+	s.SetInventory(inv)
+	for _, state := range []inventory.State{inventory.StatePending, inventory.StateRevoked} {
+		_ = inv.SetState("a1", state)
+		if rr := post(`{"agent_id":"a1","channel":"beta"}`); rr.Code != http.StatusForbidden {
+			t.Fatalf("%s agent: status=%d", state, rr.Code)
+		}
+	}
+	if rr := post(`{"agent_id":"zz","channel":"beta"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("unknown agent: status=%d", rr.Code)
+	}
+	_ = inv.SetState("a1", inventory.StateApproved)
+	if rr := post(`{"agent_id":"a1","channel":"beta"}`); rr.Code != http.StatusOK {
+		t.Fatalf("approved agent: status=%d", rr.Code)
+	}
+}
+
+func postLogout(t *testing.T, s *Server, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "http://example/api/v1/agent/logout", bytes.NewBufferString(body))
+	req.RemoteAddr = "192.168.1.55:12345"
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestLogout_ClearsIdentity(t *testing.T) {
+	reg := agent.NewRegistry(time.Minute)
+	var shown string
+	var loggedOut bool
+	s := New(reg, func(_, _, username string, _ bool) { shown = username })
+	s.SetOnLogout(func(srcIP string) { loggedOut = srcIP == "192.168.1.55" })
+
+	postHeartbeat(t, s, `{"hostname":"rds","username":"alice","agent_id":"a1"}`, nil)
+	postHeartbeat(t, s, `{"hostname":"rds","username":"bob","agent_id":"a2"}`, nil)
+
+	// Another agent cannot log out bob.
+	if code := postLogout(t, s, `{"hostname":"rds","username":"bob","agent_id":"a1"}`); code != http.StatusOK {
+		t.Fatalf("logout bob by a1: status=%d", code)
+	}
+	// One of two users logs off: the other one stays.
+	if code := postLogout(t, s, `{"hostname":"rds","username":"alice","agent_id":"a1","reason":"logoff"}`); code != http.StatusOK {
+		t.Fatalf("logout alice: status=%d", code)
+	}
+	if info, ok := reg.LookupInfo("192.168.1.55", time.Now()); !ok || info.Username != "bob" || shown != "bob" || loggedOut {
+		t.Fatalf("after alice: info=%+v shown=%q loggedOut=%v", info, shown, loggedOut)
+	}
+
+	if code := postLogout(t, s, `{"hostname":"rds","username":"bob","agent_id":"a2","reason":"shutdown"}`); code != http.StatusOK {
+		t.Fatalf("logout bob: status=%d", code)
+	}
+	if _, ok := reg.LookupInfo("192.168.1.55", time.Now()); ok || !loggedOut {
+		t.Fatalf("identity still present after last logout (loggedOut=%v)", loggedOut)
+	}
+}
+
+func TestLogout_RefusesAgentsNotApproved(t *testing.T) {
+	reg := agent.NewRegistry(time.Minute)
+	s := New(reg, nil)
+	inv, _ := inventory.Open(inventory.Options{})
+	s.SetInventory(inv)
+	reg.Update("192.168.1.55", "pc", "a1", "alice", false, time.Now())
+	inv.Seen(inventory.Heartbeat{ID: "a1"}, time.Now())
+	_ = inv.SetState("a1", inventory.StateRevoked)
+
+	if code := postLogout(t, s, `{"username":"alice","agent_id":"a1"}`); code != http.StatusForbidden {
+		t.Fatalf("revoked agent: status=%d, want 403", code)
+	}
+	if code := postLogout(t, s, `{"username":"alice"}`); code != http.StatusForbidden {
+		t.Fatalf("agent without id: status=%d, want 403", code)
+	}
+	if _, ok := reg.LookupInfo("192.168.1.55", time.Now()); !ok {
+		t.Fatal("refused logout cleared the identity")
+	}
+}
+
+func TestLogout_RequiresSignatureInRequireMode(t *testing.T) {
+	reg := agent.NewRegistry(time.Minute)
+	s := New(reg, nil)
+	reg.Update("192.168.1.55", "pc", "", "alice", true, time.Now())
+	v := agentauth.NewVerifier(0)
+	v.SetKeys(map[string]string{"pc-01": "0123456789abcdef0123456789abcdef"})
+	s.SetAuth(agentauth.ModeRequire, v)
+
+	if code := postLogout(t, s, `{"username":"alice"}`); code != http.StatusUnauthorized {
+		t.Fatalf("status=%d, want 401", code)
+	}
+	if _, ok := reg.LookupInfo("192.168.1.55", time.Now()); !ok {
+		t.Fatal("unsigned logout must not clear the identity")
+	}
+}
@@ -0,0 +1,191 @@
+package agenthttp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSMode selects how the agent API listener treats TLS.
+type TLSMode string
+
+const (
+	TLSOff     TLSMode = "off"     // plain HTTP only
+	TLSOn      TLSMode = "on"      // HTTPS and plain HTTP on the same port
+	TLSRequire TLSMode = "require" // HTTPS only
+)
+
+// ParseTLSMode parses an -agent-tls value.
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch m := TLSMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case TLSOff, TLSOn, TLSRequire:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid agent TLS mode %q (expected off, on or require)", s)
+}
+
+// LoadOrCreateCert loads the agent API certificate, generating a self-signed
+// one when neither file exists. Agents pin its fingerprint, so it is kept on
+// disk and reused across restarts.
+func LoadOrCreateCert(certFile, keyFile string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateCert(certFile, keyFile, time.Now()); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func generateCert(certFile, keyFile string, now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "zid-proxy agent API"},
+		DNSNames:              []string{"zid-proxy.lan", "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// NewListener wraps ln so that connections are served over TLS. In TLSOn mode
+// the first byte of each connection decides between TLS and plain HTTP, so old
+// agents keep working on the same port; TLSRequire closes plain connections.
+func NewListener(ln net.Listener, config *tls.Config, mode TLSMode) net.Listener {
+	switch mode {
+	case TLSOff:
+		return ln
+	case TLSRequire:
+		return tls.NewListener(ln, config)
+	}
+	l := &sniffListener{
+		Listener: ln,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// sniffTimeout bounds how long a client may stay silent before its first byte.
+const sniffTimeout = 5 * time.Second
+
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *sniffListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		go l.sniff(c)
+	}
+}
+
+func (l *sniffListener) sniff(c net.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	var out net.Conn = &peekedConn{Conn: c, r: br}
+	if first[0] == 0x16 { // TLS handshake record
+		out = tls.Server(out, l.config)
+	}
+	select {
+	case l.conns <- out:
+	case <-l.done:
+		_ = c.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniffListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekedConn replays the bytes buffered while sniffing.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,96 @@
+package agenthttp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/agentauth"
+)
+
+func TestLoadOrCreateCert_ReusesGeneratedCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "etc", "agent_tls.crt")
+	keyFile := filepath.Join(dir, "etc", "agent_tls.key")
+
+	first, err := LoadOrCreateCert(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if st, err := os.Stat(keyFile); err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("key file: %v %v", st, err)
+	}
+	second, err := LoadOrCreateCert(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatal("certificate changed across loads; pinned agents would break")
+	}
+
+	// Only one of the two files present is a configuration error, not a reason to regenerate.
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := LoadOrCreateCert(certFile, keyFile); err == nil {
+		t.Fatal("expected error when the key file is missing")
+	}
+}
+
+func serveAgentAPI(t *testing.T, mode TLSMode) (addr, fingerprint string) {
+	t.Helper()
+	dir := t.TempDir()
+	cert, err := LoadOrCreateCert(filepath.Join(dir, "c.crt"), filepath.Join(dir, "c.key"))
+	if err != nil {
+		t.Fatalf("cert: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: New(nil, nil).Handler()}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	go func() { _ = srv.Serve(NewListener(ln, cfg, mode)) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ln.Addr().String(), agentauth.CertFingerprint(cert.Certificate[0])
+}
+
+func postHeartbeatTo(url string, tlsConfig *tls.Config) (int, error) {
+	client := &http.Client{
+		Timeout:   2 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBufferString(`{"hostname":"pc","username":"u"}`))
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestNewListener_ServesTLSAndPlainOnSamePort(t *testing.T) {
+	addr, fp := serveAgentAPI(t, TLSOn)
+
+	if code, err := postHeartbeatTo("https://"+addr+"/api/v1/agent/heartbeat", agentauth.PinnedTLSConfig(fp, nil)); err != nil || code != http.StatusOK {
+		t.Fatalf("https: code=%d err=%v", code, err)
+	}
+	if code, err := postHeartbeatTo("http://"+addr+"/api/v1/agent/heartbeat", nil); err != nil || code != http.StatusOK {
+		t.Fatalf("http: code=%d err=%v", code, err)
+	}
+}
+
+func TestNewListener_RequireRefusesPlainHTTP(t *testing.T) {
+	addr, fp := serveAgentAPI(t, TLSRequire)
+
+	if code, err := postHeartbeatTo("https://"+addr+"/api/v1/agent/heartbeat", agentauth.PinnedTLSConfig(fp, nil)); err != nil || code != http.StatusOK {
+		t.Fatalf("https: code=%d err=%v", code, err)
+	}
+	if code, err := postHeartbeatTo("http://"+addr+"/api/v1/agent/heartbeat", nil); err == nil && code == http.StatusOK {
+		t.Fatal("plain HTTP heartbeat must not be accepted in require mode")
+	}
+}
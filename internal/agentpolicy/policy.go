@@ -0,0 +1,248 @@
+// Package agentpolicy defines the agent configuration published by the
+// firewall and pushed to zid-agent in heartbeat responses.
+//
+// The document is signed per agent with the agent's HMAC key (see
+// agentauth.SignDocument) and names the agent it is addressed to, so only
+// that agent accepts it. Every published document carries a serial that never
+// goes back; agents ignore documents not newer than the one they applied.
+package agentpolicy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnmanagedRevision is the revision of the document that releases agents
+// after the policy file is removed (see Unmanaged).
+const UnmanagedRevision = "unmanaged"
+
+// Settings an admin can lock. A locked setting always takes the pushed value
+// and cannot be changed in the agent's Settings window.
+const (
+	SettingInterval     = "interval_seconds"
+	SettingRequireTLS   = "require_tls"
+	SettingLogoutOnLock = "logout_on_lock"
+	SettingMuteBlocks   = "mute_block_notifications"
+)
+
+// MaxTargets caps the extra heartbeat targets of a policy.
+const MaxTargets = 16
+
+var lockable = map[string]bool{
+	SettingInterval:     true,
+	SettingRequireTLS:   true,
+	SettingLogoutOnLock: true,
+	SettingMuteBlocks:   true,
+}
+
+// Policy is the agent configuration document. Unset fields leave the agent's
+// local value alone.
+type Policy struct {
+	// Revision identifies the document; set by Load from the file content.
+	Revision string `json:"revision"`
+	// Serial increases with every published document; set by Publish.
+	Serial uint64 `json:"serial"`
+	// AgentID is the agent a pushed copy is addressed to (see Document).
+	AgentID string `json:"agent_id,omitempty"`
+	// Unmanaged releases the agent: nothing is locked or pushed any more.
+	Unmanaged       bool `json:"unmanaged,omitempty"`
+	IntervalSeconds int  `json:"interval_seconds,omitempty"`
+	// Targets are extra "host" or "host:port" proxies tried after the
+	// gateway and the DNS fallback.
+	Targets         []string `json:"targets,omitempty"`
+	UpdateChannel   string   `json:"update_channel,omitempty"`
+	MinAgentVersion string   `json:"min_agent_version,omitempty"`
+	RequireTLS      *bool    `json:"require_tls,omitempty"`
+	LogoutOnLock    *bool    `json:"logout_on_lock,omitempty"`
+	MuteBlocks      *bool    `json:"mute_block_notifications,omitempty"`
+	// Locked lists the settings users cannot override locally.
+	Locked []string `json:"locked,omitempty"`
+}
+
+// Validate checks the values of a policy.
+func (p Policy) Validate() error {
+	if p.IntervalSeconds != 0 && (p.IntervalSeconds < 5 || p.IntervalSeconds > 3600) {
+		return fmt.Errorf("invalid interval_seconds: %d (expected 5..3600)", p.IntervalSeconds)
+	}
+	if len(p.Targets) > MaxTargets {
+		return fmt.Errorf("too many targets: %d (max %d)", len(p.Targets), MaxTargets)
+	}
+	for _, t := range p.Targets {
+		if !validTarget(t) {
+			return fmt.Errorf("invalid target %q (expected host or host:port)", t)
+		}
+	}
+	if p.MinAgentVersion != "" {
+		if _, ok := parseVersion(p.MinAgentVersion); !ok {
+			return fmt.Errorf("invalid min_agent_version %q", p.MinAgentVersion)
+		}
+	}
+	for _, s := range p.Locked {
+		if !lockable[s] {
+			return fmt.Errorf("setting %q cannot be locked", s)
+		}
+	}
+	return nil
+}
+
+func validTarget(t string) bool {
+	if t == "" || strings.ContainsAny(t, " /") {
+		return false
+	}
+	host, port, err := net.SplitHostPort(t)
+	if err != nil {
+		return !strings.Contains(t, ":") || net.ParseIP(t) != nil
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && host != "" && n >= 1 && n <= 65535
+}
+
+// IsLocked reports whether setting is locked by the policy.
+func (p Policy) IsLocked(setting string) bool {
+	for _, s := range p.Locked {
+		if s == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the policy file at path and returns it with its revision set.
+func Load(path string) (Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return Policy{}, err
+	}
+	if err := p.Validate(); err != nil {
+		return Policy{}, err
+	}
+	p.Revision, p.Serial, p.AgentID, p.Unmanaged = "", 0, "", false
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return Policy{}, err
+	}
+	sum := sha256.Sum256(doc)
+	p.Revision = hex.EncodeToString(sum[:8])
+	return p, nil
+}
+
+// Unmanaged returns the document published when there is no policy file, so
+// agents managed before are unlocked.
+func Unmanaged() Policy {
+	return Policy{Revision: UnmanagedRevision, Unmanaged: true}
+}
+
+type publishState struct {
+	Serial   uint64 `json:"serial"`
+	Revision string `json:"revision"`
+}
+
+// Publish sets the serial of p from the state file at statePath. The serial
+// is kept while the revision is unchanged; a new revision gets the next
+// serial, but never less than the current Unix time, so serials keep growing
+// even if the state file is lost. The state is saved before p is returned;
+// on a save error p is still returned with its serial.
+func Publish(p Policy, statePath string) (Policy, error) {
+	var st publishState
+	if b, err := os.ReadFile(statePath); err == nil {
+		// A corrupt state is replaced; the time floor keeps serials growing.
+		_ = json.Unmarshal(b, &st)
+	}
+	if st.Revision == p.Revision && st.Serial != 0 {
+		p.Serial = st.Serial
+		return p, nil
+	}
+	p.Serial = max(st.Serial+1, uint64(time.Now().Unix()))
+	b, err := json.Marshal(publishState{Serial: p.Serial, Revision: p.Revision})
+	if err != nil {
+		return p, err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return p, err
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return p, err
+	}
+	return p, os.Rename(tmp, statePath)
+}
+
+// Document returns the JSON document of p addressed to agentID.
+func (p Policy) Document(agentID string) ([]byte, error) {
+	p.AgentID = agentID
+	return json.Marshal(p)
+}
+
+// Parse decodes and validates a pushed document.
+func Parse(doc []byte) (Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(doc, &p); err != nil {
+		return Policy{}, err
+	}
+	if p.Revision == "" {
+		return Policy{}, fmt.Errorf("policy has no revision")
+	}
+	if p.Serial == 0 {
+		return Policy{}, fmt.Errorf("policy has no serial")
+	}
+	if p.AgentID == "" {
+		return Policy{}, fmt.Errorf("policy is not addressed to an agent")
+	}
+	return p, p.Validate()
+}
+
+// VersionLess reports whether version a is older than b. Versions are dotted
+// numbers with an optional "v" prefix; unparsable versions (e.g. "dev") are
+// never older.
+func VersionLess(a, b string) bool {
+	va, ok := parseVersion(a)
+	if !ok {
+		return false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if v == "" {
+		return nil, false
+	}
+	parts := strings.Split(v, ".")
+	out := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
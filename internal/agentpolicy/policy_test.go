@@ -0,0 +1,111 @@
+package agentpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_config.json")
+	content := `{"interval_seconds":60,"targets":["10.0.0.1","proxy.lan:18443"],"update_channel":"beta","min_agent_version":"1.3.0","require_tls":true,"locked":["interval_seconds","require_tls"]}`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if p.Revision == "" || p.IntervalSeconds != 60 || len(p.Targets) != 2 || !*p.RequireTLS || !p.IsLocked(SettingInterval) || p.IsLocked(SettingMuteBlocks) {
+		t.Fatalf("policy=%+v", p)
+	}
+
+	p.Serial = 1
+	doc, err := p.Document("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(doc)
+	if err != nil || got.Revision != p.Revision || got.AgentID != "a1" || got.UpdateChannel != "beta" {
+		t.Fatalf("parse: %+v %v", got, err)
+	}
+
+	// The revision follows the content.
+	if err := os.WriteFile(path, []byte(`{"interval_seconds":90}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if p2, _ := Load(path); p2.Revision == p.Revision {
+		t.Fatal("revision did not change")
+	}
+}
+
+func TestPublish_SerialNeverGoesBack(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "agent_config.json.serial")
+	if err := os.WriteFile(state, []byte(`{"serial":9999999999,"revision":"r1"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Publish(Policy{Revision: "r1"}, state)
+	if err != nil || p.Serial != 9999999999 {
+		t.Fatalf("same revision: serial=%d err=%v", p.Serial, err)
+	}
+	p, err = Publish(Unmanaged(), state)
+	if err != nil || p.Serial != 10000000000 || !p.Unmanaged {
+		t.Fatalf("unmanaged: %+v err=%v", p, err)
+	}
+	// The old revision is published again with a newer serial.
+	p, _ = Publish(Policy{Revision: "r1"}, state)
+	if p.Serial != 10000000001 {
+		t.Fatalf("republished: serial=%d", p.Serial)
+	}
+
+	// A lost state file falls back to the current time.
+	os.Remove(state)
+	if p, _ := Publish(Policy{Revision: "r2"}, state); p.Serial < uint64(time.Now().Unix())-60 {
+		t.Fatalf("lost state: serial=%d", p.Serial)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	bad := []Policy{
+		{IntervalSeconds: 2},
+		{Targets: []string{"http://proxy"}},
+		{Targets: []string{"proxy:99999"}},
+		{MinAgentVersion: "latest"},
+		{Locked: []string{"key"}},
+	}
+	for _, p := range bad {
+		if err := p.Validate(); err == nil {
+			t.Errorf("expected error for %+v", p)
+		}
+	}
+	for _, doc := range []string{
+		`{"serial":1,"agent_id":"a1","interval_seconds":60}`,
+		`{"revision":"r1","agent_id":"a1"}`,
+		`{"revision":"r1","serial":1}`,
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.2.9", "1.2.10", true},
+		{"v1.3", "1.3.0", false},
+		{"1.3.1", "1.3.0", false},
+		{"dev", "1.0.0", false},
+		{"1.0.0", "dev", false},
+	}
+	for _, tt := range tests {
+		if got := VersionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("VersionLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package agentui
+
+import (
+	"fmt"
+
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+)
+
+// BlockMessage describes a block reported by the proxy for the desktop
+// notification shown to the user.
+func BlockMessage(b blocklog.Block) string {
+	switch {
+	case b.Reason == blocklog.ReasonQuota && b.Group != "":
+		return fmt.Sprintf("%s bloqueado: cota de dados do grupo %s esgotada", b.Hostname, b.Group)
+	case b.Reason == blocklog.ReasonQuota:
+		return fmt.Sprintf("%s bloqueado: cota de dados esgotada", b.Hostname)
+	case b.Reason == blocklog.ReasonApp && b.App != "" && b.Group != "":
+		return fmt.Sprintf("%s bloqueado: aplicativo %s não permitido no grupo %s", b.Hostname, b.App, b.Group)
+	case b.Group != "":
+		return fmt.Sprintf("%s bloqueado pela política do grupo %s", b.Hostname, b.Group)
+	default:
+		return fmt.Sprintf("%s bloqueado pela política de acesso", b.Hostname)
+	}
+}
+
+// BlockLogLine describes a block for the logs window.
+func BlockLogLine(b blocklog.Block) string {
+	line := fmt.Sprintf("Blocked: %s (reason=%s", b.Hostname, b.Reason)
+	if b.Group != "" {
+		line += ", group=" + b.Group
+	}
+	if b.App != "" {
+		line += ", app=" + b.App
+	}
+	if b.Username != "" {
+		line += ", user=" + b.Username
+	}
+	if b.Count > 1 {
+		line += fmt.Sprintf(", %d attempts", b.Count)
+	}
+	return line + ", at " + b.Time.Local().Format("15:04:05") + ")"
+}
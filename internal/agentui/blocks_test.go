@@ -0,0 +1,35 @@
+package agentui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+)
+
+func TestBlockMessage(t *testing.T) {
+	tests := []struct {
+		block blocklog.Block
+		want  string
+	}{
+		{blocklog.Block{Hostname: "www.tiktok.com", Group: "alunos", Reason: blocklog.ReasonRule}, "www.tiktok.com bloqueado pela política do grupo alunos"},
+		{blocklog.Block{Hostname: "www.tiktok.com", Reason: blocklog.ReasonRule}, "www.tiktok.com bloqueado pela política de acesso"},
+		{blocklog.Block{Hostname: "youtube.com", Group: "alunos", Reason: blocklog.ReasonQuota}, "youtube.com bloqueado: cota de dados do grupo alunos esgotada"},
+		{blocklog.Block{Hostname: "youtube.com", Reason: blocklog.ReasonQuota}, "youtube.com bloqueado: cota de dados esgotada"},
+		{blocklog.Block{Hostname: "www.netflix.com", Group: "alunos", App: "netflix", Reason: blocklog.ReasonApp}, "www.netflix.com bloqueado: aplicativo netflix não permitido no grupo alunos"},
+	}
+	for _, tt := range tests {
+		if got := BlockMessage(tt.block); got != tt.want {
+			t.Errorf("BlockMessage(%+v) = %q, want %q", tt.block, got, tt.want)
+		}
+	}
+}
+
+func TestBlockLogLine(t *testing.T) {
+	line := BlockLogLine(blocklog.Block{Hostname: "www.tiktok.com", Group: "alunos", Username: "joao", Reason: blocklog.ReasonRule, Count: 3})
+	for _, want := range []string{"Blocked: www.tiktok.com", "reason=rule", "group=alunos", "user=joao", "3 attempts"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("line %q lacks %q", line, want)
+		}
+	}
+}
@@ -1,15 +1,44 @@
 package agentui
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
 )
 
 type Config struct {
+	// AgentID identifies this installation in the proxy's agent inventory.
+	// It is generated on first run and kept when Settings are saved.
+	AgentID         string `json:"agent_id,omitempty"`
 	Port            int    `json:"port"`
 	DNSFallback     string `json:"dns_fallback"`
 	IntervalSeconds int    `json:"interval_seconds"`
+	// KeyID and Key sign heartbeats (HMAC); both empty sends unsigned heartbeats.
+	KeyID string `json:"key_id,omitempty"`
+	Key   string `json:"key,omitempty"`
+	// RequireTLS refuses plain HTTP even before a certificate is pinned.
+	RequireTLS bool `json:"require_tls,omitempty"`
+	// PinnedCert is the SHA-256 of the proxy certificate, recorded on the
+	// first HTTPS heartbeat (trust on first use). Once set, plain HTTP is refused.
+	PinnedCert string `json:"pinned_cert_sha256,omitempty"`
+	// LogoutOnLock drops the identity at the proxy while the screen is locked.
+	LogoutOnLock bool `json:"logout_on_lock,omitempty"`
+	// MuteBlocks turns off desktop notifications for blocked sites (they are
+	// still listed in the logs window).
+	MuteBlocks bool `json:"mute_block_notifications,omitempty"`
+	// ReportSessions sends every logged-in user instead of the agent's own
+	// user (terminal servers running a single agent).
+	ReportSessions bool `json:"report_sessions,omitempty"`
+	// SessionPorts maps a username to the source-port range ("LOW-HIGH")
+	// the host assigns to that user's connections.
+	SessionPorts map[string]string `json:"session_ports,omitempty"`
+	// Managed is the last configuration pushed by the firewall (see agentpolicy).
+	Managed *agentpolicy.Policy `json:"managed,omitempty"`
 }
 
 func DefaultConfig() Config {
@@ -20,6 +49,15 @@ func DefaultConfig() Config {
 	}
 }
 
+// NewAgentID returns a random agent ID (32 hex characters).
+func NewAgentID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
 func (c Config) Validate() error {
 	if c.Port < 1 || c.Port > 65535 {
 		return fmt.Errorf("invalid port: %d", c.Port)
@@ -30,5 +68,62 @@ func (c Config) Validate() error {
 	if c.IntervalSeconds < 5 || c.IntervalSeconds > 3600 {
 		return fmt.Errorf("invalid interval_seconds: %d (expected 5..3600)", c.IntervalSeconds)
 	}
+	if (strings.TrimSpace(c.KeyID) == "") != (c.Key == "") {
+		return errors.New("key_id and key must be set together")
+	}
+	if c.Key != "" && len(c.Key) < 16 {
+		return errors.New("key must be at least 16 characters")
+	}
+	for user, ports := range c.SessionPorts {
+		if _, _, err := ParsePortRange(ports); err != nil {
+			return fmt.Errorf("session_ports[%s]: %w", user, err)
+		}
+	}
+	if c.PinnedCert != "" {
+		if b, err := hex.DecodeString(c.PinnedCert); err != nil || len(b) != sha256.Size {
+			return errors.New("pinned_cert_sha256 must be 64 hex characters")
+		}
+	}
 	return nil
 }
+
+// WithPolicy returns c with the values pushed in p. Unlocked settings take the
+// pushed value once per revision and may then be changed locally; locked
+// settings always keep it. An unmanaged policy sets and locks nothing; it is
+// kept so its serial still guards against replayed documents.
+func (c Config) WithPolicy(p agentpolicy.Policy) Config {
+	if c.Managed == nil || c.Managed.Revision != p.Revision {
+		c = applyPolicy(c, p, true)
+	}
+	c.Managed = &p
+	return c
+}
+
+// EnforceLocked resets the settings locked by the managed configuration.
+func (c Config) EnforceLocked() Config {
+	if c.Managed == nil {
+		return c
+	}
+	return applyPolicy(c, *c.Managed, false)
+}
+
+func applyPolicy(c Config, p agentpolicy.Policy, all bool) Config {
+	if p.IntervalSeconds != 0 && (all || p.IsLocked(agentpolicy.SettingInterval)) {
+		c.IntervalSeconds = p.IntervalSeconds
+	}
+	if p.RequireTLS != nil && (all || p.IsLocked(agentpolicy.SettingRequireTLS)) {
+		c.RequireTLS = *p.RequireTLS
+	}
+	if p.LogoutOnLock != nil && (all || p.IsLocked(agentpolicy.SettingLogoutOnLock)) {
+		c.LogoutOnLock = *p.LogoutOnLock
+	}
+	if p.MuteBlocks != nil && (all || p.IsLocked(agentpolicy.SettingMuteBlocks)) {
+		c.MuteBlocks = *p.MuteBlocks
+	}
+	return c
+}
+
+// Locked reports whether setting is locked by the managed configuration.
+func (c Config) Locked(setting string) bool {
+	return c.Managed != nil && c.Managed.IsLocked(setting)
+}
@@ -2,9 +2,12 @@ package agentui
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
 )
 
 type ConfigManager struct {
@@ -34,7 +37,10 @@ func (cm *ConfigManager) Get() Config {
 	return cm.cfg
 }
 
+// Set replaces the configuration; settings locked by the managed
+// configuration keep their pushed values.
 func (cm *ConfigManager) Set(cfg Config) error {
+	cfg = cfg.EnforceLocked()
 	if err := cfg.Validate(); err != nil {
 		return err
 	}
@@ -47,6 +53,29 @@ func (cm *ConfigManager) Set(cfg Config) error {
 	return nil
 }
 
+// ApplyPolicy applies a configuration pushed by the firewall and notifies
+// subscribers. It reports false when p is already applied, and refuses
+// documents addressed to another agent or older than the applied one, so a
+// recorded document cannot be replayed.
+func (cm *ConfigManager) ApplyPolicy(p agentpolicy.Policy) (bool, error) {
+	cfg := cm.Get()
+	if p.AgentID != cfg.AgentID {
+		return false, fmt.Errorf("addressed to agent %q", p.AgentID)
+	}
+	if cfg.Managed != nil {
+		if cfg.Managed.Serial == p.Serial && cfg.Managed.Revision == p.Revision {
+			return false, nil
+		}
+		if p.Serial <= cfg.Managed.Serial {
+			return false, fmt.Errorf("serial %d is not newer than the applied %d", p.Serial, cfg.Managed.Serial)
+		}
+	}
+	if err := cm.Set(cfg.WithPolicy(p)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (cm *ConfigManager) LoadFromDisk() error {
 	cm.mu.RLock()
 	path := cm.path
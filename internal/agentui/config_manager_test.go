@@ -2,7 +2,10 @@ package agentui
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/guilherme/zid-proxy/internal/agentpolicy"
 )
 
 func TestConfigManager_SaveLoadRoundTrip(t *testing.T) {
@@ -51,4 +54,106 @@ func TestConfig_Validate(t *testing.T) {
 	if err := cfg.Validate(); err == nil {
 		t.Fatal("expected error for interval_seconds=2")
 	}
+
+	cfg = DefaultConfig()
+	cfg.KeyID = "pc-01"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for key_id without key")
+	}
+
+	cfg.Key = "short"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for key shorter than 16 characters")
+	}
+
+	cfg.Key = "0123456789abcdef"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.PinnedCert = "not-a-fingerprint"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for malformed pinned_cert_sha256")
+	}
+	cfg.PinnedCert = strings.Repeat("ab", 32)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigManager_ApplyPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AgentID = "a1"
+	cm := NewConfigManager("", cfg)
+	ch := cm.Subscribe()
+	defer cm.Unsubscribe(ch)
+
+	yes := true
+	p := agentpolicy.Policy{
+		Revision:        "r1",
+		Serial:          10,
+		AgentID:         "a1",
+		IntervalSeconds: 120,
+		RequireTLS:      &yes,
+		LogoutOnLock:    &yes,
+		Locked:          []string{agentpolicy.SettingRequireTLS},
+	}
+	if changed, err := cm.ApplyPolicy(p); !changed || err != nil {
+		t.Fatalf("apply: changed=%v err=%v", changed, err)
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("subscribers not notified")
+	}
+	got := cm.Get()
+	if got.IntervalSeconds != 120 || !got.RequireTLS || !got.LogoutOnLock || got.Managed == nil || !got.Locked(agentpolicy.SettingRequireTLS) {
+		t.Fatalf("applied: %+v", got)
+	}
+
+	// Unlocked settings can be changed locally; locked ones cannot.
+	local := got
+	local.IntervalSeconds = 30
+	local.LogoutOnLock = false
+	local.RequireTLS = false
+	if err := cm.Set(local); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	got = cm.Get()
+	if got.IntervalSeconds != 30 || got.LogoutOnLock || !got.RequireTLS {
+		t.Fatalf("local override: %+v", got)
+	}
+
+	// The same revision does not reset local changes.
+	if changed, _ := cm.ApplyPolicy(p); changed || cm.Get().IntervalSeconds != 30 {
+		t.Fatalf("reapplied same revision: %+v", cm.Get())
+	}
+	old := p
+	p.Revision, p.Serial = "r2", 11
+	if changed, _ := cm.ApplyPolicy(p); !changed || cm.Get().IntervalSeconds != 120 {
+		t.Fatalf("new revision: %+v", cm.Get())
+	}
+
+	// Replayed older documents and documents for other agents are refused.
+	if changed, err := cm.ApplyPolicy(old); changed || err == nil || cm.Get().Managed.Revision != "r2" {
+		t.Fatalf("replay: changed=%v err=%v", changed, err)
+	}
+	other := p
+	other.Serial, other.AgentID = 12, "a2"
+	if changed, err := cm.ApplyPolicy(other); changed || err == nil {
+		t.Fatalf("other agent: changed=%v err=%v", changed, err)
+	}
+
+	// The unmanaged document unlocks every setting.
+	release := agentpolicy.Unmanaged()
+	release.Serial, release.AgentID = 12, "a1"
+	if changed, err := cm.ApplyPolicy(release); !changed || err != nil {
+		t.Fatalf("unmanaged: changed=%v err=%v", changed, err)
+	}
+	local = cm.Get()
+	local.RequireTLS = false
+	if err := cm.Set(local); err != nil || cm.Get().RequireTLS || cm.Get().Locked(agentpolicy.SettingRequireTLS) {
+		t.Fatalf("still locked: %+v err=%v", cm.Get(), err)
+	}
 }
@@ -0,0 +1,57 @@
+package agentui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseWho returns the distinct users in the output of the Unix "who" command.
+func ParseWho(out string) []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		users = append(users, fields[0])
+	}
+	return users
+}
+
+// ParseQuser returns the distinct users in the output of the Windows "quser"
+// command. The first line is the (localized) header; the current session is
+// prefixed with ">".
+func ParseQuser(out string) []string {
+	lines := strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
+	if len(lines) > 0 {
+		lines = lines[1:]
+	}
+	var users []string
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), ">"))
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		users = append(users, fields[0])
+	}
+	return users
+}
+
+// ParsePortRange parses a "LOW-HIGH" source-port range.
+func ParsePortRange(s string) (low, high int, err error) {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q (expected LOW-HIGH)", s)
+	}
+	low, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	high, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q (expected LOW-HIGH within 1-65535)", s)
+	}
+	return low, high, nil
+}
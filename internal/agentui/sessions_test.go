@@ -0,0 +1,35 @@
+package agentui
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWho(t *testing.T) {
+	out := "alice    pts/0        2026-03-10 09:00 (10.0.0.9)\n" +
+		"bob      pts/1        2026-03-10 09:05 (10.0.0.10)\n" +
+		"alice    pts/2        2026-03-10 09:30 (10.0.0.9)\n"
+	if got := ParseWho(out); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestParseQuser(t *testing.T) {
+	out := " USERNAME              SESSIONNAME        ID  STATE   IDLE TIME  LOGON TIME\r\n" +
+		">alice                 rdp-tcp#0           2  Active          .  3/10/2026 9:00 AM\r\n" +
+		" bob                                       3  Disc         1:02  3/10/2026 8:00 AM\r\n"
+	if got := ParseQuser(out); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if lo, hi, err := ParsePortRange(" 20000 - 20999 "); err != nil || lo != 20000 || hi != 20999 {
+		t.Fatalf("got %d-%d err=%v", lo, hi, err)
+	}
+	for _, s := range []string{"20000", "0-10", "200-100", "1-70000", "a-b"} {
+		if _, _, err := ParsePortRange(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
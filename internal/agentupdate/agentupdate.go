@@ -69,29 +69,3 @@ func (d Downloader) DownloadToFile(ctx context.Context, url, outPath string) err
 	_, err = io.Copy(f, resp.Body)
 	return err
 }
-
-func PrepareFromURL(ctx context.Context, downloader Downloader, url, expectedBinaryName string) (PreparedUpdate, error) {
-	tmpDir, err := os.MkdirTemp("", "zid-agent-update-*")
-	if err != nil {
-		return PreparedUpdate{}, err
-	}
-
-	archivePath := filepath.Join(tmpDir, "bundle.tar.gz")
-	if err := downloader.DownloadToFile(ctx, url, archivePath); err != nil {
-		_ = os.RemoveAll(tmpDir)
-		return PreparedUpdate{}, err
-	}
-
-	version, binPath, err := ExtractVersionAndBinary(archivePath, tmpDir, expectedBinaryName)
-	if err != nil {
-		_ = os.RemoveAll(tmpDir)
-		return PreparedUpdate{}, err
-	}
-
-	return PreparedUpdate{
-		TempDir:     tmpDir,
-		ArchivePath: archivePath,
-		Version:     version,
-		BinaryPath:  binPath,
-	}, nil
-}
@@ -0,0 +1,220 @@
+package agentupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultChannel is used when the firewall does not set an update channel.
+const DefaultChannel = "stable"
+
+var (
+	ErrNoReleaseKey     = errors.New("no release public key built in")
+	ErrBadSignature     = errors.New("update manifest signature is invalid")
+	ErrChecksumMismatch = errors.New("update bundle checksum mismatch")
+	ErrNoPlatform       = errors.New("update manifest has no bundle for this platform")
+)
+
+// releaseKey is the base64 ed25519 public key that signs update manifests.
+// Lines starting with # are ignored; see zid-update-sign -keygen.
+//
+//go:embed release_key.pub
+var releaseKey string
+
+var channelRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// ValidChannel reports whether name is a valid update channel name.
+func ValidChannel(name string) bool {
+	return channelRe.MatchString(name)
+}
+
+// Manifest describes one agent release.
+type Manifest struct {
+	Version string `json:"version"`
+	Channel string `json:"channel"`
+	// RolloutPercent is the share of agents (0-100) offered this release;
+	// see InRollout.
+	RolloutPercent int `json:"rollout_percent"`
+	// Platforms maps "GOOS/GOARCH" to the bundle for that platform.
+	Platforms map[string]Bundle `json:"platforms"`
+}
+
+// Bundle is a release archive (tar.gz with VERSION and the agent binary).
+type Bundle struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// SignedManifest is the document published by the firewall.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// Validate checks the fields of a manifest.
+func (m Manifest) Validate() error {
+	if strings.TrimSpace(m.Version) == "" {
+		return errors.New("manifest has no version")
+	}
+	if !ValidChannel(m.Channel) {
+		return fmt.Errorf("invalid channel %q", m.Channel)
+	}
+	if m.RolloutPercent < 0 || m.RolloutPercent > 100 {
+		return fmt.Errorf("invalid rollout_percent %d (expected 0..100)", m.RolloutPercent)
+	}
+	if len(m.Platforms) == 0 {
+		return errors.New("manifest has no platforms")
+	}
+	for platform, b := range m.Platforms {
+		if !strings.HasPrefix(b.URL, "https://") && !strings.HasPrefix(b.URL, "http://") {
+			return fmt.Errorf("%s: invalid url %q", platform, b.URL)
+		}
+		if sum, err := hex.DecodeString(b.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("%s: sha256 must be 64 hex characters", platform)
+		}
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key, ignoring # comment lines.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	var b64 string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			b64 = line
+			break
+		}
+	}
+	if b64 == "" {
+		return nil, ErrNoReleaseKey
+	}
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ReleaseKey returns the public key built into the agent.
+func ReleaseKey() (ed25519.PublicKey, error) {
+	return ParsePublicKey(releaseKey)
+}
+
+// SignManifest validates m and signs it with priv.
+func SignManifest(priv ed25519.PrivateKey, m Manifest) (SignedManifest, error) {
+	if err := m.Validate(); err != nil {
+		return SignedManifest{}, err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return SignedManifest{}, err
+	}
+	return SignedManifest{
+		Manifest:  raw,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, raw)),
+	}, nil
+}
+
+// VerifyManifest checks the signature of sm with pub and returns the manifest.
+// The signature covers the compact JSON encoding, so indenting the published
+// file does not invalidate it.
+func VerifyManifest(pub ed25519.PublicKey, sm SignedManifest) (Manifest, error) {
+	var raw bytes.Buffer
+	if err := json.Compact(&raw, sm.Manifest); err != nil {
+		return Manifest{}, ErrBadSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(sm.Signature)
+	if err != nil || !ed25519.Verify(pub, raw.Bytes(), sig) {
+		return Manifest{}, ErrBadSignature
+	}
+	var m Manifest
+	if err := json.Unmarshal(sm.Manifest, &m); err != nil {
+		return Manifest{}, err
+	}
+	return m, m.Validate()
+}
+
+// InRollout reports whether the agent identified by agentID is offered m.
+// Each agent gets a stable bucket per release, so raising the percentage only
+// adds agents.
+func InRollout(agentID string, m Manifest) bool {
+	if m.RolloutPercent >= 100 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(agentID + "/" + m.Version))
+	return int(binary.BigEndian.Uint32(sum[:4])%100) < m.RolloutPercent
+}
+
+// PrepareFromManifest downloads the bundle of platform ("GOOS/GOARCH"),
+// checks its SHA-256 against the (already verified) manifest and extracts it.
+// The bundle's VERSION must match the manifest.
+func PrepareFromManifest(ctx context.Context, downloader Downloader, m Manifest, platform, expectedBinaryName string) (PreparedUpdate, error) {
+	b, ok := m.Platforms[platform]
+	if !ok {
+		return PreparedUpdate{}, ErrNoPlatform
+	}
+
+	tmpDir, err := os.MkdirTemp("", "zid-agent-update-*")
+	if err != nil {
+		return PreparedUpdate{}, err
+	}
+
+	archivePath := filepath.Join(tmpDir, "bundle.tar.gz")
+	if err := downloader.DownloadToFile(ctx, b.URL, archivePath); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return PreparedUpdate{}, err
+	}
+	if err := checkSHA256(archivePath, b.SHA256); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return PreparedUpdate{}, err
+	}
+
+	version, binPath, err := ExtractVersionAndBinary(archivePath, tmpDir, expectedBinaryName)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return PreparedUpdate{}, err
+	}
+	if version != m.Version {
+		_ = os.RemoveAll(tmpDir)
+		return PreparedUpdate{}, fmt.Errorf("bundle version %s does not match manifest version %s", version, m.Version)
+	}
+
+	return PreparedUpdate{
+		TempDir:     tmpDir,
+		ArchivePath: archivePath,
+		Version:     version,
+		BinaryPath:  binPath,
+	}, nil
+}
+
+func checkSHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), want) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package agentupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testManifest(url, sum string) Manifest {
+	return Manifest{
+		Version:        "1.2.3",
+		Channel:        DefaultChannel,
+		RolloutPercent: 100,
+		Platforms:      map[string]Bundle{"linux/amd64": {URL: url, SHA256: sum}},
+	}
+}
+
+func TestSignAndVerifyManifest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest("https://example.com/bundle.tar.gz", hex.EncodeToString(make([]byte, 32)))
+
+	sm, err := SignManifest(priv, m)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	got, err := VerifyManifest(pub, sm)
+	if err != nil || got.Version != "1.2.3" {
+		t.Fatalf("verify: %+v %v", got, err)
+	}
+
+	// Reformatting the published file keeps the signature valid.
+	indented, _ := json.MarshalIndent(sm, "", "  ")
+	var reread SignedManifest
+	if err := json.Unmarshal(indented, &reread); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyManifest(pub, reread); err != nil {
+		t.Fatalf("indented manifest: %v", err)
+	}
+
+	tampered := sm
+	tampered.Manifest = []byte(strings.Replace(string(sm.Manifest), "1.2.3", "1.2.4", 1))
+	if _, err := VerifyManifest(pub, tampered); err != ErrBadSignature {
+		t.Fatalf("tampered manifest: got %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err := VerifyManifest(otherPub, sm); err != ErrBadSignature {
+		t.Fatalf("other key: got %v", err)
+	}
+
+	m.RolloutPercent = 150
+	if _, err := SignManifest(priv, m); err == nil {
+		t.Fatal("expected invalid rollout to be refused")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	if _, err := ParsePublicKey("# comment only\n"); err != ErrNoReleaseKey {
+		t.Fatalf("empty: got %v", err)
+	}
+	pub, _, _ := ed25519.GenerateKey(nil)
+	got, err := ParsePublicKey("# release key\n" + base64.StdEncoding.EncodeToString(pub) + "\n")
+	if err != nil || !got.Equal(pub) {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := ParsePublicKey("bm90LWEta2V5"); err == nil {
+		t.Fatal("expected short key to be refused")
+	}
+}
+
+func TestInRollout(t *testing.T) {
+	m := testManifest("https://example.com/b.tar.gz", "")
+	m.RolloutPercent = 25
+
+	in := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("agent-%d", i)
+		if InRollout(id, m) {
+			in++
+			// Raising the percentage keeps the agents already included.
+			wider := m
+			wider.RolloutPercent = 50
+			if !InRollout(id, wider) {
+				t.Fatalf("%s left the rollout at 50%%", id)
+			}
+		}
+	}
+	if in < 180 || in > 320 {
+		t.Fatalf("%d of 1000 agents in a 25%% rollout", in)
+	}
+
+	m.RolloutPercent = 0
+	if InRollout("agent-1", m) {
+		t.Fatal("0% rollout included an agent")
+	}
+}
+
+func TestPrepareFromManifest(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+	if err := writeTestTarGz(archivePath, map[string][]byte{
+		"zid-agent-linux-gui/VERSION":             []byte("1.2.3\n"),
+		"zid-agent-linux-gui/zid-agent-linux-gui": []byte("fakebin"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(archivePath)
+	sum := sha256.Sum256(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	m := testManifest(srv.URL+"/bundle.tar.gz", hex.EncodeToString(sum[:]))
+	pu, err := PrepareFromManifest(context.Background(), Downloader{}, m, "linux/amd64", "zid-agent-linux-gui")
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer pu.Cleanup()
+	if pu.Version != "1.2.3" {
+		t.Fatalf("version=%q", pu.Version)
+	}
+
+	if _, err := PrepareFromManifest(context.Background(), Downloader{}, m, "windows/amd64", "zid-agent-windows-gui.exe"); err != ErrNoPlatform {
+		t.Fatalf("missing platform: got %v", err)
+	}
+
+	bad := testManifest(srv.URL+"/bundle.tar.gz", hex.EncodeToString(make([]byte, 32)))
+	if _, err := PrepareFromManifest(context.Background(), Downloader{}, bad, "linux/amd64", "zid-agent-linux-gui"); err != ErrChecksumMismatch {
+		t.Fatalf("checksum: got %v", err)
+	}
+
+	other := m
+	other.Version = "1.2.4"
+	if _, err := PrepareFromManifest(context.Background(), Downloader{}, other, "linux/amd64", "zid-agent-linux-gui"); err == nil {
+		t.Fatal("expected version mismatch to be refused")
+	}
+}
@@ -11,12 +11,37 @@ import (
 )
 
 // Client is a Unix socket client for communicating with zid-appid daemon.
+// It negotiates protocol version 2 when connecting and falls back to
+// version 1 with older daemons. Over version 2, concurrent calls share the
+// connection: their requests are pipelined and matched to the responses by
+// id.
 type Client struct {
 	mu         sync.Mutex
 	socketPath string
 	conn       net.Conn
 	reader     *bufio.Reader
 	timeout    time.Duration
+
+	version int                       // protocol version of conn
+	nextID  uint64                    // last version 2 request id
+	pending map[uint64]chan *Response // version 2 requests awaiting a response
+}
+
+// reply is the answer to a request: the result (version 2) or the response
+// line (version 1).
+type reply struct {
+	v2     bool
+	result json.RawMessage
+	line   string
+}
+
+// data returns the JSON document of the reply (version 1 commands such as
+// STATS answer with JSON too).
+func (r reply) data() []byte {
+	if r.v2 {
+		return r.result
+	}
+	return []byte(r.line)
 }
 
 // LookupResult contains the result of an AppID lookup.
@@ -24,6 +49,13 @@ type LookupResult struct {
 	AppName    string  `json:"app_name"`
 	Confidence float32 `json:"confidence"`
 	Found      bool    `json:"found"`
+	Pattern    string  `json:"pattern,omitempty"`  // matched hostname pattern (LOOKUP_HOST)
+	Category   string  `json:"category,omitempty"` // app category (LOOKUP_HOST in v1)
+
+	// Only returned by protocol version 2
+	DisplayName string `json:"display_name,omitempty"`
+	Source      string `json:"source,omitempty"`   // how the app was identified (Source*)
+	Hostname    string `json:"hostname,omitempty"` // SNI, Host or DNS name of the flow
 }
 
 // StatsResult contains AppID daemon statistics.
@@ -40,61 +72,172 @@ func NewClient(socketPath string, timeout time.Duration) *Client {
 	}
 }
 
-// connect establishes a connection to the daemon.
-func (c *Client) connect() error {
+// connect establishes a connection to the daemon and negotiates the
+// protocol version. Must be called with c.mu held.
+func (c *Client) connect(deadline time.Time) error {
 	if c.conn != nil {
 		return nil
 	}
 
-	conn, err := net.DialTimeout("unix", c.socketPath, c.timeout)
+	conn, err := net.DialTimeout("unix", c.socketPath, time.Until(deadline))
 	if err != nil {
 		return fmt.Errorf("failed to connect to appid daemon: %w", err)
 	}
+	reader := bufio.NewReader(conn)
+
+	// Daemons that only speak version 1 answer HELLO with an error
+	conn.SetDeadline(deadline)
+	if _, err := fmt.Fprintf(conn, "HELLO %d\n", ProtocolVersion); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read response: %w", err)
+	}
 
 	c.conn = conn
-	c.reader = bufio.NewReader(conn)
+	c.reader = reader
+	c.version = ProtocolV1
+	if strings.TrimSpace(response) == fmt.Sprintf("OK %d", ProtocolV2) {
+		c.version = ProtocolV2
+		c.pending = make(map[uint64]chan *Response)
+		conn.SetDeadline(time.Time{})
+		go c.readLoop(conn, reader)
+	}
 	return nil
 }
 
+// readLoop delivers the version 2 responses read from conn to the pending
+// requests until conn fails or is closed.
+func (c *Client) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			c.mu.Lock()
+			if c.conn == conn {
+				c.disconnect()
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+}
+
+// disconnect closes the connection and fails the pending requests. Must be
+// called with c.mu held.
+func (c *Client) disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.conn = nil
+	c.reader = nil
+	c.pending = nil
+	c.version = 0
+	return err
+}
+
 // Close closes the connection.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-
-	if c.conn != nil {
-		err := c.conn.Close()
-		c.conn = nil
-		c.reader = nil
-		return err
-	}
-	return nil
+	return c.disconnect()
 }
 
-// sendCommand sends a command and returns the response.
-func (c *Client) sendCommand(cmd string) (string, error) {
+// Version returns the protocol version negotiated with the daemon, or 0
+// when not connected.
+func (c *Client) Version() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.version
+}
 
-	if err := c.connect(); err != nil {
-		return "", err
+// roundTrip sends req over protocol version 2, or cmd when the daemon only
+// speaks version 1. The whole exchange (connect, write and read) is bounded
+// by the client timeout.
+func (c *Client) roundTrip(req *Request, cmd string) (reply, error) {
+	deadline := time.Now().Add(c.timeout)
+
+	c.mu.Lock()
+	if err := c.connect(deadline); err != nil {
+		c.mu.Unlock()
+		return reply{}, err
+	}
+	if c.version != ProtocolV2 {
+		defer c.mu.Unlock()
+		line, err := c.sendCommand(cmd, deadline)
+		return reply{line: line}, err
+	}
+
+	c.nextID++
+	req.ID = c.nextID
+	data, err := json.Marshal(req)
+	if err != nil {
+		c.mu.Unlock()
+		return reply{}, fmt.Errorf("failed to encode request: %w", err)
+	}
+	ch := make(chan *Response, 1)
+	c.pending[req.ID] = ch
+	c.conn.SetWriteDeadline(deadline)
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		c.disconnect()
+		c.mu.Unlock()
+		return reply{}, fmt.Errorf("failed to send command: %w", err)
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return reply{}, fmt.Errorf("failed to read response: connection closed")
+		}
+		if resp.Error != nil {
+			return reply{}, resp.Error
+		}
+		return reply{v2: true, result: resp.Result}, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return reply{}, fmt.Errorf("failed to read response: timeout")
 	}
+}
 
-	// Set deadline
-	c.conn.SetDeadline(time.Now().Add(c.timeout))
+// sendCommand sends a version 1 command and returns the response line.
+// Must be called with c.mu held.
+func (c *Client) sendCommand(cmd string, deadline time.Time) (string, error) {
+	c.conn.SetDeadline(deadline)
 
 	// Send command
 	_, err := fmt.Fprintf(c.conn, "%s\n", cmd)
 	if err != nil {
-		c.conn.Close()
-		c.conn = nil
+		c.disconnect()
 		return "", fmt.Errorf("failed to send command: %w", err)
 	}
 
 	// Read response
 	response, err := c.reader.ReadString('\n')
 	if err != nil {
-		c.conn.Close()
-		c.conn = nil
+		c.disconnect()
 		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
@@ -104,35 +247,134 @@ func (c *Client) sendCommand(cmd string) (string, error) {
 // Lookup queries the daemon for the app associated with a flow.
 // Command format: LOOKUP srcIP dstIP proto srcPort dstPort
 func (c *Client) Lookup(srcIP, dstIP string, proto uint8, srcPort, dstPort uint16) (*LookupResult, error) {
-	protoStr := "TCP"
-	if proto == 17 {
-		protoStr = "UDP"
-	}
+	req, args := flowRequest(CmdLookup, FlowKey{SrcIP: srcIP, DstIP: dstIP, SrcPort: srcPort, DstPort: dstPort, Protocol: proto})
+	return c.lookup(req, "LOOKUP "+args)
+}
 
-	cmd := fmt.Sprintf("LOOKUP %s %s %s %d %d", srcIP, dstIP, protoStr, srcPort, dstPort)
-	response, err := c.sendCommand(cmd)
+// LookupIP queries the daemon for the most recent app for a source IP.
+// Command format: LOOKUP_IP srcIP
+func (c *Client) LookupIP(srcIP string) (*LookupResult, error) {
+	return c.lookup(&Request{Cmd: CmdLookupIP, SrcIP: srcIP}, fmt.Sprintf("LOOKUP_IP %s", srcIP))
+}
+
+// LookupHost queries the daemon for the app of a hostname (SNI).
+// Command format: LOOKUP_HOST hostname
+func (c *Client) LookupHost(hostname string) (*LookupResult, error) {
+	return c.lookup(&Request{Cmd: CmdLookupHost, Host: hostname}, fmt.Sprintf("LOOKUP_HOST %s", hostname))
+}
+
+// lookup sends a lookup request and decodes its result.
+func (c *Client) lookup(req *Request, cmd string) (*LookupResult, error) {
+	r, err := c.roundTrip(req, cmd)
 	if err != nil {
 		return nil, err
 	}
+	if !r.v2 {
+		return c.parseResponse(r.line)
+	}
 
-	return c.parseResponse(response)
+	var result LookupResult
+	if err := json.Unmarshal(r.result, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse lookup result: %w", err)
+	}
+	return &result, nil
 }
 
-// LookupIP queries the daemon for the most recent app for a source IP.
-// Command format: LOOKUP_IP srcIP
-func (c *Client) LookupIP(srcIP string) (*LookupResult, error) {
-	cmd := fmt.Sprintf("LOOKUP_IP %s", srcIP)
-	response, err := c.sendCommand(cmd)
+// ReportDNS tells the daemon that client (nil if unknown) received addrs in
+// the answer for name, so later flows to them can be classified.
+// Command format: DNS clientIP name ttl ip [ip...]
+func (c *Client) ReportDNS(client net.IP, name string, ttl time.Duration, addrs ...net.IP) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	req := &Request{Cmd: CmdDNS, Host: name, TTL: uint32(ttl / time.Second)}
+	clientStr := "-"
+	if client != nil {
+		clientStr = client.String()
+		req.Client = clientStr
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "DNS %s %s %d", clientStr, name, req.TTL)
+	for _, ip := range addrs {
+		req.Addrs = append(req.Addrs, ip.String())
+		b.WriteString(" ")
+		b.WriteString(ip.String())
+	}
+
+	r, err := c.roundTrip(req, b.String())
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !r.v2 && strings.HasPrefix(r.line, "ERROR") {
+		return fmt.Errorf("daemon error: %s", strings.TrimSpace(strings.TrimPrefix(r.line, "ERROR")))
+	}
+	return nil
+}
+
+// RegisterFlow reports a connection relayed by zid-proxy with its SNI and
+// user ("" if unknown), and returns the app of the hostname. Version 1 only
+// carries users without spaces.
+// Command format: REGISTER_FLOW srcIP dstIP proto srcPort dstPort hostname [user]
+func (c *Client) RegisterFlow(key FlowKey, hostname, user string) (*LookupResult, error) {
+	req, args := flowRequest(CmdRegisterFlow, key)
+	req.Host = hostname
+	req.User = user
+	cmd := fmt.Sprintf("REGISTER_FLOW %s %s", args, hostname)
+	if user != "" && !strings.ContainsAny(user, " \t") {
+		cmd += " " + user
+	}
+	return c.lookup(req, cmd)
+}
+
+// UpdateFlow reports the bytes relayed so far on a registered connection.
+// It returns false if the daemon does not know the flow.
+// Command format: UPDATE_FLOW srcIP dstIP proto srcPort dstPort bytesIn bytesOut
+func (c *Client) UpdateFlow(key FlowKey, bytesIn, bytesOut uint64) (bool, error) {
+	return c.flowBytes(CmdUpdateFlow, "UPDATE_FLOW", key, bytesIn, bytesOut)
+}
+
+// CloseFlow reports the final byte counts of a registered connection.
+// It returns false if the daemon does not know the flow.
+// Command format: CLOSE_FLOW srcIP dstIP proto srcPort dstPort bytesIn bytesOut
+func (c *Client) CloseFlow(key FlowKey, bytesIn, bytesOut uint64) (bool, error) {
+	return c.flowBytes(CmdCloseFlow, "CLOSE_FLOW", key, bytesIn, bytesOut)
+}
+
+func (c *Client) flowBytes(cmd, cmdV1 string, key FlowKey, bytesIn, bytesOut uint64) (bool, error) {
+	req, args := flowRequest(cmd, key)
+	req.BytesIn, req.BytesOut = bytesIn, bytesOut
+	r, err := c.roundTrip(req, fmt.Sprintf("%s %s %d %d", cmdV1, args, bytesIn, bytesOut))
+	if err != nil {
+		return false, err
+	}
+	if r.v2 {
+		var result FlowResult
+		if err := json.Unmarshal(r.result, &result); err != nil {
+			return false, fmt.Errorf("failed to parse flow result: %w", err)
+		}
+		return result.Found, nil
 	}
+	res, err := c.parseResponse(r.line)
+	if err != nil {
+		return false, err
+	}
+	return res.Found, nil
+}
 
-	return c.parseResponse(response)
+// flowRequest returns the version 2 request of a flow command and the
+// "srcIP dstIP proto srcPort dstPort" arguments of its version 1 form.
+func flowRequest(cmd string, key FlowKey) (*Request, string) {
+	proto := "TCP"
+	if key.Protocol == 17 {
+		proto = "UDP"
+	}
+	req := &Request{Cmd: cmd, SrcIP: key.SrcIP, DstIP: key.DstIP, Proto: strings.ToLower(proto), SrcPort: key.SrcPort, DstPort: key.DstPort}
+	return req, fmt.Sprintf("%s %s %s %d %d", key.SrcIP, key.DstIP, proto, key.SrcPort, key.DstPort)
 }
 
 // parseResponse parses the daemon response.
 // Formats:
-//   - OK app_name [confidence]
+//   - OK app_name [confidence [pattern [category]]]
 //   - UNKNOWN
 //   - ERROR message
 func (c *Client) parseResponse(response string) (*LookupResult, error) {
@@ -152,6 +394,12 @@ func (c *Client) parseResponse(response string) (*LookupResult, error) {
 		} else {
 			result.Confidence = 1.0
 		}
+		if len(parts) >= 4 {
+			result.Pattern = parts[3]
+		}
+		if len(parts) >= 5 {
+			result.Category = parts[4]
+		}
 		return result, nil
 
 	case "UNKNOWN":
@@ -171,13 +419,13 @@ func (c *Client) parseResponse(response string) (*LookupResult, error) {
 
 // Stats retrieves statistics from the daemon.
 func (c *Client) Stats() (*StatsResult, error) {
-	response, err := c.sendCommand("STATS")
+	r, err := c.roundTrip(&Request{Cmd: CmdStats}, "STATS")
 	if err != nil {
 		return nil, err
 	}
 
 	var result StatsResult
-	if err := json.Unmarshal([]byte(response), &result); err != nil {
+	if err := json.Unmarshal(r.data(), &result); err != nil {
 		return nil, fmt.Errorf("failed to parse stats: %w", err)
 	}
 
@@ -186,22 +434,69 @@ func (c *Client) Stats() (*StatsResult, error) {
 
 // Apps retrieves the list of supported applications.
 func (c *Client) Apps() ([]string, error) {
-	response, err := c.sendCommand("APPS")
+	r, err := c.roundTrip(&Request{Cmd: CmdApps}, "APPS")
 	if err != nil {
 		return nil, err
 	}
 
 	var apps []string
-	if err := json.Unmarshal([]byte(response), &apps); err != nil {
+	if err := json.Unmarshal(r.data(), &apps); err != nil {
 		return nil, fmt.Errorf("failed to parse apps list: %w", err)
 	}
 
 	return apps, nil
 }
 
+// Usage retrieves the daily app usage records matching q.
+// Command format: USAGE from to identity app ("-" = any)
+func (c *Client) Usage(q UsageQuery) ([]UsageRecord, error) {
+	dash := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+	req := &Request{Cmd: CmdUsage, From: q.From, To: q.To, Identity: q.Identity, App: q.App}
+	r, err := c.roundTrip(req, fmt.Sprintf("USAGE %s %s %s %s", dash(q.From), dash(q.To), dash(q.Identity), dash(q.App)))
+	if err != nil {
+		return nil, err
+	}
+	if !r.v2 && strings.HasPrefix(r.line, "ERROR") {
+		return nil, fmt.Errorf("daemon error: %s", strings.TrimSpace(strings.TrimPrefix(r.line, "ERROR")))
+	}
+
+	var records []UsageRecord
+	if err := json.Unmarshal(r.data(), &records); err != nil {
+		return nil, fmt.Errorf("failed to parse usage: %w", err)
+	}
+	return records, nil
+}
+
+// SignaturesInfo describes the signature database loaded by the daemon.
+type SignaturesInfo struct {
+	Format  int    `json:"format"`
+	Version string `json:"version"` // "" = built-ins only
+	Apps    int    `json:"apps"`
+}
+
+// Signatures retrieves the version of the daemon's signature database.
+func (c *Client) Signatures() (*SignaturesInfo, error) {
+	r, err := c.roundTrip(&Request{Cmd: CmdSignatures}, "SIGNATURES")
+	if err != nil {
+		return nil, err
+	}
+
+	var info SignaturesInfo
+	if err := json.Unmarshal(r.data(), &info); err != nil {
+		return nil, fmt.Errorf("failed to parse signatures info: %w", err)
+	}
+
+	return &info, nil
+}
+
 // Ping checks if the daemon is responsive.
 func (c *Client) Ping() error {
-	_, err := c.sendCommand("PING")
+	_, err := c.roundTrip(&Request{Cmd: CmdPing}, "PING")
 	return err
 }
 
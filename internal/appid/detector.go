@@ -1,6 +1,8 @@
 package appid
 
 import (
+	"net"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -26,6 +28,12 @@ type AppDefinition struct {
 	DisplayName string      // Human-readable name (e.g., "Netflix")
 	Category    AppCategory // Application category
 	Hostnames   []string    // Known hostnames (wildcards supported)
+
+	// Optional hints from the signature database (see signatures.go)
+	IPRanges []*net.IPNet // Networks owned by the app
+	JA3      []string     // TLS client fingerprints (JA3 MD5, lower case)
+	JA4      []string     // TLS client fingerprints (JA4)
+	ALPN     []string     // ALPN protocols the app negotiates (e.g. "h2")
 }
 
 // Detector provides application detection functionality.
@@ -34,26 +42,84 @@ type AppDefinition struct {
 type Detector struct {
 	mu   sync.RWMutex
 	apps map[string]*AppDefinition // name -> definition
-	// Hostname index for fast lookup
-	hostnameIndex map[string]string // hostname suffix -> app name
+	// Hostname patterns by label, most specific suffix wins (see trie.go)
+	hostnames *hostnameTrie
+	// Indexes of the signature database hints
+	ipIndex          []ipRange
+	fingerprintIndex map[string]string // JA3/JA4 -> app name
+
+	// Signature database merged over the built-ins (see LoadSignatures)
+	signatures []AppDefinition
+	sigPath    string
+	sigVersion string
+	custom     []*AppDefinition // added with AddCustomApp, kept across reloads
 }
 
 // NewDetector creates a new application detector with built-in definitions.
 func NewDetector() *Detector {
-	d := &Detector{
-		apps:          make(map[string]*AppDefinition),
-		hostnameIndex: make(map[string]string),
-	}
+	d := &Detector{}
 
 	// Load built-in app definitions
-	d.loadBuiltinApps()
+	d.rebuild()
 
 	return d
 }
 
-// loadBuiltinApps loads the built-in application definitions.
-func (d *Detector) loadBuiltinApps() {
-	apps := []AppDefinition{
+// rebuild indexes the built-in apps, then the signature database (an app with
+// the same name replaces the built-in one), then the custom apps. Apps are
+// indexed in that order, so a pattern shared by two apps always goes to the
+// later one. Callers hold d.mu (or own d exclusively).
+func (d *Detector) rebuild() {
+	d.apps = make(map[string]*AppDefinition)
+	d.hostnames = &hostnameTrie{}
+	d.ipIndex = nil
+	d.fingerprintIndex = make(map[string]string)
+
+	builtins := builtinApps()
+	ordered := make([]*AppDefinition, 0, len(builtins)+len(d.signatures)+len(d.custom))
+	for i := range builtins {
+		ordered = append(ordered, &builtins[i])
+	}
+	for i := range d.signatures {
+		ordered = append(ordered, &d.signatures[i])
+	}
+	ordered = append(ordered, d.custom...)
+
+	for _, app := range ordered {
+		d.apps[app.Name] = app
+	}
+	for _, app := range ordered {
+		if d.apps[app.Name] == app {
+			d.index(app)
+		}
+	}
+	// Most specific range first
+	sort.SliceStable(d.ipIndex, func(i, j int) bool {
+		bi, _ := d.ipIndex[i].network.Mask.Size()
+		bj, _ := d.ipIndex[j].network.Mask.Size()
+		return bi > bj
+	})
+}
+
+// index adds the patterns of app to the lookup indexes.
+func (d *Detector) index(app *AppDefinition) {
+	for _, hostname := range app.Hostnames {
+		d.hostnames.insert(hostname, app.Name)
+	}
+	for _, network := range app.IPRanges {
+		d.ipIndex = append(d.ipIndex, ipRange{network: network, app: app.Name})
+	}
+	for _, fp := range app.JA3 {
+		d.fingerprintIndex[fp] = app.Name
+	}
+	for _, fp := range app.JA4 {
+		d.fingerprintIndex[fp] = app.Name
+	}
+}
+
+// builtinApps returns the built-in application definitions.
+func builtinApps() []AppDefinition {
+	return []AppDefinition{
 		// Streaming Media
 		{Name: "netflix", DisplayName: "Netflix", Category: CategoryStreamingMedia,
 			Hostnames: []string{"netflix.com", "nflxvideo.net", "nflximg.net", "nflxso.net", "nflxext.com"}},
@@ -198,38 +264,37 @@ func (d *Detector) loadBuiltinApps() {
 		{Name: "facebook_ads", DisplayName: "Facebook Ads", Category: CategoryAds,
 			Hostnames: []string{"facebook.com/ads", "an.facebook.com"}},
 	}
-
-	for i := range apps {
-		app := &apps[i]
-		d.apps[app.Name] = app
-
-		// Build hostname index
-		for _, hostname := range app.Hostnames {
-			d.hostnameIndex[hostname] = app.Name
-		}
-	}
 }
 
 // DetectByHostname detects the application based on the hostname (SNI).
 func (d *Detector) DetectByHostname(hostname string) (*AppDefinition, float32) {
+	m := d.MatchHostname(hostname)
+	return m.App, m.Confidence
+}
+
+// HostnameMatch is the result of MatchHostname.
+type HostnameMatch struct {
+	App        *AppDefinition // nil = no pattern matched
+	Pattern    string         // the matched hostname pattern
+	Confidence float32        // 1.0 exact, 0.9 parent domain
+}
+
+// MatchHostname finds the most specific hostname pattern for hostname:
+// the pattern itself, else its longest matching parent domain (e.g.
+// "r1.googlevideo.com" matches "googlevideo.com", never "google.com").
+func (d *Detector) MatchHostname(hostname string) HostnameMatch {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	hostname = strings.ToLower(hostname)
-
-	// Direct match
-	if appName, ok := d.hostnameIndex[hostname]; ok {
-		return d.apps[appName], 1.0
+	appName, pattern, exact := d.hostnames.lookup(strings.ToLower(hostname))
+	if appName == "" {
+		return HostnameMatch{}
 	}
-
-	// Suffix match (e.g., api.netflix.com matches netflix.com)
-	for suffix, appName := range d.hostnameIndex {
-		if strings.HasSuffix(hostname, "."+suffix) || hostname == suffix {
-			return d.apps[appName], 0.9
-		}
+	m := HostnameMatch{App: d.apps[appName], Pattern: pattern, Confidence: 0.9}
+	if exact {
+		m.Confidence = 1.0
 	}
-
-	return nil, 0
+	return m
 }
 
 // GetApp returns an app definition by name.
@@ -275,13 +340,13 @@ func (d *Detector) ListAppsByCategory() map[AppCategory][]*AppDefinition {
 	return result
 }
 
-// AddCustomApp adds a custom application definition.
+// AddCustomApp adds a custom application definition. It takes precedence
+// over the built-ins and the signature database, also after a reload.
 func (d *Detector) AddCustomApp(app *AppDefinition) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	d.custom = append(d.custom, app)
 	d.apps[app.Name] = app
-	for _, hostname := range app.Hostnames {
-		d.hostnameIndex[hostname] = app.Name
-	}
+	d.index(app)
 }
@@ -0,0 +1,193 @@
+package appid
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DNSConfidence scales the hostname confidence of a flow classified from
+	// a DNS answer its client received: several names (and apps) may share
+	// the same CDN address.
+	DNSConfidence = 0.8
+	// DNSSharedConfidence is used when only another client received the
+	// answer for the address.
+	DNSSharedConfidence = 0.6
+
+	// DNSMinTTL keeps short-lived answers long enough for the client to
+	// connect; DNSMaxTTL bounds answers with very long TTLs.
+	DNSMinTTL = 5 * time.Minute
+	DNSMaxTTL = 24 * time.Hour
+)
+
+// DNSCache remembers the names that answered addresses were resolved from,
+// per client, so flows to an address without SNI (calls, games, VPNs) can
+// be classified by the name the client asked for. It is fed by the capture
+// mode and by resolver hooks through the DNS socket command. When full, the
+// least recently observed answer makes room for the new one.
+type DNSCache struct {
+	mu       sync.RWMutex
+	entries  *dnsLRU // per-client answers
+	byServer *dnsLRU // latest answer for an address, any client (client "")
+}
+
+type dnsKey struct {
+	client string
+	server string
+}
+
+type dnsEntry struct {
+	key     dnsKey
+	name    string
+	expires time.Time
+}
+
+// dnsLRU is a map of answers bounded by evicting the least recently
+// observed one. It is not safe for concurrent use.
+type dnsLRU struct {
+	items map[dnsKey]*list.Element
+	order *list.List // *dnsEntry, most recently observed first
+	max   int
+}
+
+func newDNSLRU(max int) *dnsLRU {
+	return &dnsLRU{items: make(map[dnsKey]*list.Element), order: list.New(), max: max}
+}
+
+func (l *dnsLRU) get(key dnsKey) (*dnsEntry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*dnsEntry), true
+}
+
+// put stores e, evicting the least recently observed answer when full.
+func (l *dnsLRU) put(e dnsEntry) {
+	if el, ok := l.items[e.key]; ok {
+		*el.Value.(*dnsEntry) = e
+		l.order.MoveToFront(el)
+		return
+	}
+	if l.max > 0 && len(l.items) >= l.max {
+		if oldest := l.order.Back(); oldest != nil {
+			l.remove(oldest)
+		}
+	}
+	l.items[e.key] = l.order.PushFront(&e)
+}
+
+func (l *dnsLRU) remove(el *list.Element) {
+	delete(l.items, el.Value.(*dnsEntry).key)
+	l.order.Remove(el)
+}
+
+// expire removes the answers expired at now and returns how many were removed.
+func (l *dnsLRU) expire(now time.Time) int {
+	removed := 0
+	for el := l.order.Front(); el != nil; {
+		next := el.Next()
+		if !now.Before(el.Value.(*dnsEntry).expires) {
+			l.remove(el)
+			removed++
+		}
+		el = next
+	}
+	return removed
+}
+
+// NewDNSCache creates a cache holding at most maxEntries answers.
+func NewDNSCache(maxEntries int) *DNSCache {
+	return &DNSCache{
+		entries:  newDNSLRU(maxEntries),
+		byServer: newDNSLRU(maxEntries),
+	}
+}
+
+// Observe records that client received addr in the answer for name, valid
+// for ttl. client may be nil when the asker is unknown.
+func (c *DNSCache) Observe(client net.IP, name string, addr net.IP, ttl time.Duration, now time.Time) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || addr == nil {
+		return
+	}
+	if ttl < DNSMinTTL {
+		ttl = DNSMinTTL
+	} else if ttl > DNSMaxTTL {
+		ttl = DNSMaxTTL
+	}
+	server := addr.String()
+	expires := now.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client != nil {
+		c.entries.put(dnsEntry{key: dnsKey{client: client.String(), server: server}, name: name, expires: expires})
+	}
+	c.byServer.put(dnsEntry{key: dnsKey{server: server}, name: name, expires: expires})
+}
+
+// Lookup returns the name client resolved server from. If client never
+// received an answer for server, the latest answer of any client is
+// returned with shared set.
+func (c *DNSCache) Lookup(client, server net.IP, now time.Time) (name string, shared, ok bool) {
+	if server == nil {
+		return "", false, false
+	}
+	addr := server.String()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if client != nil {
+		if e, found := c.entries.get(dnsKey{client: client.String(), server: addr}); found && now.Before(e.expires) {
+			return e.name, false, true
+		}
+	}
+	if e, found := c.byServer.get(dnsKey{server: addr}); found && now.Before(e.expires) {
+		return e.name, true, true
+	}
+	return "", false, false
+}
+
+// GC removes expired answers and returns how many per-client answers were
+// removed.
+func (c *DNSCache) GC(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byServer.expire(now)
+	return c.entries.expire(now)
+}
+
+// Len returns the number of per-client answers held.
+func (c *DNSCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries.items)
+}
+
+// DetectByDNS classifies a flow from client to server by the name the
+// client resolved server from. It returns the app, the name and the
+// hostname confidence scaled by DNSConfidence (or DNSSharedConfidence).
+func (d *Detector) DetectByDNS(dns *DNSCache, client, server net.IP, now time.Time) (*AppDefinition, string, float32) {
+	if dns == nil {
+		return nil, "", 0
+	}
+	name, shared, ok := dns.Lookup(client, server, now)
+	if !ok {
+		return nil, "", 0
+	}
+	m := d.MatchHostname(name)
+	if m.App == nil {
+		return nil, name, 0
+	}
+	scale := float32(DNSConfidence)
+	if shared {
+		scale = DNSSharedConfidence
+	}
+	return m.App, name, m.Confidence * scale
+}
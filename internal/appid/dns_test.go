@@ -0,0 +1,124 @@
+package appid
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	c := NewDNSCache(2)
+	now := time.Unix(1760000000, 0)
+	alice, bob := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.11")
+	server := net.ParseIP("203.0.113.5")
+
+	c.Observe(alice, "API.TikTokv.com.", server, 30*time.Second, now)
+	if name, shared, ok := c.Lookup(alice, server, now); !ok || shared || name != "api.tiktokv.com" {
+		t.Fatalf("own answer = %q shared=%v ok=%v", name, shared, ok)
+	}
+	if name, shared, ok := c.Lookup(bob, server, now); !ok || !shared || name != "api.tiktokv.com" {
+		t.Fatalf("shared answer = %q shared=%v ok=%v", name, shared, ok)
+	}
+
+	// Short TTLs are raised to DNSMinTTL
+	if _, _, ok := c.Lookup(alice, server, now.Add(DNSMinTTL-time.Second)); !ok {
+		t.Fatal("answer expired before DNSMinTTL")
+	}
+	if _, _, ok := c.Lookup(alice, server, now.Add(DNSMinTTL)); ok {
+		t.Fatal("answer not expired after DNSMinTTL")
+	}
+
+	// A full cache evicts the least recently observed answer
+	c.Observe(bob, "b.example", net.ParseIP("198.51.100.1"), time.Hour, now)
+	c.Observe(alice, "API.TikTokv.com.", server, 30*time.Second, now) // refreshed
+	c.Observe(bob, "c.example", net.ParseIP("198.51.100.2"), time.Hour, now)
+	if c.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", c.Len())
+	}
+	if name, _, ok := c.Lookup(bob, net.ParseIP("198.51.100.2"), now); !ok || name != "c.example" {
+		t.Fatalf("new answer = %q ok=%v, want c.example", name, ok)
+	}
+	if _, _, ok := c.Lookup(bob, net.ParseIP("198.51.100.1"), now); ok {
+		t.Fatal("least recently observed answer not evicted")
+	}
+	if _, shared, ok := c.Lookup(alice, server, now); !ok || shared {
+		t.Fatal("refreshed answer evicted")
+	}
+	if removed := c.GC(now.Add(DNSMinTTL)); removed != 1 || c.Len() != 1 {
+		t.Fatalf("GC removed %d, Len = %d", removed, c.Len())
+	}
+}
+
+func TestDetector_DetectByDNS(t *testing.T) {
+	d := NewDetector()
+	c := NewDNSCache(100)
+	now := time.Now()
+	alice, bob := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.11")
+	server := net.ParseIP("203.0.113.5")
+
+	if app, _, _ := d.DetectByDNS(nil, alice, server, now); app != nil {
+		t.Fatal("detected without a cache")
+	}
+	c.Observe(alice, "api.tiktokv.com", server, time.Minute, now)
+
+	own, name, ownConf := d.DetectByDNS(c, alice, server, now)
+	if own == nil || own.Name != "tiktok" || name != "api.tiktokv.com" {
+		t.Fatalf("DetectByDNS = %v %q", own, name)
+	}
+	shared, _, sharedConf := d.DetectByDNS(c, bob, server, now)
+	if shared == nil || shared.Name != "tiktok" {
+		t.Fatalf("shared DetectByDNS = %v", shared)
+	}
+	hostConf := d.MatchHostname(name).Confidence
+	if ownConf != hostConf*DNSConfidence || sharedConf != hostConf*DNSSharedConfidence {
+		t.Fatalf("confidence own=%.2f shared=%.2f host=%.2f", ownConf, sharedConf, hostConf)
+	}
+
+	c.Observe(alice, "unknown.example", net.ParseIP("198.51.100.1"), time.Minute, now)
+	if app, name, _ := d.DetectByDNS(c, alice, net.ParseIP("198.51.100.1"), now); app != nil || name != "unknown.example" {
+		t.Fatalf("unknown name = %v %q", app, name)
+	}
+}
+
+func TestServer_DNS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "appid.sock")
+	s := NewServer(socket, NewFlowCache(10, time.Minute), NewDetector())
+	s.SetDNSCache(NewDNSCache(100))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+
+	res, err := c.Lookup("192.168.1.10", "203.0.113.5", 6, 50000, 8443)
+	if err != nil || res.Found {
+		t.Fatalf("Lookup before DNS = %+v, %v", res, err)
+	}
+	if err := c.ReportDNS(net.ParseIP("192.168.1.10"), "api.tiktokv.com", 300*time.Second, net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")); err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Lookup("192.168.1.10", "2001:db8::5", 17, 50000, 443)
+	if err != nil || !res.Found || res.AppName != "tiktok" || res.Confidence >= 1 {
+		t.Fatalf("Lookup after DNS = %+v, %v", res, err)
+	}
+
+	for _, cmd := range []string{"DNS 192.168.1.10 a.com", "DNS bad a.com 60 192.0.2.1", "DNS - a.com x 192.0.2.1"} {
+		if resp := s.handleCommand(cmd); !strings.HasPrefix(resp, "ERROR") {
+			t.Errorf("%q = %q", cmd, resp)
+		}
+	}
+	if resp := s.handleCommand("DNS - a.com 60 192.0.2.1 not-an-ip"); resp != "OK 1" {
+		t.Errorf("DNS without client = %q", resp)
+	}
+}
@@ -17,17 +17,30 @@ type FlowKey struct {
 	Protocol uint8 // 6=TCP, 17=UDP
 }
 
+// Sources an app can be identified from, reported by lookups.
+const (
+	SourceSNI         = "sni"         // TLS or QUIC SNI, HTTP Host seen on the flow
+	SourceDNS         = "dns"         // DNS answer the client received for the server
+	SourceIP          = "ip"          // signature IP ranges of the server
+	SourceFingerprint = "fingerprint" // JA3/JA4 TLS client fingerprint
+	SourceHostname    = "hostname"    // hostname given to LOOKUP_HOST
+)
+
 // FlowInfo contains information about a detected flow.
 type FlowInfo struct {
 	Key         FlowKey
 	AppName     string    // Detected application name (e.g., "netflix", "youtube")
 	AppCategory string    // Category (e.g., "streaming_media", "social_networking")
+	Hostname    string    // SNI, HTTP Host or DNS name the app was detected from
+	User        string    // zid-proxy user of the connection ("" = unknown)
 	Confidence  float32   // Detection confidence (0.0 to 1.0)
+	Source      string    // How the app was identified (Source*)
 	FirstSeen   time.Time // When the flow was first seen
 	LastSeen    time.Time // Last activity timestamp
 	BytesIn     uint64    // Bytes received
 	BytesOut    uint64    // Bytes sent
 	PacketCount uint64    // Total packets processed
+	Closed      bool      // Connection closed (reported by zid-proxy)
 }
 
 // FlowCache maintains a thread-safe cache of detected flows.
@@ -36,6 +49,7 @@ type FlowCache struct {
 	flows    map[FlowKey]*FlowInfo
 	maxFlows int
 	ttl      time.Duration
+	onEvict  func(*FlowInfo)
 }
 
 // NewFlowCache creates a new flow cache with the specified parameters.
@@ -47,6 +61,23 @@ func NewFlowCache(maxFlows int, ttl time.Duration) *FlowCache {
 	}
 }
 
+// SetEvictHandler sets a function called with each flow removed from the
+// cache (expired, evicted to make room, or flushed), e.g. to account its
+// usage. It runs with the cache locked and must not call the cache. It must
+// be set before the cache is used.
+func (c *FlowCache) SetEvictHandler(fn func(*FlowInfo)) {
+	c.onEvict = fn
+}
+
+// remove deletes a flow and passes it to the evict handler.
+// Must be called with lock held.
+func (c *FlowCache) remove(key FlowKey, flow *FlowInfo) {
+	delete(c.flows, key)
+	if c.onEvict != nil {
+		c.onEvict(flow)
+	}
+}
+
 // Get retrieves flow information by key.
 func (c *FlowCache) Get(key FlowKey) (*FlowInfo, bool) {
 	c.mu.RLock()
@@ -100,8 +131,91 @@ func (c *FlowCache) Update(key FlowKey, bytesIn, bytesOut uint64) {
 	}
 }
 
-// SetApp sets the detected application for a flow.
-func (c *FlowCache) SetApp(key FlowKey, appName, category string, confidence float32) {
+// Account adds a packet of n bytes to the flow of key, creating the flow at
+// its first packet. out tells whether the packet was sent by the flow's
+// source (BytesOut) or is a reply (BytesIn). Returns true if the flow is new.
+func (c *FlowCache) Account(key FlowKey, n uint64, out bool, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flow, ok := c.flows[key]
+	if !ok {
+		if len(c.flows) >= c.maxFlows {
+			c.evictOldest()
+		}
+		flow = &FlowInfo{Key: key, FirstSeen: now}
+		c.flows[key] = flow
+	}
+	flow.LastSeen = now
+	if out {
+		flow.BytesOut += n
+	} else {
+		flow.BytesIn += n
+	}
+	flow.PacketCount++
+	return !ok
+}
+
+// Register creates the flow of a connection reported by zid-proxy, or
+// updates its hostname and app if the flow is already known (e.g. from
+// captured packets). An empty appName registers a flow of an unknown app;
+// an empty user keeps the user known before.
+func (c *FlowCache) Register(key FlowKey, hostname, user, appName, category string, confidence float32, source string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flow, ok := c.flows[key]
+	if !ok {
+		if len(c.flows) >= c.maxFlows {
+			c.evictOldest()
+		}
+		flow = &FlowInfo{Key: key, FirstSeen: now}
+		c.flows[key] = flow
+	}
+	flow.LastSeen = now
+	flow.Hostname = hostname
+	if user != "" {
+		flow.User = user
+	}
+	if appName != "" {
+		flow.AppName = appName
+		flow.AppCategory = category
+		flow.Confidence = confidence
+		flow.Source = source
+	}
+}
+
+// SetBytes sets the byte counts of a flow to the totals reported by
+// zid-proxy and marks it closed after the final report. Returns false if the
+// flow is unknown (expired, or registered before a daemon restart).
+func (c *FlowCache) SetBytes(key FlowKey, bytesIn, bytesOut uint64, closed bool, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flow, ok := c.flows[key]
+	if !ok {
+		return false
+	}
+	flow.LastSeen = now
+	flow.BytesIn = bytesIn
+	flow.BytesOut = bytesOut
+	flow.Closed = flow.Closed || closed
+	return true
+}
+
+// SetHostname records the hostname seen on a flow.
+func (c *FlowCache) SetHostname(key FlowKey, hostname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if flow, ok := c.flows[key]; ok {
+		flow.Hostname = hostname
+	}
+}
+
+// SetApp sets the detected application for a flow and the source it was
+// identified from.
+func (c *FlowCache) SetApp(key FlowKey, appName, category string, confidence float32, source string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -109,6 +223,7 @@ func (c *FlowCache) SetApp(key FlowKey, appName, category string, confidence flo
 		flow.AppName = appName
 		flow.AppCategory = category
 		flow.Confidence = confidence
+		flow.Source = source
 	}
 }
 
@@ -119,24 +234,24 @@ func (c *FlowCache) evictOldest() {
 	now := time.Now()
 	for key, flow := range c.flows {
 		if now.Sub(flow.LastSeen) > c.ttl {
-			delete(c.flows, key)
+			c.remove(key, flow)
 		}
 	}
 
 	// If still over limit, remove oldest entries
 	if len(c.flows) >= c.maxFlows {
 		var oldestKey FlowKey
-		var oldestTime time.Time
+		var oldest *FlowInfo
 
 		for key, flow := range c.flows {
-			if oldestTime.IsZero() || flow.LastSeen.Before(oldestTime) {
+			if oldest == nil || flow.LastSeen.Before(oldest.LastSeen) {
 				oldestKey = key
-				oldestTime = flow.LastSeen
+				oldest = flow
 			}
 		}
 
-		if !oldestTime.IsZero() {
-			delete(c.flows, oldestKey)
+		if oldest != nil {
+			c.remove(oldestKey, oldest)
 		}
 	}
 }
@@ -149,7 +264,7 @@ func (c *FlowCache) GC(now time.Time) int {
 	removed := 0
 	for key, flow := range c.flows {
 		if now.Sub(flow.LastSeen) > c.ttl {
-			delete(c.flows, key)
+			c.remove(key, flow)
 			removed++
 		}
 	}
@@ -157,6 +272,33 @@ func (c *FlowCache) GC(now time.Time) int {
 	return removed
 }
 
+// Flush removes every flow, e.g. so the evict handler accounts the flows
+// still open at shutdown. It returns the number of flows removed.
+func (c *FlowCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.flows)
+	for key, flow := range c.flows {
+		c.remove(key, flow)
+	}
+	return n
+}
+
+// View calls fn with a copy of the flows while holding the cache, so no flow
+// leaves it (and reaches the evict handler) until fn returns. fn must not
+// call the cache.
+func (c *FlowCache) View(fn func(flows []FlowInfo)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	flows := make([]FlowInfo, 0, len(c.flows))
+	for _, flow := range c.flows {
+		flows = append(flows, *flow)
+	}
+	fn(flows)
+}
+
 // Stats returns statistics about the cache.
 func (c *FlowCache) Stats() map[string]interface{} {
 	c.mu.RLock()
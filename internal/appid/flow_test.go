@@ -0,0 +1,125 @@
+package appid
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cacheFlowHandler registers the reported flows in a FlowCache, as the SNI
+// mode of zid-appid does.
+type cacheFlowHandler struct {
+	cache    *FlowCache
+	detector *Detector
+}
+
+func (h cacheFlowHandler) RegisterFlow(key FlowKey, hostname, user string) (*AppDefinition, float32) {
+	app, confidence := h.detector.DetectByHostname(hostname)
+	if app == nil {
+		h.cache.Register(key, hostname, user, "", "", 0, "", time.Now())
+		return nil, 0
+	}
+	h.cache.Register(key, hostname, user, app.Name, string(app.Category), confidence, SourceSNI, time.Now())
+	return app, confidence
+}
+
+func (h cacheFlowHandler) UpdateFlow(key FlowKey, bytesIn, bytesOut uint64) bool {
+	return h.cache.SetBytes(key, bytesIn, bytesOut, false, time.Now())
+}
+
+func (h cacheFlowHandler) CloseFlow(key FlowKey, bytesIn, bytesOut uint64) bool {
+	return h.cache.SetBytes(key, bytesIn, bytesOut, true, time.Now())
+}
+
+func TestFlowCache_RegisterKeepsCounters(t *testing.T) {
+	c := NewFlowCache(10, time.Minute)
+	key := FlowKey{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: 50000, DstPort: 443, Protocol: 6}
+	now := time.Now()
+
+	if c.SetBytes(key, 1, 1, false, now) {
+		t.Fatal("SetBytes on an unknown flow")
+	}
+	c.Account(key, 500, true, now)
+	c.Register(key, "www.netflix.com", "alice", "netflix", "streaming_media", 0.95, SourceSNI, now)
+	f, _ := c.Get(key)
+	if f.BytesOut != 500 || f.AppName != "netflix" || f.Hostname != "www.netflix.com" || f.Source != SourceSNI {
+		t.Fatalf("flow = %+v", f)
+	}
+
+	// An unknown hostname does not erase the app or user found before
+	c.Register(key, "cdn.example.net", "", "", "", 0, "", now)
+	if f, _ := c.Get(key); f.AppName != "netflix" || f.Hostname != "cdn.example.net" || f.User != "alice" {
+		t.Fatalf("flow = %+v", f)
+	}
+
+	if !c.SetBytes(key, 7000, 900, true, now) {
+		t.Fatal("SetBytes on a known flow")
+	}
+	c.SetBytes(key, 7100, 900, false, now)
+	if f, _ := c.Get(key); f.BytesIn != 7100 || f.BytesOut != 900 || !f.Closed {
+		t.Fatalf("flow = %+v", f)
+	}
+}
+
+func TestServer_FlowCommands(t *testing.T) {
+	cache := NewFlowCache(10, time.Minute)
+
+	// Disabled without a handler
+	if resp := NewServer("", cache, NewDetector()).handleCommand("REGISTER_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 www.netflix.com"); resp != "ERROR flow registration disabled" {
+		t.Fatalf("without handler = %q", resp)
+	}
+
+	socket := filepath.Join(t.TempDir(), "appid.sock")
+	s := NewServer(socket, cache, NewDetector())
+	s.SetFlowHandler(cacheFlowHandler{cache: cache, detector: s.detector})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// Version 1
+	tests := []struct{ cmd, want string }{
+		{"REGISTER_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 www.netflix.com", "OK netflix 0.90"},
+		{"REGISTER_FLOW 192.168.1.10 198.51.100.8 TCP 50001 443 intranet.example", "UNKNOWN"},
+		{"UPDATE_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 1000 200", "OK"},
+		{"CLOSE_FLOW 192.168.1.10 198.51.100.8 TCP 50001 443 30 40", "OK"},
+		{"CLOSE_FLOW 192.168.1.10 198.51.100.9 TCP 50002 443 30 40", "UNKNOWN"},
+		{"REGISTER_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443", "ERROR usage: REGISTER_FLOW srcIP dstIP proto srcPort dstPort hostname [user]"},
+		{"UPDATE_FLOW 192.168.1.10 198.51.100.7 TCP 50000 99999 1 1", "ERROR invalid port"},
+		{"UPDATE_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 -1 1", "ERROR invalid byte count"},
+		{"LOOKUP 192.168.1.10 198.51.100.7 TCP 50000 443", "OK netflix 0.90"},
+	}
+	for _, tt := range tests {
+		if got := s.handleCommand(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	f, _ := cache.Get(FlowKey{SrcIP: "192.168.1.10", DstIP: "198.51.100.8", SrcPort: 50001, DstPort: 443, Protocol: 6})
+	if f.Hostname != "intranet.example" || f.AppName != "" || !f.Closed || f.BytesIn != 30 {
+		t.Fatalf("unknown app flow = %+v", f)
+	}
+
+	// Version 2, through the client
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+	key := FlowKey{SrcIP: "192.168.1.11", DstIP: "2001:db8::7", SrcPort: 40000, DstPort: 443, Protocol: 6}
+	res, err := c.RegisterFlow(key, "open.spotify.com", "bob")
+	if err != nil || res.AppName != "spotify" || res.Source != SourceSNI || res.Hostname != "open.spotify.com" {
+		t.Fatalf("RegisterFlow = %+v, %v", res, err)
+	}
+	if found, err := c.UpdateFlow(key, 5000, 100); err != nil || !found {
+		t.Fatalf("UpdateFlow = %v, %v", found, err)
+	}
+	if found, err := c.CloseFlow(key, 6000, 120); err != nil || !found {
+		t.Fatalf("CloseFlow = %v, %v", found, err)
+	}
+	if found, err := c.CloseFlow(FlowKey{SrcIP: "192.168.1.11", DstIP: "2001:db8::7", SrcPort: 1, DstPort: 443, Protocol: 6}, 1, 1); err != nil || found {
+		t.Fatalf("CloseFlow unknown = %v, %v", found, err)
+	}
+	if f, _ := cache.Get(key); f.BytesIn != 6000 || f.BytesOut != 120 || !f.Closed {
+		t.Fatalf("v2 flow = %+v", f)
+	}
+	if res, err := c.LookupIP("192.168.1.11"); err != nil || res.AppName != "spotify" {
+		t.Fatalf("LookupIP = %+v, %v", res, err)
+	}
+}
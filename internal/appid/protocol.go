@@ -0,0 +1,101 @@
+package appid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Socket protocol versions. Version 1 is the line-based text protocol
+// (LOOKUP ..., OK app 0.95). A client that sends "HELLO 2" and gets "OK 2"
+// back switches the connection to version 2: one JSON Request per line,
+// answered by one JSON Response per line carrying the same id. Requests may
+// be pipelined; their responses can come back in any order.
+const (
+	ProtocolV1      = 1
+	ProtocolV2      = 2
+	ProtocolVersion = ProtocolV2 // latest version spoken by this package
+)
+
+// Version 2 commands.
+const (
+	CmdPing         = "ping"
+	CmdLookup       = "lookup"        // flow: src_ip, dst_ip, proto, src_port, dst_port
+	CmdLookupIP     = "lookup_ip"     // latest flow of src_ip
+	CmdLookupHost   = "lookup_host"   // host
+	CmdDNS          = "dns"           // client, host, ttl, addrs
+	CmdRegisterFlow = "register_flow" // flow, host (SNI) and user of a proxied connection
+	CmdUpdateFlow   = "update_flow"   // flow, bytes_in, bytes_out (totals so far)
+	CmdCloseFlow    = "close_flow"    // flow, final bytes_in, bytes_out
+	CmdStats        = "stats"
+	CmdApps         = "apps"
+	CmdSignatures   = "signatures"
+	CmdUsage        = "usage" // from, to, identity, app
+)
+
+// Version 2 error codes.
+const (
+	ErrCodeBadRequest     = "bad_request"     // malformed JSON or arguments
+	ErrCodeUnknownCommand = "unknown_command" // cmd not supported by the daemon
+	ErrCodeUnavailable    = "unavailable"     // feature disabled in the daemon
+	ErrCodeInternal       = "internal"
+)
+
+// Request is a version 2 request. Only the fields of the command are set.
+type Request struct {
+	ID      uint64   `json:"id"`
+	Cmd     string   `json:"cmd"`
+	SrcIP   string   `json:"src_ip,omitempty"`
+	DstIP   string   `json:"dst_ip,omitempty"`
+	Proto   string   `json:"proto,omitempty"` // "tcp" (default) or "udp"
+	SrcPort uint16   `json:"src_port,omitempty"`
+	DstPort uint16   `json:"dst_port,omitempty"`
+	Host    string   `json:"host,omitempty"`
+	Client  string   `json:"client,omitempty"` // DNS client, "" if unknown
+	TTL     uint32   `json:"ttl,omitempty"`    // DNS answer TTL, seconds
+	Addrs   []string `json:"addrs,omitempty"`  // DNS answer addresses
+	User    string   `json:"user,omitempty"`   // register_flow: zid-proxy user
+
+	BytesIn  uint64 `json:"bytes_in,omitempty"`  // update_flow, close_flow
+	BytesOut uint64 `json:"bytes_out,omitempty"` // update_flow, close_flow
+
+	// usage: days (YYYY-MM-DD, inclusive) and filters; "" = any
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	App      string `json:"app,omitempty"`
+}
+
+// Response is a version 2 response: Result on success, Error otherwise.
+type Response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ProtocolError  `json:"error,omitempty"`
+}
+
+// ProtocolError is an error reported by the daemon.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("daemon error (%s): %s", e.Code, e.Message)
+}
+
+// IsUnavailable reports whether err is the daemon's answer to a command of
+// a feature it runs without (ErrCodeUnavailable).
+func IsUnavailable(err error) bool {
+	var pe *ProtocolError
+	return errors.As(err, &pe) && pe.Code == ErrCodeUnavailable
+}
+
+// FlowResult is the result of the update_flow and close_flow commands.
+type FlowResult struct {
+	Found bool `json:"found"` // false if the daemon does not know the flow
+}
+
+// DNSResult is the result of the dns command.
+type DNSResult struct {
+	Recorded int `json:"recorded"`
+}
@@ -0,0 +1,204 @@
+package appid
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server on a temporary socket.
+func startTestServer(t *testing.T, cache *FlowCache) (*Server, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "appid.sock")
+	s := NewServer(socket, cache, NewDetector())
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, socket
+}
+
+func TestClient_V2(t *testing.T) {
+	cache := NewFlowCache(10, time.Minute)
+	key := FlowKey{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: 50000, DstPort: 443, Protocol: 6}
+	cache.Account(key, 100, true, time.Now())
+	cache.SetHostname(key, "www.netflix.com")
+	cache.SetApp(key, "netflix", "streaming_media", 0.95, SourceSNI)
+
+	s, socket := startTestServer(t, cache)
+	defer s.Stop()
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+
+	if err := c.Ping(); err != nil || c.Version() != ProtocolV2 {
+		t.Fatalf("Ping = %v, version %d", err, c.Version())
+	}
+
+	res, err := c.Lookup(key.SrcIP, key.DstIP, 6, key.SrcPort, key.DstPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LookupResult{AppName: "netflix", Confidence: 0.95, Found: true, Category: "streaming_media",
+		DisplayName: "Netflix", Source: SourceSNI, Hostname: "www.netflix.com"}
+	if *res != want {
+		t.Fatalf("Lookup = %+v, want %+v", *res, want)
+	}
+
+	res, err = c.LookupHost("rr1.googlevideo.com")
+	if err != nil || res.AppName != "youtube" || res.Pattern != "googlevideo.com" || res.Source != SourceHostname || res.DisplayName != "YouTube" {
+		t.Fatalf("LookupHost = %+v, %v", res, err)
+	}
+	if res, err := c.LookupIP("192.168.1.99"); err != nil || res.Found {
+		t.Fatalf("LookupIP unknown = %+v, %v", res, err)
+	}
+
+	var perr *ProtocolError
+	if _, err := c.LookupIP("not-an-ip"); !errors.As(err, &perr) || perr.Code != ErrCodeBadRequest {
+		t.Fatalf("LookupIP invalid = %v", err)
+	}
+	if err := c.ReportDNS(nil, "a.com", time.Minute, net.ParseIP("192.0.2.1")); !errors.As(err, &perr) || perr.Code != ErrCodeUnavailable {
+		t.Fatalf("ReportDNS without cache = %v", err)
+	}
+
+	if stats, err := c.Stats(); err != nil || stats.FlowsTotal != 1 || stats.AppsDetected["netflix"] != 1 {
+		t.Fatalf("Stats = %+v, %v", stats, err)
+	}
+	if apps, err := c.Apps(); err != nil || len(apps) == 0 {
+		t.Fatalf("Apps = %v, %v", apps, err)
+	}
+
+	// Concurrent calls share the connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.LookupHost("www.netflix.com")
+			if err == nil && res.AppName != "netflix" {
+				err = fmt.Errorf("got %+v", res)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServer_V2Pipelining(t *testing.T) {
+	s, socket := startTestServer(t, NewFlowCache(10, time.Minute))
+	defer s.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Version 1 until the handshake
+	fmt.Fprintf(conn, "PING\nHELLO 3\n")
+	for _, want := range []string{"PONG", "OK 2"} {
+		if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != want {
+			t.Fatalf("got %q, %v; want %q", line, err, want)
+		}
+	}
+
+	fmt.Fprintf(conn, "%s\n%s\n%s\nnot json\n",
+		`{"id":1,"cmd":"lookup_host","host":"open.spotify.com"}`,
+		`{"id":2,"cmd":"frobnicate"}`,
+		`{"id":3,"cmd":"lookup","src_ip":"10.0.0.1","dst_ip":"10.0.0.2","proto":"sctp"}`)
+
+	responses := make(map[uint64]Response)
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("response %q: %v", line, err)
+		}
+		responses[resp.ID] = resp
+	}
+
+	var res LookupResult
+	if r := responses[1]; r.Error != nil || json.Unmarshal(r.Result, &res) != nil || res.AppName != "spotify" || res.Category != "streaming_media" {
+		t.Errorf("lookup_host = %+v (%s)", r, r.Result)
+	}
+	for id, code := range map[uint64]string{0: ErrCodeBadRequest, 2: ErrCodeUnknownCommand, 3: ErrCodeBadRequest} {
+		if r := responses[id]; r.Error == nil || r.Error.Code != code {
+			t.Errorf("response %d = %+v, want error %s", id, r, code)
+		}
+	}
+}
+
+func TestClient_FallbackV1(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A daemon predating version 2
+	socket := filepath.Join(dir, "appid.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.Fields(line)[0]; cmd {
+			case "LOOKUP_HOST":
+				fmt.Fprintf(conn, "OK netflix 0.95 netflix.com streaming_media\n")
+			case "STATS":
+				fmt.Fprintf(conn, "{\"flows_total\":3}\n")
+			default:
+				fmt.Fprintf(conn, "ERROR unknown command: %s\n", cmd)
+			}
+		}
+	}()
+
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+	res, err := c.LookupHost("www.netflix.com")
+	if err != nil || res.AppName != "netflix" || res.Category != "streaming_media" || res.Confidence != 0.95 {
+		t.Fatalf("LookupHost = %+v, %v", res, err)
+	}
+	if c.Version() != ProtocolV1 {
+		t.Fatalf("version = %d, want 1", c.Version())
+	}
+	if stats, err := c.Stats(); err != nil || stats.FlowsTotal != 3 {
+		t.Fatalf("Stats = %+v, %v", stats, err)
+	}
+}
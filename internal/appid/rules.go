@@ -7,21 +7,31 @@ import (
 	"os"
 	"strings"
 	"sync"
+
+	"github.com/guilherme/zid-proxy/internal/rules"
 )
 
 // RuleType represents the type of an AppID rule.
 type RuleType string
 
 const (
-	RuleAllowApp RuleType = "ALLOW_APP"
-	RuleBlockApp RuleType = "BLOCK_APP"
+	RuleAllowApp      RuleType = "ALLOW_APP"
+	RuleBlockApp      RuleType = "BLOCK_APP"
+	RuleAllowCategory RuleType = "ALLOW_CATEGORY"
+	RuleBlockCategory RuleType = "BLOCK_CATEGORY"
 )
 
-// AppRule represents a rule that matches group + application.
+// IsBlock reports whether the rule type blocks the connection.
+func (t RuleType) IsBlock() bool {
+	return t == RuleBlockApp || t == RuleBlockCategory
+}
+
+// AppRule represents a rule that matches group + application (or category).
 type AppRule struct {
-	Type      RuleType // ALLOW_APP or BLOCK_APP
+	Type      RuleType // ALLOW_APP, BLOCK_APP, ALLOW_CATEGORY or BLOCK_CATEGORY
 	GroupName string   // Group name (e.g., "acesso_restrito")
-	AppName   string   // App name (e.g., "netflix") or "*" for all
+	AppName   string   // App name (e.g., "netflix") or "*" for all (app rules)
+	Category  string   // App category (e.g., "games") (category rules)
 }
 
 // GroupMember represents an IP or CIDR that belongs to a group.
@@ -30,11 +40,24 @@ type GroupMember struct {
 	Network   *net.IPNet
 }
 
+// GroupMembers flattens the groups of the access rules into members, keeping
+// the file order so the first group containing an IP wins, as in
+// rules.RuleSet.Match.
+func GroupMembers(groups []rules.Group) []GroupMember {
+	var members []GroupMember
+	for _, g := range groups {
+		for _, network := range g.Members {
+			members = append(members, GroupMember{GroupName: g.Name, Network: network})
+		}
+	}
+	return members
+}
+
 // AppRuleSet contains the parsed AppID rules.
 type AppRuleSet struct {
 	mu       sync.RWMutex
 	rules    []AppRule
-	groups   map[string][]*net.IPNet // groupName -> list of member networks
+	groups   []GroupMember // ordered group membership (from access_rules.txt)
 	filePath string
 }
 
@@ -42,7 +65,7 @@ type AppRuleSet struct {
 func NewAppRuleSet(filePath string) *AppRuleSet {
 	return &AppRuleSet{
 		rules:    make([]AppRule, 0),
-		groups:   make(map[string][]*net.IPNet),
+		groups:   make([]GroupMember, 0),
 		filePath: filePath,
 	}
 }
@@ -81,7 +104,7 @@ func (rs *AppRuleSet) Load() error {
 			line = strings.TrimSpace(line[:idx])
 		}
 
-		// Parse rule: TYPE;GROUP;APP_NAME
+		// Parse rule: TYPE;GROUP;APP_NAME (or TYPE;GROUP;CATEGORY)
 		parts := strings.Split(line, ";")
 		if len(parts) != 3 {
 			return fmt.Errorf("invalid rule format at line %d: expected TYPE;GROUP;APP_NAME", lineNum)
@@ -91,8 +114,10 @@ func (rs *AppRuleSet) Load() error {
 		groupName := strings.TrimSpace(parts[1])
 		appName := strings.ToLower(strings.TrimSpace(parts[2]))
 
-		if ruleType != RuleAllowApp && ruleType != RuleBlockApp {
-			return fmt.Errorf("invalid rule type at line %d: %s (expected ALLOW_APP or BLOCK_APP)", lineNum, ruleType)
+		switch ruleType {
+		case RuleAllowApp, RuleBlockApp, RuleAllowCategory, RuleBlockCategory:
+		default:
+			return fmt.Errorf("invalid rule type at line %d: %s (expected ALLOW_APP, BLOCK_APP, ALLOW_CATEGORY or BLOCK_CATEGORY)", lineNum, ruleType)
 		}
 
 		if groupName == "" {
@@ -103,11 +128,16 @@ func (rs *AppRuleSet) Load() error {
 			return fmt.Errorf("empty app name at line %d", lineNum)
 		}
 
-		rs.rules = append(rs.rules, AppRule{
-			Type:      ruleType,
-			GroupName: groupName,
-			AppName:   appName,
-		})
+		rule := AppRule{Type: ruleType, GroupName: groupName}
+		if ruleType == RuleAllowCategory || ruleType == RuleBlockCategory {
+			if appName == "*" {
+				return fmt.Errorf("invalid category at line %d: use ALLOW_APP/BLOCK_APP with * for all apps", lineNum)
+			}
+			rule.Category = appName
+		} else {
+			rule.AppName = appName
+		}
+		rs.rules = append(rs.rules, rule)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -122,32 +152,65 @@ func (rs *AppRuleSet) Reload() error {
 	return rs.Load()
 }
 
-// SetGroups sets the group membership data (loaded from zid-proxy groups).
-func (rs *AppRuleSet) SetGroups(groups map[string][]*net.IPNet) {
+// SetGroups sets the group membership data (see GroupMembers). Members are
+// checked in order.
+func (rs *AppRuleSet) SetGroups(members []GroupMember) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
-	rs.groups = groups
+	rs.groups = members
 }
 
-// FindGroup returns the group name for a given source IP.
+// LoadGroups reads the group membership from the zid-proxy access rules file.
+func (rs *AppRuleSet) LoadGroups(accessRulesFile string) error {
+	ruleSet := rules.NewRuleSet(accessRulesFile)
+	if err := ruleSet.Load(); err != nil {
+		return err
+	}
+	rs.SetGroups(GroupMembers(ruleSet.Groups()))
+	return nil
+}
+
+// FindGroup returns the name of the first group containing srcIP.
 func (rs *AppRuleSet) FindGroup(srcIP net.IP) string {
 	rs.mu.RLock()
 	defer rs.mu.RUnlock()
 
-	for groupName, networks := range rs.groups {
-		for _, network := range networks {
-			if network.Contains(srcIP) {
-				return groupName
-			}
+	for _, member := range rs.groups {
+		if member.Network.Contains(srcIP) {
+			return member.GroupName
 		}
 	}
 	return ""
 }
 
+// GroupCount returns the number of distinct groups with members.
+func (rs *AppRuleSet) GroupCount() int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, member := range rs.groups {
+		seen[member.GroupName] = true
+	}
+	return len(seen)
+}
+
 // Match checks if there's a matching rule for the given group and app.
 // Returns: action (ALLOW/BLOCK), matched (bool)
 // Priority: ALLOW_APP > BLOCK_APP
 func (rs *AppRuleSet) Match(groupName, appName string) (RuleType, bool) {
+	return rs.MatchApp(groupName, appName, "")
+}
+
+// MatchApp checks the rules of the group for an app of the given category
+// ("" = unknown). The most specific rules decide:
+//
+//  1. rules naming the app (ALLOW_APP/BLOCK_APP;group;netflix)
+//  2. rules naming its category (ALLOW_CATEGORY/BLOCK_CATEGORY;group;streaming_media)
+//  3. wildcard app rules (ALLOW_APP/BLOCK_APP;group;*)
+//
+// Within a level, ALLOW has priority over BLOCK.
+func (rs *AppRuleSet) MatchApp(groupName, appName string, category AppCategory) (RuleType, bool) {
 	rs.mu.RLock()
 	defer rs.mu.RUnlock()
 
@@ -156,37 +219,65 @@ func (rs *AppRuleSet) Match(groupName, appName string) (RuleType, bool) {
 	}
 
 	appName = strings.ToLower(appName)
-	var hasAllow, hasBlock bool
+	var levels [3]struct{ allow, block bool }
 
 	for _, rule := range rs.rules {
 		if rule.GroupName != groupName {
 			continue
 		}
 
-		// Check if app matches (exact match or wildcard)
-		if rule.AppName != appName && rule.AppName != "*" {
+		var level int
+		switch {
+		case rule.Category != "":
+			if category == "" || rule.Category != string(category) {
+				continue
+			}
+			level = 1
+		case rule.AppName == appName:
+			level = 0
+		case rule.AppName == "*":
+			level = 2
+		default:
 			continue
 		}
 
-		switch rule.Type {
-		case RuleAllowApp:
-			hasAllow = true
-		case RuleBlockApp:
-			hasBlock = true
+		if rule.Type.IsBlock() {
+			levels[level].block = true
+		} else {
+			levels[level].allow = true
 		}
 	}
 
-	// ALLOW has priority over BLOCK
-	if hasAllow {
-		return RuleAllowApp, true
-	}
-	if hasBlock {
-		return RuleBlockApp, true
+	for i, l := range levels {
+		allow, block := RuleAllowApp, RuleBlockApp
+		if i == 1 {
+			allow, block = RuleAllowCategory, RuleBlockCategory
+		}
+		// ALLOW has priority over BLOCK
+		if l.allow {
+			return allow, true
+		}
+		if l.block {
+			return block, true
+		}
 	}
 
 	return "", false
 }
 
+// HasRules reports whether any rule applies to the given group.
+func (rs *AppRuleSet) HasRules(groupName string) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, rule := range rs.rules {
+		if rule.GroupName == groupName {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchForIP combines group lookup and rule matching.
 // Returns: action, matched, groupName
 func (rs *AppRuleSet) MatchForIP(srcIP net.IP, appName string) (RuleType, bool, string) {
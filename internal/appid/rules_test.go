@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/guilherme/zid-proxy/internal/rules"
 )
 
 func TestAppRuleSet_Load(t *testing.T) {
@@ -115,15 +117,74 @@ func TestAppRuleSet_Priority(t *testing.T) {
 	}
 }
 
+func TestAppRuleSet_MatchCategory(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "appid_rules.txt")
+	content := `BLOCK_CATEGORY;alunos;games
+BLOCK_CATEGORY;alunos;streaming_media
+ALLOW_APP;alunos;youtube
+ALLOW_CATEGORY;alunos;education
+BLOCK_APP;alunos;*
+`
+	if err := os.WriteFile(rulesFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs := NewAppRuleSet(rulesFile)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+	if rules := rs.ListRules(); rules[0].Category != "games" || rules[0].AppName != "" {
+		t.Fatalf("category rule parsed as %+v", rules[0])
+	}
+
+	tests := []struct {
+		app      string
+		category AppCategory
+		want     RuleType
+	}{
+		{"steam", CategoryGames, RuleBlockCategory},
+		{"netflix", CategoryStreamingMedia, RuleBlockCategory},
+		// App-specific rules beat category rules
+		{"youtube", CategoryStreamingMedia, RuleAllowApp},
+		// Category rules beat the wildcard
+		{"khan_academy", "education", RuleAllowCategory},
+		{"whatsapp", CategoryMessaging, RuleBlockApp},
+		{"steam", "", RuleBlockApp},
+	}
+	for _, tt := range tests {
+		got, matched := rs.MatchApp("alunos", tt.app, tt.category)
+		if !matched || got != tt.want {
+			t.Errorf("MatchApp(%s, %s) = %s, %v; want %s", tt.app, tt.category, got, matched, tt.want)
+		}
+	}
+	if _, matched := rs.MatchApp("professores", "steam", CategoryGames); matched {
+		t.Error("category rule matched another group")
+	}
+	if !RuleBlockCategory.IsBlock() || RuleAllowCategory.IsBlock() {
+		t.Error("IsBlock")
+	}
+}
+
+func TestAppRuleSet_LoadCategoryErrors(t *testing.T) {
+	for _, content := range []string{"BLOCK_CATEGORY;alunos;*\n", "DENY_CATEGORY;alunos;games\n"} {
+		rulesFile := filepath.Join(t.TempDir(), "appid_rules.txt")
+		if err := os.WriteFile(rulesFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewAppRuleSet(rulesFile).Load(); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
 func TestAppRuleSet_FindGroup(t *testing.T) {
 	rs := NewAppRuleSet("")
 
 	_, net1, _ := net.ParseCIDR("192.168.1.0/24")
 	_, net2, _ := net.ParseCIDR("10.0.0.0/8")
 
-	rs.SetGroups(map[string][]*net.IPNet{
-		"office":    {net1},
-		"datacenter": {net2},
+	rs.SetGroups([]GroupMember{
+		{GroupName: "office", Network: net1},
+		{GroupName: "datacenter", Network: net2},
 	})
 
 	tests := []struct {
@@ -152,8 +213,8 @@ func TestAppRuleSet_MatchForIP(t *testing.T) {
 	rs := NewAppRuleSet("")
 
 	_, net1, _ := net.ParseCIDR("192.168.1.0/24")
-	rs.SetGroups(map[string][]*net.IPNet{
-		"office": {net1},
+	rs.SetGroups([]GroupMember{
+		{GroupName: "office", Network: net1},
 	})
 
 	rs.rules = []AppRule{
@@ -181,3 +242,56 @@ func TestAppRuleSet_MatchForIP(t *testing.T) {
 		t.Errorf("expected empty group, got '%s'", groupName)
 	}
 }
+
+func TestAppRuleSet_HasRules(t *testing.T) {
+	rs := NewAppRuleSet("")
+	rs.rules = []AppRule{
+		{Type: RuleBlockApp, GroupName: "alunos", AppName: "tiktok"},
+	}
+
+	if !rs.HasRules("alunos") {
+		t.Error("expected rules for alunos")
+	}
+	if rs.HasRules("professores") {
+		t.Error("expected no rules for professores")
+	}
+}
+
+func TestAppRuleSet_LoadGroupsMatchesRuleSet(t *testing.T) {
+	// Overlapping groups: the first group containing the IP must win in both engines.
+	content := `GROUP;diretoria
+MEMBER;192.168.1.50
+GROUP;alunos
+MEMBER;192.168.1.0/24
+MEMBER;10.10.0.0/16
+GROUP;todos
+MEMBER;192.168.0.0/16
+MEMBER;10.0.0.0/8
+ALLOW;*
+`
+	path := filepath.Join(t.TempDir(), "access_rules.txt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ruleSet := rules.NewRuleSet(path)
+	if err := ruleSet.Load(); err != nil {
+		t.Fatal(err)
+	}
+	rs := NewAppRuleSet("")
+	if err := rs.LoadGroups(path); err != nil {
+		t.Fatalf("LoadGroups: %v", err)
+	}
+	if n := rs.GroupCount(); n != 3 {
+		t.Fatalf("GroupCount = %d, want 3", n)
+	}
+
+	for _, ip := range []string{"192.168.1.50", "192.168.1.51", "192.168.2.1", "10.10.5.5", "10.20.0.1", "172.16.0.1"} {
+		_, _, want := ruleSet.Match(net.ParseIP(ip), "example.com")
+		// Repeat: group selection must not depend on iteration order.
+		for i := 0; i < 20; i++ {
+			if got := rs.FindGroup(net.ParseIP(ip)); got != want {
+				t.Fatalf("FindGroup(%s) = %q, rules.RuleSet selected %q", ip, got, want)
+			}
+		}
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Server is the Unix socket server for the AppID daemon.
@@ -17,10 +19,24 @@ type Server struct {
 	listener   net.Listener
 	flowCache  *FlowCache
 	detector   *Detector
+	dns        *DNSCache
+	flows      FlowHandler
+	usage      *UsageStore
 	wg         sync.WaitGroup
 	quit       chan struct{}
 }
 
+// FlowHandler records the connections reported by zid-proxy with the
+// REGISTER_FLOW, UPDATE_FLOW and CLOSE_FLOW commands. The user is the
+// zid-proxy user of the connection ("" if unknown). Byte counts are the
+// totals of the connection so far; the Update and Close methods return
+// false for flows the handler does not know.
+type FlowHandler interface {
+	RegisterFlow(key FlowKey, hostname, user string) (*AppDefinition, float32)
+	UpdateFlow(key FlowKey, bytesIn, bytesOut uint64) bool
+	CloseFlow(key FlowKey, bytesIn, bytesOut uint64) bool
+}
+
 // NewServer creates a new AppID server.
 func NewServer(socketPath string, flowCache *FlowCache, detector *Detector) *Server {
 	return &Server{
@@ -31,6 +47,25 @@ func NewServer(socketPath string, flowCache *FlowCache, detector *Detector) *Ser
 	}
 }
 
+// SetDNSCache enables the DNS command and the classification of unknown
+// flows by the DNS answers their client received. It must be called before
+// Start.
+func (s *Server) SetDNSCache(dns *DNSCache) {
+	s.dns = dns
+}
+
+// SetFlowHandler enables the flow registration commands. It must be called
+// before Start.
+func (s *Server) SetFlowHandler(h FlowHandler) {
+	s.flows = h
+}
+
+// SetUsageStore enables the USAGE command, answered from usage. It must be
+// called before Start.
+func (s *Server) SetUsageStore(usage *UsageStore) {
+	s.usage = usage
+}
+
 // Start starts the Unix socket server.
 func (s *Server) Start() error {
 	// Remove existing socket if present
@@ -90,7 +125,8 @@ func (s *Server) acceptLoop() {
 	}
 }
 
-// handleConnection handles a client connection.
+// handleConnection handles a client connection. It speaks version 1 until
+// the client switches to version 2 with "HELLO 2".
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
 	defer conn.Close()
@@ -114,12 +150,210 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
+		if version, ok := parseHello(line); ok {
+			fmt.Fprintf(conn, "OK %d\n", version)
+			if version == ProtocolV2 {
+				s.serveV2(conn, reader)
+				return
+			}
+			continue
+		}
+
 		response := s.handleCommand(line)
 		fmt.Fprintf(conn, "%s\n", response)
 	}
 }
 
-// handleCommand processes a command and returns the response.
+// parseHello parses "HELLO version" and returns the version the server
+// will speak: the requested one, capped at ProtocolVersion.
+func parseHello(line string) (int, bool) {
+	parts := strings.Fields(line)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "HELLO") {
+		return 0, false
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || version < ProtocolV1 {
+		return ProtocolV1, true
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return version, true
+}
+
+// maxPipelined bounds the requests of a version 2 connection handled at
+// the same time; further requests wait to be read.
+const maxPipelined = 32
+
+// serveV2 handles the version 2 requests of a connection. Each request is
+// handled in its own goroutine, so a client can pipeline requests and match
+// the responses by id.
+func (s *Server) serveV2(conn net.Conn, reader *bufio.Reader) {
+	var (
+		writeMu  sync.Mutex
+		inflight sync.WaitGroup
+		slots    = make(chan struct{}, maxPipelined)
+	)
+	defer inflight.Wait()
+
+	write := func(resp *Response) {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			data, _ = json.Marshal(&Response{ID: resp.ID, Error: &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}})
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.Write(append(data, '\n'))
+	}
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return // Client disconnected
+		}
+
+		var req Request
+		if err := json.Unmarshal(line, &req); err != nil {
+			if len(strings.TrimSpace(string(line))) > 0 {
+				write(&Response{Error: &ProtocolError{Code: ErrCodeBadRequest, Message: "invalid JSON request"}})
+			}
+			continue
+		}
+
+		slots <- struct{}{}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			write(s.handleRequest(&req))
+		}()
+	}
+}
+
+// handleRequest processes a version 2 request.
+func (s *Server) handleRequest(req *Request) *Response {
+	resp := &Response{ID: req.ID}
+	fail := func(code, format string, args ...interface{}) *Response {
+		resp.Error = &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+		return resp
+	}
+
+	var result interface{}
+	switch strings.ToLower(req.Cmd) {
+	case CmdPing:
+		result = "pong"
+
+	case CmdLookup:
+		key, err := requestFlowKey(req)
+		if err != nil {
+			return fail(ErrCodeBadRequest, "%v", err)
+		}
+		result = s.lookupFlow(key)
+
+	case CmdLookupIP:
+		srcIP := net.ParseIP(req.SrcIP)
+		if srcIP == nil {
+			return fail(ErrCodeBadRequest, "invalid src_ip")
+		}
+		result = s.lookupIP(srcIP)
+
+	case CmdLookupHost:
+		if req.Host == "" {
+			return fail(ErrCodeBadRequest, "missing host")
+		}
+		result = s.lookupHost(req.Host)
+
+	case CmdDNS:
+		if s.dns == nil {
+			return fail(ErrCodeUnavailable, "DNS correlation disabled")
+		}
+		var client net.IP
+		if req.Client != "" {
+			if client = net.ParseIP(req.Client); client == nil {
+				return fail(ErrCodeBadRequest, "invalid client")
+			}
+		}
+		if req.Host == "" || len(req.Addrs) == 0 {
+			return fail(ErrCodeBadRequest, "missing host or addrs")
+		}
+		result = DNSResult{Recorded: s.recordDNS(client, req.Host, time.Duration(req.TTL)*time.Second, req.Addrs)}
+
+	case CmdRegisterFlow, CmdUpdateFlow, CmdCloseFlow:
+		if s.flows == nil {
+			return fail(ErrCodeUnavailable, "flow registration disabled")
+		}
+		key, err := requestFlowKey(req)
+		if err != nil {
+			return fail(ErrCodeBadRequest, "%v", err)
+		}
+		switch strings.ToLower(req.Cmd) {
+		case CmdRegisterFlow:
+			if req.Host == "" {
+				return fail(ErrCodeBadRequest, "missing host")
+			}
+			result = s.registerFlow(key, req.Host, req.User)
+		case CmdUpdateFlow:
+			result = FlowResult{Found: s.flows.UpdateFlow(key, req.BytesIn, req.BytesOut)}
+		default:
+			result = FlowResult{Found: s.flows.CloseFlow(key, req.BytesIn, req.BytesOut)}
+		}
+
+	case CmdUsage:
+		if s.usage == nil {
+			return fail(ErrCodeUnavailable, "usage reports disabled")
+		}
+		q := UsageQuery{From: req.From, To: req.To, Identity: req.Identity, App: req.App}
+		if err := checkUsageQuery(q); err != nil {
+			return fail(ErrCodeBadRequest, "%v", err)
+		}
+		result = s.usage.Query(q)
+
+	case CmdStats:
+		result = s.flowCache.Stats()
+
+	case CmdApps:
+		result = s.detector.ListAppNames()
+
+	case CmdSignatures:
+		version, apps := s.detector.SignaturesVersion()
+		result = SignaturesInfo{Format: SignatureFormat, Version: version, Apps: apps}
+
+	default:
+		return fail(ErrCodeUnknownCommand, "unknown command: %s", req.Cmd)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fail(ErrCodeInternal, "failed to marshal result: %v", err)
+	}
+	resp.Result = data
+	return resp
+}
+
+// requestFlowKey returns the flow of a version 2 lookup request.
+func requestFlowKey(req *Request) (FlowKey, error) {
+	key := FlowKey{SrcIP: req.SrcIP, DstIP: req.DstIP, SrcPort: req.SrcPort, DstPort: req.DstPort}
+	if net.ParseIP(req.SrcIP) == nil || net.ParseIP(req.DstIP) == nil {
+		return key, fmt.Errorf("invalid src_ip or dst_ip")
+	}
+	switch strings.ToLower(req.Proto) {
+	case "", "tcp":
+		key.Protocol = 6
+	case "udp":
+		key.Protocol = 17
+	default:
+		return key, fmt.Errorf("invalid proto: %s", req.Proto)
+	}
+	return key, nil
+}
+
+// handleCommand processes a version 1 command and returns the response.
 func (s *Server) handleCommand(cmd string) string {
 	parts := strings.Fields(cmd)
 	if len(parts) == 0 {
@@ -139,17 +373,112 @@ func (s *Server) handleCommand(cmd string) string {
 	case "LOOKUP_HOST":
 		return s.handleLookupHost(parts[1:])
 
+	case "DNS":
+		return s.handleDNS(parts[1:])
+
+	case "REGISTER_FLOW":
+		return s.handleRegisterFlow(parts[1:])
+
+	case "UPDATE_FLOW", "CLOSE_FLOW":
+		return s.handleFlowBytes(strings.ToUpper(parts[0]), parts[1:])
+
+	case "USAGE":
+		return s.handleUsage(parts[1:])
+
 	case "STATS":
 		return s.handleStats()
 
 	case "APPS":
 		return s.handleApps()
 
+	case "SIGNATURES":
+		return s.handleSignatures()
+
 	default:
 		return fmt.Sprintf("ERROR unknown command: %s", parts[0])
 	}
 }
 
+// appResult describes app in a lookup result.
+func (s *Server) appResult(name, category string, confidence float32, source string) LookupResult {
+	res := LookupResult{Found: true, AppName: name, Category: category, Confidence: confidence, Source: source}
+	if app := s.detector.GetApp(name); app != nil {
+		res.DisplayName = app.DisplayName
+		if res.Category == "" {
+			res.Category = string(app.Category)
+		}
+	}
+	return res
+}
+
+// lookupFlow returns the app of a flow. Flows without a known app (no SNI)
+// may still be named by the DNS answer that pointed the client at the server.
+func (s *Server) lookupFlow(key FlowKey) LookupResult {
+	if flow, found := s.flowCache.Get(key); found && flow.AppName != "" {
+		res := s.appResult(flow.AppName, flow.AppCategory, flow.Confidence, flow.Source)
+		res.Hostname = flow.Hostname
+		return res
+	}
+
+	app, name, confidence := s.detector.DetectByDNS(s.dns, net.ParseIP(key.SrcIP), net.ParseIP(key.DstIP), time.Now())
+	if app == nil {
+		return LookupResult{}
+	}
+	res := s.appResult(app.Name, string(app.Category), confidence, SourceDNS)
+	res.Hostname = name
+	return res
+}
+
+// lookupIP returns the app of the most recent flow of srcIP.
+func (s *Server) lookupIP(srcIP net.IP) LookupResult {
+	flow, found := s.flowCache.GetByIP(srcIP)
+	if !found || flow.AppName == "" {
+		return LookupResult{}
+	}
+	res := s.appResult(flow.AppName, flow.AppCategory, flow.Confidence, flow.Source)
+	res.Hostname = flow.Hostname
+	return res
+}
+
+// lookupHost returns the app of a hostname and the pattern that matched.
+func (s *Server) lookupHost(hostname string) LookupResult {
+	m := s.detector.MatchHostname(hostname)
+	if m.App == nil {
+		return LookupResult{}
+	}
+	res := s.appResult(m.App.Name, string(m.App.Category), m.Confidence, SourceHostname)
+	res.Pattern = m.Pattern
+	res.Hostname = hostname
+	return res
+}
+
+// registerFlow registers a proxied connection and returns its app.
+func (s *Server) registerFlow(key FlowKey, hostname, user string) LookupResult {
+	app, confidence := s.flows.RegisterFlow(key, hostname, user)
+	if app == nil {
+		return LookupResult{Hostname: hostname}
+	}
+	res := s.appResult(app.Name, string(app.Category), confidence, SourceSNI)
+	res.Hostname = hostname
+	return res
+}
+
+// recordDNS records the addresses a DNS answer for name gave client and
+// returns how many were valid. The DNS cache must be set.
+func (s *Server) recordDNS(client net.IP, name string, ttl time.Duration, addrs []string) int {
+	now := time.Now()
+	recorded := 0
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		s.dns.Observe(client, name, ip, ttl, now)
+		recorded++
+	}
+	return recorded
+}
+
 // handleLookup handles: LOOKUP srcIP dstIP proto srcPort dstPort
 func (s *Server) handleLookup(args []string) string {
 	if len(args) < 5 {
@@ -176,12 +505,112 @@ func (s *Server) handleLookup(args []string) string {
 		Protocol: protoNum,
 	}
 
-	flow, found := s.flowCache.Get(key)
-	if !found || flow.AppName == "" {
+	res := s.lookupFlow(key)
+	if !res.Found {
 		return "UNKNOWN"
 	}
 
-	return fmt.Sprintf("OK %s %.2f", flow.AppName, flow.Confidence)
+	return fmt.Sprintf("OK %s %.2f", res.AppName, res.Confidence)
+}
+
+// parseFlowKey parses the "srcIP dstIP proto srcPort dstPort" arguments of
+// the version 1 flow commands.
+func parseFlowKey(args []string) (FlowKey, error) {
+	req := &Request{SrcIP: args[0], DstIP: args[1], Proto: args[2]}
+	srcPort, err1 := strconv.ParseUint(args[3], 10, 16)
+	dstPort, err2 := strconv.ParseUint(args[4], 10, 16)
+	if err1 != nil || err2 != nil {
+		return FlowKey{}, fmt.Errorf("invalid port")
+	}
+	req.SrcPort, req.DstPort = uint16(srcPort), uint16(dstPort)
+	return requestFlowKey(req)
+}
+
+// handleRegisterFlow handles: REGISTER_FLOW srcIP dstIP proto srcPort dstPort hostname [user]
+// zid-proxy reports each relayed connection with its SNI and, when known,
+// its user; the answer is the app of the hostname, as for LOOKUP.
+func (s *Server) handleRegisterFlow(args []string) string {
+	if s.flows == nil {
+		return "ERROR flow registration disabled"
+	}
+	if len(args) < 6 {
+		return "ERROR usage: REGISTER_FLOW srcIP dstIP proto srcPort dstPort hostname [user]"
+	}
+	key, err := parseFlowKey(args)
+	if err != nil {
+		return fmt.Sprintf("ERROR %v", err)
+	}
+
+	user := ""
+	if len(args) > 6 {
+		user = args[6]
+	}
+	res := s.registerFlow(key, args[5], user)
+	if !res.Found {
+		return "UNKNOWN"
+	}
+	return fmt.Sprintf("OK %s %.2f", res.AppName, res.Confidence)
+}
+
+// handleFlowBytes handles:
+//
+//	UPDATE_FLOW srcIP dstIP proto srcPort dstPort bytesIn bytesOut
+//	CLOSE_FLOW srcIP dstIP proto srcPort dstPort bytesIn bytesOut
+//
+// with the byte totals of the connection; UNKNOWN if the flow is not known.
+func (s *Server) handleFlowBytes(cmd string, args []string) string {
+	if s.flows == nil {
+		return "ERROR flow registration disabled"
+	}
+	if len(args) < 7 {
+		return fmt.Sprintf("ERROR usage: %s srcIP dstIP proto srcPort dstPort bytesIn bytesOut", cmd)
+	}
+	key, err := parseFlowKey(args)
+	if err != nil {
+		return fmt.Sprintf("ERROR %v", err)
+	}
+	bytesIn, err1 := strconv.ParseUint(args[5], 10, 64)
+	bytesOut, err2 := strconv.ParseUint(args[6], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "ERROR invalid byte count"
+	}
+
+	var found bool
+	if cmd == "CLOSE_FLOW" {
+		found = s.flows.CloseFlow(key, bytesIn, bytesOut)
+	} else {
+		found = s.flows.UpdateFlow(key, bytesIn, bytesOut)
+	}
+	if !found {
+		return "UNKNOWN"
+	}
+	return "OK"
+}
+
+// handleDNS handles: DNS clientIP name ttl ip [ip...]
+// Resolver hooks report the A/AAAA answers they send; clientIP is "-" when
+// the asker is unknown and ttl is in seconds.
+func (s *Server) handleDNS(args []string) string {
+	if s.dns == nil {
+		return "ERROR DNS correlation disabled"
+	}
+	if len(args) < 4 {
+		return "ERROR usage: DNS clientIP name ttl ip [ip...]"
+	}
+
+	var client net.IP
+	if args[0] != "-" {
+		if client = net.ParseIP(args[0]); client == nil {
+			return "ERROR invalid client IP address"
+		}
+	}
+	ttl, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return "ERROR invalid TTL"
+	}
+
+	recorded := s.recordDNS(client, args[1], time.Duration(ttl)*time.Second, args[3:])
+	return fmt.Sprintf("OK %d", recorded)
 }
 
 // handleLookupIP handles: LOOKUP_IP srcIP
@@ -195,28 +624,65 @@ func (s *Server) handleLookupIP(args []string) string {
 		return "ERROR invalid IP address"
 	}
 
-	flow, found := s.flowCache.GetByIP(srcIP)
-	if !found || flow.AppName == "" {
+	res := s.lookupIP(srcIP)
+	if !res.Found {
 		return "UNKNOWN"
 	}
 
-	return fmt.Sprintf("OK %s %.2f", flow.AppName, flow.Confidence)
+	return fmt.Sprintf("OK %s %.2f", res.AppName, res.Confidence)
 }
 
 // handleLookupHost handles: LOOKUP_HOST hostname
 // This is used for SNI-based detection when full DPI isn't available.
+// The response also carries the hostname pattern that matched and the
+// category of the app.
 func (s *Server) handleLookupHost(args []string) string {
 	if len(args) < 1 {
 		return "ERROR usage: LOOKUP_HOST hostname"
 	}
 
-	hostname := args[0]
-	app, confidence := s.detector.DetectByHostname(hostname)
-	if app == nil {
+	res := s.lookupHost(args[0])
+	if !res.Found {
 		return "UNKNOWN"
 	}
 
-	return fmt.Sprintf("OK %s %.2f", app.Name, confidence)
+	return fmt.Sprintf("OK %s %.2f %s %s", res.AppName, res.Confidence, res.Pattern, res.Category)
+}
+
+// handleUsage handles: USAGE [from [to [identity [app]]]]
+// Days are YYYY-MM-DD (inclusive) and "-" matches any value. The answer is
+// the JSON array of the matching usage records.
+func (s *Server) handleUsage(args []string) string {
+	if s.usage == nil {
+		return "ERROR usage reports disabled"
+	}
+	if len(args) > 4 {
+		return "ERROR usage: USAGE [from [to [identity [app]]]]"
+	}
+	var fields [4]string
+	for i, a := range args {
+		if a != "-" {
+			fields[i] = a
+		}
+	}
+	q := UsageQuery{From: fields[0], To: fields[1], Identity: fields[2], App: fields[3]}
+	if err := checkUsageQuery(q); err != nil {
+		return fmt.Sprintf("ERROR %v", err)
+	}
+
+	data, err := json.Marshal(s.usage.Query(q))
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to marshal usage: %v", err)
+	}
+	return string(data)
+}
+
+// checkUsageQuery validates the days of a usage query.
+func checkUsageQuery(q UsageQuery) error {
+	if (q.From != "" && !ValidUsageDay(q.From)) || (q.To != "" && !ValidUsageDay(q.To)) {
+		return fmt.Errorf("invalid day (expected YYYY-MM-DD)")
+	}
+	return nil
 }
 
 // handleStats returns statistics.
@@ -238,3 +704,13 @@ func (s *Server) handleApps() string {
 	}
 	return string(data)
 }
+
+// handleSignatures returns the version of the signature database.
+func (s *Server) handleSignatures() string {
+	version, apps := s.detector.SignaturesVersion()
+	data, err := json.Marshal(SignaturesInfo{Format: SignatureFormat, Version: version, Apps: apps})
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to marshal signatures: %v", err)
+	}
+	return string(data)
+}
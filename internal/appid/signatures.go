@@ -0,0 +1,257 @@
+package appid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SignatureFormat is the signature file format understood by this build.
+const SignatureFormat = 1
+
+// SignatureFile is the external application signature database, shipped and
+// updated by the pfSense package independently of the binaries:
+//
+//	{
+//	  "format": 1,
+//	  "version": "2026.10.1",
+//	  "apps": [
+//	    {"name": "netflix", "display_name": "Netflix", "category": "streaming_media",
+//	     "hostnames": ["netflix.com", "*.nflxvideo.net"],
+//	     "ip_ranges": ["45.57.0.0/17"],
+//	     "ja3": [], "ja4": [], "alpn": ["h2"]}
+//	  ]
+//	}
+type SignatureFile struct {
+	Format  int         `json:"format"`
+	Version string      `json:"version"`
+	Apps    []Signature `json:"apps"`
+}
+
+// Signature is one application in the signature file.
+type Signature struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Category    string   `json:"category"`
+	Hostnames   []string `json:"hostnames"`
+	IPRanges    []string `json:"ip_ranges,omitempty"`
+	JA3         []string `json:"ja3,omitempty"`
+	JA4         []string `json:"ja4,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"`
+	// ASNs is only decoded to refuse it: there is no IP to ASN table, so
+	// autonomous systems must be listed as ip_ranges.
+	ASNs []any `json:"asns,omitempty"`
+}
+
+// ipRange maps a network from the signature database to an app.
+type ipRange struct {
+	network *net.IPNet
+	app     string
+}
+
+var (
+	appNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+	ja3Re     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Re     = regexp.MustCompile(`^[tqd][0-9a-z]{9}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// ParseSignatures decodes and validates a signature file.
+func ParseSignatures(data []byte) (SignatureFile, []AppDefinition, error) {
+	var f SignatureFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return SignatureFile{}, nil, err
+	}
+	if f.Format != SignatureFormat {
+		return SignatureFile{}, nil, fmt.Errorf("unsupported signature format %d (expected %d)", f.Format, SignatureFormat)
+	}
+	if strings.TrimSpace(f.Version) == "" {
+		return SignatureFile{}, nil, fmt.Errorf("signature file has no version")
+	}
+
+	apps := make([]AppDefinition, 0, len(f.Apps))
+	seen := make(map[string]bool)
+	for i, sig := range f.Apps {
+		app, err := sig.definition()
+		if err != nil {
+			return SignatureFile{}, nil, fmt.Errorf("app %d (%s): %w", i+1, sig.Name, err)
+		}
+		if seen[app.Name] {
+			return SignatureFile{}, nil, fmt.Errorf("duplicate app %s", app.Name)
+		}
+		seen[app.Name] = true
+		apps = append(apps, app)
+	}
+	return f, apps, nil
+}
+
+// definition validates sig and converts it to an AppDefinition.
+func (sig Signature) definition() (AppDefinition, error) {
+	app := AppDefinition{
+		Name:        strings.ToLower(strings.TrimSpace(sig.Name)),
+		DisplayName: strings.TrimSpace(sig.DisplayName),
+		Category:    AppCategory(strings.ToLower(strings.TrimSpace(sig.Category))),
+		ALPN:        sig.ALPN,
+	}
+	if !appNameRe.MatchString(app.Name) {
+		return AppDefinition{}, fmt.Errorf("invalid name %q", sig.Name)
+	}
+	if len(sig.ASNs) > 0 {
+		return AppDefinition{}, fmt.Errorf("asns are not supported; list the networks of the AS in ip_ranges")
+	}
+	if app.DisplayName == "" {
+		app.DisplayName = app.Name
+	}
+	if app.Category == "" {
+		app.Category = CategoryUnknown
+	}
+
+	for _, h := range sig.Hostnames {
+		// "*.example.com" and "example.com" both match the domain and its subdomains.
+		h = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(h)), "*.")
+		if h == "" || strings.ContainsAny(h, " */") {
+			return AppDefinition{}, fmt.Errorf("invalid hostname %q", h)
+		}
+		app.Hostnames = append(app.Hostnames, h)
+	}
+	for _, r := range sig.IPRanges {
+		network, err := parseNetwork(r)
+		if err != nil {
+			return AppDefinition{}, err
+		}
+		app.IPRanges = append(app.IPRanges, network)
+	}
+	for _, fp := range sig.JA3 {
+		fp = strings.ToLower(strings.TrimSpace(fp))
+		if !ja3Re.MatchString(fp) {
+			return AppDefinition{}, fmt.Errorf("invalid ja3 %q", fp)
+		}
+		app.JA3 = append(app.JA3, fp)
+	}
+	for _, fp := range sig.JA4 {
+		fp = strings.ToLower(strings.TrimSpace(fp))
+		if !ja4Re.MatchString(fp) {
+			return AppDefinition{}, fmt.Errorf("invalid ja4 %q", fp)
+		}
+		app.JA4 = append(app.JA4, fp)
+	}
+	if len(app.Hostnames) == 0 && len(app.IPRanges) == 0 && len(app.JA3) == 0 && len(app.JA4) == 0 {
+		return AppDefinition{}, fmt.Errorf("no hostnames, ip_ranges or fingerprints")
+	}
+	return app, nil
+}
+
+// parseNetwork parses a CIDR or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip range %q", s)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip range %q", s)
+	}
+	return network, nil
+}
+
+// LoadSignatures loads the signature file at path and merges it over the
+// built-in apps. A missing file leaves only the built-ins; an invalid one is
+// rejected and the current signatures are kept.
+func (d *Detector) LoadSignatures(path string) error {
+	// Remember the path first so a file fixed later is picked up on reload.
+	d.mu.Lock()
+	d.sigPath = path
+	d.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read signatures: %w", err)
+	}
+
+	var f SignatureFile
+	var apps []AppDefinition
+	if err == nil {
+		f, apps, err = ParseSignatures(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sigVersion = f.Version
+	d.signatures = apps
+	d.rebuild()
+	return nil
+}
+
+// ReloadSignatures reloads the signature file given to LoadSignatures.
+func (d *Detector) ReloadSignatures() error {
+	d.mu.RLock()
+	path := d.sigPath
+	d.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+	return d.LoadSignatures(path)
+}
+
+// SignaturesVersion returns the version of the loaded signature file and
+// the number of apps it defines ("" and 0 = built-ins only).
+func (d *Detector) SignaturesVersion() (string, int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.sigVersion, len(d.signatures)
+}
+
+// DetectByIP detects the application owning a destination IP.
+func (d *Detector) DetectByIP(ip net.IP) (*AppDefinition, float32) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, r := range d.ipIndex {
+		if r.network.Contains(ip) {
+			return d.apps[r.app], 0.7
+		}
+	}
+	return nil, 0
+}
+
+// DetectByFingerprint detects the application from a JA3 or JA4 TLS client
+// fingerprint.
+func (d *Detector) DetectByFingerprint(fingerprint string) (*AppDefinition, float32) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if name, ok := d.fingerprintIndex[strings.ToLower(fingerprint)]; ok {
+		return d.apps[name], 0.8
+	}
+	return nil, 0
+}
+
+// MatchesALPN reports whether the protocols offered by a client are
+// consistent with the ALPN hints of app: one of them is a hint, or either
+// list is empty.
+func (app *AppDefinition) MatchesALPN(offered ...string) bool {
+	if len(app.ALPN) == 0 || len(offered) == 0 {
+		return true
+	}
+	for _, p := range app.ALPN {
+		for _, o := range offered {
+			if strings.EqualFold(p, o) {
+				return true
+			}
+		}
+	}
+	return false
+}
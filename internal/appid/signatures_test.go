@@ -0,0 +1,180 @@
+package appid
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSignatures = `{
+  "format": 1,
+  "version": "2026.10.1",
+  "apps": [
+    {"name": "chatgpt", "display_name": "ChatGPT", "category": "business",
+     "hostnames": ["chatgpt.com", "*.oaiusercontent.com"], "alpn": ["h2"]},
+    {"name": "netflix", "display_name": "Netflix", "category": "streaming_media",
+     "hostnames": ["netflix.com"],
+     "ip_ranges": ["45.57.0.0/17", "45.57.1.1"],
+     "ja3": ["E7D705A3286E19EA42F587B344EE6865"]}
+  ]
+}`
+
+func writeSignatures(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appid_signatures.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetector_LoadSignatures(t *testing.T) {
+	d := NewDetector()
+	path := writeSignatures(t, testSignatures)
+	if err := d.LoadSignatures(path); err != nil {
+		t.Fatalf("LoadSignatures: %v", err)
+	}
+	if version, n := d.SignaturesVersion(); version != "2026.10.1" || n != 2 {
+		t.Fatalf("SignaturesVersion = %q, %d", version, n)
+	}
+
+	// New app from the file, wildcard pattern included
+	if app, _ := d.DetectByHostname("files.oaiusercontent.com"); app == nil || app.Name != "chatgpt" {
+		t.Fatalf("chatgpt not detected: %+v", app)
+	}
+	// The file replaces the built-in netflix: its other hostnames are gone
+	if app, _ := d.DetectByHostname("nflxvideo.net"); app != nil {
+		t.Fatalf("replaced built-in hostname still detected as %s", app.Name)
+	}
+	if app, _ := d.DetectByHostname("www.netflix.com"); app == nil || app.DisplayName != "Netflix" {
+		t.Fatalf("netflix not detected: %+v", app)
+	}
+	// Other built-ins stay
+	if app, _ := d.DetectByHostname("www.youtube.com"); app == nil || app.Name != "youtube" {
+		t.Fatal("built-in youtube lost after loading signatures")
+	}
+
+	if app, _ := d.DetectByIP(net.ParseIP("45.57.10.1")); app == nil || app.Name != "netflix" {
+		t.Fatal("netflix not detected by IP range")
+	}
+	if app, _ := d.DetectByIP(net.ParseIP("8.8.8.8")); app != nil {
+		t.Fatalf("8.8.8.8 detected as %s", app.Name)
+	}
+	if app, _ := d.DetectByFingerprint("e7d705a3286e19ea42f587b344ee6865"); app == nil || app.Name != "netflix" {
+		t.Fatal("netflix not detected by JA3")
+	}
+	if app := d.GetApp("chatgpt"); !app.MatchesALPN("h2") || !app.MatchesALPN("http/1.1", "h2") || app.MatchesALPN("http/1.1") || !app.MatchesALPN() {
+		t.Fatal("ALPN hints not applied")
+	}
+}
+
+func TestDetector_ReloadSignatures(t *testing.T) {
+	d := NewDetector()
+	d.AddCustomApp(&AppDefinition{Name: "intranet", Category: CategoryBusiness, Hostnames: []string{"intra.example"}})
+	path := writeSignatures(t, testSignatures)
+	if err := d.LoadSignatures(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid update is refused and the loaded signatures are kept
+	if err := os.WriteFile(path, []byte(`{"format": 1, "version": "2026.10.2", "apps": [{"name": "Bad Name", "hostnames": ["x.com"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReloadSignatures(); err == nil {
+		t.Fatal("expected invalid signatures to be refused")
+	}
+	if version, _ := d.SignaturesVersion(); version != "2026.10.1" {
+		t.Fatalf("version after failed reload = %q", version)
+	}
+
+	update := strings.Replace(testSignatures, `"2026.10.1"`, `"2026.10.2"`, 1)
+	update = strings.Replace(update, `"chatgpt.com"`, `"chatgpt.com", "openai.com"`, 1)
+	if err := os.WriteFile(path, []byte(update), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReloadSignatures(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if version, _ := d.SignaturesVersion(); version != "2026.10.2" {
+		t.Fatalf("version after reload = %q", version)
+	}
+	if app, _ := d.DetectByHostname("api.openai.com"); app == nil || app.Name != "chatgpt" {
+		t.Fatal("hostname added by the update not detected")
+	}
+	if app, _ := d.DetectByHostname("intra.example"); app == nil || app.Name != "intranet" {
+		t.Fatal("custom app lost on reload")
+	}
+
+	// Removing the file falls back to the built-ins
+	os.Remove(path)
+	if err := d.ReloadSignatures(); err != nil {
+		t.Fatalf("reload without file: %v", err)
+	}
+	if version, n := d.SignaturesVersion(); version != "" || n != 0 {
+		t.Fatalf("SignaturesVersion = %q, %d", version, n)
+	}
+	if app, _ := d.DetectByHostname("nflxvideo.net"); app == nil || app.Name != "netflix" {
+		t.Fatal("built-in netflix not restored")
+	}
+}
+
+func TestParseSignatures_Errors(t *testing.T) {
+	tests := map[string]string{
+		"format":      `{"format": 2, "version": "1", "apps": []}`,
+		"version":     `{"format": 1, "apps": []}`,
+		"duplicate":   `{"format": 1, "version": "1", "apps": [{"name": "a", "hostnames": ["a.com"]}, {"name": "a", "hostnames": ["b.com"]}]}`,
+		"no patterns": `{"format": 1, "version": "1", "apps": [{"name": "a"}]}`,
+		"ip range":    `{"format": 1, "version": "1", "apps": [{"name": "a", "ip_ranges": ["300.1.1.0/24"]}]}`,
+		"ja3":         `{"format": 1, "version": "1", "apps": [{"name": "a", "ja3": ["xyz"]}]}`,
+		"hostname":    `{"format": 1, "version": "1", "apps": [{"name": "a", "hostnames": ["a.com/path"]}]}`,
+		"asns":        `{"format": 1, "version": "1", "apps": [{"name": "a", "hostnames": ["a.com"], "asns": [2906]}]}`,
+	}
+	for name, doc := range tests {
+		if _, _, err := ParseSignatures([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestServer_Signatures(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDetector()
+	if err := d.LoadSignatures(writeSignatures(t, testSignatures)); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "appid.sock")
+	s := NewServer(socket, NewFlowCache(10, time.Minute), d)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+	info, err := c.Signatures()
+	if err != nil || info.Version != "2026.10.1" || info.Apps != 2 || info.Format != SignatureFormat {
+		t.Fatalf("Signatures = %+v, %v", info, err)
+	}
+	res, err := c.LookupHost("chatgpt.com")
+	if err != nil || res.AppName != "chatgpt" || res.Pattern != "chatgpt.com" || res.Category != "business" {
+		t.Fatalf("LookupHost = %+v, %v", res, err)
+	}
+}
+
+func TestShippedSignaturesParse(t *testing.T) {
+	data, err := os.ReadFile("../../pkg-zid-proxy/files/usr/local/share/zid-proxy/appid_signatures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseSignatures(data); err != nil {
+		t.Fatalf("shipped signatures: %v", err)
+	}
+}
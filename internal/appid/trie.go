@@ -0,0 +1,68 @@
+package appid
+
+import "strings"
+
+// hostnameTrie indexes hostname patterns by their labels from right to left
+// (com -> google -> mail), so a lookup walks at most one node per label of
+// the hostname and the deepest pattern found is the most specific suffix.
+type hostnameTrie struct {
+	root trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	app      string // app of the pattern ending here ("" = none)
+	pattern  string
+}
+
+// insert adds pattern for app. Inserting a pattern again replaces its app.
+func (t *hostnameTrie) insert(pattern, app string) {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if pattern == "" {
+		return
+	}
+
+	n := &t.root
+	labels := strings.Split(pattern, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	if n.app == "" {
+		t.size++
+	}
+	n.app = app
+	n.pattern = pattern
+}
+
+// lookup returns the app of the longest pattern equal to hostname or to one
+// of its parent domains, the pattern itself and whether it matched exactly.
+func (t *hostnameTrie) lookup(hostname string) (app, pattern string, exact bool) {
+	hostname = strings.TrimSuffix(hostname, ".")
+	n := &t.root
+	end := len(hostname)
+	for end > 0 {
+		start := strings.LastIndexByte(hostname[:end], '.') + 1
+		child, ok := n.children[hostname[start:end]]
+		if !ok {
+			break
+		}
+		n = child
+		if n.app != "" {
+			app, pattern, exact = n.app, n.pattern, start == 0
+		}
+		if start == 0 {
+			break
+		}
+		end = start - 1
+	}
+	return app, pattern, exact
+}
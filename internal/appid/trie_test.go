@@ -0,0 +1,111 @@
+package appid
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHostnameTrie_Lookup(t *testing.T) {
+	var tr hostnameTrie
+	tr.insert("example.com", "a")
+	tr.insert("api.example.com", "b")
+	tr.insert("Deep.API.example.com.", "c")
+
+	tests := []struct {
+		hostname, app, pattern string
+		exact                  bool
+	}{
+		{"example.com", "a", "example.com", true},
+		{"www.example.com", "a", "example.com", false},
+		{"api.example.com", "b", "api.example.com", true},
+		{"v2.api.example.com", "b", "api.example.com", false},
+		{"x.deep.api.example.com", "c", "deep.api.example.com", false},
+		{"example.com.", "a", "example.com", true},
+		{"notexample.com", "", "", false},
+		{"com", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		app, pattern, exact := tr.lookup(tt.hostname)
+		if app != tt.app || pattern != tt.pattern || exact != tt.exact {
+			t.Errorf("lookup(%q) = %q, %q, %v; want %q, %q, %v", tt.hostname, app, pattern, exact, tt.app, tt.pattern, tt.exact)
+		}
+	}
+	if tr.size != 3 {
+		t.Errorf("size = %d, want 3", tr.size)
+	}
+}
+
+func TestDetector_OverlappingApps(t *testing.T) {
+	tests := []struct {
+		hostname, app, pattern string
+	}{
+		// google_workspace (google.com) vs google_ads (adservice.google.com)
+		{"adservice.google.com", "google_ads", "adservice.google.com"},
+		{"eu.adservice.google.com", "google_ads", "adservice.google.com"},
+		{"mail.google.com", "google_workspace", "google.com"},
+		// youtube (googlevideo.com) never falls back to a shorter suffix
+		{"rr3---sn-abc.googlevideo.com", "youtube", "googlevideo.com"},
+		{"googleads.g.doubleclick.net", "google_ads", "googleads.g.doubleclick.net"},
+	}
+
+	// Each run builds the indexes again; the result must never change.
+	for run := 0; run < 20; run++ {
+		d := NewDetector()
+		for _, tt := range tests {
+			m := d.MatchHostname(tt.hostname)
+			if m.App == nil || m.App.Name != tt.app || m.Pattern != tt.pattern {
+				t.Fatalf("run %d: MatchHostname(%s) = %+v, want %s via %s", run, tt.hostname, m, tt.app, tt.pattern)
+			}
+		}
+	}
+}
+
+func TestDetector_SharedPatternGoesToLaterSource(t *testing.T) {
+	d := NewDetector()
+	d.AddCustomApp(&AppDefinition{Name: "yt_kids", Category: CategoryStreamingMedia, Hostnames: []string{"youtube.com"}})
+
+	for run := 0; run < 20; run++ {
+		if app, _ := d.DetectByHostname("m.youtube.com"); app == nil || app.Name != "yt_kids" {
+			t.Fatalf("custom app did not take the shared pattern: %+v", app)
+		}
+		// The built-in keeps its other patterns
+		if app, _ := d.DetectByHostname("i.ytimg.com"); app == nil || app.Name != "youtube" {
+			t.Fatalf("built-in lost its other patterns: %+v", app)
+		}
+	}
+}
+
+func benchmarkHostnames() []string {
+	return []string{
+		"www.netflix.com", // parent domain
+		"netflix.com",     // exact
+		"rr5---sn-ab5l6nzr.googlevideo.com",
+		"adservice.google.com",
+		"unknown.example.org", // miss
+	}
+}
+
+func BenchmarkDetectByHostname(b *testing.B) {
+	d := NewDetector()
+	hosts := benchmarkHostnames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.DetectByHostname(hosts[i%len(hosts)])
+	}
+}
+
+func BenchmarkDetectByHostname_LargeDB(b *testing.B) {
+	d := NewDetector()
+	for i := 0; i < 10000; i++ {
+		d.AddCustomApp(&AppDefinition{
+			Name:      fmt.Sprintf("app%d", i),
+			Hostnames: []string{fmt.Sprintf("app%d.example.net", i), fmt.Sprintf("cdn%d.example.org", i)},
+		})
+	}
+	hosts := benchmarkHostnames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.DetectByHostname(hosts[i%len(hosts)])
+	}
+}
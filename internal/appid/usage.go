@@ -0,0 +1,457 @@
+package appid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnknownApp is the app of the usage of flows no app was detected on.
+const UnknownApp = "unknown"
+
+// Usage store defaults.
+const (
+	DefaultUsageRetentionDays = 31
+	DefaultUsageMaxRecords    = 500000
+)
+
+// UsageDayFormat is the format of usage days (in the store's time zone).
+const UsageDayFormat = "2006-01-02"
+
+// UsageRecord is the usage of one app by one identity on one day.
+type UsageRecord struct {
+	Day      string `json:"day"`      // YYYY-MM-DD
+	Identity string `json:"identity"` // zid-proxy user, else client IP
+	App      string `json:"app"`
+	Category string `json:"category,omitempty"`
+	Seconds  uint64 `json:"seconds"`   // connection time, overlapping flows counted once
+	BytesIn  uint64 `json:"bytes_in"`  // download
+	BytesOut uint64 `json:"bytes_out"` // upload
+	Conns    uint64 `json:"conns"`
+}
+
+// UsageQuery selects usage records. Days are inclusive; "" matches any.
+type UsageQuery struct {
+	From     string
+	To       string
+	Identity string
+	App      string
+}
+
+// UsageOptions configures a UsageStore.
+type UsageOptions struct {
+	Location      *time.Location // day boundaries (nil = time.Local)
+	RetentionDays int            // days kept by GC (0 = DefaultUsageRetentionDays)
+	MaxRecords    int            // new records are dropped beyond (0 = DefaultUsageMaxRecords)
+}
+
+// usageKey identifies a record. The category is not part of it: an app has
+// one category, and a record keeps the first non-empty category of its flows,
+// so a signature update that moves an app does not split its day.
+type usageKey struct {
+	Day      string
+	Identity string
+	App      string
+}
+
+// usageSpan is an interval [Start, End) of connection time, in Unix seconds.
+type usageSpan struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// maxUsageSpans bounds the intervals kept per record; beyond it, the
+// earliest interval is no longer merged with new flows.
+const maxUsageSpans = 256
+
+// usageEntry is a record with the connection time intervals it is made of,
+// so concurrent flows of an identity and app count their shared time once.
+type usageEntry struct {
+	UsageRecord
+	spans []usageSpan // merged, sorted
+	extra uint64      // seconds not covered by spans (folded or loaded)
+}
+
+// addSpan merges sp into the intervals and updates Seconds. The intervals
+// are replaced, never modified in place, so copies of the entry can share
+// them.
+func (e *usageEntry) addSpan(sp usageSpan) {
+	if sp.End <= sp.Start {
+		return
+	}
+	spans := make([]usageSpan, 0, len(e.spans)+1)
+	i := 0
+	for ; i < len(e.spans) && e.spans[i].End < sp.Start; i++ {
+		spans = append(spans, e.spans[i])
+	}
+	for ; i < len(e.spans) && e.spans[i].Start <= sp.End; i++ {
+		sp.Start = min(sp.Start, e.spans[i].Start)
+		sp.End = max(sp.End, e.spans[i].End)
+	}
+	spans = append(spans, sp)
+	spans = append(spans, e.spans[i:]...)
+	if len(spans) > maxUsageSpans {
+		e.extra += uint64(spans[0].End - spans[0].Start)
+		spans = spans[1:]
+	}
+	e.spans = spans
+	e.updateSeconds()
+}
+
+func (e *usageEntry) updateSeconds() {
+	e.Seconds = e.extra
+	for _, sp := range e.spans {
+		e.Seconds += uint64(sp.End - sp.Start)
+	}
+}
+
+// usagePart is the share of a flow on one day.
+type usagePart struct {
+	day      string
+	span     usageSpan
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// UsageStore accumulates the connection time and bytes of each (identity,
+// app) in daily buckets. It is fed the flows leaving the FlowCache (see
+// FlowCache.SetEvictHandler), up to the flow TTL after their last packet;
+// Query adds the flows still in the cache (see SetLiveFlows). The time of
+// overlapping flows of an identity and app counts once, and a flow is split
+// at midnight, its bytes in proportion to its time on each day. A flow
+// counts as a connection on the day it started.
+type UsageStore struct {
+	mu      sync.Mutex
+	records map[usageKey]*usageEntry
+	opts    UsageOptions
+	dropped uint64
+	live    *FlowCache
+	loadErr error // the file failed to load and could not be moved aside
+
+	saveMu sync.Mutex // serializes Save
+}
+
+// NewUsageStore creates an empty UsageStore.
+func NewUsageStore(opts UsageOptions) *UsageStore {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.RetentionDays <= 0 {
+		opts.RetentionDays = DefaultUsageRetentionDays
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = DefaultUsageMaxRecords
+	}
+	return &UsageStore{
+		records: make(map[usageKey]*usageEntry),
+		opts:    opts,
+	}
+}
+
+// SetLiveFlows makes Query include the flows of cache that were not
+// recorded yet. cache must be the one whose evict handler feeds Record, and
+// SetLiveFlows must be called before the store is used.
+func (s *UsageStore) SetLiveFlows(cache *FlowCache) {
+	s.live = cache
+}
+
+// Day returns the usage day of t.
+func (s *UsageStore) Day(t time.Time) string {
+	return t.In(s.opts.Location).Format(UsageDayFormat)
+}
+
+// Record adds the usage of a flow. The identity is the flow's user, else its
+// source IP.
+func (s *UsageStore) Record(f *FlowInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.add(s.records, f, s.opts.MaxRecords) {
+		s.dropped++
+	}
+}
+
+// split returns the shares of f on each day it spans.
+func (s *UsageStore) split(f *FlowInfo) []usagePart {
+	start, end := f.FirstSeen.Unix(), f.LastSeen.Unix()
+	if end < start {
+		end = start
+	}
+
+	var parts []usagePart
+	for from := start; ; {
+		t := time.Unix(from, 0).In(s.opts.Location)
+		y, m, d := t.Date()
+		to := min(end, time.Date(y, m, d+1, 0, 0, 0, 0, s.opts.Location).Unix())
+		parts = append(parts, usagePart{day: t.Format(UsageDayFormat), span: usageSpan{Start: from, End: to}})
+		if to >= end {
+			break
+		}
+		from = to
+	}
+
+	// Bytes follow the time on each day; the last day gets the remainder
+	in, out := f.BytesIn, f.BytesOut
+	for i := range parts[:len(parts)-1] {
+		share := float64(parts[i].span.End-parts[i].span.Start) / float64(end-start)
+		parts[i].bytesIn = min(in, uint64(float64(f.BytesIn)*share))
+		parts[i].bytesOut = min(out, uint64(float64(f.BytesOut)*share))
+		in -= parts[i].bytesIn
+		out -= parts[i].bytesOut
+	}
+	parts[len(parts)-1].bytesIn = in
+	parts[len(parts)-1].bytesOut = out
+	return parts
+}
+
+// add charges f to records, creating at most maxRecords records (0 = no
+// limit). It returns false if a record was not created because of the limit.
+func (s *UsageStore) add(records map[usageKey]*usageEntry, f *FlowInfo, maxRecords int) bool {
+	identity := f.User
+	if identity == "" {
+		identity = f.Key.SrcIP
+	}
+	app := f.AppName
+	if app == "" {
+		app = UnknownApp
+	}
+
+	ok := true
+	for i, part := range s.split(f) {
+		k := usageKey{Day: part.day, Identity: identity, App: app}
+		e := records[k]
+		if e == nil {
+			if maxRecords > 0 && len(records) >= maxRecords {
+				ok = false
+				continue
+			}
+			e = &usageEntry{UsageRecord: UsageRecord{Day: k.Day, Identity: identity, App: app}}
+			records[k] = e
+		}
+		if e.Category == "" {
+			e.Category = f.AppCategory
+		}
+		e.addSpan(part.span)
+		e.BytesIn += part.bytesIn
+		e.BytesOut += part.bytesOut
+		if i == 0 {
+			e.Conns++
+		}
+	}
+	return ok
+}
+
+func (q UsageQuery) matches(k usageKey) bool {
+	return (q.From == "" || k.Day >= q.From) && (q.To == "" || k.Day <= q.To) &&
+		(q.Identity == "" || k.Identity == q.Identity) && (q.App == "" || k.App == q.App)
+}
+
+// Query returns the records matching q, ordered by day, identity and app,
+// including the flows not recorded yet.
+func (s *UsageStore) Query(q UsageQuery) []UsageRecord {
+	var records map[usageKey]*usageEntry
+	var live []FlowInfo
+	if s.live != nil {
+		// The cache is held so no flow is recorded between both copies
+		s.live.View(func(flows []FlowInfo) {
+			live = flows
+			records = s.copyRecords(q)
+		})
+	} else {
+		records = s.copyRecords(q)
+	}
+	for i := range live {
+		s.add(records, &live[i], 0)
+	}
+
+	out := make([]UsageRecord, 0, len(records))
+	for k, e := range records {
+		if q.matches(k) {
+			out = append(out, e.UsageRecord)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return usageLess(out[i], out[j]) })
+	return out
+}
+
+// copyRecords returns a copy of the records matching q.
+func (s *UsageStore) copyRecords(q UsageQuery) map[usageKey]*usageEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make(map[usageKey]*usageEntry)
+	for k, e := range s.records {
+		if q.matches(k) {
+			cp := *e
+			records[k] = &cp
+		}
+	}
+	return records
+}
+
+// usageLess orders records by day, identity and app.
+func usageLess(a, b UsageRecord) bool {
+	if a.Day != b.Day {
+		return a.Day < b.Day
+	}
+	if a.Identity != b.Identity {
+		return a.Identity < b.Identity
+	}
+	return a.App < b.App
+}
+
+// Len returns the number of records.
+func (s *UsageStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// Dropped returns the number of flows not recorded because MaxRecords was
+// reached.
+func (s *UsageStore) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// GC drops the days older than the retention and returns how many records
+// were removed.
+func (s *UsageStore) GC(now time.Time) int {
+	cutoff := s.Day(now.AddDate(0, 0, -(s.opts.RetentionDays - 1)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for k := range s.records {
+		if k.Day < cutoff {
+			delete(s.records, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// ValidUsageDay reports whether day is a YYYY-MM-DD date.
+func ValidUsageDay(day string) bool {
+	_, err := time.Parse(UsageDayFormat, day)
+	return err == nil
+}
+
+const usageFileVersion = 1
+
+type usageFile struct {
+	Version int               `json:"version"`
+	Records []usageFileRecord `json:"records"`
+}
+
+// usageFileRecord is a saved record with its connection time intervals.
+type usageFileRecord struct {
+	UsageRecord
+	Spans []usageSpan `json:"spans,omitempty"`
+}
+
+// Load restores the records saved by Save, adding them to the store.
+// A missing file is not an error. A file that cannot be decoded is renamed to
+// path.bad; if it cannot be read or renamed, Save refuses to write over it.
+func (s *UsageStore) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.loadErr = err
+		return err
+	}
+
+	var f usageFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return s.moveAside(path, err)
+	}
+	if f.Version != usageFileVersion {
+		return s.moveAside(path, fmt.Errorf("unsupported usage file version %d", f.Version))
+	}
+
+	for _, r := range f.Records {
+		if r.Identity == "" || r.App == "" || !ValidUsageDay(r.Day) {
+			continue
+		}
+		k := usageKey{Day: r.Day, Identity: r.Identity, App: r.App}
+		e := s.records[k]
+		if e == nil {
+			e = &usageEntry{UsageRecord: UsageRecord{Day: r.Day, Identity: r.Identity, App: r.App, Category: r.Category}}
+			s.records[k] = e
+		}
+		// Seconds not covered by the saved intervals cannot be merged
+		var covered uint64
+		for _, sp := range r.Spans {
+			if sp.End > sp.Start {
+				covered += uint64(sp.End - sp.Start)
+			}
+		}
+		if r.Seconds > covered {
+			e.extra += r.Seconds - covered
+		}
+		for _, sp := range r.Spans {
+			e.addSpan(sp)
+		}
+		e.updateSeconds()
+		e.BytesIn += r.BytesIn
+		e.BytesOut += r.BytesOut
+		e.Conns += r.Conns
+	}
+	return nil
+}
+
+// moveAside renames the file at path that failed to load with err, or keeps
+// Save from writing over it when it cannot be renamed. s.mu must be held.
+func (s *UsageStore) moveAside(path string, err error) error {
+	bad := path + ".bad"
+	if rerr := os.Rename(path, bad); rerr != nil {
+		s.loadErr = err
+		return err
+	}
+	return fmt.Errorf("%w (moved to %s)", err, bad)
+}
+
+// Save writes the recorded usage (without the flows still in the cache) to
+// path via a temp file + rename.
+func (s *UsageStore) Save(path string) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if s.loadErr != nil {
+		err := s.loadErr
+		s.mu.Unlock()
+		return fmt.Errorf("not saving over a usage file that failed to load: %w", err)
+	}
+	f := usageFile{Version: usageFileVersion, Records: make([]usageFileRecord, 0, len(s.records))}
+	for _, e := range s.records {
+		f.Records = append(f.Records, usageFileRecord{UsageRecord: e.UsageRecord, Spans: e.spans})
+	}
+	s.mu.Unlock()
+	sort.Slice(f.Records, func(i, j int) bool { return usageLess(f.Records[i].UsageRecord, f.Records[j].UsageRecord) })
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,229 @@
+package appid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	s := NewUsageStore(UsageOptions{Location: time.UTC, RetentionDays: 2})
+	day := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	flow := func(src, user, app string, start time.Time, secs int, in uint64) *FlowInfo {
+		return &FlowInfo{
+			Key:       FlowKey{SrcIP: src, DstIP: "198.51.100.7", SrcPort: 50000, DstPort: 443, Protocol: 6},
+			User:      user,
+			AppName:   app,
+			FirstSeen: start,
+			LastSeen:  start.Add(time.Duration(secs) * time.Second),
+			BytesIn:   in,
+			BytesOut:  in / 10,
+		}
+	}
+
+	yt := flow("192.168.1.10", "alice", "youtube", day, 600, 5000)
+	yt.AppCategory = "streaming_media"
+	s.Record(yt)
+	s.Record(flow("192.168.1.11", "alice", "youtube", day.Add(time.Hour), 120, 1000))
+	s.Record(flow("192.168.1.12", "", "", day, 30, 300))
+	s.Record(flow("192.168.1.10", "alice", "youtube", day.Add(-24*time.Hour), 60, 100))
+
+	got := s.Query(UsageQuery{From: "2026-10-19", To: "2026-10-19"})
+	want := []UsageRecord{
+		{Day: "2026-10-19", Identity: "192.168.1.12", App: UnknownApp, Seconds: 30, BytesIn: 300, BytesOut: 30, Conns: 1},
+		{Day: "2026-10-19", Identity: "alice", App: "youtube", Category: "streaming_media", Seconds: 720, BytesIn: 6000, BytesOut: 600, Conns: 2},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Query = %+v", got)
+	}
+	if got := s.Query(UsageQuery{Identity: "alice", App: "youtube"}); len(got) != 2 || got[0].Day != "2026-10-18" {
+		t.Fatalf("Query alice = %+v", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewUsageStore(UsageOptions{Location: time.UTC, RetentionDays: 2})
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 3 {
+		t.Fatalf("loaded %d records", loaded.Len())
+	}
+
+	// The day before yesterday is past the retention
+	if removed := loaded.GC(day.Add(24 * time.Hour)); removed != 1 || loaded.Len() != 2 {
+		t.Fatalf("GC removed %d, %d left", removed, loaded.Len())
+	}
+
+	full := NewUsageStore(UsageOptions{MaxRecords: 1})
+	full.Record(flow("192.168.1.10", "", "youtube", day, 1, 1))
+	full.Record(flow("192.168.1.11", "", "youtube", day, 1, 1))
+	if full.Len() != 1 || full.Dropped() != 1 {
+		t.Fatalf("full store: %d records, %d dropped", full.Len(), full.Dropped())
+	}
+}
+
+func TestUsageStore_CorruptFileMovedAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := os.WriteFile(path, []byte(`{"version":9,"records":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewUsageStore(UsageOptions{})
+	if err := s.Load(path); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+	now := time.Now()
+	s.Record(&FlowInfo{Key: FlowKey{SrcIP: "192.168.1.10"}, AppName: "youtube", FirstSeen: now, LastSeen: now.Add(time.Second)})
+	if err := s.Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if b, _ := os.ReadFile(path + ".bad"); string(b) != `{"version":9,"records":[]}` {
+		t.Fatalf("bad file not kept: %s", b)
+	}
+
+	// A file that cannot be read is never written over.
+	dir := filepath.Join(t.TempDir(), "usage.json")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s = NewUsageStore(UsageOptions{})
+	if err := s.Load(dir); err == nil {
+		t.Fatal("expected an error for a directory")
+	}
+	if err := s.Save(dir); err == nil {
+		t.Fatal("saved over a file that failed to load")
+	}
+}
+
+func TestUsageStore_OverlapsDaysAndLiveFlows(t *testing.T) {
+	s := NewUsageStore(UsageOptions{Location: time.UTC})
+	cache := NewFlowCache(10, time.Hour)
+	cache.SetEvictHandler(s.Record)
+	s.SetLiveFlows(cache)
+	key := func(port uint16) FlowKey {
+		return FlowKey{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: port, DstPort: 443, Protocol: 6}
+	}
+	add := func(port uint16, start time.Time, secs int, in uint64) {
+		cache.Set(&FlowInfo{Key: key(port), User: "alice", AppName: "youtube", FirstSeen: start,
+			LastSeen: start.Add(time.Duration(secs) * time.Second), BytesIn: in})
+	}
+	day := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	// Two concurrent connections count their shared 5 minutes once
+	add(1, day, 600, 1000)
+	add(2, day.Add(5*time.Minute), 600, 1000)
+	// One hour across midnight: half of it, and of its bytes, on each day
+	add(3, time.Date(2026, 10, 19, 23, 30, 0, 0, time.UTC), 3600, 4000)
+
+	check := func(label string) {
+		t.Helper()
+		got := s.Query(UsageQuery{Identity: "alice"})
+		want := []UsageRecord{
+			{Day: "2026-10-19", Identity: "alice", App: "youtube", Seconds: 900 + 1800, BytesIn: 4000, Conns: 3},
+			{Day: "2026-10-20", Identity: "alice", App: "youtube", Seconds: 1800, BytesIn: 2000},
+		}
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Fatalf("%s: Query = %+v", label, got)
+		}
+	}
+	check("live")
+	if s.Len() != 0 {
+		t.Fatalf("live flows recorded: %d records", s.Len())
+	}
+
+	cache.Flush()
+	check("recorded")
+
+	// The intervals are saved, so flows recorded after a restart still merge
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewUsageStore(UsageOptions{Location: time.UTC})
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Record(&FlowInfo{Key: key(4), User: "alice", AppName: "youtube", FirstSeen: day.Add(time.Minute), LastSeen: day.Add(2 * time.Minute)})
+	if got := loaded.Query(UsageQuery{From: "2026-10-19", To: "2026-10-19"}); len(got) != 1 || got[0].Seconds != 2700 || got[0].Conns != 4 {
+		t.Fatalf("loaded Query = %+v", got)
+	}
+}
+
+func TestFlowCache_EvictHandler(t *testing.T) {
+	c := NewFlowCache(2, time.Minute)
+	var evicted []FlowKey
+	c.SetEvictHandler(func(f *FlowInfo) { evicted = append(evicted, f.Key) })
+
+	now := time.Now()
+	keys := []FlowKey{
+		{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: 1, DstPort: 443, Protocol: 6},
+		{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: 2, DstPort: 443, Protocol: 6},
+		{SrcIP: "192.168.1.10", DstIP: "198.51.100.7", SrcPort: 3, DstPort: 443, Protocol: 6},
+	}
+	c.Account(keys[0], 1, true, now.Add(-time.Second))
+	c.Account(keys[1], 1, true, now)
+	c.Account(keys[2], 1, true, now) // evicts the oldest
+	if len(evicted) != 1 || evicted[0] != keys[0] {
+		t.Fatalf("evicted %v", evicted)
+	}
+	if removed := c.GC(now.Add(2 * time.Minute)); removed != 2 || len(evicted) != 3 {
+		t.Fatalf("GC removed %d, evicted %v", removed, evicted)
+	}
+
+	c.Account(keys[0], 1, true, now)
+	if n := c.Flush(); n != 1 || len(evicted) != 4 || len(c.List()) != 0 {
+		t.Fatalf("Flush = %d, evicted %v", n, evicted)
+	}
+}
+
+func TestServer_Usage(t *testing.T) {
+	cache := NewFlowCache(10, time.Minute)
+	if resp := NewServer("", cache, NewDetector()).handleCommand("USAGE"); resp != "ERROR usage reports disabled" {
+		t.Fatalf("without store = %q", resp)
+	}
+
+	usage := NewUsageStore(UsageOptions{})
+	cache.SetEvictHandler(usage.Record)
+	socket := filepath.Join(t.TempDir(), "appid.sock")
+	s := NewServer(socket, cache, NewDetector())
+	s.SetFlowHandler(cacheFlowHandler{cache: cache, detector: s.detector})
+	s.SetUsageStore(usage)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	s.handleCommand("REGISTER_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 www.youtube.com alice")
+	s.handleCommand("CLOSE_FLOW 192.168.1.10 198.51.100.7 TCP 50000 443 9000 100")
+	s.handleCommand("REGISTER_FLOW 192.168.1.11 198.51.100.8 TCP 50001 443 intranet.example")
+	cache.Flush()
+	today := usage.Day(time.Now())
+
+	tests := []struct{ cmd, want string }{
+		{"USAGE - - alice", `[{"day":"` + today + `","identity":"alice","app":"youtube","category":"streaming_media","seconds":0,"bytes_in":9000,"bytes_out":100,"conns":1}]`},
+		{"USAGE " + today + " " + today + " 192.168.1.11", `[{"day":"` + today + `","identity":"192.168.1.11","app":"unknown","seconds":0,"bytes_in":0,"bytes_out":0,"conns":1}]`},
+		{"USAGE 2000-01-01 2000-01-02", "[]"},
+		{"USAGE yesterday", "ERROR invalid day (expected YYYY-MM-DD)"},
+	}
+	for _, tt := range tests {
+		if got := s.handleCommand(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	// Version 2, through the client
+	c := NewClient(socket, time.Second)
+	defer c.Close()
+	records, err := c.Usage(UsageQuery{From: today, To: today, App: "youtube"})
+	if err != nil || len(records) != 1 || records[0].Identity != "alice" || records[0].BytesIn != 9000 {
+		t.Fatalf("Usage = %+v, %v", records, err)
+	}
+	var perr *ProtocolError
+	if _, err := c.Usage(UsageQuery{From: "19/10/2026"}); !errors.As(err, &perr) || perr.Code != ErrCodeBadRequest {
+		t.Fatalf("Usage invalid = %v", err)
+	}
+}
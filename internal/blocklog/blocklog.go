@@ -0,0 +1,128 @@
+// Package blocklog remembers the connections the proxy blocked recently, per
+// source IP, so zid-agent can tell its user why a site does not load.
+package blocklog
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// MaxPerIP is the number of blocks remembered per source IP.
+	MaxPerIP = 32
+	// DefaultMaxAge is how long a block is kept.
+	DefaultMaxAge = 10 * time.Minute
+	// CoalesceWindow merges repeated blocks of the same host and user (browser
+	// retries, several connections per page) into one entry.
+	CoalesceWindow = time.Minute
+)
+
+// Reasons for a block.
+const (
+	ReasonRule  = "rule"  // BLOCK rule or default policy
+	ReasonQuota = "quota" // group data quota used up
+	ReasonApp   = "app"   // BLOCK_APP or BLOCK_CATEGORY rule of the group
+)
+
+// Block is one blocked host as reported to agents.
+type Block struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Group    string    `json:"group,omitempty"`
+	Username string    `json:"username,omitempty"`
+	App      string    `json:"app,omitempty"`
+	Reason   string    `json:"reason"`
+	Count    int       `json:"count"`
+}
+
+// Log holds the recent blocks of every source IP.
+type Log struct {
+	mu     sync.Mutex
+	maxAge time.Duration
+	seq    uint64
+	ips    map[string][]Block
+}
+
+// New creates a Log keeping blocks for maxAge (<= 0 = DefaultMaxAge).
+func New(maxAge time.Duration) *Log {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Log{maxAge: maxAge, ips: make(map[string][]Block)}
+}
+
+// Record adds a block for srcIP. A repeat of a block of the same host and user
+// within CoalesceWindow only bumps its count and time, keeping its sequence
+// number so agents do not notify it twice.
+func (l *Log) Record(srcIP string, b Block) {
+	if srcIP == "" || b.Hostname == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	blocks := l.ips[srcIP]
+	for i := len(blocks) - 1; i >= 0; i-- {
+		prev := &blocks[i]
+		if prev.Hostname == b.Hostname && prev.Username == b.Username && b.Time.Sub(prev.Time) < CoalesceWindow {
+			prev.Count++
+			prev.Time = b.Time
+			prev.Group = b.Group
+			prev.App = b.App
+			prev.Reason = b.Reason
+			return
+		}
+	}
+
+	l.seq++
+	b.Seq = l.seq
+	b.Count = 1
+	blocks = append(blocks, b)
+	if len(blocks) > MaxPerIP {
+		blocks = append(blocks[:0:0], blocks[len(blocks)-MaxPerIP:]...)
+	}
+	l.ips[srcIP] = blocks
+}
+
+// Since returns the blocks of srcIP with a sequence number above after, oldest
+// first, and the highest sequence number handed out so far (to send back as
+// the next after). A non-empty username skips blocks of other users sharing
+// the IP; blocks without a user are returned to everyone.
+func (l *Log) Since(srcIP, username string, after uint64, now time.Time) ([]Block, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []Block
+	for _, b := range l.ips[srcIP] {
+		if b.Seq <= after || now.Sub(b.Time) > l.maxAge {
+			continue
+		}
+		if username != "" && b.Username != "" && b.Username != username {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, l.seq
+}
+
+// GC drops blocks older than the maximum age.
+func (l *Log) GC(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, blocks := range l.ips {
+		kept := blocks[:0]
+		for _, b := range blocks {
+			if now.Sub(b.Time) <= l.maxAge {
+				kept = append(kept, b)
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.ips, ip)
+			continue
+		}
+		l.ips[ip] = kept
+	}
+}
@@ -0,0 +1,64 @@
+package blocklog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLog_SinceAndCoalesce(t *testing.T) {
+	l := New(0)
+	now := time.Unix(1700000000, 0)
+
+	l.Record("10.0.0.5", Block{Time: now, Hostname: "www.tiktok.com", Group: "alunos", Username: "joao", Reason: ReasonRule})
+	l.Record("10.0.0.5", Block{Time: now.Add(10 * time.Second), Hostname: "www.tiktok.com", Group: "alunos", Username: "joao", Reason: ReasonRule})
+	l.Record("10.0.0.6", Block{Time: now, Hostname: "youtube.com", Reason: ReasonQuota})
+
+	blocks, seq := l.Since("10.0.0.5", "", 0, now.Add(time.Minute))
+	if len(blocks) != 1 || blocks[0].Count != 2 || blocks[0].Seq != 1 || seq != 2 {
+		t.Fatalf("blocks=%+v seq=%d", blocks, seq)
+	}
+	if blocks, _ := l.Since("10.0.0.5", "", blocks[0].Seq, now.Add(time.Minute)); len(blocks) != 0 {
+		t.Fatalf("after seq: %+v", blocks)
+	}
+
+	// Outside the coalesce window the block is new again
+	l.Record("10.0.0.5", Block{Time: now.Add(2 * time.Minute), Hostname: "www.tiktok.com", Username: "joao", Reason: ReasonRule})
+	if blocks, seq := l.Since("10.0.0.5", "", 1, now.Add(2*time.Minute)); len(blocks) != 1 || blocks[0].Seq != 3 || seq != 3 {
+		t.Fatalf("repeat: %+v seq=%d", blocks, seq)
+	}
+}
+
+func TestLog_SinceFiltersUserAndAge(t *testing.T) {
+	l := New(5 * time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	l.Record("10.0.0.5", Block{Time: now, Hostname: "a.com", Username: "alice"})
+	l.Record("10.0.0.5", Block{Time: now, Hostname: "b.com", Username: "bob"})
+	l.Record("10.0.0.5", Block{Time: now, Hostname: "c.com"})
+
+	blocks, _ := l.Since("10.0.0.5", "alice", 0, now)
+	if len(blocks) != 2 || blocks[0].Hostname != "a.com" || blocks[1].Hostname != "c.com" {
+		t.Fatalf("alice: %+v", blocks)
+	}
+	if blocks, _ := l.Since("10.0.0.5", "", 0, now.Add(6*time.Minute)); len(blocks) != 0 {
+		t.Fatalf("expired: %+v", blocks)
+	}
+
+	l.GC(now.Add(6 * time.Minute))
+	if len(l.ips) != 0 {
+		t.Fatalf("gc left %d IPs", len(l.ips))
+	}
+}
+
+func TestLog_CapsPerIP(t *testing.T) {
+	l := New(0)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < MaxPerIP+8; i++ {
+		l.Record("10.0.0.5", Block{Time: now, Hostname: fmt.Sprintf("h%d.com", i)})
+	}
+	blocks, _ := l.Since("10.0.0.5", "", 0, now)
+	if len(blocks) != MaxPerIP || blocks[0].Hostname != "h8.com" {
+		t.Fatalf("len=%d first=%+v", len(blocks), blocks[0])
+	}
+}
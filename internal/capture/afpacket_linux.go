@@ -0,0 +1,74 @@
+//go:build linux
+
+package capture
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// afPacket captures from a Linux AF_PACKET socket bound to one interface.
+type afPacket struct {
+	fd  int
+	buf []byte
+}
+
+// OpenLive opens the interface for capture in promiscuous mode, so mirrored
+// (SPAN) traffic is seen too.
+func OpenLive(iface string) (Source, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("AF_PACKET socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bind %s: %w", iface, err)
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("promiscuous mode on %s: %w", iface, err)
+	}
+	// Wake up every second so the reader can notice cancellation
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &afPacket{fd: fd, buf: make([]byte, snapLen)}, nil
+}
+
+// ReadPacket implements Source.
+func (s *afPacket) ReadPacket() ([]byte, time.Time, error) {
+	n, _, err := unix.Recvfrom(s.fd, s.buf, 0)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return nil, time.Time{}, ErrTimeout
+		}
+		return nil, time.Time{}, err
+	}
+	return s.buf[:n], time.Now(), nil
+}
+
+// LinkType implements Source.
+func (s *afPacket) LinkType() LinkType {
+	return LinkTypeEthernet
+}
+
+// Close implements Source.
+func (s *afPacket) Close() error {
+	return unix.Close(s.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,139 @@
+//go:build freebsd
+
+package capture
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfBufLen is the BPF buffer size requested from the kernel.
+const bpfBufLen = 1 << 20
+
+// bpfDevice captures from a FreeBSD BPF device (/dev/bpf) attached to one
+// interface. A read returns a buffer of packets, each behind a bpf_hdr.
+type bpfDevice struct {
+	fd       int
+	linkType LinkType
+	buf      []byte
+	pending  []byte // packets of the last read not returned yet
+}
+
+// OpenLive opens the interface for capture in promiscuous mode, so mirrored
+// (SPAN) traffic is seen too.
+func OpenLive(iface string) (Source, error) {
+	fd, err := unix.Open("/dev/bpf", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/bpf: %w", err)
+	}
+	s := &bpfDevice{fd: fd}
+	if err := s.setup(iface); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *bpfDevice) setup(iface string) error {
+	// The buffer size must be set before attaching the interface
+	if err := unix.IoctlSetPointerInt(s.fd, unix.BIOCSBLEN, bpfBufLen); err != nil {
+		return fmt.Errorf("BIOCSBLEN: %w", err)
+	}
+
+	var ifr [unix.IFNAMSIZ + 16]byte // struct ifreq
+	if len(iface) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name too long: %s", iface)
+	}
+	copy(ifr[:], iface)
+	if err := ioctl(s.fd, unix.BIOCSETIF, unsafe.Pointer(&ifr[0])); err != nil {
+		return fmt.Errorf("attach %s: %w", iface, err)
+	}
+	if err := unix.IoctlSetPointerInt(s.fd, unix.BIOCIMMEDIATE, 1); err != nil {
+		return fmt.Errorf("BIOCIMMEDIATE: %w", err)
+	}
+	if err := ioctl(s.fd, unix.BIOCPROMISC, nil); err != nil {
+		return fmt.Errorf("promiscuous mode on %s: %w", iface, err)
+	}
+	// Wake up every second so the reader can notice cancellation
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := ioctl(s.fd, unix.BIOCSRTIMEOUT, unsafe.Pointer(&tv)); err != nil {
+		return fmt.Errorf("BIOCSRTIMEOUT: %w", err)
+	}
+
+	dlt, err := unix.IoctlGetInt(s.fd, unix.BIOCGDLT)
+	if err != nil {
+		return fmt.Errorf("BIOCGDLT: %w", err)
+	}
+	s.linkType = LinkType(dlt)
+	if s.linkType == 12 { // DLT_RAW on BSD
+		s.linkType = LinkTypeRaw
+	}
+
+	n, err := unix.IoctlGetInt(s.fd, unix.BIOCGBLEN)
+	if err != nil {
+		return fmt.Errorf("BIOCGBLEN: %w", err)
+	}
+	s.buf = make([]byte, n)
+	return nil
+}
+
+// ReadPacket implements Source.
+func (s *bpfDevice) ReadPacket() ([]byte, time.Time, error) {
+	for len(s.pending) == 0 {
+		n, err := unix.Read(s.fd, s.buf)
+		if err != nil {
+			if err == unix.EINTR || err == unix.EAGAIN {
+				return nil, time.Time{}, ErrTimeout
+			}
+			return nil, time.Time{}, err
+		}
+		if n == 0 {
+			return nil, time.Time{}, ErrTimeout
+		}
+		s.pending = s.buf[:n]
+	}
+
+	if len(s.pending) < unix.SizeofBpfHdr {
+		s.pending = nil
+		return nil, time.Time{}, ErrTimeout
+	}
+	hdr := (*unix.BpfHdr)(unsafe.Pointer(&s.pending[0]))
+	start := int(hdr.Hdrlen)
+	end := start + int(hdr.Caplen)
+	if end > len(s.pending) {
+		s.pending = nil
+		return nil, time.Time{}, ErrTimeout
+	}
+	data := s.pending[start:end]
+	ts := time.Unix(int64(hdr.Tstamp.Sec), int64(hdr.Tstamp.Usec)*1000)
+
+	// Records are aligned to the size of a long
+	next := (end + int(unsafe.Sizeof(uintptr(0))) - 1) &^ (int(unsafe.Sizeof(uintptr(0))) - 1)
+	if next >= len(s.pending) {
+		s.pending = nil
+	} else {
+		s.pending = s.pending[next:]
+	}
+	return data, ts, nil
+}
+
+// LinkType implements Source.
+func (s *bpfDevice) LinkType() LinkType {
+	return s.linkType
+}
+
+// Close implements Source.
+func (s *bpfDevice) Close() error {
+	return unix.Close(s.fd)
+}
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
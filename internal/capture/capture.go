@@ -0,0 +1,41 @@
+// Package capture reads packets from a live interface (AF_PACKET on Linux,
+// BPF on FreeBSD) or from a pcap file, and tracks the TCP/UDP flows they
+// belong to in the AppID flow cache. Payload inspection (TLS SNI, HTTP Host,
+// QUIC SNI and DNS answers) names the application of each flow.
+package capture
+
+import (
+	"errors"
+	"time"
+)
+
+// LinkType is the link-layer header type of captured packets, using the
+// pcap LINKTYPE_* values.
+type LinkType uint32
+
+const (
+	LinkTypeNull     LinkType = 0   // BSD loopback: 4-byte address family
+	LinkTypeEthernet LinkType = 1   // Ethernet II, optionally 802.1Q tagged
+	LinkTypeRaw      LinkType = 101 // raw IPv4/IPv6
+	LinkTypeLinuxSLL LinkType = 113 // Linux "cooked" capture
+)
+
+// ErrUnsupported is returned for live capture on platforms without a backend.
+var ErrUnsupported = errors.New("live capture not supported on this platform")
+
+// Source delivers captured packets.
+type Source interface {
+	// ReadPacket returns the next packet and its capture time. The data is
+	// only valid until the next call. io.EOF ends an offline capture; live
+	// sources return ErrTimeout when no packet arrived within their poll
+	// interval, so callers can check for cancellation.
+	ReadPacket() (data []byte, ts time.Time, err error)
+	LinkType() LinkType
+	Close() error
+}
+
+// ErrTimeout is returned by live sources when no packet arrived in time.
+var ErrTimeout = errors.New("capture read timeout")
+
+// snapLen is the largest packet read from live sources.
+const snapLen = 65535
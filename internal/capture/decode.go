@@ -0,0 +1,223 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IP protocol numbers.
+const (
+	ProtoTCP uint8 = 6
+	ProtoUDP uint8 = 17
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+var (
+	// ErrNotIP is returned for frames that carry no IPv4/IPv6 packet (ARP, ...).
+	ErrNotIP = errors.New("not an IP packet")
+	// ErrNotTCPUDP is returned for IP packets other than TCP and UDP.
+	ErrNotTCPUDP = errors.New("not a TCP or UDP packet")
+	// ErrFragment is returned for IP fragments after the first one.
+	ErrFragment = errors.New("IP fragment")
+	// ErrTruncated is returned when a header is cut short.
+	ErrTruncated = errors.New("truncated packet")
+)
+
+// Packet is a decoded TCP or UDP packet.
+type Packet struct {
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	TCPFlags uint8
+	Seq      uint32
+	// Length is the size of the IP packet on the wire, even when the capture
+	// was truncated by the snap length.
+	Length int
+	// Payload is the captured TCP/UDP payload (may be shorter than sent).
+	Payload []byte
+}
+
+// Decode decodes a captured frame of the given link type into p. The slices
+// of p point into data.
+func Decode(linkType LinkType, data []byte, p *Packet) error {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return ErrTruncated
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// 802.1Q / 802.1ad tags, possibly stacked
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		return decodeEtherType(etherType, data, p)
+
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return ErrTruncated
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[14:16]), data[16:], p)
+
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return ErrTruncated
+		}
+		// The address family is in host byte order of the capturing machine.
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		switch family {
+		case 2: // AF_INET
+			return decodeIPv4(data[4:], p)
+		case 24, 28, 30: // AF_INET6 on NetBSD/OpenBSD, FreeBSD, Darwin
+			return decodeIPv6(data[4:], p)
+		}
+		return ErrNotIP
+
+	case LinkTypeRaw:
+		return decodeIP(data, p)
+
+	default:
+		return fmt.Errorf("unsupported link type %d", linkType)
+	}
+}
+
+func decodeEtherType(etherType uint16, data []byte, p *Packet) error {
+	switch etherType {
+	case 0x0800:
+		return decodeIPv4(data, p)
+	case 0x86dd:
+		return decodeIPv6(data, p)
+	}
+	return ErrNotIP
+}
+
+// decodeIP decodes a raw IP packet, telling the version from its first nibble.
+func decodeIP(data []byte, p *Packet) error {
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data, p)
+	case 6:
+		return decodeIPv6(data, p)
+	}
+	return ErrNotIP
+}
+
+func decodeIPv4(data []byte, p *Packet) error {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return ErrTruncated
+	}
+	ihl := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if ihl < 20 || len(data) < ihl || total < ihl {
+		return ErrTruncated
+	}
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+		return ErrFragment
+	}
+
+	p.Length = total
+	p.Protocol = data[9]
+	p.SrcIP = net.IP(data[12:16])
+	p.DstIP = net.IP(data[16:20])
+
+	// Drop Ethernet padding past the IP packet
+	if len(data) > total {
+		data = data[:total]
+	}
+	return decodeTransport(data[ihl:], p)
+}
+
+func decodeIPv6(data []byte, p *Packet) error {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return ErrTruncated
+	}
+	total := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+	p.Length = total
+	p.SrcIP = net.IP(data[8:24])
+	p.DstIP = net.IP(data[24:40])
+	if len(data) > total {
+		data = data[:total]
+	}
+
+	next := data[6]
+	data = data[40:]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return ErrTruncated
+			}
+			next, data = data[0], data[n:]
+		case 44: // fragment
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			if binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0 {
+				return ErrFragment
+			}
+			next, data = data[0], data[8:]
+		default:
+			p.Protocol = next
+			return decodeTransport(data, p)
+		}
+	}
+}
+
+func decodeTransport(data []byte, p *Packet) error {
+	switch p.Protocol {
+	case ProtoTCP:
+		if len(data) < 20 {
+			return ErrTruncated
+		}
+		off := int(data[12]>>4) * 4
+		if off < 20 || len(data) < off {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.Seq = binary.BigEndian.Uint32(data[4:8])
+		p.TCPFlags = data[13]
+		p.Payload = data[off:]
+		return nil
+
+	case ProtoUDP:
+		if len(data) < 8 {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.TCPFlags = 0
+		p.Seq = 0
+		p.Payload = data[8:]
+		if n := int(binary.BigEndian.Uint16(data[4:6])); n >= 8 && n-8 < len(p.Payload) {
+			p.Payload = p.Payload[:n-8]
+		}
+		return nil
+	}
+	return ErrNotTCPUDP
+}
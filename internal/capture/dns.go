@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsAnswer maps an address from a DNS response to the name the client
+// asked for (the question, not the CNAME target).
+type dnsAnswer struct {
+	Name string
+	IP   net.IP
+	TTL  time.Duration
+}
+
+var errBadDNS = errors.New("malformed DNS message")
+
+// parseDNSAnswers returns the A and AAAA records of a DNS response.
+func parseDNSAnswers(msg []byte) ([]dnsAnswer, error) {
+	if len(msg) < 12 {
+		return nil, errBadDNS
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 == 0 || flags&0x000f != 0 { // not a response, or an error rcode
+		return nil, nil
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:6]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:8]))
+	if qdCount != 1 || anCount == 0 {
+		return nil, nil
+	}
+
+	pos := 12
+	question, pos, err := readDNSName(msg, pos)
+	if err != nil {
+		return nil, err
+	}
+	pos += 4 // QTYPE, QCLASS
+	if pos > len(msg) {
+		return nil, errBadDNS
+	}
+
+	var answers []dnsAnswer
+	for i := 0; i < anCount; i++ {
+		if _, pos, err = readDNSName(msg, pos); err != nil {
+			return answers, err
+		}
+		if pos+10 > len(msg) {
+			return answers, errBadDNS
+		}
+		rrType := binary.BigEndian.Uint16(msg[pos : pos+2])
+		ttl := binary.BigEndian.Uint32(msg[pos+4 : pos+8])
+		rdLen := int(binary.BigEndian.Uint16(msg[pos+8 : pos+10]))
+		pos += 10
+		if pos+rdLen > len(msg) {
+			return answers, errBadDNS
+		}
+		rdata := msg[pos : pos+rdLen]
+		pos += rdLen
+
+		if (rrType == 1 && rdLen == 4) || (rrType == 28 && rdLen == 16) {
+			answers = append(answers, dnsAnswer{
+				Name: question,
+				IP:   append(net.IP(nil), rdata...),
+				TTL:  time.Duration(ttl) * time.Second,
+			})
+		}
+	}
+	return answers, nil
+}
+
+// readDNSName reads a (possibly compressed) domain name at pos and returns
+// it with the position after it.
+func readDNSName(msg []byte, pos int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if pos >= len(msg) {
+			return "", 0, errBadDNS
+		}
+		n := int(msg[pos])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = pos + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xc0 == 0xc0:
+			if pos+1 >= len(msg) || jumps > 16 {
+				return "", 0, errBadDNS
+			}
+			if end < 0 {
+				end = pos + 2
+			}
+			pos = int(binary.BigEndian.Uint16(msg[pos:pos+2]) & 0x3fff)
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errBadDNS
+		default:
+			if pos+1+n > len(msg) {
+				return "", 0, errBadDNS
+			}
+			labels = append(labels, string(msg[pos+1:pos+1+n]))
+			pos += 1 + n
+		}
+	}
+}
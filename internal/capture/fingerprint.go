@@ -0,0 +1,290 @@
+package capture
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/guilherme/zid-proxy/internal/sni"
+)
+
+// helloInfo is what the first bytes sent by a client tell about its flow.
+type helloInfo struct {
+	Host string   // TLS/QUIC SNI or HTTP Host ("" = none)
+	ALPN []string // protocols offered in the ClientHello
+	JA3  string   // TLS client fingerprints ("" = not TLS)
+	JA4  string
+}
+
+// TLS extensions read for the fingerprints.
+const (
+	extServerName        = 0x0000
+	extSupportedGroups   = 0x000a
+	extECPointFormats    = 0x000b
+	extSignatureAlgs     = 0x000d
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+// clientHello holds the ClientHello fields the fingerprints are made of.
+type clientHello struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+	sigAlgs      []uint16
+	versions     []uint16
+	alpn         []string
+}
+
+// parseHello decodes a complete ClientHello handshake message; quic selects
+// the JA4 transport prefix.
+func parseHello(msg []byte, quic bool) (helloInfo, inspectResult) {
+	ch, ok := parseClientHello(msg)
+	if !ok {
+		return helloInfo{}, inspectGiveUp
+	}
+	info := helloInfo{ALPN: ch.alpn, JA3: ch.ja3(), JA4: ch.ja4(quic)}
+	if host, err := sni.ExtractSNI(msg); err == nil {
+		info.Host = strings.ToLower(host)
+	}
+	return info, inspectFound
+}
+
+// helloReader reads the big-endian fields of a ClientHello.
+type helloReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.b) {
+		r.ok = false
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *helloReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *helloReader) u16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// u16s splits b into big-endian 16-bit values.
+func u16s(b []byte) []uint16 {
+	out := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		out = append(out, binary.BigEndian.Uint16(b[i:]))
+	}
+	return out
+}
+
+func parseClientHello(msg []byte) (clientHello, bool) {
+	if len(msg) < 4 || msg[0] != 0x01 || len(msg) < 4+handshakeLen(msg) {
+		return clientHello{}, false
+	}
+	r := &helloReader{b: msg[4 : 4+handshakeLen(msg)], ok: true}
+
+	var ch clientHello
+	ch.version = uint16(r.u16())
+	r.bytes(32)     // random
+	r.bytes(r.u8()) // session ID
+	ch.ciphers = u16s(r.bytes(r.u16()))
+	r.bytes(r.u8()) // compression methods
+	if !r.ok {
+		return clientHello{}, false
+	}
+	if len(r.b) == 0 {
+		return ch, true // no extensions
+	}
+
+	exts := &helloReader{b: r.bytes(r.u16()), ok: r.ok}
+	for exts.ok && len(exts.b) >= 4 {
+		typ := uint16(exts.u16())
+		data := exts.bytes(exts.u16())
+		if !exts.ok {
+			break
+		}
+		ch.extensions = append(ch.extensions, typ)
+
+		ext := &helloReader{b: data, ok: true}
+		switch typ {
+		case extSupportedGroups:
+			ch.groups = u16s(ext.bytes(ext.u16()))
+		case extECPointFormats:
+			ch.pointFormats = append(ch.pointFormats, ext.bytes(ext.u8())...)
+		case extSignatureAlgs:
+			ch.sigAlgs = u16s(ext.bytes(ext.u16()))
+		case extSupportedVersions:
+			ch.versions = u16s(ext.bytes(ext.u8()))
+		case extALPN:
+			list := &helloReader{b: ext.bytes(ext.u16()), ok: ext.ok}
+			for list.ok && len(list.b) > 0 {
+				if p := list.bytes(list.u8()); list.ok && len(p) > 0 {
+					ch.alpn = append(ch.alpn, string(p))
+				}
+			}
+		}
+	}
+	return ch, exts.ok
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which the
+// fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// ja3 returns the JA3 fingerprint: the MD5 of the version, ciphers,
+// extensions, groups and point formats, without GREASE values.
+func (ch clientHello) ja3() string {
+	formats := make([]uint16, len(ch.pointFormats))
+	for i, f := range ch.pointFormats {
+		formats[i] = uint16(f)
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", ch.version,
+		joinDecimal(withoutGREASE(ch.ciphers)),
+		joinDecimal(withoutGREASE(ch.extensions)),
+		joinDecimal(withoutGREASE(ch.groups)),
+		joinDecimal(formats))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint (FoxIO JA4 TLS client fingerprint).
+func (ch clientHello) ja4(quic bool) string {
+	ciphers := withoutGREASE(ch.ciphers)
+	extensions := withoutGREASE(ch.extensions)
+
+	var b strings.Builder
+	if quic {
+		b.WriteByte('q')
+	} else {
+		b.WriteByte('t')
+	}
+	b.WriteString(ja4Version(ch))
+	sniFlag := byte('i')
+	for _, e := range extensions {
+		if e == extServerName {
+			sniFlag = 'd'
+		}
+	}
+	b.WriteByte(sniFlag)
+	fmt.Fprintf(&b, "%02d%02d", min(len(ciphers), 99), min(len(extensions), 99))
+	b.WriteString(ja4ALPN(ch.alpn))
+
+	b.WriteByte('_')
+	b.WriteString(ja4Hash(sortedHex(ciphers), ""))
+
+	var rest []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			rest = append(rest, e)
+		}
+	}
+	b.WriteByte('_')
+	b.WriteString(ja4Hash(sortedHex(rest), hexList(withoutGREASE(ch.sigAlgs))))
+	return b.String()
+}
+
+func ja4Version(ch clientHello) string {
+	v := ch.version
+	for _, sv := range withoutGREASE(ch.versions) {
+		if sv > v {
+			v = sv
+		}
+	}
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN value.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte{first, last})
+	return string([]byte{h[0], h[3]})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedHex(values []uint16) string {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return hexList(sorted)
+}
+
+// ja4Hash returns the truncated SHA-256 of list (and suffix, "_"-joined), or
+// twelve zeros when list is empty.
+func ja4Hash(list, suffix string) string {
+	if list == "" {
+		return "000000000000"
+	}
+	if suffix != "" {
+		list += "_" + suffix
+	}
+	sum := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(sum[:])[:12]
+}
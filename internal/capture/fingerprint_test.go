@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+)
+
+// testHello builds a ClientHello handshake message with GREASE values, the
+// way browsers send them.
+func testHello(serverName string) []byte {
+	u16 := func(v int) []byte { return []byte{byte(v >> 8), byte(v)} }
+	ext := func(typ int, data []byte) []byte {
+		return append(append(u16(typ), u16(len(data))...), data...)
+	}
+	vec16 := func(b []byte) []byte { return append(u16(len(b)), b...) }
+
+	var exts []byte
+	if serverName != "" {
+		name := append([]byte{0}, vec16([]byte(serverName))...)
+		exts = append(exts, ext(0x0000, vec16(name))...)
+	}
+	exts = append(exts, ext(0x000a, vec16([]byte{0x1a, 0x1a, 0x00, 0x1d}))...)
+	exts = append(exts, ext(0x000b, []byte{1, 0})...)
+	exts = append(exts, ext(0x000d, vec16([]byte{0x04, 0x03, 0x08, 0x04}))...)
+	exts = append(exts, ext(0x0010, vec16(append([]byte{2, 'h', '2', 8}, "http/1.1"...)))...)
+	exts = append(exts, ext(0x002b, []byte{6, 0x2a, 0x2a, 0x03, 0x04, 0x03, 0x03})...)
+
+	body := u16(0x0303)
+	body = append(body, make([]byte, 32)...)                                  // random
+	body = append(body, 0)                                                    // session ID
+	body = append(body, vec16([]byte{0x0a, 0x0a, 0x13, 0x01, 0x13, 0x02})...) // ciphers
+	body = append(body, 1, 0)                                                 // compression
+	body = append(body, vec16(exts)...)
+
+	msg := []byte{0x01, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(body)))
+	return append(msg, body...)
+}
+
+func TestParseHello_Fingerprints(t *testing.T) {
+	info, result := parseHello(testHello("WWW.Example.com"), false)
+	if result != inspectFound || info.Host != "www.example.com" {
+		t.Fatalf("parseHello = %+v, %d", info, result)
+	}
+	if len(info.ALPN) != 2 || info.ALPN[0] != "h2" || info.ALPN[1] != "http/1.1" {
+		t.Fatalf("ALPN = %q", info.ALPN)
+	}
+
+	ja3 := md5.Sum([]byte("771,4865-4866,0-10-11-13-16-43,29,0"))
+	if info.JA3 != hex.EncodeToString(ja3[:]) {
+		t.Errorf("JA3 = %s", info.JA3)
+	}
+	ciphers := sha256.Sum256([]byte("1301,1302"))
+	exts := sha256.Sum256([]byte("000a,000b,000d,002b_0403,0804"))
+	want := "t13d0206h2_" + hex.EncodeToString(ciphers[:])[:12] + "_" + hex.EncodeToString(exts[:])[:12]
+	if info.JA4 != want {
+		t.Errorf("JA4 = %s, want %s", info.JA4, want)
+	}
+
+	// Without SNI the hello is still fingerprinted
+	if info, result := parseHello(testHello(""), true); result != inspectFound || info.Host != "" || info.JA4[:4] != "q13i" {
+		t.Fatalf("no SNI = %+v, %d", info, result)
+	}
+	if _, result := parseHello(testHello("a.example")[:50], false); result != inspectGiveUp {
+		t.Fatal("truncated hello not given up")
+	}
+}
+
+func TestTracker_ClassifyHello(t *testing.T) {
+	fp, _ := parseHello(testHello(""), false)
+	d := appid.NewDetector()
+	d.AddCustomApp(&appid.AppDefinition{Name: "updater", Category: appid.CategoryBusiness, JA4: []string{fp.JA4}})
+	d.AddCustomApp(&appid.AppDefinition{Name: "chat", Category: appid.CategoryBusiness, Hostnames: []string{"chat.example"}, ALPN: []string{"h3"}})
+	cache := appid.NewFlowCache(100, time.Minute)
+	tracker := NewTracker(cache, d, appid.NewDNSCache(100))
+	now := time.Now()
+
+	unknown := appid.FlowKey{SrcIP: "10.0.0.1", DstIP: "192.0.2.1", SrcPort: 50000, DstPort: 443, Protocol: ProtoTCP}
+	cache.Account(unknown, 100, true, now)
+	tracker.classifyHello(unknown, fp)
+	if f, _ := cache.Get(unknown); f.AppName != "updater" || f.Source != appid.SourceFingerprint {
+		t.Errorf("fingerprint flow = %+v", f)
+	}
+
+	// The hostname wins, with less confidence when ALPN disagrees
+	chat := appid.FlowKey{SrcIP: "10.0.0.1", DstIP: "192.0.2.2", SrcPort: 50001, DstPort: 443, Protocol: ProtoTCP}
+	cache.Account(chat, 100, true, now)
+	info, _ := parseHello(testHello("chat.example"), false)
+	tracker.classifyHello(chat, info)
+	if f, _ := cache.Get(chat); f.AppName != "chat" || f.Source != appid.SourceSNI || f.Confidence != alpnMismatchScale {
+		t.Errorf("ALPN mismatch flow = %+v", f)
+	}
+}
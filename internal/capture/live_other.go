@@ -0,0 +1,8 @@
+//go:build !linux && !freebsd
+
+package capture
+
+// OpenLive is not available on this platform; use a pcap file instead.
+func OpenLive(iface string) (Source, error) {
+	return nil, ErrUnsupported
+}
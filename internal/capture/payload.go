@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// maxStream is how much of the client's first bytes is kept to find the
+// ClientHello or the HTTP request headers.
+const maxStream = 16 * 1024
+
+// inspectResult tells what the first bytes of a TCP stream revealed.
+type inspectResult int
+
+const (
+	inspectMore   inspectResult = iota // need more data
+	inspectFound                       // ClientHello or HTTP Host found
+	inspectGiveUp                      // not TLS/HTTP or no hostname
+)
+
+// tlsHello decodes the TLS ClientHello at the start of stream. The
+// ClientHello may span several TLS records and TCP segments.
+func tlsHello(stream []byte) (helloInfo, inspectResult) {
+	if len(stream) == 0 {
+		return helloInfo{}, inspectMore
+	}
+	if stream[0] != 0x16 {
+		return helloInfo{}, inspectGiveUp
+	}
+
+	// Reassemble the handshake message from the records' fragments
+	var msg []byte
+	for len(stream) > 0 {
+		if len(stream) < 5 {
+			return helloInfo{}, inspectMore
+		}
+		if stream[0] != 0x16 {
+			return helloInfo{}, inspectGiveUp
+		}
+		n := int(binary.BigEndian.Uint16(stream[3:5]))
+		if len(stream) < 5+n {
+			// Take what arrived; the message may already be complete
+			msg = append(msg, stream[5:]...)
+			stream = nil
+		} else {
+			msg = append(msg, stream[5:5+n]...)
+			stream = stream[5+n:]
+		}
+		if len(msg) >= 4 && len(msg) >= 4+handshakeLen(msg) {
+			return parseHello(msg[:4+handshakeLen(msg)], false)
+		}
+	}
+	return helloInfo{}, inspectMore
+}
+
+// handshakeLen returns the body length of the handshake message in msg.
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// httpHost extracts the Host header of the HTTP/1.x request at the start of
+// stream.
+func httpHost(stream []byte) (string, inspectResult) {
+	method := false
+	for _, m := range httpMethods {
+		if len(stream) < len(m) {
+			if bytes.HasPrefix(m, stream) {
+				return "", inspectMore
+			}
+			continue
+		}
+		if bytes.HasPrefix(stream, m) {
+			method = true
+			break
+		}
+	}
+	if !method {
+		return "", inspectGiveUp
+	}
+
+	end := bytes.Index(stream, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", inspectMore
+	}
+	for _, line := range bytes.Split(stream[:end], []byte("\r\n"))[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(string(value)))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			break
+		}
+		return host, inspectFound
+	}
+	return "", inspectGiveUp
+}
+
+// inspectStream looks for a ClientHello or an HTTP Host at the start of a
+// client TCP stream.
+func inspectStream(stream []byte) (helloInfo, inspectResult) {
+	if len(stream) > 0 && stream[0] == 0x16 {
+		return tlsHello(stream)
+	}
+	host, result := httpHost(stream)
+	return helloInfo{Host: host}, result
+}
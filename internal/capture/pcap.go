@@ -0,0 +1,125 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapngMagic     = 0x0a0d0d0a
+
+	pcapHeaderSize = 24
+	pcapRecordSize = 16
+)
+
+// PcapReader reads a classic libpcap capture file (tcpdump -w). Both byte
+// orders and microsecond or nanosecond timestamps are supported; pcapng is
+// not (convert with "editcap -F pcap").
+type PcapReader struct {
+	r        *bufio.Reader
+	f        *os.File
+	order    binary.ByteOrder
+	nanos    bool
+	linkType LinkType
+	snapLen  uint32
+	hdr      [pcapRecordSize]byte
+	buf      []byte
+}
+
+// OpenPcap opens the capture file at path.
+func OpenPcap(path string) (*PcapReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewPcapReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.f = f
+	return r, nil
+}
+
+// NewPcapReader reads a capture from r, starting with its file header.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{r: bufio.NewReaderSize(r, 1<<16)}
+
+	var hdr [pcapHeaderSize]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); magic {
+	case pcapMagicMicros:
+		pr.order = binary.LittleEndian
+	case pcapMagicNanos:
+		pr.order, pr.nanos = binary.LittleEndian, true
+	default:
+		switch binary.BigEndian.Uint32(hdr[0:4]) {
+		case pcapMagicMicros:
+			pr.order = binary.BigEndian
+		case pcapMagicNanos:
+			pr.order, pr.nanos = binary.BigEndian, true
+		case pcapngMagic:
+			return nil, errors.New("pcapng files are not supported, convert with: editcap -F pcap")
+		default:
+			return nil, fmt.Errorf("not a pcap file (magic %#x)", magic)
+		}
+	}
+
+	pr.snapLen = pr.order.Uint32(hdr[16:20])
+	// The upper bits of the link type field carry FCS information.
+	pr.linkType = LinkType(pr.order.Uint32(hdr[20:24]) & 0x0fffffff)
+	if pr.snapLen == 0 || pr.snapLen > 1<<18 {
+		pr.snapLen = 1 << 18
+	}
+	pr.buf = make([]byte, pr.snapLen)
+	return pr, nil
+}
+
+// ReadPacket implements Source.
+func (pr *PcapReader) ReadPacket() ([]byte, time.Time, error) {
+	if _, err := io.ReadFull(pr.r, pr.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, time.Time{}, fmt.Errorf("truncated pcap record header")
+		}
+		return nil, time.Time{}, err
+	}
+	sec := pr.order.Uint32(pr.hdr[0:4])
+	frac := pr.order.Uint32(pr.hdr[4:8])
+	capLen := pr.order.Uint32(pr.hdr[8:12])
+	if capLen > pr.snapLen {
+		return nil, time.Time{}, fmt.Errorf("pcap record of %d bytes exceeds snaplen %d", capLen, pr.snapLen)
+	}
+
+	data := pr.buf[:capLen]
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, time.Time{}, fmt.Errorf("truncated pcap record: %w", err)
+	}
+
+	nsec := int64(frac)
+	if !pr.nanos {
+		nsec *= 1000
+	}
+	return data, time.Unix(int64(sec), nsec), nil
+}
+
+// LinkType implements Source.
+func (pr *PcapReader) LinkType() LinkType {
+	return pr.linkType
+}
+
+// Close implements Source.
+func (pr *PcapReader) Close() error {
+	if pr.f != nil {
+		return pr.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCapture builds a little-endian, microsecond pcap file of Ethernet frames.
+type testCapture struct {
+	buf bytes.Buffer
+	ts  time.Time
+}
+
+func newTestCapture(linkType LinkType) *testCapture {
+	c := &testCapture{ts: time.Unix(1760000000, 0)}
+	hdr := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(linkType))
+	c.buf.Write(hdr)
+	return c
+}
+
+func (c *testCapture) add(frame []byte) {
+	c.ts = c.ts.Add(time.Millisecond)
+	rec := make([]byte, pcapRecordSize)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(c.ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(c.ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+	c.buf.Write(rec)
+	c.buf.Write(frame)
+}
+
+func (c *testCapture) write(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(path, c.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ethernet wraps an IP packet in an Ethernet II frame.
+func ethernet(ipPacket []byte) []byte {
+	frame := make([]byte, 14, 14+len(ipPacket))
+	etherType := uint16(0x0800)
+	if ipPacket[0]>>4 == 6 {
+		etherType = 0x86dd
+	}
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+	return append(frame, ipPacket...)
+}
+
+// ipPacket builds an IPv4 or IPv6 packet (checksums are left empty).
+func ipPacket(src, dst string, proto uint8, transport []byte) []byte {
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s4, d4 := s.To4(), d.To4(); s4 != nil && d4 != nil {
+		p := make([]byte, 20, 20+len(transport))
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:4], uint16(20+len(transport)))
+		p[8] = 64
+		p[9] = proto
+		copy(p[12:16], s4)
+		copy(p[16:20], d4)
+		return append(p, transport...)
+	}
+	p := make([]byte, 40, 40+len(transport))
+	p[0] = 0x60
+	binary.BigEndian.PutUint16(p[4:6], uint16(len(transport)))
+	p[6] = proto
+	p[7] = 64
+	copy(p[8:24], s.To16())
+	copy(p[24:40], d.To16())
+	return append(p, transport...)
+}
+
+func tcpSegment(sport, dport uint16, seq uint32, flags uint8, payload []byte) []byte {
+	seg := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], sport)
+	binary.BigEndian.PutUint16(seg[2:4], dport)
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	seg[12] = 5 << 4
+	seg[13] = flags
+	return append(seg, payload...)
+}
+
+func udpDatagram(sport, dport uint16, payload []byte) []byte {
+	d := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(d[0:2], sport)
+	binary.BigEndian.PutUint16(d[2:4], dport)
+	binary.BigEndian.PutUint16(d[4:6], uint16(8+len(payload)))
+	return append(d, payload...)
+}
+
+// clientHelloRecord returns the TLS record of a real ClientHello for serverName.
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[3:5]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+func TestPcapReader(t *testing.T) {
+	c := newTestCapture(LinkTypeEthernet)
+	frame := ethernet(ipPacket("10.0.0.1", "10.0.0.2", ProtoUDP, udpDatagram(1000, 53, []byte("x"))))
+	c.add(frame)
+	c.add(frame)
+
+	r, err := NewPcapReader(bytes.NewReader(c.buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != LinkTypeEthernet {
+		t.Fatalf("link type %d", r.LinkType())
+	}
+	for i := 0; i < 2; i++ {
+		data, ts, err := r.ReadPacket()
+		if err != nil || !bytes.Equal(data, frame) || ts.Unix() != 1760000000 {
+			t.Fatalf("packet %d: %v %v", i, ts, err)
+		}
+	}
+	if _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestPcapReader_BigEndianNanos(t *testing.T) {
+	hdr := make([]byte, pcapHeaderSize)
+	binary.BigEndian.PutUint32(hdr[0:4], pcapMagicNanos)
+	binary.BigEndian.PutUint32(hdr[16:20], 65535)
+	binary.BigEndian.PutUint32(hdr[20:24], uint32(LinkTypeRaw))
+	rec := make([]byte, pcapRecordSize)
+	binary.BigEndian.PutUint32(rec[0:4], 100)
+	binary.BigEndian.PutUint32(rec[4:8], 5)
+	binary.BigEndian.PutUint32(rec[8:12], 1)
+	binary.BigEndian.PutUint32(rec[12:16], 1)
+	data := append(append(hdr, rec...), 0x45)
+
+	r, err := NewPcapReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts, err := r.ReadPacket()
+	if err != nil || ts.UnixNano() != 100*int64(time.Second)+5 || r.LinkType() != LinkTypeRaw {
+		t.Fatalf("ts=%v link=%d err=%v", ts, r.LinkType(), err)
+	}
+}
+
+func TestPcapReader_Errors(t *testing.T) {
+	pcapng := []byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := NewPcapReader(bytes.NewReader(pcapng)); err == nil || !strings.Contains(err.Error(), "pcapng") {
+		t.Fatalf("pcapng: %v", err)
+	}
+	if _, err := NewPcapReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Fatal("expected error for bad magic")
+	}
+
+	c := newTestCapture(LinkTypeEthernet)
+	c.add(make([]byte, 60))
+	r, err := NewPcapReader(bytes.NewReader(c.buf.Bytes()[:c.buf.Len()-10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadPacket(); err == nil || err == io.EOF {
+		t.Fatalf("expected truncated record error, got %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	seg := tcpSegment(40000, 443, 7, tcpSYN, nil)
+
+	// 802.1Q tagged IPv4 with Ethernet padding
+	frame := ethernet(ipPacket("192.0.2.1", "198.51.100.2", ProtoTCP, seg))
+	tagged := append(append(append([]byte{}, frame[:12]...), 0x81, 0x00, 0x00, 0x0a), frame[12:]...)
+	tagged = append(tagged, make([]byte, 6)...)
+	var p Packet
+	if err := Decode(LinkTypeEthernet, tagged, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.SrcIP.String() != "192.0.2.1" || p.DstPort != 443 || p.Seq != 7 || p.TCPFlags != tcpSYN || p.Length != 40 || len(p.Payload) != 0 {
+		t.Fatalf("decoded %+v", p)
+	}
+
+	// IPv6 over Linux cooked capture
+	sll := make([]byte, 16)
+	binary.BigEndian.PutUint16(sll[14:16], 0x86dd)
+	pkt := ipPacket("2001:db8::1", "2001:db8::2", ProtoUDP, udpDatagram(5353, 53, []byte("abc")))
+	if err := Decode(LinkTypeLinuxSLL, append(sll, pkt...), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.DstIP.String() != "2001:db8::2" || p.Protocol != ProtoUDP || string(p.Payload) != "abc" || p.Length != 51 {
+		t.Fatalf("decoded %+v", p)
+	}
+
+	// BSD loopback, address family in host order
+	null := []byte{2, 0, 0, 0}
+	if err := Decode(LinkTypeNull, append(null, ipPacket("127.0.0.1", "127.0.0.1", ProtoTCP, seg)...), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not TCP/UDP, not IP, non-first fragment
+	icmp := ipPacket("192.0.2.1", "192.0.2.2", 1, make([]byte, 8))
+	if err := Decode(LinkTypeRaw, icmp, &p); err != ErrNotTCPUDP {
+		t.Fatalf("icmp: %v", err)
+	}
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+	if err := Decode(LinkTypeEthernet, arp, &p); err != ErrNotIP {
+		t.Fatalf("arp: %v", err)
+	}
+	frag := ipPacket("192.0.2.1", "192.0.2.2", ProtoUDP, make([]byte, 16))
+	binary.BigEndian.PutUint16(frag[6:8], 10)
+	if err := Decode(LinkTypeRaw, frag, &p); err != ErrFragment {
+		t.Fatalf("fragment: %v", err)
+	}
+}
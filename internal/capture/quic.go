@@ -0,0 +1,263 @@
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// QUIC version 1 (RFC 9000) and its Initial salt (RFC 9001, section 5.2).
+const quicV1 = 0x00000001
+
+var quicV1Salt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errNotQUICInitial = errors.New("not a QUIC v1 client Initial packet")
+
+// cryptoFrame is a piece of the CRYPTO stream of a QUIC Initial packet.
+type cryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// quicKeys are the client Initial packet protection keys.
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// quicInitialKeys derives the client Initial keys from the Destination
+// Connection ID chosen by the client (RFC 9001, section 5.2).
+func quicInitialKeys(dcid []byte) (*quicKeys, error) {
+	initial := hkdfExtract(quicV1Salt, dcid)
+	client := hkdfExpandLabel(initial, "client in", 32)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(client, "quic key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(client, "quic hp", 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(client, "quic iv", 12), hp: hp}, nil
+}
+
+// hkdfExtract is HKDF-Extract with SHA-256 (RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is the TLS 1.3 HKDF-Expand-Label with an empty context
+// (RFC 8446, section 7.1).
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0) // context length
+
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, section 16).
+func readVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// isQUICInitial reports whether a UDP payload starts with a QUIC v1 Initial
+// packet header.
+func isQUICInitial(b []byte) bool {
+	return len(b) >= 7 && b[0]&0xc0 == 0xc0 && (b[0]>>4)&0x03 == 0 &&
+		binary.BigEndian.Uint32(b[1:5]) == quicV1
+}
+
+// quicInitialCrypto removes the protection of the client Initial packet at
+// the start of datagram and returns its CRYPTO frames.
+func quicInitialCrypto(datagram []byte) ([]cryptoFrame, error) {
+	if !isQUICInitial(datagram) {
+		return nil, errNotQUICInitial
+	}
+
+	pos := 5
+	dcidLen := int(datagram[pos])
+	pos++
+	if dcidLen > 20 || pos+dcidLen >= len(datagram) {
+		return nil, errNotQUICInitial
+	}
+	dcid := datagram[pos : pos+dcidLen]
+	pos += dcidLen
+	scidLen := int(datagram[pos])
+	pos += 1 + scidLen
+	if scidLen > 20 || pos >= len(datagram) {
+		return nil, errNotQUICInitial
+	}
+	tokenLen, n, ok := readVarint(datagram[pos:])
+	if !ok || uint64(len(datagram)-pos-n) < tokenLen {
+		return nil, errNotQUICInitial
+	}
+	pos += n + int(tokenLen)
+	length, n, ok := readVarint(datagram[pos:])
+	if !ok {
+		return nil, errNotQUICInitial
+	}
+	pos += n
+	pnOffset := pos
+	if length < 20 || uint64(len(datagram)-pnOffset) < length {
+		return nil, errNotQUICInitial
+	}
+
+	keys, err := quicInitialKeys(dcid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header protection: the sample starts 4 bytes after the packet number
+	// offset (RFC 9001, section 5.4.2).
+	var mask [aes.BlockSize]byte
+	keys.hp.Encrypt(mask[:], datagram[pnOffset+4:pnOffset+4+aes.BlockSize])
+	header := append([]byte(nil), datagram[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	header = header[:pnOffset+pnLen]
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := keys.aead.Open(nil, nonce, datagram[pnOffset+pnLen:pnOffset+int(length)], header)
+	if err != nil {
+		return nil, err
+	}
+	return parseCryptoFrames(payload)
+}
+
+// parseCryptoFrames returns the CRYPTO frames of a decrypted Initial payload,
+// skipping the other frames allowed in Initial packets.
+func parseCryptoFrames(b []byte) ([]cryptoFrame, error) {
+	var frames []cryptoFrame
+	errFrame := errors.New("malformed QUIC frame")
+	for len(b) > 0 {
+		typ, n, ok := readVarint(b)
+		if !ok {
+			return frames, errFrame
+		}
+		b = b[n:]
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			fields := 4
+			var ranges uint64
+			for i := 0; i < fields; i++ {
+				v, n, ok := readVarint(b)
+				if !ok {
+					return frames, errFrame
+				}
+				if i == 2 {
+					ranges = v
+				}
+				b = b[n:]
+			}
+			skip := 2 * ranges
+			if typ == 0x03 {
+				skip += 3 // ECN counts
+			}
+			for ; skip > 0; skip-- {
+				_, n, ok := readVarint(b)
+				if !ok {
+					return frames, errFrame
+				}
+				b = b[n:]
+			}
+		case 0x06: // CRYPTO
+			offset, n, ok := readVarint(b)
+			if !ok {
+				return frames, errFrame
+			}
+			b = b[n:]
+			length, n, ok := readVarint(b)
+			if !ok || uint64(len(b)-n) < length {
+				return frames, errFrame
+			}
+			b = b[n:]
+			frames = append(frames, cryptoFrame{offset: offset, data: append([]byte(nil), b[:length]...)})
+			b = b[length:]
+		default:
+			// CONNECTION_CLOSE or anything unexpected ends the parse
+			return frames, nil
+		}
+	}
+	return frames, nil
+}
+
+// assembleCrypto returns the contiguous start of the CRYPTO stream from
+// frames, which may arrive out of order and in several packets.
+func assembleCrypto(frames []cryptoFrame) []byte {
+	sort.Slice(frames, func(i, j int) bool { return frames[i].offset < frames[j].offset })
+	var stream []byte
+	for _, f := range frames {
+		end := f.offset + uint64(len(f.data))
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	return stream
+}
+
+// quicHello decodes the ClientHello carried by the CRYPTO frames received
+// so far.
+func quicHello(frames []cryptoFrame) (helloInfo, inspectResult) {
+	msg := assembleCrypto(frames)
+	if len(msg) < 4 {
+		return helloInfo{}, inspectMore
+	}
+	if msg[0] != 0x01 {
+		return helloInfo{}, inspectGiveUp
+	}
+	if len(msg) < 4+handshakeLen(msg) {
+		return helloInfo{}, inspectMore
+	}
+	return parseHello(msg[:4+handshakeLen(msg)], true)
+}
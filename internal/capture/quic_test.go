@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestQUICInitialKeys(t *testing.T) {
+	// RFC 9001, Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	initial := hkdfExtract(quicV1Salt, dcid)
+	if got := hex.EncodeToString(initial); got != "7db5df06e7a69e432496adedb00851923595221596ae2ae9fb8115c1e9ed0a44" {
+		t.Fatalf("initial_secret %s", got)
+	}
+	client := hkdfExpandLabel(initial, "client in", 32)
+	if got := hex.EncodeToString(client); got != "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea" {
+		t.Fatalf("client_initial_secret %s", got)
+	}
+	for label, want := range map[string]string{
+		"quic key": "1f369613dd76d5467730efcbe3b1a22d",
+		"quic iv":  "fa044b2f42a3fd3b46fb255c",
+		"quic hp":  "9f50449e04a0e810283a1e9933adedd2",
+	} {
+		if got := hex.EncodeToString(hkdfExpandLabel(client, label, len(want)/2)); got != want {
+			t.Errorf("%s = %s, want %s", label, got, want)
+		}
+	}
+}
+
+// quicInitial builds a protected client Initial packet carrying frames.
+func quicInitial(t *testing.T, dcid []byte, pn uint32, frames []cryptoFrame) []byte {
+	t.Helper()
+	var payload []byte
+	for _, f := range frames {
+		payload = append(payload, 0x06)
+		payload = appendVarint(payload, f.offset)
+		payload = appendVarint(payload, uint64(len(f.data)))
+		payload = append(payload, f.data...)
+	}
+	// Clients pad Initial datagrams to 1200 bytes
+	if len(payload) < 1100 {
+		payload = append(payload, make([]byte, 1100-len(payload))...)
+	}
+
+	keys, err := quicInitialKeys(dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0, 0) // SCID length, token length
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(4+len(payload)+16))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, pn)
+
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := keys.aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+
+	var mask [aes.BlockSize]byte
+	keys.hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, 0x4000|uint16(v))
+	default:
+		return binary.BigEndian.AppendUint32(b, 0x80000000|uint32(v))
+	}
+}
+
+func TestQUICServerName(t *testing.T) {
+	hello := clientHelloRecord(t, "open.spotify.com")[5:]
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	half := len(hello) / 2
+
+	// Second half first, as Chrome scrambles CRYPTO frames
+	p1 := quicInitial(t, dcid, 0, []cryptoFrame{{offset: uint64(half), data: hello[half:]}})
+	p2 := quicInitial(t, dcid, 1, []cryptoFrame{{offset: 0, data: hello[:half]}})
+
+	frames, err := quicInitialCrypto(p1)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if _, result := quicHello(frames); result != inspectMore {
+		t.Fatalf("expected more data, got %d", result)
+	}
+	more, err := quicInitialCrypto(p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, more...)
+	if !bytes.Equal(assembleCrypto(frames), hello) {
+		t.Fatal("CRYPTO stream not reassembled")
+	}
+	if hello, result := quicHello(frames); result != inspectFound || hello.Host != "open.spotify.com" || hello.JA4[0] != 'q' {
+		t.Fatalf("quicHello = %+v, %d", hello, result)
+	}
+
+	// Tampered packets fail authentication
+	p1[len(p1)-1] ^= 1
+	if _, err := quicInitialCrypto(p1); err == nil {
+		t.Fatal("expected authentication failure")
+	}
+	if _, err := quicInitialCrypto([]byte{0x40, 1, 2, 3, 4, 5, 6, 7}); err != errNotQUICInitial {
+		t.Fatalf("short header: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+)
+
+const (
+	// maxInspectPackets is how many client packets of a flow are inspected
+	// before giving up on finding its hostname.
+	maxInspectPackets = 8
+	// stateIdle drops the inspection state of flows quiet for this long.
+	stateIdle = 2 * time.Minute
+	// gcEvery is how many packets are handled between state cleanups, and
+	// gcInterval the longest time between them.
+	gcEvery    = 4096
+	gcInterval = time.Minute
+	// alpnMismatchScale lowers the confidence of a hostname match when the
+	// ClientHello offers none of the app's ALPN protocols.
+	alpnMismatchScale = 0.5
+)
+
+// Stats counts the packets and flows seen by a Tracker.
+type Stats struct {
+	Packets  uint64 // packets read
+	Skipped  uint64 // packets that were not TCP/UDP over IP
+	Flows    uint64 // flows created in the cache
+	Detected uint64 // flows whose app was identified
+}
+
+// flowState is the inspection state of a flow whose hostname is unknown.
+type flowState struct {
+	stream   []byte // first bytes sent by the client (TCP)
+	nextSeq  uint32
+	crypto   []cryptoFrame // CRYPTO frames of QUIC Initial packets
+	packets  int
+	done     bool
+	lastSeen time.Time
+}
+
+// Tracker accounts captured packets to flows in the AppID flow cache and
+// identifies the app of each flow from its first packets. A Tracker is fed
+// by a single goroutine.
+type Tracker struct {
+	cache    *appid.FlowCache
+	detector *appid.Detector
+	dns      *appid.DNSCache
+
+	// Now stamps the flows; it defaults to time.Now, so flows read from an
+	// old capture file are not expired by the cache right away.
+	Now func() time.Time
+
+	states  map[appid.FlowKey]*flowState
+	handled uint64
+	lastGC  time.Time
+
+	packets, skipped, flows, detected atomic.Uint64
+}
+
+// NewTracker creates a tracker feeding cache with apps identified by
+// detector. The DNS answers it sees are recorded in dns, which may be shared
+// with the socket server; the caller expires them with dns.GC.
+func NewTracker(cache *appid.FlowCache, detector *appid.Detector, dns *appid.DNSCache) *Tracker {
+	return &Tracker{
+		cache:    cache,
+		detector: detector,
+		dns:      dns,
+		Now:      time.Now,
+		states:   make(map[appid.FlowKey]*flowState),
+	}
+}
+
+// Stats returns the counters of the tracker. It is safe to call while
+// packets are being handled.
+func (t *Tracker) Stats() Stats {
+	return Stats{
+		Packets:  t.packets.Load(),
+		Skipped:  t.skipped.Load(),
+		Flows:    t.flows.Load(),
+		Detected: t.detected.Load(),
+	}
+}
+
+// Run reads packets from src until it is exhausted (io.EOF, returns nil),
+// fails, or ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context, src Source) error {
+	linkType := src.LinkType()
+	var p Packet
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		data, _, err := src.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if errors.Is(err, ErrTimeout) {
+				// No traffic: still drop the state of flows that went quiet
+				t.maybeGC(t.Now())
+				continue
+			}
+			return err
+		}
+		t.packets.Add(1)
+		if err := Decode(linkType, data, &p); err != nil {
+			t.skipped.Add(1)
+			continue
+		}
+		t.HandlePacket(&p)
+	}
+}
+
+// HandlePacket accounts a decoded packet and inspects its payload.
+func (t *Tracker) HandlePacket(p *Packet) {
+	now := t.Now()
+	key, out := t.orient(p)
+	if t.cache.Account(key, uint64(p.Length), out, now) {
+		t.flows.Add(1)
+		t.classifyByAddress(key)
+	}
+
+	// DNS answers name the addresses the client connects to next
+	if p.Protocol == ProtoUDP && p.SrcPort == 53 && len(p.Payload) > 0 {
+		t.recordDNS(p.DstIP, p.Payload, now)
+	}
+
+	if out && len(p.Payload) > 0 {
+		t.inspect(key, p, now)
+	}
+	if p.Protocol == ProtoTCP && p.TCPFlags&(tcpFIN|tcpRST) != 0 {
+		delete(t.states, key)
+	}
+
+	if t.handled++; t.handled%gcEvery == 0 {
+		t.gc(now)
+	} else {
+		t.maybeGC(now)
+	}
+}
+
+// orient returns the key of the flow of p, oriented from the client to the
+// server, and whether p was sent by the client.
+func (t *Tracker) orient(p *Packet) (appid.FlowKey, bool) {
+	key := appid.FlowKey{
+		SrcIP:    p.SrcIP.String(),
+		DstIP:    p.DstIP.String(),
+		SrcPort:  p.SrcPort,
+		DstPort:  p.DstPort,
+		Protocol: p.Protocol,
+	}
+	reverse := appid.FlowKey{
+		SrcIP:    key.DstIP,
+		DstIP:    key.SrcIP,
+		SrcPort:  key.DstPort,
+		DstPort:  key.SrcPort,
+		Protocol: key.Protocol,
+	}
+
+	if _, ok := t.cache.Get(key); ok {
+		return key, true
+	}
+	if _, ok := t.cache.Get(reverse); ok {
+		return reverse, false
+	}
+
+	// New flow: the sender of a SYN is the client, the sender of a SYN-ACK
+	// the server. Otherwise (mid-stream or UDP) the lower port is the server.
+	if p.Protocol == ProtoTCP && p.TCPFlags&tcpSYN != 0 {
+		if p.TCPFlags&tcpACK != 0 {
+			return reverse, false
+		}
+		return key, true
+	}
+	if p.SrcPort < p.DstPort {
+		return reverse, false
+	}
+	return key, true
+}
+
+// inspect looks for the hostname in a packet sent by the client.
+func (t *Tracker) inspect(key appid.FlowKey, p *Packet, now time.Time) {
+	st, ok := t.states[key]
+	if !ok {
+		st = &flowState{}
+		if p.Protocol == ProtoTCP {
+			st.nextSeq = p.Seq
+		}
+		t.states[key] = st
+	}
+	if st.done {
+		return
+	}
+	st.lastSeen = now
+	st.packets++
+
+	var hello helloInfo
+	result := inspectGiveUp
+	switch p.Protocol {
+	case ProtoTCP:
+		// Only in-order segments extend the stream; retransmissions and
+		// segments after a gap count against the packet budget.
+		if p.Seq != st.nextSeq {
+			result = inspectMore
+			break
+		}
+		st.nextSeq += uint32(len(p.Payload))
+		st.stream = append(st.stream, p.Payload...)
+		hello, result = inspectStream(st.stream)
+		if result == inspectMore && len(st.stream) >= maxStream {
+			result = inspectGiveUp
+		}
+
+	case ProtoUDP:
+		if !isQUICInitial(p.Payload) {
+			break
+		}
+		frames, err := quicInitialCrypto(p.Payload)
+		if err != nil {
+			break
+		}
+		st.crypto = append(st.crypto, frames...)
+		hello, result = quicHello(st.crypto)
+	}
+
+	if result == inspectMore && st.packets < maxInspectPackets {
+		return
+	}
+	// Keep a finished marker so later packets are not inspected again
+	t.states[key] = &flowState{done: true, lastSeen: now}
+	if result == inspectFound {
+		t.classifyHello(key, hello)
+	}
+}
+
+// classifyHello sets the app of a flow from its SNI or HTTP Host, checked
+// against the ALPN protocols offered, else from its TLS fingerprints.
+func (t *Tracker) classifyHello(key appid.FlowKey, hello helloInfo) {
+	if hello.Host != "" {
+		t.cache.SetHostname(key, hello.Host)
+		if m := t.detector.MatchHostname(hello.Host); m.App != nil {
+			confidence := m.Confidence
+			if !m.App.MatchesALPN(hello.ALPN...) {
+				confidence *= alpnMismatchScale
+			}
+			t.setApp(key, m.App, confidence, appid.SourceSNI)
+			return
+		}
+	}
+	for _, fp := range []string{hello.JA4, hello.JA3} {
+		if fp == "" {
+			continue
+		}
+		if app, confidence := t.detector.DetectByFingerprint(fp); app != nil {
+			t.setApp(key, app, confidence, appid.SourceFingerprint)
+			return
+		}
+	}
+}
+
+// classify sets the app of a flow from a hostname seen on it (scale < 1 for
+// names learnt indirectly).
+func (t *Tracker) classify(key appid.FlowKey, host string, scale float32, source string) {
+	t.cache.SetHostname(key, host)
+	if m := t.detector.MatchHostname(host); m.App != nil {
+		t.setApp(key, m.App, m.Confidence*scale, source)
+	}
+}
+
+// setApp records the app of a flow, counting flows identified for the first time.
+func (t *Tracker) setApp(key appid.FlowKey, app *appid.AppDefinition, confidence float32, source string) {
+	if flow, ok := t.cache.Get(key); ok && flow.AppName == "" {
+		t.detected.Add(1)
+	}
+	t.cache.SetApp(key, app.Name, string(app.Category), confidence, source)
+}
+
+// classifyByAddress guesses the app of a new flow from the DNS answers the
+// client received for the server address, or from the signature IP ranges.
+func (t *Tracker) classifyByAddress(key appid.FlowKey) {
+	ip := net.ParseIP(key.DstIP)
+	if name, shared, ok := t.dns.Lookup(net.ParseIP(key.SrcIP), ip, t.Now()); ok {
+		scale := float32(appid.DNSConfidence)
+		if shared {
+			scale = appid.DNSSharedConfidence
+		}
+		t.classify(key, name, scale, appid.SourceDNS)
+		return
+	}
+	if app, confidence := t.detector.DetectByIP(ip); app != nil {
+		t.setApp(key, app, confidence, appid.SourceIP)
+	}
+}
+
+// recordDNS remembers the A/AAAA answers of a DNS response sent to client.
+func (t *Tracker) recordDNS(client net.IP, msg []byte, now time.Time) {
+	answers, _ := parseDNSAnswers(msg)
+	for _, a := range answers {
+		t.dns.Observe(client, a.Name, a.IP, a.TTL, now)
+	}
+}
+
+// maybeGC runs gc when the last cleanup is gcInterval old.
+func (t *Tracker) maybeGC(now time.Time) {
+	if t.lastGC.IsZero() {
+		t.lastGC = now
+	}
+	if now.Sub(t.lastGC) >= gcInterval {
+		t.gc(now)
+	}
+}
+
+// gc drops idle inspection state.
+func (t *Tracker) gc(now time.Time) {
+	t.lastGC = now
+	for key, st := range t.states {
+		if now.Sub(st.lastSeen) > stateIdle {
+			delete(t.states, key)
+		}
+	}
+}
+
+// LogStats logs the counters of the tracker.
+func (t *Tracker) LogStats() {
+	s := t.Stats()
+	log.Printf("Capture: %d packets (%d skipped), %d flows, %d identified", s.Packets, s.Skipped, s.Flows, s.Detected)
+}
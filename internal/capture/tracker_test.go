@@ -0,0 +1,214 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+)
+
+// dnsResponse builds a response for name answered by a CNAME and then addrs.
+func dnsResponse(name string, ttl uint32, addrs ...string) []byte {
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, byte(1 + len(addrs)), 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1)
+
+	// CNAME to cdn.example.net, then the addresses under a pointer to it
+	cname := []byte{3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'n', 'e', 't', 0}
+	msg = append(msg, 0xc0, 12, 0, 5, 0, 1)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(cname)))
+	target := len(msg)
+	msg = append(msg, cname...)
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		rrType, rdata := uint16(28), ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			rrType, rdata = 1, ip4
+		}
+		msg = append(msg, 0xc0, byte(target))
+		msg = binary.BigEndian.AppendUint16(msg, rrType)
+		msg = append(msg, 0, 1)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestParseDNSAnswers(t *testing.T) {
+	answers, err := parseDNSAnswers(dnsResponse("Api.TikTok.com", 30, "203.0.113.5", "2001:db8::5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 {
+		t.Fatalf("answers = %+v", answers)
+	}
+	for _, a := range answers {
+		if a.Name != "api.tiktok.com" || a.TTL != 30*time.Second {
+			t.Errorf("answer %+v", a)
+		}
+	}
+	if answers[1].IP.String() != "2001:db8::5" {
+		t.Errorf("AAAA = %s", answers[1].IP)
+	}
+
+	// Queries and truncated messages carry no answers
+	query := dnsResponse("a.com", 1, "192.0.2.1")
+	query[2] = 0x01
+	if answers, _ := parseDNSAnswers(query); len(answers) != 0 {
+		t.Fatal("query parsed as response")
+	}
+	if _, err := parseDNSAnswers(dnsResponse("a.com", 1, "192.0.2.1")[:40]); err == nil {
+		t.Fatal("expected error for truncated response")
+	}
+}
+
+func TestInspectStream(t *testing.T) {
+	hello := clientHelloRecord(t, "WWW.Netflix.com")
+	if info, result := inspectStream(hello[:100]); result != inspectMore || info.Host != "" {
+		t.Fatalf("partial ClientHello = %+v, %d", info, result)
+	}
+	if info, result := inspectStream(hello); result != inspectFound || info.Host != "www.netflix.com" || info.JA3 == "" {
+		t.Fatalf("ClientHello = %+v, %d", info, result)
+	}
+
+	req := "GET /watch HTTP/1.1\r\nUser-Agent: x\r\nhost: www.youtube.com:8080\r\n\r\n"
+	if _, result := inspectStream([]byte(req[:20])); result != inspectMore {
+		t.Fatal("partial request not waiting for more")
+	}
+	if info, result := inspectStream([]byte(req)); result != inspectFound || info.Host != "www.youtube.com" {
+		t.Fatalf("HTTP = %+v, %d", info, result)
+	}
+	if _, result := inspectStream([]byte("SSH-2.0-OpenSSH_9.6\r\n")); result != inspectGiveUp {
+		t.Fatal("SSH not given up")
+	}
+}
+
+func TestTracker_PcapFile(t *testing.T) {
+	const client = "192.168.1.10"
+	c := newTestCapture(LinkTypeEthernet)
+	add := func(src, dst string, proto uint8, transport []byte) int {
+		pkt := ipPacket(src, dst, proto, transport)
+		c.add(ethernet(pkt))
+		return len(pkt)
+	}
+
+	// TLS: handshake, then a ClientHello split over two segments
+	var tlsOut, tlsIn int
+	hello := clientHelloRecord(t, "www.netflix.com")
+	tlsOut += add(client, "198.51.100.7", ProtoTCP, tcpSegment(50000, 443, 100, tcpSYN, nil))
+	tlsIn += add("198.51.100.7", client, ProtoTCP, tcpSegment(443, 50000, 900, tcpSYN|tcpACK, nil))
+	tlsOut += add(client, "198.51.100.7", ProtoTCP, tcpSegment(50000, 443, 101, tcpACK, nil))
+	tlsOut += add(client, "198.51.100.7", ProtoTCP, tcpSegment(50000, 443, 101, tcpACK, hello[:100]))
+	tlsOut += add(client, "198.51.100.7", ProtoTCP, tcpSegment(50000, 443, 101+100, tcpACK, hello[100:]))
+	tlsIn += add("198.51.100.7", client, ProtoTCP, tcpSegment(443, 50000, 901, tcpACK, make([]byte, 1000)))
+
+	// HTTP captured mid-stream: the lower port is the server
+	add(client, "198.51.100.8", ProtoTCP, tcpSegment(50001, 80, 1, tcpACK, []byte("GET / HTTP/1.1\r\nHost: m.youtube.com\r\n\r\n")))
+
+	// DNS answer, then a connection to the answered address without SNI
+	add("192.168.1.1", client, ProtoUDP, udpDatagram(53, 40000, dnsResponse("api.tiktokv.com", 300, "203.0.113.5")))
+	add(client, "203.0.113.5", ProtoTCP, tcpSegment(50002, 8443, 1, tcpSYN, nil))
+
+	// QUIC over IPv6, ClientHello in two Initial packets
+	qhello := clientHelloRecord(t, "open.spotify.com")[5:]
+	half := len(qhello) / 2
+	dcid := []byte{9, 8, 7, 6, 5, 4, 3, 2}
+	add("2001:db8::10", "2001:db8::443", ProtoUDP, udpDatagram(50003, 443, quicInitial(t, dcid, 0, []cryptoFrame{{offset: 0, data: qhello[:half]}})))
+	add("2001:db8::10", "2001:db8::443", ProtoUDP, udpDatagram(50003, 443, quicInitial(t, dcid, 1, []cryptoFrame{{offset: uint64(half), data: qhello[half:]}})))
+
+	// Not TCP/UDP
+	c.add(ethernet(ipPacket(client, "192.0.2.1", 1, make([]byte, 8))))
+
+	src, err := OpenPcap(c.write(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	cache := appid.NewFlowCache(100, time.Minute)
+	dns := appid.NewDNSCache(100)
+	tracker := NewTracker(cache, appid.NewDetector(), dns)
+	if err := tracker.Run(context.Background(), src); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	stats := tracker.Stats()
+	if stats.Packets != 12 || stats.Skipped != 1 || stats.Flows != 5 || stats.Detected != 4 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	flow := func(src, dst string, sport, dport uint16, proto uint8) *appid.FlowInfo {
+		t.Helper()
+		f, ok := cache.Get(appid.FlowKey{SrcIP: src, DstIP: dst, SrcPort: sport, DstPort: dport, Protocol: proto})
+		if !ok {
+			t.Fatalf("flow %s:%d -> %s:%d not found", src, sport, dst, dport)
+		}
+		return f
+	}
+
+	f := flow(client, "198.51.100.7", 50000, 443, ProtoTCP)
+	if f.AppName != "netflix" || f.AppCategory != "streaming_media" || f.Hostname != "www.netflix.com" || f.Source != appid.SourceSNI {
+		t.Errorf("TLS flow = %+v", f)
+	}
+	if f.BytesOut != uint64(tlsOut) || f.BytesIn != uint64(tlsIn) || f.PacketCount != 6 {
+		t.Errorf("TLS counters out=%d in=%d packets=%d, want %d %d 6", f.BytesOut, f.BytesIn, f.PacketCount, tlsOut, tlsIn)
+	}
+
+	if f := flow(client, "198.51.100.8", 50001, 80, ProtoTCP); f.AppName != "youtube" || f.Hostname != "m.youtube.com" {
+		t.Errorf("HTTP flow = %+v", f)
+	}
+
+	f = flow(client, "203.0.113.5", 50002, 8443, ProtoTCP)
+	if f.AppName != "tiktok" || f.Hostname != "api.tiktokv.com" || f.Confidence >= 0.9 || f.Source != appid.SourceDNS {
+		t.Errorf("DNS-correlated flow = %+v", f)
+	}
+
+	if f := flow("2001:db8::10", "2001:db8::443", 50003, 443, ProtoUDP); f.AppName != "spotify" || f.Hostname != "open.spotify.com" || f.PacketCount != 2 {
+		t.Errorf("QUIC flow = %+v", f)
+	}
+
+	if name, shared, ok := dns.Lookup(net.ParseIP(client), net.ParseIP("203.0.113.5"), time.Now()); !ok || shared || name != "api.tiktokv.com" {
+		t.Errorf("DNS cache lookup = %q shared=%v ok=%v", name, shared, ok)
+	}
+
+	// The DNS flow itself is oriented from the client to the resolver
+	if f := flow(client, "192.168.1.1", 40000, 53, ProtoUDP); f.BytesIn == 0 || f.BytesOut != 0 {
+		t.Errorf("DNS flow = %+v", f)
+	}
+}
+
+func TestTracker_PrunesStateOnTimer(t *testing.T) {
+	cache := appid.NewFlowCache(100, time.Hour)
+	tracker := NewTracker(cache, appid.NewDetector(), appid.NewDNSCache(100))
+	now := time.Unix(1700000000, 0)
+	tracker.Now = func() time.Time { return now }
+
+	// A ClientHello that never completes leaves inspection state behind
+	hello := clientHelloRecord(t, "www.netflix.com")
+	tracker.HandlePacket(&Packet{
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("192.0.2.1"), SrcPort: 50000, DstPort: 443,
+		Protocol: ProtoTCP, TCPFlags: tcpACK, Seq: 1, Length: 100, Payload: hello[:50],
+	})
+	if len(tracker.states) != 1 {
+		t.Fatalf("states = %d, want 1", len(tracker.states))
+	}
+
+	// Far fewer than gcEvery packets later, the idle state is dropped anyway
+	now = now.Add(stateIdle + time.Second)
+	tracker.HandlePacket(&Packet{
+		SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("192.0.2.1"), SrcPort: 50001, DstPort: 443,
+		Protocol: ProtoTCP, TCPFlags: tcpACK, Seq: 1, Length: 40,
+	})
+	if len(tracker.states) != 0 {
+		t.Fatalf("states = %d, want 0", len(tracker.states))
+	}
+}
@@ -30,27 +30,121 @@ type Config struct {
 	ActiveIPsTimeout time.Duration
 	// ActiveIPsMax caps the number of tracked IPs
 	ActiveIPsMax int
+	// ActiveIPsStateFile persists the per-IP counters across restarts (empty = disabled)
+	ActiveIPsStateFile string
 
 	// AgentListenAddr enables the agent HTTP API listener when non-empty (e.g. "192.168.1.1:18443")
 	AgentListenAddr string
 	// AgentTTL removes agent entries after this idle time (no heartbeat)
 	AgentTTL time.Duration
+	// AgentAuthMode is off, flag (accept unsigned heartbeats as unverified) or require
+	AgentAuthMode string
+	// AgentKeysFile lists the agent HMAC keys, one "KEY_ID;SECRET" per line
+	AgentKeysFile string
+	// AgentTLSMode is off (plain HTTP), on (HTTPS and plain HTTP on the same port) or require
+	AgentTLSMode string
+	// AgentTLSCertFile and AgentTLSKeyFile hold the agent API certificate (self-signed one generated if both are missing)
+	AgentTLSCertFile string
+	AgentTLSKeyFile  string
+	// AgentInventoryFile persists the agent inventory (empty = memory only)
+	AgentInventoryFile string
+	// AgentEnroll is auto (new signed agents approved on first heartbeat) or manual (pending until approved)
+	AgentEnroll string
+	// AgentInventoryMax caps the number of agents in the inventory
+	AgentInventoryMax int
+	// AgentStaleAfter reports agents without a heartbeat for this long as stale
+	AgentStaleAfter time.Duration
+	// AgentConfigFile is the agent configuration pushed in heartbeat responses (missing = none)
+	AgentConfigFile string
+	// AgentUpdateDir holds the signed agent update manifests, one "<channel>.json" per channel
+	AgentUpdateDir string
+
+	// ConnectionsFile is the JSON snapshot file path for the live connection table
+	ConnectionsFile string
+	// RevokeOnReload closes live connections that a rules reload now blocks
+	RevokeOnReload bool
+	// AdminListenAddr enables the local admin HTTP API when non-empty. It must be
+	// a loopback address (e.g. "127.0.0.1:18444"): the API is not authenticated.
+	AdminListenAddr string
+
+	// MaxConns caps in-flight connections across all clients (0 = unlimited)
+	MaxConns int
+	// MaxConnsPerIP caps concurrent connections from one source IP (0 = unlimited,
+	// the default: clients behind NAT share an IP)
+	MaxConnsPerIP int
+	// MaxConnRatePerIP caps new connections per second from one source IP (0 = unlimited)
+	MaxConnRatePerIP int
+
+	// QuotaFile persists data quota counters across restarts (empty = memory only)
+	QuotaFile string
+	// QuotaSaveInterval controls how often the quota counters are written
+	QuotaSaveInterval time.Duration
+
+	// HistoryDir holds the traffic history files (empty = disabled)
+	HistoryDir string
+	// HistoryMaxSeries caps the number of keys per dimension (IP, user, group, domain)
+	HistoryMaxSeries int
+	// HistorySaveInterval controls how often the traffic history is written
+	HistorySaveInterval time.Duration
+
+	// AppIDMode selects how applications are identified: off, local (in-process
+	// hostname signatures) or daemon (zid-appid over its Unix socket)
+	AppIDMode string
+	// AppIDSocket is the zid-appid Unix socket used in daemon mode
+	AppIDSocket string
+	// AppIDTimeout bounds each zid-appid lookup
+	AppIDTimeout time.Duration
+	// AppIDFailOpen lets connections through when zid-appid does not answer
+	AppIDFailOpen bool
+	// AppIDReportFlows reports each relayed connection (5-tuple, SNI, bytes)
+	// to zid-appid in daemon mode, for its per-IP app usage
+	AppIDReportFlows bool
+	// AppIDSignaturesFile is the application signature database used in local mode (missing = built-ins only)
+	AppIDSignaturesFile string
+	// AppIDRulesFile holds the ALLOW_APP/BLOCK_APP rules per group (missing = none)
+	AppIDRulesFile string
 }
 
 // Default returns a Config with default values
 func Default() *Config {
 	return &Config{
-		ListenAddr:        ":443",
-		RulesFile:         "/usr/local/etc/zid-proxy/access_rules.txt",
-		LogFile:           "/var/log/zid-proxy.log",
-		PidFile:           "/var/run/zid-proxy.pid",
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		ActiveIPsFile:     "/var/run/zid-proxy.active_ips.json",
-		ActiveIPsInterval: 2 * time.Second,
-		ActiveIPsTimeout:  300 * time.Second,
-		ActiveIPsMax:      5000,
-		AgentListenAddr:   "",
-		AgentTTL:          60 * time.Second,
+		ListenAddr:          ":443",
+		RulesFile:           "/usr/local/etc/zid-proxy/access_rules.txt",
+		LogFile:             "/var/log/zid-proxy.log",
+		PidFile:             "/var/run/zid-proxy.pid",
+		ReadTimeout:         30 * time.Second,
+		WriteTimeout:        30 * time.Second,
+		ActiveIPsFile:       "/var/run/zid-proxy.active_ips.json",
+		ActiveIPsInterval:   2 * time.Second,
+		ActiveIPsTimeout:    300 * time.Second,
+		ActiveIPsMax:        5000,
+		AgentListenAddr:     "",
+		AgentTTL:            60 * time.Second,
+		AgentAuthMode:       "flag",
+		AgentKeysFile:       "/usr/local/etc/zid-proxy/agent_keys.txt",
+		AgentTLSMode:        "on",
+		AgentTLSCertFile:    "/usr/local/etc/zid-proxy/agent_tls.crt",
+		AgentTLSKeyFile:     "/usr/local/etc/zid-proxy/agent_tls.key",
+		AgentInventoryFile:  "/var/db/zid-proxy/agents.json",
+		AgentEnroll:         "auto",
+		AgentInventoryMax:   10000,
+		AgentStaleAfter:     7 * 24 * time.Hour,
+		AgentConfigFile:     "/usr/local/etc/zid-proxy/agent_config.json",
+		AgentUpdateDir:      "/usr/local/etc/zid-proxy/agent-updates",
+		ConnectionsFile:     "/var/run/zid-proxy.connections.json",
+		AdminListenAddr:     "127.0.0.1:18444",
+		MaxConns:            10000,
+		QuotaFile:           "/var/db/zid-proxy/quota.json",
+		QuotaSaveInterval:   30 * time.Second,
+		HistoryDir:          "/var/db/zid-proxy/history",
+		HistoryMaxSeries:    2000,
+		HistorySaveInterval: 60 * time.Second,
+		AppIDMode:           "local",
+		AppIDSocket:         "/var/run/zid-appid.sock",
+		AppIDTimeout:        200 * time.Millisecond,
+		AppIDFailOpen:       true,
+		AppIDReportFlows:    true,
+		AppIDSignaturesFile: "/usr/local/share/zid-proxy/appid_signatures.json",
+		AppIDRulesFile:      "/usr/local/etc/zid-proxy/appid_rules.txt",
 	}
 }
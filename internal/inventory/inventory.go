@@ -0,0 +1,441 @@
+// Package inventory keeps a persistent record of every zid-agent that has
+// sent a heartbeat, keyed by the stable agent ID generated on its first run,
+// together with its enrollment state.
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the enrollment state of an agent.
+type State string
+
+const (
+	StatePending  State = "pending"  // seen, waiting for an admin (identity not applied)
+	StateApproved State = "approved" // identity applied to the agent's IP
+	StateRevoked  State = "revoked"  // heartbeats rejected
+)
+
+// ParseState parses an enrollment state name.
+func ParseState(s string) (State, error) {
+	switch st := State(strings.ToLower(strings.TrimSpace(s))); st {
+	case StatePending, StateApproved, StateRevoked:
+		return st, nil
+	}
+	return "", fmt.Errorf("invalid agent state %q (expected pending, approved or revoked)", s)
+}
+
+const (
+	// MaxIPHistory is the number of distinct IPs remembered per agent.
+	MaxIPHistory = 10
+	// DefaultStaleAfter marks agents without a heartbeat for this long as stale.
+	DefaultStaleAfter = 7 * 24 * time.Hour
+	// DefaultMaxRecords caps the number of agents in the inventory.
+	DefaultMaxRecords = 10000
+
+	stateVersion = 1
+	maxIDLen     = 64
+)
+
+var (
+	ErrNotFound    = errors.New("agent not found")
+	ErrInvalidID   = errors.New("invalid agent id")
+	ErrKeyMismatch = errors.New("agent id is bound to another key")
+	ErrFull        = errors.New("agent inventory is full")
+)
+
+// Heartbeat carries what one agent heartbeat tells about the agent.
+type Heartbeat struct {
+	ID       string
+	Hostname string
+	Username string
+	Version  string
+	OS       string
+	IP       string
+	KeyID    string
+	Verified bool
+}
+
+// IPSeen is one entry of an agent's IP history.
+type IPSeen struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Record is the persistent inventory entry of one agent.
+type Record struct {
+	ID       string `json:"id"`
+	State    State  `json:"state"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	Version  string `json:"agent_version,omitempty"`
+	OS       string `json:"os,omitempty"`
+	// KeyID is the key of the first verified heartbeat; once set, only
+	// heartbeats signed with it are accepted for this ID.
+	KeyID     string    `json:"key_id,omitempty"`
+	Verified  bool      `json:"verified"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastIP    string    `json:"last_ip"`
+	IPHistory []IPSeen  `json:"ip_history,omitempty"`
+}
+
+// Options configures a Store.
+type Options struct {
+	// Path is the JSON state file (empty = memory only).
+	Path string
+	// AutoApprove enrolls new agents with a verified heartbeat as approved
+	// instead of pending.
+	AutoApprove bool
+	// StaleAfter is the idle time after which an agent is reported stale.
+	StaleAfter time.Duration
+	// MaxRecords caps the number of agents (default DefaultMaxRecords).
+	MaxRecords int
+}
+
+// Store is the agent inventory.
+type Store struct {
+	mu      sync.Mutex
+	opts    Options
+	agents  map[string]*Record
+	changes uint64 // incremented by every change
+	saved   uint64 // changes written by the last successful Save
+	loadErr error  // the file failed to load and could not be moved aside
+
+	saveMu sync.Mutex // serializes Save
+}
+
+type stateFile struct {
+	Version int       `json:"version"`
+	Agents  []*Record `json:"agents"`
+}
+
+// Snapshot is the JSON document served by the admin API.
+type Snapshot struct {
+	Version     int     `json:"version"`
+	GeneratedAt string  `json:"generated_at"`
+	Agents      []Entry `json:"agents"`
+}
+
+// Entry is a Record plus the fields derived at snapshot time.
+type Entry struct {
+	Record
+	Stale bool `json:"stale"`
+}
+
+// Open creates a Store and loads opts.Path. A missing file is not an error.
+// A file that cannot be decoded is renamed aside (".bad" suffix) so the next
+// Save does not overwrite it, and Open returns an error; if it cannot be read
+// or moved, Save refuses to write it.
+func Open(opts Options) (*Store, error) {
+	if opts.StaleAfter <= 0 {
+		opts.StaleAfter = DefaultStaleAfter
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = DefaultMaxRecords
+	}
+	s := &Store{opts: opts, agents: make(map[string]*Record)}
+	if opts.Path == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		s.loadErr = err
+		return s, err
+	}
+	var st stateFile
+	if err := json.Unmarshal(b, &st); err != nil {
+		return s, s.moveAside(err)
+	}
+	if st.Version != stateVersion {
+		return s, s.moveAside(fmt.Errorf("unsupported agent inventory version %d", st.Version))
+	}
+	for _, r := range st.Agents {
+		if r == nil || !ValidID(r.ID) {
+			continue
+		}
+		if _, err := ParseState(string(r.State)); err != nil {
+			r.State = StatePending
+		}
+		s.agents[r.ID] = r
+	}
+	return s, nil
+}
+
+// moveAside renames the file that failed to load with err, or keeps Save
+// from writing over it when it cannot be renamed.
+func (s *Store) moveAside(err error) error {
+	bad := s.opts.Path + ".bad"
+	if rerr := os.Rename(s.opts.Path, bad); rerr != nil {
+		s.loadErr = err
+		return err
+	}
+	return fmt.Errorf("%w (moved to %s)", err, bad)
+}
+
+// AutoApprove reports whether new verified agents are approved on first contact.
+func (s *Store) AutoApprove() bool {
+	return s.opts.AutoApprove
+}
+
+// ValidID reports whether id looks like an agent ID (1-64 letters, digits or dashes).
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Seen records a heartbeat and returns the agent's updated record. New agents
+// are enrolled as pending, or approved when AutoApprove is set and the
+// heartbeat is verified; a new ID signed with the key of a revoked agent is
+// enrolled as revoked. The first verified heartbeat binds the ID to its key,
+// after which heartbeats not signed with that key fail with ErrKeyMismatch.
+// When the inventory is full, the least recently seen pending agent without a
+// key makes room, or the heartbeat fails with ErrFull.
+func (s *Store) Seen(hb Heartbeat, now time.Time) (Record, error) {
+	if !ValidID(hb.ID) {
+		return Record{}, ErrInvalidID
+	}
+	now = now.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.agents[hb.ID]
+	if r == nil {
+		if len(s.agents) >= s.opts.MaxRecords && !s.evictPending() {
+			return Record{}, ErrFull
+		}
+		r = &Record{ID: hb.ID, State: StatePending, FirstSeen: now}
+		switch {
+		case hb.Verified && s.revokedKey(hb.KeyID):
+			r.State = StateRevoked
+		case hb.Verified && s.opts.AutoApprove:
+			r.State = StateApproved
+		}
+		s.agents[hb.ID] = r
+	} else if r.KeyID != "" && (!hb.Verified || hb.KeyID != r.KeyID) {
+		return copyRecord(r), ErrKeyMismatch
+	}
+	if hb.Verified && r.KeyID == "" {
+		r.KeyID = hb.KeyID
+	}
+	r.Hostname = hb.Hostname
+	r.Username = hb.Username
+	r.Version = hb.Version
+	r.OS = hb.OS
+	r.Verified = hb.Verified
+	r.LastSeen = now
+	r.LastIP = hb.IP
+	r.IPHistory = touchIP(r.IPHistory, hb.IP, now)
+	s.changes++
+	return copyRecord(r), nil
+}
+
+// revokedKey reports whether keyID is bound to a revoked agent.
+func (s *Store) revokedKey(keyID string) bool {
+	if keyID == "" {
+		return false
+	}
+	for _, r := range s.agents {
+		if r.KeyID == keyID && r.State == StateRevoked {
+			return true
+		}
+	}
+	return false
+}
+
+// evictPending removes the least recently seen pending agent that is not
+// bound to a key and reports whether one was found.
+func (s *Store) evictPending() bool {
+	var oldest *Record
+	for _, r := range s.agents {
+		if r.State != StatePending || r.KeyID != "" {
+			continue
+		}
+		if oldest == nil || r.LastSeen.Before(oldest.LastSeen) {
+			oldest = r
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(s.agents, oldest.ID)
+	return true
+}
+
+// touchIP moves ip to the front of the history, most recent first.
+func touchIP(history []IPSeen, ip string, now time.Time) []IPSeen {
+	if ip == "" {
+		return history
+	}
+	entry := IPSeen{IP: ip, FirstSeen: now, LastSeen: now}
+	for i, h := range history {
+		if h.IP == ip {
+			entry.FirstSeen = h.FirstSeen
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
+	}
+	history = append([]IPSeen{entry}, history...)
+	if len(history) > MaxIPHistory {
+		history = history[:MaxIPHistory]
+	}
+	return history
+}
+
+func copyRecord(r *Record) Record {
+	cp := *r
+	cp.IPHistory = append([]IPSeen(nil), r.IPHistory...)
+	return cp
+}
+
+// Get returns the record of agent id.
+func (s *Store) Get(id string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.agents[id]
+	if !ok {
+		return Record{}, false
+	}
+	return copyRecord(r), true
+}
+
+// SetState changes the enrollment state of agent id and saves the store.
+func (s *Store) SetState(id string, state State) error {
+	s.mu.Lock()
+	r, ok := s.agents[id]
+	if ok {
+		r.State = state
+		s.changes++
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return s.Save()
+}
+
+// Delete removes agent id and saves the store. A deleted agent that sends
+// another heartbeat enrolls again as a new agent.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	_, ok := s.agents[id]
+	if ok {
+		delete(s.agents, id)
+		s.changes++
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return s.Save()
+}
+
+// Snapshot lists the agents ordered by hostname then ID. An empty state
+// matches every agent; staleOnly keeps only agents idle for StaleAfter.
+func (s *Store) Snapshot(now time.Time, state State, staleOnly bool) Snapshot {
+	s.mu.Lock()
+	out := Snapshot{
+		Version:     1,
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Agents:      make([]Entry, 0, len(s.agents)),
+	}
+	for _, r := range s.agents {
+		if state != "" && r.State != state {
+			continue
+		}
+		stale := now.Sub(r.LastSeen) > s.opts.StaleAfter
+		if staleOnly && !stale {
+			continue
+		}
+		out.Agents = append(out.Agents, Entry{Record: copyRecord(r), Stale: stale})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out.Agents, func(i, j int) bool {
+		a, b := out.Agents[i], out.Agents[j]
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.ID < b.ID
+	})
+	return out
+}
+
+// SaveIfDirty writes the store when heartbeats changed it since the last save.
+func (s *Store) SaveIfDirty() error {
+	s.mu.Lock()
+	dirty := s.changes != s.saved
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return s.Save()
+}
+
+// Save writes the store to Options.Path via a temp file + rename. Saves are
+// serialized, so an older snapshot never replaces a newer one; changes stay
+// pending for SaveIfDirty until a save succeeds.
+func (s *Store) Save() error {
+	if s.opts.Path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if s.loadErr != nil {
+		err := s.loadErr
+		s.mu.Unlock()
+		return fmt.Errorf("not saving over an agent inventory that failed to load: %w", err)
+	}
+	st := stateFile{Version: stateVersion, Agents: make([]*Record, 0, len(s.agents))}
+	for _, r := range s.agents {
+		cp := copyRecord(r)
+		st.Agents = append(st.Agents, &cp)
+	}
+	changes := s.changes
+	s.mu.Unlock()
+
+	sort.Slice(st.Agents, func(i, j int) bool { return st.Agents[i].ID < st.Agents[j].ID })
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(s.opts.Path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.opts.Path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.opts.Path); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.saved = changes
+	s.mu.Unlock()
+	return nil
+}
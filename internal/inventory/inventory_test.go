@@ -0,0 +1,200 @@
+package inventory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_EnrollmentAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	now := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+
+	s, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	r, err := s.Seen(Heartbeat{ID: "a1b2", Hostname: "pc-01", Username: "diretor", Version: "1.2.0", OS: "windows/amd64", IP: "192.168.1.10"}, now)
+	if err != nil {
+		t.Fatalf("seen: %v", err)
+	}
+	if r.State != StatePending || !r.FirstSeen.Equal(now) {
+		t.Fatalf("new agent: %+v", r)
+	}
+
+	if err := s.SetState("a1b2", StateApproved); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if err := s.SetState("missing", StateApproved); err != ErrNotFound {
+		t.Fatalf("approve missing: got %v", err)
+	}
+
+	later := now.Add(time.Hour)
+	r, _ = s.Seen(Heartbeat{ID: "a1b2", Hostname: "pc-01", Username: "joao", Version: "1.3.0", IP: "192.168.1.20"}, later)
+	if r.State != StateApproved || r.Username != "joao" || r.Version != "1.3.0" || !r.FirstSeen.Equal(now) || !r.LastSeen.Equal(later) {
+		t.Fatalf("update: %+v", r)
+	}
+	if len(r.IPHistory) != 2 || r.IPHistory[0].IP != "192.168.1.20" || r.LastIP != "192.168.1.20" {
+		t.Fatalf("ip history: %+v", r.IPHistory)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, ok := s2.Get("a1b2")
+	if !ok || got.State != StateApproved || got.Username != "joao" || len(got.IPHistory) != 2 {
+		t.Fatalf("reloaded: %+v ok=%v", got, ok)
+	}
+}
+
+func TestStore_AutoApproveAndInvalidID(t *testing.T) {
+	s, _ := Open(Options{AutoApprove: true})
+	now := time.Unix(1700000000, 0)
+
+	r, err := s.Seen(Heartbeat{ID: "pc-01", IP: "10.0.0.1", KeyID: "pc-01", Verified: true}, now)
+	if err != nil || r.State != StateApproved {
+		t.Fatalf("auto approve: %+v %v", r, err)
+	}
+	// Unsigned agents are never approved automatically.
+	if r, _ := s.Seen(Heartbeat{ID: "pc-02", IP: "10.0.0.2"}, now); r.State != StatePending {
+		t.Fatalf("unsigned auto enroll: %+v", r)
+	}
+	for _, id := range []string{"", "has space", "../etc", string(make([]byte, 65))} {
+		if _, err := s.Seen(Heartbeat{ID: id}, now); err != ErrInvalidID {
+			t.Fatalf("id %q: got %v", id, err)
+		}
+	}
+}
+
+func TestStore_KeyBinding(t *testing.T) {
+	s, _ := Open(Options{AutoApprove: true})
+	now := time.Unix(1700000000, 0)
+
+	// An unsigned record is bound by the first verified heartbeat.
+	s.Seen(Heartbeat{ID: "pc-01", Hostname: "pc"}, now)
+	if r, err := s.Seen(Heartbeat{ID: "pc-01", Hostname: "pc", KeyID: "k1", Verified: true}, now); err != nil || r.KeyID != "k1" {
+		t.Fatalf("bind: %+v %v", r, err)
+	}
+	for _, hb := range []Heartbeat{
+		{ID: "pc-01", Hostname: "spoofed"},
+		{ID: "pc-01", Hostname: "spoofed", KeyID: "k2", Verified: true},
+	} {
+		if _, err := s.Seen(hb, now); err != ErrKeyMismatch {
+			t.Fatalf("%+v: got %v, want ErrKeyMismatch", hb, err)
+		}
+	}
+	if r, _ := s.Get("pc-01"); r.Hostname != "pc" {
+		t.Fatalf("record overwritten: %+v", r)
+	}
+
+	// A revoked agent's key cannot enroll a new ID.
+	s.Seen(Heartbeat{ID: "pc-02", KeyID: "k2", Verified: true}, now)
+	s.SetState("pc-02", StateRevoked)
+	if r, err := s.Seen(Heartbeat{ID: "pc-03", KeyID: "k2", Verified: true}, now); err != nil || r.State != StateRevoked {
+		t.Fatalf("re-enroll: %+v %v", r, err)
+	}
+}
+
+func TestStore_MaxRecords(t *testing.T) {
+	s, _ := Open(Options{MaxRecords: 2})
+	now := time.Unix(1700000000, 0)
+
+	s.Seen(Heartbeat{ID: "old"}, now)
+	s.Seen(Heartbeat{ID: "signed", KeyID: "k1", Verified: true}, now.Add(-time.Hour))
+	// The oldest unsigned pending agent makes room.
+	if _, err := s.Seen(Heartbeat{ID: "new"}, now.Add(time.Minute)); err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if _, ok := s.Get("old"); ok {
+		t.Fatal("old pending agent must be evicted")
+	}
+	s.SetState("new", StateApproved)
+	if _, err := s.Seen(Heartbeat{ID: "more"}, now); err != ErrFull {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+}
+
+func TestStore_CorruptFileMovedAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	if err := os.WriteFile(path, []byte(`{"version":9,"agents":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(Options{Path: path})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+	if _, err := os.Stat(path + ".bad"); err != nil {
+		t.Fatalf("bad file not kept: %v", err)
+	}
+	s.Seen(Heartbeat{ID: "a1"}, time.Now())
+	if err := s.SaveIfDirty(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if b, _ := os.ReadFile(path + ".bad"); string(b) != `{"version":9,"agents":[]}` {
+		t.Fatalf("bad file overwritten: %s", b)
+	}
+}
+
+func TestStore_FailedSaveIsRetried(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "db")
+	path := filepath.Join(blocker, "agents.json")
+	s, _ := Open(Options{Path: path})
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.Seen(Heartbeat{ID: "a1"}, time.Now())
+	if err := s.SaveIfDirty(); err == nil {
+		t.Fatal("save under a file succeeded")
+	}
+
+	os.Remove(blocker)
+	if err := s.SaveIfDirty(); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	loaded, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("a1"); !ok {
+		t.Fatal("change lost after a failed save")
+	}
+}
+
+func TestStore_IPHistoryIsCapped(t *testing.T) {
+	s, _ := Open(Options{})
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < MaxIPHistory+5; i++ {
+		s.Seen(Heartbeat{ID: "pc", IP: fmt.Sprintf("10.0.0.%d", i)}, now.Add(time.Duration(i)*time.Minute))
+	}
+	r, _ := s.Get("pc")
+	if len(r.IPHistory) != MaxIPHistory || r.IPHistory[0].IP != fmt.Sprintf("10.0.0.%d", MaxIPHistory+4) {
+		t.Fatalf("history=%+v", r.IPHistory)
+	}
+}
+
+func TestStore_SnapshotFilters(t *testing.T) {
+	s, _ := Open(Options{StaleAfter: 24 * time.Hour})
+	now := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+
+	s.Seen(Heartbeat{ID: "old", Hostname: "a-old"}, now.Add(-48*time.Hour))
+	s.Seen(Heartbeat{ID: "new", Hostname: "b-new"}, now)
+	_ = s.SetState("new", StateRevoked)
+
+	snap := s.Snapshot(now, "", false)
+	if len(snap.Agents) != 2 || snap.Agents[0].ID != "old" || !snap.Agents[0].Stale || snap.Agents[1].Stale {
+		t.Fatalf("all: %+v", snap.Agents)
+	}
+	if snap := s.Snapshot(now, "", true); len(snap.Agents) != 1 || snap.Agents[0].ID != "old" {
+		t.Fatalf("stale: %+v", snap.Agents)
+	}
+	if snap := s.Snapshot(now, StateRevoked, false); len(snap.Agents) != 1 || snap.Agents[0].ID != "new" {
+		t.Fatalf("revoked: %+v", snap.Agents)
+	}
+}
@@ -15,6 +15,12 @@ type Action string
 const (
 	ActionAllow Action = "ALLOW"
 	ActionBlock Action = "BLOCK"
+	// ActionRevoked marks a live connection closed because a rules reload now blocks it
+	ActionRevoked Action = "REVOKED"
+	// ActionReject marks a connection refused by the connection limits (before reading SNI)
+	ActionReject Action = "REJECT"
+	// ActionQuota marks a connection blocked because the client's data quota is used up
+	ActionQuota Action = "QUOTA"
 )
 
 // Entry represents a single log entry
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+// AppInfo is the application resolved for a connection.
+type AppInfo struct {
+	Name     string            // "" = unknown
+	Category appid.AppCategory // "" = unknown
+}
+
+// AppResolver identifies the application behind a connection from its SNI.
+// An empty name means the application is unknown.
+type AppResolver interface {
+	ResolveApp(srcIP net.IP, hostname string) (AppInfo, error)
+}
+
+// DetectorResolver resolves applications in-process with the AppID hostname
+// signatures.
+type DetectorResolver struct {
+	detector *appid.Detector
+}
+
+// NewDetectorResolver creates a resolver backed by detector.
+func NewDetectorResolver(detector *appid.Detector) *DetectorResolver {
+	return &DetectorResolver{detector: detector}
+}
+
+// ResolveApp implements AppResolver.
+func (r *DetectorResolver) ResolveApp(_ net.IP, hostname string) (AppInfo, error) {
+	app, _ := r.detector.DetectByHostname(hostname)
+	if app == nil {
+		return AppInfo{}, nil
+	}
+	return AppInfo{Name: app.Name, Category: app.Category}, nil
+}
+
+// cachedResolver is implemented by resolvers whose lookups are slow enough
+// to be kept off the connection path when the app only goes to the logs.
+type cachedResolver interface {
+	// CachedApp returns the last app resolved for hostname, if still cached,
+	// and resolves it in the background otherwise.
+	CachedApp(hostname string) (AppInfo, bool)
+}
+
+const (
+	// appCacheTTL is how long ClientResolver remembers the app of a hostname.
+	appCacheTTL = 5 * time.Minute
+	// appCacheMax bounds the cached hostnames; the cache is reset when full.
+	appCacheMax = 4096
+	// maxBackgroundLookups bounds the concurrent background lookups.
+	maxBackgroundLookups = 8
+)
+
+type cachedApp struct {
+	app     AppInfo
+	expires time.Time
+}
+
+// ClientResolver asks the zid-appid daemon over its Unix socket (LOOKUP_HOST).
+type ClientResolver struct {
+	client *appid.Client
+
+	mu      sync.Mutex
+	lastErr time.Time
+	cache   map[string]cachedApp
+	pending map[string]bool
+}
+
+// NewClientResolver creates a resolver for the daemon at socketPath. Each
+// lookup (connect, write and read) is bounded by timeout.
+func NewClientResolver(socketPath string, timeout time.Duration) *ClientResolver {
+	return &ClientResolver{
+		client:  appid.NewClient(socketPath, timeout),
+		cache:   make(map[string]cachedApp),
+		pending: make(map[string]bool),
+	}
+}
+
+// CachedApp implements cachedResolver.
+func (r *ClientResolver) CachedApp(hostname string) (AppInfo, bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.cache[hostname]; ok && now.Before(c.expires) {
+		return c.app, true
+	}
+	if !r.pending[hostname] && len(r.pending) < maxBackgroundLookups {
+		r.pending[hostname] = true
+		go func() {
+			_, _ = r.ResolveApp(nil, hostname)
+			r.mu.Lock()
+			delete(r.pending, hostname)
+			r.mu.Unlock()
+		}()
+	}
+	return AppInfo{}, false
+}
+
+// ResolveApp implements AppResolver.
+func (r *ClientResolver) ResolveApp(_ net.IP, hostname string) (AppInfo, error) {
+	app, err := r.lookup(hostname)
+	if err == nil {
+		r.mu.Lock()
+		if len(r.cache) >= appCacheMax {
+			r.cache = make(map[string]cachedApp)
+		}
+		r.cache[hostname] = cachedApp{app: app, expires: time.Now().Add(appCacheTTL)}
+		r.mu.Unlock()
+	}
+	return app, err
+}
+
+func (r *ClientResolver) lookup(hostname string) (AppInfo, error) {
+	res, err := r.client.LookupHost(hostname)
+	if err != nil {
+		// At most one warning per minute while the daemon is down
+		r.mu.Lock()
+		if now := time.Now(); now.Sub(r.lastErr) >= time.Minute {
+			r.lastErr = now
+			log.Printf("Warning: AppID lookup failed: %v", err)
+		}
+		r.mu.Unlock()
+		return AppInfo{}, err
+	}
+	if !res.Found {
+		return AppInfo{}, nil
+	}
+	return AppInfo{Name: res.AppName, Category: appid.AppCategory(res.Category)}, nil
+}
+
+// Close closes the connection to the daemon.
+func (r *ClientResolver) Close() error {
+	return r.client.Close()
+}
+
+// syncAppGroups shares the groups of the access rules with the app rules, so
+// AppRules.FindGroup selects the same group as the hostname rules.
+func (s *Server) syncAppGroups() {
+	if s.config.AppRules != nil {
+		s.config.AppRules.SetGroups(appid.GroupMembers(s.rules.Groups()))
+	}
+}
+
+// appDecides reports whether the app of a connection from srcIP can change
+// the verdict: its group has app rules or "@category:" rules.
+func (s *Server) appDecides(srcIP net.IP) bool {
+	if appRules := s.config.AppRules; appRules != nil && appRules.HasRules(s.rules.GroupFor(srcIP)) {
+		return true
+	}
+	return s.rules.HasCategoryRules(srcIP)
+}
+
+// resolveApp returns the application of hostname (zero = unknown or AppID
+// disabled). failed is set when the resolver returned an error. When the app
+// is only logged, slow resolvers answer from their cache without blocking.
+func (s *Server) resolveApp(srcIP net.IP, hostname string) (app AppInfo, failed bool) {
+	if s.config.Apps == nil {
+		return AppInfo{}, false
+	}
+	if c, ok := s.config.Apps.(cachedResolver); ok && !s.appDecides(srcIP) {
+		app, _ := c.CachedApp(hostname)
+		return app, false
+	}
+	app, err := s.config.Apps.ResolveApp(srcIP, hostname)
+	if err != nil {
+		return AppInfo{}, true
+	}
+	return app, false
+}
+
+// decide combines the hostname rules with the group's app and category
+// rules. The AppID rules are evaluated first: a matching BLOCK_APP or
+// BLOCK_CATEGORY rule blocks, and a matching ALLOW_APP or ALLOW_CATEGORY rule
+// allows unless a hostname rule of the group explicitly blocks the SNI. Without
+// a matching app rule the access rules apply (hostname rules before
+// @category: rules). When the app lookup failed and AppFailOpen is off,
+// connections of groups with app rules are blocked.
+func (s *Server) decide(srcIP net.IP, hostname string, app AppInfo, appFailed bool) (action rules.RuleType, matched bool, groupName string, byApp bool) {
+	action, matched, groupName = s.rules.MatchCategory(srcIP, hostname, string(app.Category))
+	appRules := s.config.AppRules
+	if groupName == "" || appRules == nil {
+		return action, matched, groupName, false
+	}
+
+	if appFailed {
+		if !s.config.AppFailOpen && appRules.HasRules(groupName) {
+			return rules.RuleBlock, true, groupName, true
+		}
+		return action, matched, groupName, false
+	}
+
+	appAction, ok := appRules.MatchApp(groupName, app.Name, app.Category)
+	if !ok {
+		return action, matched, groupName, false
+	}
+	if appAction.IsBlock() {
+		return rules.RuleBlock, true, groupName, true
+	}
+	// An explicit hostname BLOCK still wins over app allows. A hostname rule
+	// can only block if the combined access rules did.
+	if matched && action == rules.RuleBlock {
+		if hostAction, hostMatched, _ := s.rules.Match(srcIP, hostname); hostMatched && hostAction == rules.RuleBlock {
+			return rules.RuleBlock, true, groupName, false
+		}
+	}
+	return rules.RuleAllow, true, groupName, true
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+	"github.com/guilherme/zid-proxy/internal/logger"
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+const appTestRules = `GROUP;alunos
+MEMBER;127.0.0.0/8
+ALLOW;www.youtube.com
+BLOCK;*.tiktok.com
+`
+
+// failingResolver simulates an unreachable zid-appid daemon.
+type failingResolver struct{}
+
+func (failingResolver) ResolveApp(net.IP, string) (AppInfo, error) {
+	return AppInfo{}, errors.New("daemon down")
+}
+
+func newAppRuleSet(t *testing.T, content string) *appid.AppRuleSet {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appid_rules.txt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write app rules: %v", err)
+	}
+	rs := appid.NewAppRuleSet(path)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("load app rules: %v", err)
+	}
+	return rs
+}
+
+func TestServer_DecideAppRules(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), appTestRules, logger.NewNullLogger())
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_APP;alunos;youtube\nBLOCK_APP;alunos;netflix\nALLOW_APP;alunos;tiktok\n")
+	ip := net.ParseIP("127.0.0.1")
+
+	tests := []struct {
+		hostname, app string
+		failed        bool
+		want          rules.RuleType
+		byApp         bool
+	}{
+		{"www.netflix.com", "netflix", false, rules.RuleBlock, true},
+		{"example.com", "", false, rules.RuleAllow, false},
+		// An app BLOCK overrides a hostname ALLOW, but an app ALLOW does not
+		// override a hostname BLOCK.
+		{"www.youtube.com", "youtube", false, rules.RuleBlock, true},
+		{"m.tiktok.com", "tiktok", false, rules.RuleBlock, false},
+		{"tiktokcdn.example", "tiktok", false, rules.RuleAllow, true},
+		{"m.tiktok.com", "", false, rules.RuleBlock, false},
+		// A failed lookup is ignored while AppFailOpen is set.
+		{"www.netflix.com", "", true, rules.RuleAllow, false},
+	}
+	for _, tt := range tests {
+		action, _, group, byApp := s.decide(ip, tt.hostname, AppInfo{Name: tt.app}, tt.failed)
+		if action != tt.want || byApp != tt.byApp || group != "alunos" {
+			t.Errorf("decide(%s, %q) = %s byApp=%v group=%q, want %s byApp=%v", tt.hostname, tt.app, action, byApp, group, tt.want, tt.byApp)
+		}
+	}
+
+	s.config.AppFailOpen = false
+	if action, _, _, byApp := s.decide(ip, "www.netflix.com", AppInfo{}, true); action != rules.RuleBlock || !byApp {
+		t.Errorf("fail-closed lookup error: %s byApp=%v", action, byApp)
+	}
+	if action, _, _, _ := s.decide(ip, "www.youtube.com", AppInfo{}, true); action != rules.RuleBlock {
+		t.Errorf("fail-closed with hostname rule: %s", action)
+	}
+	if action, _, _, _ := s.decide(net.ParseIP("10.9.9.9"), "www.netflix.com", AppInfo{}, true); action != rules.RuleAllow {
+		t.Errorf("fail-closed outside any group: %s", action)
+	}
+}
+
+func TestServer_DecideCategoryRules(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), appTestRules+"BLOCK;@category:ads\n", logger.NewNullLogger())
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_CATEGORY;alunos;streaming_media\nALLOW_APP;alunos;youtube\n")
+	ip := net.ParseIP("127.0.0.1")
+
+	tests := []struct {
+		hostname string
+		app      AppInfo
+		want     rules.RuleType
+		byApp    bool
+	}{
+		{"www.netflix.com", AppInfo{"netflix", appid.CategoryStreamingMedia}, rules.RuleBlock, true},
+		// The app-specific rule beats the category rule.
+		{"www.youtube.com", AppInfo{"youtube", appid.CategoryStreamingMedia}, rules.RuleAllow, true},
+		// @category: access rule
+		{"ads.example.com", AppInfo{"adnet", appid.CategoryAds}, rules.RuleBlock, false},
+		// A hostname rule beats the @category: rule.
+		{"www.youtube.com", AppInfo{"adnet", appid.CategoryAds}, rules.RuleAllow, false},
+		// An app allow beats the @category: block, not a hostname block.
+		{"www.youtube.com", AppInfo{"youtube", appid.CategoryAds}, rules.RuleAllow, true},
+		{"m.tiktok.com", AppInfo{"youtube", appid.CategoryStreamingMedia}, rules.RuleBlock, false},
+		{"example.com", AppInfo{}, rules.RuleAllow, false},
+	}
+	for _, tt := range tests {
+		action, _, _, byApp := s.decide(ip, tt.hostname, tt.app, false)
+		if action != tt.want || byApp != tt.byApp {
+			t.Errorf("decide(%s, %+v) = %s byApp=%v, want %s byApp=%v", tt.hostname, tt.app, action, byApp, tt.want, tt.byApp)
+		}
+	}
+}
+
+func TestServer_ReloadSharesGroupsWithAppRules(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "access_rules.txt")
+	s := newTestServer(t, rulesFile, appTestRules, logger.NewNullLogger())
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_APP;alunos;netflix\n")
+	s.config.RevokeOnReload = false
+
+	if err := os.WriteFile(rulesFile, []byte("GROUP;professores\nMEMBER;127.0.0.1\n"+appTestRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	_, _, want := s.rules.Match(net.ParseIP("127.0.0.1"), "example.com")
+	if got := s.config.AppRules.FindGroup(net.ParseIP("127.0.0.1")); got != want || got != "professores" {
+		t.Fatalf("app rules group %q, access rules group %q", got, want)
+	}
+	if _, matched, _ := s.config.AppRules.MatchForIP(net.ParseIP("127.0.0.2"), "netflix"); !matched {
+		t.Fatal("expected BLOCK_APP of alunos to match 127.0.0.2")
+	}
+}
+
+func TestServer_BlocksAppFromDaemon(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "appid.sock")
+	daemon := appid.NewServer(socket, appid.NewFlowCache(100, time.Minute), appid.NewDetector())
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("start appid: %v", err)
+	}
+	defer daemon.Stop()
+
+	var buf syncBuffer
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), appTestRules, logger.NewWriterLogger(&buf))
+	resolver := NewClientResolver(socket, time.Second)
+	defer resolver.Close()
+	s.config.Apps = resolver
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_APP;alunos;netflix\n")
+	s.config.Blocks = blocklog.New(0)
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	c, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tls.Client(c, &tls.Config{ServerName: "www.netflix.com"}).Handshake(); err == nil {
+		t.Fatal("expected blocked handshake to fail")
+	}
+
+	waitConnections(t, s, 0)
+	if logged := buf.String(); !strings.Contains(logged, "| alunos | BLOCK |  |  | netflix") {
+		t.Fatalf("access log lacks the app: %q", logged)
+	}
+	blocks, _ := s.config.Blocks.Since("127.0.0.1", "", 0, time.Now())
+	if len(blocks) != 1 || blocks[0].App != "netflix" || blocks[0].Reason != blocklog.ReasonApp {
+		t.Fatalf("blocks=%+v", blocks)
+	}
+}
+
+func TestServer_ResolveApp(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), appTestRules, logger.NewNullLogger())
+	s.config.Apps = failingResolver{}
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_APP;alunos;netflix\n")
+
+	app, failed := s.resolveApp(net.ParseIP("127.0.0.1"), "www.netflix.com")
+	if app.Name != "" || !failed {
+		t.Fatalf("resolveApp = %+v failed=%v", app, failed)
+	}
+
+	s.config.Apps = NewDetectorResolver(appid.NewDetector())
+	app, failed = s.resolveApp(net.ParseIP("127.0.0.1"), "api.netflix.com")
+	if app.Name != "netflix" || app.Category != appid.CategoryStreamingMedia || failed {
+		t.Fatalf("detector resolveApp = %+v failed=%v", app, failed)
+	}
+}
+
+// slowResolver is a daemon resolver that counts its lookups.
+type slowResolver struct {
+	calls chan string
+}
+
+func (r slowResolver) ResolveApp(_ net.IP, hostname string) (AppInfo, error) {
+	r.calls <- hostname
+	return AppInfo{Name: "netflix"}, nil
+}
+
+func (r slowResolver) CachedApp(hostname string) (AppInfo, bool) {
+	return AppInfo{Name: "cached"}, true
+}
+
+func TestServer_ResolveAppOnlyBlocksForAppRules(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), appTestRules, logger.NewNullLogger())
+	r := slowResolver{calls: make(chan string, 1)}
+	s.config.Apps = r
+
+	// No app rules: the app is only logged, the cache answers.
+	if app, _ := s.resolveApp(net.ParseIP("127.0.0.1"), "www.netflix.com"); app.Name != "cached" || len(r.calls) != 0 {
+		t.Fatalf("without app rules: %+v (lookups=%d)", app, len(r.calls))
+	}
+
+	s.config.AppRules = newAppRuleSet(t, "BLOCK_APP;alunos;netflix\n")
+	if app, _ := s.resolveApp(net.ParseIP("127.0.0.1"), "www.netflix.com"); app.Name != "netflix" || len(r.calls) != 1 {
+		t.Fatalf("with app rules: %+v (lookups=%d)", app, len(r.calls))
+	}
+}
+
+func TestClientResolver_CachedAppResolvesInBackground(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "appid.sock")
+	daemon := appid.NewServer(socket, appid.NewFlowCache(100, time.Minute), appid.NewDetector())
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("start appid: %v", err)
+	}
+	defer daemon.Stop()
+
+	r := NewClientResolver(socket, time.Second)
+	defer r.Close()
+	if _, ok := r.CachedApp("www.netflix.com"); ok {
+		t.Fatal("first lookup must miss the cache")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if app, ok := r.CachedApp("www.netflix.com"); ok {
+			if app.Name != "netflix" {
+				t.Fatalf("cached app = %+v", app)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background lookup did not fill the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/logger"
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+// ConnectionsSnapshot is the JSON document describing all in-flight connections.
+type ConnectionsSnapshot struct {
+	Version     int            `json:"version"`
+	GeneratedAt string         `json:"generated_at"`
+	Connections []ConnSnapshot `json:"connections"`
+}
+
+// ConnSnapshot describes a single in-flight connection.
+type ConnSnapshot struct {
+	ID              uint64 `json:"id"`
+	SrcIP           string `json:"src_ip"`
+	SrcPort         int    `json:"src_port"`
+	SNI             string `json:"sni,omitempty"`
+	Group           string `json:"group,omitempty"`
+	Machine         string `json:"machine,omitempty"`
+	Username        string `json:"username,omitempty"`
+	App             string `json:"app,omitempty"`
+	UpstreamIP      string `json:"upstream_ip,omitempty"`
+	StartedAt       string `json:"started_at"`
+	DurationSeconds int    `json:"duration_seconds"`
+	BytesIn         uint64 `json:"bytes_in"`
+	BytesOut        uint64 `json:"bytes_out"`
+	BytesTotal      uint64 `json:"bytes_total"`
+}
+
+func (s *Server) register(h *Handler) {
+	s.connsMu.Lock()
+	s.conns[h.id] = h
+	s.connsMu.Unlock()
+}
+
+func (s *Server) unregister(h *Handler) {
+	s.connsMu.Lock()
+	delete(s.conns, h.id)
+	s.connsMu.Unlock()
+}
+
+// handlers returns the current in-flight handlers (copy, safe to iterate without the lock).
+func (s *Server) handlers() []*Handler {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	out := make([]*Handler, 0, len(s.conns))
+	for _, h := range s.conns {
+		out = append(out, h)
+	}
+	return out
+}
+
+// snapshot returns the current state of the handler.
+func (h *Handler) snapshot(now time.Time) ConnSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cs := ConnSnapshot{
+		ID:        h.id,
+		SNI:       h.hostname,
+		Group:     h.group,
+		Machine:   h.machine,
+		Username:  h.username,
+		App:       h.app.Name,
+		StartedAt: h.startedAt.UTC().Format(time.RFC3339),
+		BytesIn:   h.bytesIn.Load(),
+		BytesOut:  h.bytesOut.Load(),
+	}
+	cs.BytesTotal = cs.BytesIn + cs.BytesOut
+	if d := int(now.Sub(h.startedAt).Seconds()); d > 0 {
+		cs.DurationSeconds = d
+	}
+	if addr, ok := h.clientConn.RemoteAddr().(*net.TCPAddr); ok {
+		cs.SrcIP = addr.IP.String()
+		cs.SrcPort = addr.Port
+	}
+	if h.upstreamConn != nil {
+		if addr, ok := h.upstreamConn.RemoteAddr().(*net.TCPAddr); ok {
+			cs.UpstreamIP = addr.IP.String()
+		}
+	}
+	return cs
+}
+
+// srcIP returns the normalized client IP of the handler.
+func (h *Handler) srcIP() string {
+	if addr, ok := h.clientConn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// Connections returns a snapshot of all in-flight connections, oldest first.
+func (s *Server) Connections(now time.Time) ConnectionsSnapshot {
+	hs := s.handlers()
+
+	out := ConnectionsSnapshot{
+		Version:     1,
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Connections: make([]ConnSnapshot, 0, len(hs)),
+	}
+	for _, h := range hs {
+		out.Connections = append(out.Connections, h.snapshot(now))
+	}
+	sort.Slice(out.Connections, func(i, j int) bool {
+		return out.Connections[i].ID < out.Connections[j].ID
+	})
+	return out
+}
+
+// KillConn terminates a single connection by ID. It returns false if the ID is unknown.
+func (s *Server) KillConn(id uint64) bool {
+	s.connsMu.Lock()
+	h := s.conns[id]
+	s.connsMu.Unlock()
+	if h == nil {
+		return false
+	}
+
+	h.mu.Lock()
+	hostname := h.hostname
+	h.mu.Unlock()
+
+	log.Printf("Killing connection %d (%s -> %s)", id, h.srcIP(), hostname)
+	h.kill()
+	return true
+}
+
+// KillIP terminates all connections from srcIP and returns how many were killed.
+func (s *Server) KillIP(srcIP string) int {
+	ip := net.ParseIP(srcIP)
+	if ip == nil {
+		return 0
+	}
+	srcIP = ip.String()
+
+	killed := 0
+	for _, h := range s.handlers() {
+		if h.srcIP() == srcIP {
+			h.kill()
+			killed++
+		}
+	}
+	if killed > 0 {
+		log.Printf("Killed %d connections from %s", killed, srcIP)
+	}
+	return killed
+}
+
+// revokeBlocked re-runs the rules for every live connection whose SNI is known
+// and closes the ones that the current rules now block. Each close is logged
+// with the REVOKED action.
+func (s *Server) revokeBlocked() int {
+	revoked := 0
+	for _, h := range s.handlers() {
+		h.mu.Lock()
+		hostname := h.hostname
+		machine := h.machine
+		username := h.username
+		app := h.app
+		h.mu.Unlock()
+		if hostname == "" {
+			continue // Still in handshake; Handle will match against the new rules.
+		}
+
+		srcIP := h.srcIP()
+		ip := net.ParseIP(srcIP)
+		if ip == nil {
+			continue
+		}
+		// The app resolved at connect time is reused; a failed lookup never revokes.
+		action, _, groupName, _ := s.decide(ip, hostname, app, false)
+		if action != rules.RuleBlock {
+			continue
+		}
+
+		h.kill()
+		revoked++
+		s.logger.LogConnection(srcIP, hostname, groupName, machine, username, app.Name, logger.ActionRevoked)
+		log.Printf("%s | %s -> %s | %s (connection %d revoked after reload)", srcIP, hostname, action, logger.ActionRevoked, h.id)
+	}
+	return revoked
+}
+
+// WriteConnectionsAtomic writes the connections snapshot to path via a temp file + rename.
+func WriteConnectionsAtomic(path string, snap ConnectionsSnapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
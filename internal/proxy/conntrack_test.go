@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/activeips"
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/logger"
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+func startTestServer(t *testing.T, rulesContent string) *Server {
+	t.Helper()
+
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), rulesContent, logger.NewNullLogger())
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func newTestServer(t *testing.T, rulesFile, rulesContent string, log logger.Interface) *Server {
+	t.Helper()
+
+	if err := os.WriteFile(rulesFile, []byte(rulesContent), 0644); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	rs := rules.NewRuleSet(rulesFile)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	return New(cfg, rs, log)
+}
+
+func waitConnections(t *testing.T, s *Server, want int) ConnectionsSnapshot {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		snap := s.Connections(time.Now())
+		if len(snap.Connections) == want {
+			return snap
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d connections, want %d", len(snap.Connections), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ConnectionsAndKillIP(t *testing.T) {
+	s := startTestServer(t, "BLOCK;10.0.0.1;blocked.example.com\n")
+
+	// Connections stay in the handshake phase (no ClientHello sent).
+	c1, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c2.Close()
+
+	snap := waitConnections(t, s, 2)
+	if snap.Connections[0].SrcIP != "127.0.0.1" || snap.Connections[0].ID >= snap.Connections[1].ID {
+		t.Fatalf("unexpected snapshot: %+v", snap.Connections)
+	}
+
+	if !s.KillConn(snap.Connections[0].ID) {
+		t.Fatal("KillConn returned false for live connection")
+	}
+	waitConnections(t, s, 1)
+
+	if n := s.KillIP("127.0.0.1"); n != 1 {
+		t.Fatalf("KillIP killed %d, want 1", n)
+	}
+	waitConnections(t, s, 0)
+
+	// Killed clients get a RST.
+	c1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c1.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read after kill: %v, want connection reset", err)
+	}
+}
+
+func TestServer_StopClosesWithoutReset(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "", logger.NewNullLogger())
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	c, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	waitConnections(t, s, 1)
+
+	s.Stop()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after shutdown: %v, want EOF", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// registerFakeFlow registers a handler that already passed the SNI phase,
+// backed by a real loopback TCP connection.
+func registerFakeFlow(t *testing.T, s *Server, hostname string) *Handler {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	serverSide, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { serverSide.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h := &Handler{
+		server:     s,
+		clientConn: serverSide,
+		id:         s.nextID.Add(1),
+		ctx:        ctx,
+		cancel:     cancel,
+		startedAt:  time.Now(),
+		hostname:   hostname,
+	}
+	s.register(h)
+	return h
+}
+
+func TestServer_ReloadRevokesNowBlockedFlows(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "access_rules.txt")
+	var buf syncBuffer
+	s := newTestServer(t, rulesFile, "BLOCK;10.0.0.1;nothing.example.com\n", logger.NewWriterLogger(&buf))
+	s.config.RevokeOnReload = true
+
+	video := registerFakeFlow(t, s, "video.example.com")
+	other := registerFakeFlow(t, s, "www.example.org")
+
+	if err := os.WriteFile(rulesFile, []byte("BLOCK;127.0.0.0/8;*.example.com\n"), 0644); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if video.ctx.Err() == nil {
+		t.Fatal("expected now-blocked flow to be revoked")
+	}
+	if other.ctx.Err() != nil {
+		t.Fatal("unrelated flow must stay open")
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, "| video.example.com |") || !strings.Contains(logged, "| REVOKED |") {
+		t.Fatalf("expected REVOKED access log entry, got %q", logged)
+	}
+}
+
+func TestServer_ReloadRevokesWhenAppRulesFail(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "access_rules.txt")
+	s := newTestServer(t, rulesFile, "BLOCK;10.0.0.1;nothing.example.com\n", logger.NewNullLogger())
+	s.config.RevokeOnReload = true
+	appRulesFile := filepath.Join(t.TempDir(), "appid_rules.txt")
+	s.config.AppRules = appid.NewAppRuleSet(appRulesFile)
+
+	video := registerFakeFlow(t, s, "video.example.com")
+
+	if err := os.WriteFile(rulesFile, []byte("BLOCK;127.0.0.0/8;*.example.com\n"), 0644); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := os.WriteFile(appRulesFile, []byte("not a rule\n"), 0644); err != nil {
+		t.Fatalf("write app rules: %v", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatal("reload with invalid app rules succeeded")
+	}
+	if video.ctx.Err() == nil {
+		t.Fatal("flow blocked by the new hostname rules not revoked")
+	}
+}
+
+func TestServer_ReloadWithoutRevokeKeepsFlows(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "access_rules.txt")
+	s := newTestServer(t, rulesFile, "BLOCK;10.0.0.1;nothing.example.com\n", logger.NewNullLogger())
+	s.config.RevokeOnReload = false
+
+	video := registerFakeFlow(t, s, "video.example.com")
+
+	if err := os.WriteFile(rulesFile, []byte("BLOCK;127.0.0.0/8;*.example.com\n"), 0644); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if video.ctx.Err() != nil {
+		t.Fatal("flow must not be revoked when RevokeOnReload is disabled")
+	}
+}
+
+func TestHandler_FlushUsageChargesDeltas(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "", logger.NewNullLogger())
+	tracker := activeips.New(activeips.Options{})
+	h := registerFakeFlow(t, s, "www.example.com")
+	h.activeIPs = tracker
+
+	now := time.Now()
+	h.bytesIn.Store(1000)
+	h.bytesOut.Store(200)
+	h.flushUsage(now)
+	h.bytesIn.Add(500)
+	h.flushUsage(now)
+	h.flushUsage(now) // nothing new
+
+	snap := tracker.Snapshot(now)
+	if len(snap.IPs) != 1 || snap.IPs[0].BytesIn != 1500 || snap.IPs[0].BytesOut != 200 {
+		t.Fatalf("active IPs = %+v", snap.IPs)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+)
+
+// flowUpdateInterval is how often the byte counts of a long-lived connection
+// are reported, so zid-appid does not expire its flow.
+const flowUpdateInterval = time.Minute
+
+// FlowReporter receives the connections relayed by the proxy, so zid-appid
+// can keep per-user (else per-IP) app usage. Byte counts are totals of the
+// connection so far (in = download). Calls must not block the relay.
+type FlowReporter interface {
+	OpenFlow(key appid.FlowKey, hostname, user string)
+	UpdateFlow(key appid.FlowKey, bytesIn, bytesOut uint64)
+	CloseFlow(key appid.FlowKey, bytesIn, bytesOut uint64)
+}
+
+// flowEvent is a report queued by ClientFlowReporter.
+type flowEvent struct {
+	key      appid.FlowKey
+	hostname string // open
+	user     string // open
+	bytesIn  uint64
+	bytesOut uint64
+	closed   bool
+}
+
+const (
+	// flowSenders is the number of reports in flight at once. The reports
+	// of one flow always go through the same sender, in order.
+	flowSenders = 8
+	// flowQueueSize bounds the reports waiting for each sender.
+	flowQueueSize = 256
+)
+
+// ClientFlowReporter reports flows to the zid-appid daemon over its Unix
+// socket (REGISTER_FLOW, UPDATE_FLOW, CLOSE_FLOW). Reports are queued per
+// flow to flowSenders goroutines whose requests share the pipelined
+// connection; they are dropped, with a warning at most once a minute, when
+// the queue is full. Once the daemon answers that it does not register flows
+// (capture mode), reporting stops.
+type ClientFlowReporter struct {
+	client   *appid.Client
+	senders  []chan flowEvent
+	wg       sync.WaitGroup
+	dropped  atomic.Uint64
+	disabled atomic.Bool
+
+	mu        sync.Mutex
+	lastErr   time.Time
+	lastDrop  time.Time
+	closeOnce sync.Once
+}
+
+// NewClientFlowReporter creates a reporter for the daemon at socketPath.
+// Each report is bounded by timeout.
+func NewClientFlowReporter(socketPath string, timeout time.Duration) *ClientFlowReporter {
+	r := &ClientFlowReporter{
+		client:  appid.NewClient(socketPath, timeout),
+		senders: make([]chan flowEvent, flowSenders),
+	}
+	for i := range r.senders {
+		r.senders[i] = make(chan flowEvent, flowQueueSize)
+		r.wg.Add(1)
+		go r.run(r.senders[i])
+	}
+	return r
+}
+
+// OpenFlow implements FlowReporter.
+func (r *ClientFlowReporter) OpenFlow(key appid.FlowKey, hostname, user string) {
+	r.enqueue(flowEvent{key: key, hostname: hostname, user: user})
+}
+
+// UpdateFlow implements FlowReporter.
+func (r *ClientFlowReporter) UpdateFlow(key appid.FlowKey, bytesIn, bytesOut uint64) {
+	r.enqueue(flowEvent{key: key, bytesIn: bytesIn, bytesOut: bytesOut})
+}
+
+// CloseFlow implements FlowReporter.
+func (r *ClientFlowReporter) CloseFlow(key appid.FlowKey, bytesIn, bytesOut uint64) {
+	r.enqueue(flowEvent{key: key, bytesIn: bytesIn, bytesOut: bytesOut, closed: true})
+}
+
+// Dropped returns the number of reports dropped because the queue was full.
+func (r *ClientFlowReporter) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Disabled reports whether the daemon answered that it does not register
+// flows, after which reports are discarded.
+func (r *ClientFlowReporter) Disabled() bool {
+	return r.disabled.Load()
+}
+
+func (r *ClientFlowReporter) enqueue(ev flowEvent) {
+	if r.disabled.Load() {
+		return
+	}
+	select {
+	case r.senders[senderOf(ev.key)] <- ev:
+	default:
+		dropped := r.dropped.Add(1)
+		// At most one warning per minute while reports are dropped
+		r.mu.Lock()
+		now := time.Now()
+		warn := now.Sub(r.lastDrop) >= time.Minute
+		if warn {
+			r.lastDrop = now
+		}
+		r.mu.Unlock()
+		if warn {
+			log.Printf("Warning: AppID flow report queue full, %d reports dropped so far", dropped)
+		}
+	}
+}
+
+// senderOf returns the sender of the reports of key.
+func senderOf(key appid.FlowKey) int {
+	h := fnv.New32a()
+	h.Write([]byte(key.SrcIP))
+	h.Write([]byte(key.DstIP))
+	binary.Write(h, binary.BigEndian, [3]uint16{key.SrcPort, key.DstPort, uint16(key.Protocol)})
+	return int(h.Sum32() % flowSenders)
+}
+
+// run sends the reports queued to one sender until Close.
+func (r *ClientFlowReporter) run(events <-chan flowEvent) {
+	defer r.wg.Done()
+	for ev := range events {
+		if r.disabled.Load() {
+			continue
+		}
+		var err error
+		switch {
+		case ev.hostname != "":
+			_, err = r.client.RegisterFlow(ev.key, ev.hostname, ev.user)
+		case ev.closed:
+			_, err = r.client.CloseFlow(ev.key, ev.bytesIn, ev.bytesOut)
+		default:
+			_, err = r.client.UpdateFlow(ev.key, ev.bytesIn, ev.bytesOut)
+		}
+		if err == nil {
+			continue
+		}
+		if appid.IsUnavailable(err) {
+			if r.disabled.CompareAndSwap(false, true) {
+				log.Printf("AppID flow reports disabled: %v", err)
+			}
+			continue
+		}
+		// At most one warning per minute while the daemon is down
+		r.mu.Lock()
+		now := time.Now()
+		warn := now.Sub(r.lastErr) >= time.Minute
+		if warn {
+			r.lastErr = now
+		}
+		r.mu.Unlock()
+		if warn {
+			log.Printf("Warning: AppID flow report failed: %v", err)
+		}
+	}
+}
+
+// Close sends the queued reports and closes the connection to the daemon.
+func (r *ClientFlowReporter) Close() error {
+	r.closeOnce.Do(func() {
+		for _, ch := range r.senders {
+			close(ch)
+		}
+	})
+	r.wg.Wait()
+	if n := r.dropped.Load(); n > 0 {
+		log.Printf("AppID flow reports dropped: %d", n)
+	}
+	return r.client.Close()
+}
+
+// flowKey returns the key of a relayed connection: the client address and
+// the upstream server address.
+func flowKey(client, upstream net.Addr) (appid.FlowKey, bool) {
+	c, ok1 := client.(*net.TCPAddr)
+	u, ok2 := upstream.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return appid.FlowKey{}, false
+	}
+	return appid.FlowKey{
+		SrcIP:    c.IP.String(),
+		DstIP:    u.IP.String(),
+		SrcPort:  uint16(c.Port),
+		DstPort:  uint16(u.Port),
+		Protocol: 6,
+	}, true
+}
+
+// reportFlow reports the connection, with its user, to config.Flows until
+// the returned function is called with the relay finished. The byte counts
+// of the open flow are reported by the server's usage loop (updateFlow).
+func (h *Handler) reportFlow(hostname string, upstream net.Conn) func() {
+	flows := h.server.config.Flows
+	if flows == nil {
+		return func() {}
+	}
+	key, ok := flowKey(h.clientConn.RemoteAddr(), upstream.RemoteAddr())
+	if !ok {
+		return func() {}
+	}
+
+	h.mu.Lock()
+	flows.OpenFlow(key, hostname, h.username)
+	h.flowKey, h.flowOpen = key, true
+	h.mu.Unlock()
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.flowOpen = false
+		flows.CloseFlow(key, h.bytesIn.Load(), h.bytesOut.Load())
+	}
+}
+
+// updateFlow reports the bytes relayed so far on the open flow, if any.
+// The handler lock orders the update before the flow's close report.
+func (h *Handler) updateFlow() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.flowOpen {
+		h.server.config.Flows.UpdateFlow(h.flowKey, h.bytesIn.Load(), h.bytesOut.Load())
+	}
+}
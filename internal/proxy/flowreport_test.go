@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/logger"
+)
+
+// registeringDaemon records the reported flows in a flow cache.
+type registeringDaemon struct {
+	cache *appid.FlowCache
+}
+
+func (d registeringDaemon) RegisterFlow(key appid.FlowKey, hostname, user string) (*appid.AppDefinition, float32) {
+	d.cache.Register(key, hostname, user, "", "", 0, "", time.Now())
+	return nil, 0
+}
+
+func (d registeringDaemon) UpdateFlow(key appid.FlowKey, bytesIn, bytesOut uint64) bool {
+	return d.cache.SetBytes(key, bytesIn, bytesOut, false, time.Now())
+}
+
+func (d registeringDaemon) CloseFlow(key appid.FlowKey, bytesIn, bytesOut uint64) bool {
+	return d.cache.SetBytes(key, bytesIn, bytesOut, true, time.Now())
+}
+
+// loopbackPair returns both ends of a loopback TCP connection.
+func loopbackPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client, server
+}
+
+func TestHandler_ReportsFlowToDaemon(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "appid.sock")
+	cache := appid.NewFlowCache(100, time.Minute)
+	daemon := appid.NewServer(socket, cache, appid.NewDetector())
+	daemon.SetFlowHandler(registeringDaemon{cache: cache})
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("start appid: %v", err)
+	}
+	defer daemon.Stop()
+
+	reporter := NewClientFlowReporter(socket, time.Second)
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "", logger.NewNullLogger())
+	s.config.Flows = reporter
+
+	client, clientSide := loopbackPair(t)
+	_, upstream := loopbackPair(t)
+	h := &Handler{server: s, clientConn: clientSide, ctx: context.Background(), username: "alice"}
+
+	done := h.reportFlow("www.example.com", upstream)
+	h.bytesIn.Store(1000)
+	h.updateFlow()
+	h.bytesIn.Store(4000)
+	h.bytesOut.Store(300)
+	done()
+	h.updateFlow() // closed: not reported
+	if err := reporter.Close(); err != nil {
+		t.Fatalf("close reporter: %v", err)
+	}
+
+	clientAddr := client.LocalAddr().(*net.TCPAddr)
+	upstreamAddr := upstream.RemoteAddr().(*net.TCPAddr)
+	key := appid.FlowKey{SrcIP: "127.0.0.1", DstIP: "127.0.0.1", SrcPort: uint16(clientAddr.Port), DstPort: uint16(upstreamAddr.Port), Protocol: 6}
+	f, ok := cache.Get(key)
+	if !ok {
+		t.Fatalf("flow %+v not registered (flows: %d)", key, len(cache.List()))
+	}
+	if f.Hostname != "www.example.com" || f.User != "alice" || f.BytesIn != 4000 || f.BytesOut != 300 || !f.Closed {
+		t.Fatalf("flow = %+v", f)
+	}
+	if reporter.Dropped() != 0 {
+		t.Fatalf("dropped %d reports", reporter.Dropped())
+	}
+}
+
+func TestClientFlowReporter_StopsWhenDaemonDoesNotRegisterFlows(t *testing.T) {
+	dir, err := os.MkdirTemp("", "appid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "appid.sock")
+	daemon := appid.NewServer(socket, appid.NewFlowCache(100, time.Minute), appid.NewDetector())
+	if err := daemon.Start(); err != nil { // no flow handler: capture mode
+		t.Fatalf("start appid: %v", err)
+	}
+	defer daemon.Stop()
+
+	reporter := NewClientFlowReporter(socket, time.Second)
+	key := appid.FlowKey{SrcIP: "192.168.1.10", DstIP: "203.0.113.5", SrcPort: 50000, DstPort: 443, Protocol: 6}
+	reporter.OpenFlow(key, "www.example.com", "alice")
+	reporter.CloseFlow(key, 10, 20)
+	if err := reporter.Close(); err != nil {
+		t.Fatalf("close reporter: %v", err)
+	}
+	if !reporter.Disabled() {
+		t.Fatal("reporter still enabled after an unavailable answer")
+	}
+}
@@ -2,16 +2,22 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/activeips"
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
 	"github.com/guilherme/zid-proxy/internal/logger"
 	"github.com/guilherme/zid-proxy/internal/rules"
+	"github.com/guilherme/zid-proxy/internal/shaper"
 	"github.com/guilherme/zid-proxy/internal/sni"
+	"github.com/guilherme/zid-proxy/internal/tsdb"
 )
 
 // Handler processes a single connection
@@ -21,6 +27,42 @@ type Handler struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	activeIPs    *activeips.Tracker
+
+	// Live connection table state (see conntrack.go)
+	id        uint64
+	ctx       context.Context
+	cancel    context.CancelFunc
+	killed    atomic.Bool // cancelled by kill or revoke (RST), not by shutdown
+	startedAt time.Time
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+
+	// Relayed bytes are charged to the shared quota, history and active IP
+	// counters by flushUsage, not per chunk, so relays do not contend on
+	// their locks.
+	usageMu      sync.Mutex
+	flushedIn    uint64 // bytesIn already charged
+	flushedOut   uint64 // bytesOut already charged
+	throttledIn  atomic.Uint64
+	throttledOut atomic.Uint64
+
+	// Bandwidth limiter shared with the client's other connections (nil = unlimited)
+	shaped *shaper.Client
+	// Identity charged for data quota usage ("" = no quota applies)
+	quotaID string
+	// Traffic history series of this flow (nil = history disabled)
+	history *tsdb.Labels
+
+	mu           sync.Mutex
+	hostname     string
+	group        string
+	machine      string
+	username     string
+	app          AppInfo
+	upstreamConn net.Conn
+	// Flow reported to config.Flows, updated by the server's usage loop
+	flowKey  appid.FlowKey
+	flowOpen bool
 }
 
 // Handle processes the connection
@@ -30,11 +72,9 @@ func (h *Handler) Handle() {
 	clientIP := clientAddr.IP
 	srcIP := clientIP.String()
 
-	if h.activeIPs != nil {
-		now := time.Now()
-		h.activeIPs.ConnStart(srcIP, now)
-		defer h.activeIPs.ConnEnd(srcIP, time.Now())
-	}
+	// Killing the flow (context cancel) closes both sides so blocked reads return.
+	stop := context.AfterFunc(h.ctx, h.abort)
+	defer stop()
 
 	// Set read deadline for ClientHello
 	h.clientConn.SetReadDeadline(time.Now().Add(h.readTimeout))
@@ -66,8 +106,19 @@ func (h *Handler) Handle() {
 	// Clear deadline
 	h.clientConn.SetReadDeadline(time.Time{})
 
-	// Match against rules
-	action, matched, groupName := h.server.rules.Match(clientIP, hostname)
+	// Match against the hostname rules, then the group's app rules
+	app, appFailed := h.server.resolveApp(clientIP, hostname)
+	action, matched, groupName, byApp := h.server.decide(clientIP, hostname, app, appFailed)
+
+	machine := ""
+	username := ""
+	if h.server.agents != nil {
+		// The source port picks the user on terminal servers with several sessions
+		if info, ok := h.server.agents.LookupConn(srcIP, clientAddr.Port, time.Now()); ok {
+			machine = info.Machine
+			username = info.Username
+		}
+	}
 
 	// Convert to logger action
 	var logAction logger.Action
@@ -77,30 +128,72 @@ func (h *Handler) Handle() {
 		logAction = logger.ActionAllow
 	}
 
-	// Log the connection
-	machine := ""
-	username := ""
-	if h.server.agents != nil {
-		if m, u, ok := h.server.agents.Lookup(srcIP, time.Now()); ok {
-			machine = m
-			username = u
+	// Data quota of the client's group, counted per user (agent) or per IP
+	quotaExceeded := false
+	if quotas := h.server.config.Quotas; quotas != nil && action == rules.RuleAllow {
+		if quotaGroup, limits := h.server.rules.QuotasFor(clientIP); len(limits) > 0 {
+			identity := username
+			if identity == "" {
+				identity = srcIP
+			}
+			if q, exceeded := quotas.Check(identity, quotaGroup, limits, time.Now()); exceeded {
+				action = rules.RuleBlock
+				logAction = logger.ActionQuota
+				quotaExceeded = true
+				log.Printf("%s | %s quota of %d bytes used up by %s", clientIP, q.Period, q.Bytes, identity)
+			} else {
+				h.quotaID = identity
+			}
 		}
 	}
-	// TODO: Integrate with AppID daemon to detect app
-	app := "" // Will be filled by AppID integration
-	h.server.logger.LogConnection(clientIP.String(), hostname, groupName, machine, username, app, logAction)
 
-	if matched {
+	// Log the connection
+	h.mu.Lock()
+	h.hostname = hostname
+	h.group = groupName
+	h.machine = machine
+	h.username = username
+	h.app = app
+	h.mu.Unlock()
+	h.server.logger.LogConnection(clientIP.String(), hostname, groupName, machine, username, app.Name, logAction)
+
+	if quotaExceeded {
+		log.Printf("%s | %s -> %s | %s (quota exceeded)", clientIP, hostname, action, logAction)
+	} else if byApp && appFailed {
+		log.Printf("%s | %s -> %s | %s (app lookup failed)", clientIP, hostname, action, logAction)
+	} else if byApp {
+		log.Printf("%s | %s -> %s | %s (matched app rule for %s)", clientIP, hostname, action, logAction, app.Name)
+	} else if matched {
 		log.Printf("%s | %s -> %s | %s (matched rule)", clientIP, hostname, action, logAction)
 	} else {
 		log.Printf("%s | %s -> %s | %s (default)", clientIP, hostname, action, logAction)
 	}
 
 	if action == rules.RuleBlock {
+		if blocks := h.server.config.Blocks; blocks != nil {
+			reason := blocklog.ReasonRule
+			if quotaExceeded {
+				reason = blocklog.ReasonQuota
+			} else if byApp {
+				reason = blocklog.ReasonApp
+			}
+			blocks.Record(srcIP, blocklog.Block{Time: time.Now(), Hostname: hostname, Group: groupName, Username: username, App: app.Name, Reason: reason})
+		}
 		h.sendRST()
 		return
 	}
 
+	// Bandwidth limit (LIMIT_IP or group LIMIT), shared by all of the client's connections
+	if limit, ok := h.server.rules.LimitFor(clientIP); ok {
+		h.shaped = h.server.shaper.Acquire(srcIP, limit.DownBits/8, limit.UpBits/8)
+		defer h.server.shaper.Release(h.shaped)
+	}
+
+	if hist := h.server.config.History; hist != nil {
+		h.history = &tsdb.Labels{IP: srcIP, User: username, Group: groupName, Domain: tsdb.BaseDomain(hostname)}
+		hist.Add(*h.history, 0, 0, 1, time.Now())
+	}
+
 	// Allow: proxy the connection
 	h.proxyConnection(srcIP, hostname, clientHello)
 }
@@ -113,6 +206,29 @@ func (h *Handler) sendRST() {
 	// Connection will be closed by deferred Close in handleConnection
 }
 
+// kill terminates the flow with a RST to the client (admin kill, revoke).
+func (h *Handler) kill() {
+	h.killed.Store(true)
+	h.cancel()
+}
+
+// abort terminates the flow after its context was cancelled (kill or shutdown).
+// A killed client gets a RST; on shutdown the sockets are closed normally.
+// Closing both sockets unblocks the relay goroutines.
+func (h *Handler) abort() {
+	if h.killed.Load() {
+		h.sendRST()
+	}
+	h.clientConn.Close()
+
+	h.mu.Lock()
+	upstream := h.upstreamConn
+	h.mu.Unlock()
+	if upstream != nil {
+		upstream.Close()
+	}
+}
+
 // proxyConnection establishes a connection to the upstream server and proxies traffic
 func (h *Handler) proxyConnection(srcIP string, hostname string, clientHello []byte) {
 	// Connect to the original destination (the hostname from SNI)
@@ -123,7 +239,7 @@ func (h *Handler) proxyConnection(srcIP string, hostname string, clientHello []b
 		Timeout: h.writeTimeout,
 	}
 
-	upstreamConn, err := dialer.DialContext(h.server.ctx, "tcp", upstreamAddr)
+	upstreamConn, err := dialer.DialContext(h.ctx, "tcp", upstreamAddr)
 	if err != nil {
 		log.Printf("Failed to connect to upstream %s: %v", upstreamAddr, err)
 		h.sendRST()
@@ -131,12 +247,22 @@ func (h *Handler) proxyConnection(srcIP string, hostname string, clientHello []b
 	}
 	defer upstreamConn.Close()
 
+	h.mu.Lock()
+	h.upstreamConn = upstreamConn
+	h.mu.Unlock()
+	if h.ctx.Err() != nil {
+		// Killed while dialing; abort already ran without the upstream socket.
+		return
+	}
+
+	// Report the connection to zid-appid (per-IP app usage)
+	defer h.reportFlow(hostname, upstreamConn)()
+
 	// Send the captured ClientHello to upstream
 	upstreamConn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
 	n, err := upstreamConn.Write(clientHello)
-	if h.activeIPs != nil && n > 0 {
-		// Treat "Bytes Out" as client -> upstream (upload).
-		h.activeIPs.AddBytes(srcIP, 0, uint64(n), time.Now())
+	if n > 0 {
+		h.bytesOut.Add(uint64(n))
 	}
 	if err != nil {
 		log.Printf("Failed to send ClientHello to upstream %s: %v", upstreamAddr, err)
@@ -145,7 +271,35 @@ func (h *Handler) proxyConnection(srcIP string, hostname string, clientHello []b
 	upstreamConn.SetWriteDeadline(time.Time{})
 
 	// Bidirectional proxy
-	h.bidirectionalCopy(srcIP, h.clientConn, upstreamConn)
+	h.bidirectionalCopy(h.clientConn, upstreamConn)
+}
+
+// flushUsage charges the bytes relayed since the last flush to the data
+// quota, the traffic history and the active IP counters (in = download,
+// out = upload). It runs on the server's usage ticker and when the
+// connection ends.
+func (h *Handler) flushUsage(now time.Time) {
+	h.usageMu.Lock()
+	in, out := h.bytesIn.Load(), h.bytesOut.Load()
+	dIn, dOut := in-h.flushedIn, out-h.flushedOut
+	h.flushedIn, h.flushedOut = in, out
+	tIn, tOut := h.throttledIn.Swap(0), h.throttledOut.Swap(0)
+	h.usageMu.Unlock()
+
+	if dIn+dOut > 0 {
+		if h.quotaID != "" {
+			h.server.config.Quotas.Add(h.quotaID, dIn+dOut, now)
+		}
+		if h.history != nil {
+			h.server.config.History.Add(*h.history, dIn, dOut, 0, now)
+		}
+		if h.activeIPs != nil {
+			h.activeIPs.AddBytes(h.srcIP(), dIn, dOut, now)
+		}
+	}
+	if tIn+tOut > 0 && h.activeIPs != nil {
+		h.activeIPs.AddThrottled(h.srcIP(), tIn, tOut, now)
+	}
 }
 
 // isPrivateIP checks if an IP belongs to a private network (RFC 1918 + loopback)
@@ -202,14 +356,14 @@ func (h *Handler) proxyConnectionNoSNI(clientAddr *net.TCPAddr) {
 }
 
 // bidirectionalCopy copies data between two connections in both directions
-func (h *Handler) bidirectionalCopy(srcIP string, client, upstream net.Conn) {
+func (h *Handler) bidirectionalCopy(client, upstream net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	// Copy from client to upstream
 	go func() {
 		defer wg.Done()
-		h.copyWithActivity(srcIP, upstream, client, true)
+		h.copyWithActivity(upstream, client, true)
 		// Signal upstream that we're done sending
 		if tcpConn, ok := upstream.(*net.TCPConn); ok {
 			tcpConn.CloseWrite()
@@ -219,7 +373,7 @@ func (h *Handler) bidirectionalCopy(srcIP string, client, upstream net.Conn) {
 	// Copy from upstream to client
 	go func() {
 		defer wg.Done()
-		h.copyWithActivity(srcIP, client, upstream, false)
+		h.copyWithActivity(client, upstream, false)
 		// Signal client that we're done sending
 		if tcpConn, ok := client.(*net.TCPConn); ok {
 			tcpConn.CloseWrite()
@@ -229,20 +383,32 @@ func (h *Handler) bidirectionalCopy(srcIP string, client, upstream net.Conn) {
 	wg.Wait()
 }
 
-func (h *Handler) copyWithActivity(srcIP string, dst io.Writer, src io.Reader, clientToUpstream bool) {
+func (h *Handler) copyWithActivity(dst io.Writer, src io.Reader, clientToUpstream bool) {
 	buf := make([]byte, 32*1024)
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
+			if h.shaped != nil {
+				throttled, err := h.shaped.Wait(h.ctx, nr, clientToUpstream)
+				if err != nil {
+					return
+				}
+				if throttled {
+					if clientToUpstream {
+						h.throttledOut.Add(uint64(nr))
+					} else {
+						h.throttledIn.Add(uint64(nr))
+					}
+				}
+			}
 			nw, ew := dst.Write(buf[:nr])
-			if h.activeIPs != nil && nw > 0 {
-				now := time.Now()
+			if nw > 0 {
+				// "Bytes Out" is client -> upstream (upload), "Bytes In"
+				// upstream -> client (download); see flushUsage.
 				if clientToUpstream {
-					// Treat "Bytes Out" as client -> upstream (upload).
-					h.activeIPs.AddBytes(srcIP, 0, uint64(nw), now)
+					h.bytesOut.Add(uint64(nw))
 				} else {
-					// Treat "Bytes In" as upstream -> client (download).
-					h.activeIPs.AddBytes(srcIP, uint64(nw), 0, now)
+					h.bytesIn.Add(uint64(nw))
 				}
 			}
 			if ew != nil {
@@ -6,12 +6,18 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/guilherme/zid-proxy/internal/activeips"
 	"github.com/guilherme/zid-proxy/internal/agent"
+	"github.com/guilherme/zid-proxy/internal/appid"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
 	"github.com/guilherme/zid-proxy/internal/logger"
+	"github.com/guilherme/zid-proxy/internal/quota"
 	"github.com/guilherme/zid-proxy/internal/rules"
+	"github.com/guilherme/zid-proxy/internal/shaper"
+	"github.com/guilherme/zid-proxy/internal/tsdb"
 )
 
 // Config holds server configuration
@@ -21,6 +27,32 @@ type Config struct {
 	WriteTimeout time.Duration
 	ActiveIPs    *activeips.Tracker
 	Agents       *agent.Registry
+	// RevokeOnReload re-runs the rules for every live connection after a reload
+	// and closes the ones that are now blocked (logged as REVOKED).
+	RevokeOnReload bool
+	// MaxConns caps in-flight connections across all clients (0 = unlimited).
+	MaxConns int
+	// MaxConnsPerIP and MaxConnRatePerIP cap concurrent and new-per-second
+	// connections from one source IP (0 = unlimited). They require ActiveIPs.
+	MaxConnsPerIP    int
+	MaxConnRatePerIP int
+	// Quotas enforces the QUOTA statements of the rules (nil = disabled).
+	Quotas *quota.Store
+	// History records per-IP/user/group/domain traffic over time (nil = disabled).
+	History *tsdb.Store
+	// Blocks remembers recent blocks per IP for agent notifications (nil = disabled).
+	Blocks *blocklog.Log
+	// Apps identifies the application of each connection for the access log
+	// and the app rules (nil = disabled).
+	Apps AppResolver
+	// AppRules holds the ALLOW_APP/BLOCK_APP rules of the groups (nil = none).
+	AppRules *appid.AppRuleSet
+	// AppFailOpen lets connections through when the app lookup fails; when
+	// off, groups with app rules are blocked until AppID answers again.
+	AppFailOpen bool
+	// Flows receives the relayed connections with their byte counts, so
+	// zid-appid keeps per-IP app usage (nil = not reported).
+	Flows FlowReporter
 }
 
 // DefaultConfig returns a Config with sensible defaults
@@ -31,6 +63,7 @@ func DefaultConfig() Config {
 		WriteTimeout: 30 * time.Second,
 		ActiveIPs:    nil,
 		Agents:       nil,
+		AppFailOpen:  true,
 	}
 }
 
@@ -41,6 +74,16 @@ type Server struct {
 	logger   logger.Interface
 	listener net.Listener
 	agents   *agent.Registry
+	shaper   *shaper.Shaper
+
+	// Live connection table: in-flight handlers by connection ID
+	connsMu sync.Mutex
+	conns   map[uint64]*Handler
+	nextID  atomic.Uint64
+
+	// Admitted connections (counted before the handler goroutine starts)
+	inflight atomic.Int64
+	rejected atomic.Uint64
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -50,14 +93,18 @@ type Server struct {
 // New creates a new Server
 func New(cfg Config, ruleSet *rules.RuleSet, log logger.Interface) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
+	s := &Server{
 		config: cfg,
 		rules:  ruleSet,
 		logger: log,
 		agents: cfg.Agents,
+		shaper: shaper.New(),
+		conns:  make(map[uint64]*Handler),
 		ctx:    ctx,
 		cancel: cancel,
 	}
+	s.syncAppGroups()
+	return s
 }
 
 // Start starts the proxy server
@@ -70,12 +117,44 @@ func (s *Server) Start() error {
 
 	log.Printf("zid-proxy listening on %s", s.config.ListenAddr)
 
-	s.wg.Add(1)
+	s.wg.Add(2)
 	go s.acceptLoop()
+	go s.usageLoop()
 
 	return nil
 }
 
+// usageFlushInterval is how often the bytes of live connections are charged
+// to the quota, history and active IP counters.
+const usageFlushInterval = time.Second
+
+// usageLoop periodically flushes the usage of every live connection and,
+// every flowUpdateInterval, reports their byte counts to config.Flows.
+func (s *Server) usageLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	lastFlowUpdate := time.Now()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			updateFlows := now.Sub(lastFlowUpdate) >= flowUpdateInterval
+			if updateFlows {
+				lastFlowUpdate = now
+			}
+			for _, h := range s.handlers() {
+				h.flushUsage(now)
+				if updateFlows {
+					h.updateFlow()
+				}
+			}
+		}
+	}
+}
+
 // Stop gracefully stops the server
 func (s *Server) Stop() error {
 	log.Println("Shutting down server...")
@@ -107,7 +186,24 @@ func (s *Server) Reload() error {
 		return fmt.Errorf("failed to reload rules: %w", err)
 	}
 	log.Printf("Rules reloaded successfully (%d rules)", s.rules.RuleCount())
-	return nil
+	s.syncAppGroups()
+	var appErr error
+	if s.config.AppRules != nil {
+		if err := s.config.AppRules.Reload(); err != nil {
+			// The new hostname rules are live: revoke against them before
+			// reporting the error
+			appErr = fmt.Errorf("failed to reload app rules: %w", err)
+		} else {
+			log.Printf("App rules reloaded successfully (%d rules)", s.config.AppRules.Count())
+		}
+	}
+
+	if s.config.RevokeOnReload {
+		if n := s.revokeBlocked(); n > 0 {
+			log.Printf("Revoked %d live connections blocked by the new rules", n)
+		}
+	}
+	return appErr
 }
 
 // acceptLoop accepts incoming connections
@@ -126,15 +222,64 @@ func (s *Server) acceptLoop() {
 			}
 		}
 
+		if !s.admit(conn) {
+			continue
+		}
+
 		s.wg.Add(1)
 		go s.handleConnection(conn)
 	}
 }
 
+// admit applies the global and per-IP connection limits. A refused connection
+// is closed with RST and logged as REJECT; an admitted one must be released by
+// handleConnection.
+func (s *Server) admit(conn net.Conn) bool {
+	srcIP := ""
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		srcIP = addr.IP.String()
+	}
+
+	if max := s.config.MaxConns; max > 0 && s.inflight.Load() >= int64(max) {
+		s.reject(conn, srcIP, fmt.Sprintf("global limit of %d connections reached", max))
+		return false
+	}
+
+	if s.config.ActiveIPs != nil {
+		lim := activeips.ConnLimits{
+			MaxConns:  s.config.MaxConnsPerIP,
+			MaxPerSec: s.config.MaxConnRatePerIP,
+		}
+		if err := s.config.ActiveIPs.TryConnStart(srcIP, lim, time.Now()); err != nil {
+			s.reject(conn, srcIP, err.Error())
+			return false
+		}
+	}
+
+	s.inflight.Add(1)
+	return true
+}
+
+// reject resets a connection refused by admit.
+func (s *Server) reject(conn net.Conn, srcIP, reason string) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+
+	s.rejected.Add(1)
+	s.logger.LogConnection(srcIP, "", "", "", "", "", logger.ActionReject)
+	log.Printf("%s | %s (%s)", srcIP, logger.ActionReject, reason)
+}
+
 // handleConnection processes a single connection
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
 	defer conn.Close()
+	defer s.inflight.Add(-1)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
 
 	handler := &Handler{
 		server:       s,
@@ -142,11 +287,45 @@ func (s *Server) handleConnection(conn net.Conn) {
 		readTimeout:  s.config.ReadTimeout,
 		writeTimeout: s.config.WriteTimeout,
 		activeIPs:    s.config.ActiveIPs,
+		id:           s.nextID.Add(1),
+		ctx:          ctx,
+		cancel:       cancel,
+		startedAt:    time.Now(),
+	}
+
+	if s.config.ActiveIPs != nil {
+		// Counted by admit
+		defer s.config.ActiveIPs.ConnEnd(handler.srcIP(), time.Now())
 	}
 
+	s.register(handler)
+	defer s.unregister(handler)
+	// Before ConnEnd, so the last bytes count for the IP
+	defer func() { handler.flushUsage(time.Now()) }()
+
 	handler.Handle()
 }
 
+// Metrics holds global proxy counters for the admin API.
+type Metrics struct {
+	ActiveConnections   int    `json:"active_connections"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	shaper.Stats
+}
+
+// Metrics returns the current global counters.
+func (s *Server) Metrics() Metrics {
+	s.connsMu.Lock()
+	active := len(s.conns)
+	s.connsMu.Unlock()
+
+	return Metrics{
+		ActiveConnections:   active,
+		RejectedConnections: s.rejected.Load(),
+		Stats:               s.shaper.Stats(),
+	}
+}
+
 // ListenAddr returns the actual listen address (useful when port 0 is used)
 func (s *Server) ListenAddr() string {
 	if s.listener != nil {
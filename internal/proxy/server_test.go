@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/activeips"
+	"github.com/guilherme/zid-proxy/internal/blocklog"
+	"github.com/guilherme/zid-proxy/internal/logger"
+)
+
+// expectReset waits for the server to close c (RST or EOF).
+func expectReset(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("expected rejected connection to be closed")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("rejected connection was left open")
+	}
+}
+
+func TestServer_RejectsOverPerIPLimit(t *testing.T) {
+	var buf syncBuffer
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "", logger.NewWriterLogger(&buf))
+	s.config.ActiveIPs = activeips.New(activeips.Options{})
+	s.config.MaxConnsPerIP = 1
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	// First connection stays in the handshake phase and holds the slot.
+	c1, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c1.Close()
+	waitConnections(t, s, 1)
+
+	c2, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c2.Close()
+	expectReset(t, c2)
+
+	if m := s.Metrics(); m.RejectedConnections != 1 || m.ActiveConnections != 1 {
+		t.Fatalf("metrics=%+v", m)
+	}
+	if logged := buf.String(); !strings.Contains(logged, "| 127.0.0.1 |") || !strings.Contains(logged, "| REJECT |") {
+		t.Fatalf("expected REJECT access log entry, got %q", logged)
+	}
+
+	// Closing the first connection frees the slot.
+	c1.Close()
+	waitConnections(t, s, 0)
+	c3, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c3.Close()
+	waitConnections(t, s, 1)
+}
+
+func TestServer_RejectsOverGlobalLimit(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "", logger.NewNullLogger())
+	s.config.MaxConns = 2
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", s.ListenAddr())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+	}
+	waitConnections(t, s, 2)
+
+	// The RST can arrive before the dial returns on loopback.
+	c, err := net.Dial("tcp", s.ListenAddr())
+	if err == nil {
+		defer c.Close()
+		expectReset(t, c)
+	} else if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("dial: %v", err)
+	}
+
+	if m := s.Metrics(); m.RejectedConnections != 1 {
+		t.Fatalf("rejected=%d, want 1", m.RejectedConnections)
+	}
+}
+
+func TestServer_RecordsBlocks(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "access_rules.txt"), "BLOCK;127.0.0.0/8;*.example.com\n", logger.NewNullLogger())
+	s.config.Blocks = blocklog.New(0)
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	c, err := net.Dial("tcp", s.ListenAddr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tls.Client(c, &tls.Config{ServerName: "video.example.com"}).Handshake(); err == nil {
+		t.Fatal("expected blocked handshake to fail")
+	}
+
+	waitConnections(t, s, 0)
+	blocks, _ := s.config.Blocks.Since("127.0.0.1", "", 0, time.Now())
+	if len(blocks) != 1 || blocks[0].Hostname != "video.example.com" || blocks[0].Reason != blocklog.ReasonRule {
+		t.Fatalf("blocks=%+v", blocks)
+	}
+}
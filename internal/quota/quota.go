@@ -0,0 +1,267 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+// Store counts data usage per identity (agent username, else client IP) and
+// checks it against the QUOTA statements of the identity's group.
+// Counters reset lazily on calendar boundaries in the store's time zone.
+type Store struct {
+	mu    sync.Mutex
+	usage map[string]*usage
+	loc   *time.Location
+}
+
+type usage struct {
+	Identity   string        `json:"identity"`
+	Group      string        `json:"group,omitempty"`
+	Quotas     []limitRecord `json:"quotas,omitempty"`
+	Day        string        `json:"day"`
+	DayBytes   uint64        `json:"day_bytes"`
+	Month      string        `json:"month"`
+	MonthBytes uint64        `json:"month_bytes"`
+}
+
+type limitRecord struct {
+	Period rules.QuotaPeriod `json:"period"`
+	Bytes  uint64            `json:"bytes"`
+}
+
+type stateFile struct {
+	Version int      `json:"version"`
+	Usage   []*usage `json:"usage"`
+}
+
+const stateVersion = 1
+
+// Snapshot is the JSON document describing usage against each quota.
+type Snapshot struct {
+	Version     int             `json:"version"`
+	GeneratedAt string          `json:"generated_at"`
+	Entries     []EntrySnapshot `json:"entries"`
+}
+
+// EntrySnapshot describes one identity's usage for one quota period.
+type EntrySnapshot struct {
+	Identity       string `json:"identity"`
+	Group          string `json:"group,omitempty"`
+	Period         string `json:"period"`
+	LimitBytes     uint64 `json:"limit_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	RemainingBytes uint64 `json:"remaining_bytes"`
+	Exceeded       bool   `json:"exceeded"`
+	ResetsAt       string `json:"resets_at"`
+}
+
+// New creates an empty Store. Periods follow loc (nil = time.Local).
+func New(loc *time.Location) *Store {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &Store{
+		usage: make(map[string]*usage),
+		loc:   loc,
+	}
+}
+
+func (s *Store) dayKey(now time.Time) string {
+	return now.In(s.loc).Format("2006-01-02")
+}
+
+func (s *Store) monthKey(now time.Time) string {
+	return now.In(s.loc).Format("2006-01")
+}
+
+// roll resets the counters whose period ended. Caller must hold s.mu.
+func (s *Store) roll(u *usage, now time.Time) {
+	if day := s.dayKey(now); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := s.monthKey(now); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+}
+
+// get returns the (rolled) usage entry for identity, creating it if needed.
+// Caller must hold s.mu.
+func (s *Store) get(identity string, now time.Time) *usage {
+	u := s.usage[identity]
+	if u == nil {
+		u = &usage{Identity: identity}
+		s.usage[identity] = u
+	}
+	s.roll(u, now)
+	return u
+}
+
+// Add counts n bytes (download or upload) for identity.
+func (s *Store) Add(identity string, n uint64, now time.Time) {
+	if identity == "" || n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.get(identity, now)
+	u.DayBytes += n
+	u.MonthBytes += n
+}
+
+// Check records the group and quotas that apply to identity and reports the
+// first quota the identity has used up, if any.
+func (s *Store) Check(identity, group string, quotas []rules.Quota, now time.Time) (rules.Quota, bool) {
+	if identity == "" || len(quotas) == 0 {
+		return rules.Quota{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.get(identity, now)
+	u.Group = group
+	u.Quotas = u.Quotas[:0]
+	for _, q := range quotas {
+		u.Quotas = append(u.Quotas, limitRecord{Period: q.Period, Bytes: q.Bytes})
+	}
+
+	for _, q := range quotas {
+		if used(u, q.Period) >= q.Bytes {
+			return q, true
+		}
+	}
+	return rules.Quota{}, false
+}
+
+func used(u *usage, period rules.QuotaPeriod) uint64 {
+	if period == rules.QuotaMonthly {
+		return u.MonthBytes
+	}
+	return u.DayBytes
+}
+
+// resetsAt returns the start of the next period.
+func (s *Store) resetsAt(period rules.QuotaPeriod, now time.Time) time.Time {
+	t := now.In(s.loc)
+	if period == rules.QuotaMonthly {
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+}
+
+// GC drops identities without quotas and identities with no usage in the current month.
+func (s *Store) GC(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	month := s.monthKey(now)
+	for id, u := range s.usage {
+		if len(u.Quotas) == 0 || u.Month != month {
+			delete(s.usage, id)
+		}
+	}
+}
+
+// Snapshot returns usage against every recorded quota, ordered by identity.
+func (s *Store) Snapshot(now time.Time) Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := Snapshot{
+		Version:     1,
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Entries:     make([]EntrySnapshot, 0, len(s.usage)),
+	}
+	for _, u := range s.usage {
+		s.roll(u, now)
+		for _, q := range u.Quotas {
+			e := EntrySnapshot{
+				Identity:   u.Identity,
+				Group:      u.Group,
+				Period:     string(q.Period),
+				LimitBytes: q.Bytes,
+				UsedBytes:  used(u, q.Period),
+				ResetsAt:   s.resetsAt(q.Period, now).UTC().Format(time.RFC3339),
+			}
+			if e.UsedBytes >= e.LimitBytes {
+				e.Exceeded = true
+			} else {
+				e.RemainingBytes = e.LimitBytes - e.UsedBytes
+			}
+			out.Entries = append(out.Entries, e)
+		}
+	}
+	sort.Slice(out.Entries, func(i, j int) bool {
+		if out.Entries[i].Identity != out.Entries[j].Identity {
+			return out.Entries[i].Identity < out.Entries[j].Identity
+		}
+		return out.Entries[i].Period < out.Entries[j].Period
+	})
+	return out
+}
+
+// Load restores the counters saved by Save. A missing file is not an error.
+func (s *Store) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st stateFile
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	if st.Version != stateVersion {
+		return errors.New("unsupported quota state version")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range st.Usage {
+		if u == nil || u.Identity == "" {
+			continue
+		}
+		s.usage[u.Identity] = u
+	}
+	return nil
+}
+
+// Save writes the counters to path via a temp file + rename.
+func (s *Store) Save(path string) error {
+	s.mu.Lock()
+	st := stateFile{Version: stateVersion, Usage: make([]*usage, 0, len(s.usage))}
+	for _, u := range s.usage {
+		cp := *u
+		cp.Quotas = append([]limitRecord(nil), u.Quotas...)
+		st.Usage = append(st.Usage, &cp)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(st.Usage, func(i, j int) bool { return st.Usage[i].Identity < st.Usage[j].Identity })
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,120 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guilherme/zid-proxy/internal/rules"
+)
+
+var dailyAndMonthly = []rules.Quota{
+	{Period: rules.QuotaDaily, Bytes: 1000},
+	{Period: rules.QuotaMonthly, Bytes: 2500},
+}
+
+func TestStore_CheckExceeded(t *testing.T) {
+	s := New(time.UTC)
+	now := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	if _, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, now); exceeded {
+		t.Fatal("fresh identity must not be over quota")
+	}
+	s.Add("maria", 999, now)
+	if _, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, now); exceeded {
+		t.Fatal("999/1000 must not be over quota")
+	}
+	s.Add("maria", 1, now)
+	q, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, now)
+	if !exceeded || q.Period != rules.QuotaDaily {
+		t.Fatalf("got %+v,%v; want daily exceeded", q, exceeded)
+	}
+
+	// Other identities are counted separately.
+	if _, exceeded := s.Check("192.168.1.10", "visitantes", dailyAndMonthly, now); exceeded {
+		t.Fatal("unrelated identity must not be over quota")
+	}
+}
+
+func TestStore_CalendarResets(t *testing.T) {
+	s := New(time.UTC)
+	day1 := time.Date(2025, 1, 31, 23, 59, 0, 0, time.UTC)
+
+	s.Check("maria", "visitantes", dailyAndMonthly, day1)
+	s.Add("maria", 1000, day1)
+
+	// Next day (and a new month): both counters reset.
+	day2 := time.Date(2025, 2, 1, 0, 1, 0, 0, time.UTC)
+	if _, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, day2); exceeded {
+		t.Fatal("daily quota must reset at midnight")
+	}
+
+	// Within a month the monthly counter accumulates across days.
+	for d := 1; d <= 3; d++ {
+		s.Add("maria", 900, time.Date(2025, 2, d, 12, 0, 0, 0, time.UTC))
+	}
+	q, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, time.Date(2025, 2, 3, 13, 0, 0, 0, time.UTC))
+	if !exceeded || q.Period != rules.QuotaMonthly {
+		t.Fatalf("got %+v,%v; want monthly exceeded", q, exceeded)
+	}
+	if _, exceeded := s.Check("maria", "visitantes", dailyAndMonthly, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)); exceeded {
+		t.Fatal("monthly quota must reset on the first day of the month")
+	}
+}
+
+func TestStore_SnapshotRemaining(t *testing.T) {
+	s := New(time.UTC)
+	now := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	s.Check("maria", "visitantes", dailyAndMonthly, now)
+	s.Add("maria", 1200, now)
+
+	snap := s.Snapshot(now)
+	if len(snap.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(snap.Entries))
+	}
+	daily, monthly := snap.Entries[0], snap.Entries[1]
+	if daily.Period != "daily" || !daily.Exceeded || daily.RemainingBytes != 0 || daily.ResetsAt != "2025-01-16T00:00:00Z" {
+		t.Fatalf("daily=%+v", daily)
+	}
+	if monthly.Period != "monthly" || monthly.Exceeded || monthly.RemainingBytes != 1300 || monthly.ResetsAt != "2025-02-01T00:00:00Z" {
+		t.Fatalf("monthly=%+v", monthly)
+	}
+}
+
+func TestStore_SaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db", "quota.json")
+	now := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	s := New(time.UTC)
+	s.Check("maria", "visitantes", dailyAndMonthly, now)
+	s.Add("maria", 1000, now)
+	if err := s.Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored := New(time.UTC)
+	if err := restored.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, exceeded := restored.Check("maria", "visitantes", dailyAndMonthly, now.Add(time.Hour)); !exceeded {
+		t.Fatal("usage must survive a restart")
+	}
+
+	// Missing file is not an error.
+	if err := New(time.UTC).Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("load missing: %v", err)
+	}
+}
+
+func TestStore_GCDropsStaleMonths(t *testing.T) {
+	s := New(time.UTC)
+	jan := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	s.Check("maria", "visitantes", dailyAndMonthly, jan)
+	s.Add("maria", 10, jan)
+
+	s.GC(time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC))
+	if n := len(s.Snapshot(jan).Entries); n != 0 {
+		t.Fatalf("got %d entries after GC, want 0", n)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -28,6 +29,45 @@ type Rule struct {
 type GroupRule struct {
 	Type     RuleType
 	Hostname string
+	// Category is set for "@category:NAME" patterns, which match every app of
+	// that AppID category instead of a hostname.
+	Category string
+}
+
+// CategoryPrefix introduces a category pattern in grouped rules
+// (e.g. "BLOCK;@category:games").
+const CategoryPrefix = "@category:"
+
+// RateLimit caps the bandwidth of a single client, in bits per second.
+// Zero means unlimited in that direction.
+type RateLimit struct {
+	DownBits uint64 // upstream -> client (download)
+	UpBits   uint64 // client -> upstream (upload)
+}
+
+// IsZero reports whether the limit is unlimited in both directions.
+func (l RateLimit) IsZero() bool {
+	return l.DownBits == 0 && l.UpBits == 0
+}
+
+// IPLimit binds a RateLimit to a source IP or CIDR (LIMIT_IP statement).
+type IPLimit struct {
+	SourceIP *net.IPNet
+	Limit    RateLimit
+}
+
+// QuotaPeriod is the calendar period a data quota resets on.
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// Quota caps the data (download + upload) each member of a group may transfer per period.
+type Quota struct {
+	Period QuotaPeriod
+	Bytes  uint64
 }
 
 // Group represents an ordered group of members and hostname rules.
@@ -36,13 +76,16 @@ type Group struct {
 	Name    string
 	Members []*net.IPNet
 	Rules   []GroupRule
+	Limit   RateLimit // per-client limit for members (LIMIT statement)
+	Quotas  []Quota   // per-user (or per-IP) data quotas (QUOTA statements)
 }
 
 // RuleSet manages a collection of access rules
 type RuleSet struct {
 	mu       sync.RWMutex
-	rules    []Rule  // legacy format: TYPE;IP_OR_CIDR;HOSTNAME
-	groups   []Group // grouped format: GROUP/MEMBER + ALLOW/BLOCK
+	rules    []Rule    // legacy format: TYPE;IP_OR_CIDR;HOSTNAME
+	groups   []Group   // grouped format: GROUP/MEMBER + ALLOW/BLOCK
+	ipLimits []IPLimit // LIMIT_IP;IP_OR_CIDR;DOWN;UP (both formats)
 	filePath string
 }
 
@@ -52,6 +95,7 @@ func NewRuleSet(filePath string) *RuleSet {
 		filePath: filePath,
 		rules:    make([]Rule, 0),
 		groups:   make([]Group, 0),
+		ipLimits: make([]IPLimit, 0),
 	}
 }
 
@@ -71,6 +115,7 @@ func (rs *RuleSet) Reload() error {
 	// Clear existing rules
 	rs.rules = rs.rules[:0]
 	rs.groups = rs.groups[:0]
+	rs.ipLimits = rs.ipLimits[:0]
 
 	return rs.loadInternal()
 }
@@ -139,6 +184,61 @@ func (rs *RuleSet) loadInternal() error {
 			currentGroup.Members = append(currentGroup.Members, ipNet)
 			continue
 
+		case "LIMIT":
+			groupMode = true
+			if currentGroup == nil {
+				return fmt.Errorf("line %d: LIMIT must appear after GROUP", lineNum)
+			}
+			if len(parts) != 2 {
+				return fmt.Errorf("line %d: invalid LIMIT format: expected LIMIT;DOWN;UP", lineNum)
+			}
+			limit, err := parseRateLimit(parts[0], parts[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			currentGroup.Limit = limit
+			continue
+
+		case "QUOTA":
+			groupMode = true
+			if currentGroup == nil {
+				return fmt.Errorf("line %d: QUOTA must appear after GROUP", lineNum)
+			}
+			if len(parts) != 2 {
+				return fmt.Errorf("line %d: invalid QUOTA format: expected QUOTA;daily|monthly;SIZE", lineNum)
+			}
+			period := QuotaPeriod(strings.ToLower(strings.TrimSpace(parts[0])))
+			if period != QuotaDaily && period != QuotaMonthly {
+				return fmt.Errorf("line %d: invalid QUOTA period: %q (expected daily or monthly)", lineNum, parts[0])
+			}
+			for _, q := range currentGroup.Quotas {
+				if q.Period == period {
+					return fmt.Errorf("line %d: duplicate %s QUOTA for group %s", lineNum, period, currentGroup.Name)
+				}
+			}
+			size, err := parseSize(parts[1])
+			if err != nil {
+				return fmt.Errorf("line %d: invalid QUOTA size: %w", lineNum, err)
+			}
+			currentGroup.Quotas = append(currentGroup.Quotas, Quota{Period: period, Bytes: size})
+			continue
+
+		case "LIMIT_IP":
+			// Valid in both legacy and grouped files.
+			if len(parts) != 3 {
+				return fmt.Errorf("line %d: invalid LIMIT_IP format: expected LIMIT_IP;IP_OR_CIDR;DOWN;UP", lineNum)
+			}
+			ipNet, err := parseIPOrCIDR(parts[0])
+			if err != nil {
+				return fmt.Errorf("line %d: invalid LIMIT_IP IP/CIDR: %w", lineNum, err)
+			}
+			limit, err := parseRateLimit(parts[1], parts[2])
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rs.ipLimits = append(rs.ipLimits, IPLimit{SourceIP: ipNet, Limit: limit})
+			continue
+
 		case "ALLOW", "BLOCK":
 			// Disambiguation:
 			// - Grouped rule:  "ALLOW;HOSTNAME" / "BLOCK;HOSTNAME" (1 arg)
@@ -156,7 +256,14 @@ func (rs *RuleSet) loadInternal() error {
 				if stmt == "BLOCK" {
 					rt = RuleBlock
 				}
-				currentGroup.Rules = append(currentGroup.Rules, GroupRule{Type: rt, Hostname: hostname})
+				rule := GroupRule{Type: rt, Hostname: hostname}
+				if strings.HasPrefix(hostname, CategoryPrefix) {
+					rule.Category = strings.TrimPrefix(hostname, CategoryPrefix)
+					if !validCategory(rule.Category) {
+						return fmt.Errorf("line %d: invalid category %q", lineNum, rule.Category)
+					}
+				}
+				currentGroup.Rules = append(currentGroup.Rules, rule)
 				continue
 			}
 		}
@@ -192,6 +299,9 @@ func parseRule(line string) (Rule, error) {
 	if hostname == "" {
 		return Rule{}, fmt.Errorf("hostname cannot be empty")
 	}
+	if strings.HasPrefix(hostname, CategoryPrefix) {
+		return Rule{}, fmt.Errorf("%s patterns require a grouped rules file", CategoryPrefix)
+	}
 
 	// Validate rule type
 	var rt RuleType
@@ -217,6 +327,87 @@ func parseRule(line string) (Rule, error) {
 	}, nil
 }
 
+// parseSize parses a data size like "2GB", "500MB", "1.5TB" or "1073741824" (bytes).
+// Units are binary (1 GB = 1024 MB); KiB/MiB/GiB/TiB are accepted as aliases.
+func parseSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, fmt.Errorf("size cannot be empty")
+	}
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{
+		{"TIB", 1 << 40}, {"TB", 1 << 40}, {"T", 1 << 40},
+		{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+		{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+		{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.mult
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size: %q (expected e.g. 2GB, 500MB)", s)
+	}
+	return uint64(v * multiplier), nil
+}
+
+// parseRateLimit parses the DOWN and UP fields of LIMIT/LIMIT_IP statements
+func parseRateLimit(down, up string) (RateLimit, error) {
+	downBits, err := parseRate(down)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("invalid download rate: %w", err)
+	}
+	upBits, err := parseRate(up)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("invalid upload rate: %w", err)
+	}
+	return RateLimit{DownBits: downBits, UpBits: upBits}, nil
+}
+
+// parseRate parses a rate like "5mbit", "512kbit", "1.5gbit" or "800000" (bit/s).
+// "0" or "unlimited" disables the limit.
+func parseRate(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, fmt.Errorf("rate cannot be empty")
+	}
+	if s == "unlimited" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{
+		{"gbit", 1e9},
+		{"mbit", 1e6},
+		{"kbit", 1e3},
+		{"bit", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.mult
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate: %q (expected e.g. 5mbit, 512kbit)", s)
+	}
+	return uint64(v * multiplier), nil
+}
+
 // parseIPOrCIDR parses an IP address or CIDR notation
 func parseIPOrCIDR(s string) (*net.IPNet, error) {
 	// Try CIDR first
@@ -254,6 +445,13 @@ func parseIPOrCIDR(s string) (*net.IPNet, error) {
 // Priority (within applicable rules): ALLOW > BLOCK
 // Default: ALLOW if no rule matches
 func (rs *RuleSet) Match(srcIP net.IP, hostname string) (action RuleType, matched bool, groupName string) {
+	return rs.MatchCategory(srcIP, hostname, "")
+}
+
+// MatchCategory is Match for a connection whose app belongs to category
+// ("" = unknown). In the selected group, hostname rules beat "@category:"
+// rules: the category rules only apply when no hostname rule matches.
+func (rs *RuleSet) MatchCategory(srcIP net.IP, hostname, category string) (action RuleType, matched bool, groupName string) {
 	rs.mu.RLock()
 	defer rs.mu.RUnlock()
 
@@ -281,10 +479,20 @@ func (rs *RuleSet) Match(srcIP net.IP, hostname string) (action RuleType, matche
 		group := rs.groups[selectedIdx]
 		groupName = group.Name
 
-		var allowMatched bool
-		var blockMatched bool
+		var allowMatched, blockMatched bool
+		var allowCategory, blockCategory bool
 		for _, rule := range group.Rules {
-			if matchHostname(rule.Hostname, hostname) {
+			switch {
+			case rule.Category != "":
+				if rule.Category != category {
+					continue
+				}
+				if rule.Type == RuleAllow {
+					allowCategory = true
+				} else {
+					blockCategory = true
+				}
+			case matchHostname(rule.Hostname, hostname):
 				if rule.Type == RuleAllow {
 					allowMatched = true
 				} else {
@@ -299,6 +507,12 @@ func (rs *RuleSet) Match(srcIP net.IP, hostname string) (action RuleType, matche
 		if blockMatched {
 			return RuleBlock, true, groupName
 		}
+		if allowCategory {
+			return RuleAllow, true, groupName
+		}
+		if blockCategory {
+			return RuleBlock, true, groupName
+		}
 		return RuleAllow, false, groupName
 	}
 
@@ -329,6 +543,94 @@ func (rs *RuleSet) Match(srcIP net.IP, hostname string) (action RuleType, matche
 	return RuleAllow, false, ""
 }
 
+// LimitFor returns the bandwidth limit for a client.
+//
+// LIMIT_IP statements are checked first (first match in file order); otherwise the
+// LIMIT of the first group containing srcIP applies. ok is false if no limit applies.
+func (rs *RuleSet) LimitFor(srcIP net.IP) (limit RateLimit, ok bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, l := range rs.ipLimits {
+		if l.SourceIP.Contains(srcIP) {
+			return l.Limit, !l.Limit.IsZero()
+		}
+	}
+
+	for _, g := range rs.groups {
+		for _, member := range g.Members {
+			if member.Contains(srcIP) {
+				return g.Limit, !g.Limit.IsZero()
+			}
+		}
+	}
+	return RateLimit{}, false
+}
+
+// Groups returns the groups in file order. The slice is a copy; the members
+// and rules are shared and must not be modified.
+func (rs *RuleSet) Groups() []Group {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	out := make([]Group, len(rs.groups))
+	copy(out, rs.groups)
+	return out
+}
+
+// QuotasFor returns the data quotas of the first group containing srcIP,
+// along with the group name. quotas is empty if the group has no QUOTA.
+func (rs *RuleSet) QuotasFor(srcIP net.IP) (group string, quotas []Quota) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, g := range rs.groups {
+		for _, member := range g.Members {
+			if member.Contains(srcIP) {
+				return g.Name, append([]Quota(nil), g.Quotas...)
+			}
+		}
+	}
+	return "", nil
+}
+
+// GroupFor returns the name of the first group containing srcIP ("" = none).
+func (rs *RuleSet) GroupFor(srcIP net.IP) string {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, g := range rs.groups {
+		for _, member := range g.Members {
+			if member.Contains(srcIP) {
+				return g.Name
+			}
+		}
+	}
+	return ""
+}
+
+// HasCategoryRules reports whether the first group containing srcIP has
+// "@category:" rules, i.e. whether MatchCategory needs the app's category.
+func (rs *RuleSet) HasCategoryRules(srcIP net.IP) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, g := range rs.groups {
+		for _, member := range g.Members {
+			if !member.Contains(srcIP) {
+				continue
+			}
+			for _, rule := range g.Rules {
+				if rule.Category != "" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
 // matchRule checks if a single rule matches the given connection
 func (rs *RuleSet) matchRule(rule Rule, srcIP net.IP, hostname string) bool {
 	// Check IP match
@@ -340,6 +642,20 @@ func (rs *RuleSet) matchRule(rule Rule, srcIP net.IP, hostname string) bool {
 	return matchHostname(rule.Hostname, hostname)
 }
 
+// validCategory reports whether name is a well-formed category name
+// (e.g. "social_networking").
+func validCategory(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
 // matchHostname matches a hostname against a pattern with wildcard support
 // Supports: *.example.com, example.com, *.sub.example.com
 func matchHostname(pattern, hostname string) bool {
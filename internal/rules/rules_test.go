@@ -334,3 +334,235 @@ BLOCK;172.16.0.0/12;*.youtube.com
 		rs.Match(srcIP, hostname)
 	}
 }
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{"5mbit", 5000000, false},
+		{"512kbit", 512000, false},
+		{"1.5gbit", 1500000000, false},
+		{"800000", 800000, false},
+		{"100bit", 100, false},
+		{"10 Mbit", 10000000, false},
+		{"0", 0, false},
+		{"unlimited", 0, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-1mbit", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseRate(%q) error=%v wantErr=%v", tt.in, err, tt.wantErr)
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Fatalf("parseRate(%q)=%d want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRuleSetLimitFor(t *testing.T) {
+	content := `LIMIT_IP;192.168.1.50;1mbit;256kbit
+
+GROUP;acesso_restrito
+MEMBER;192.168.1.0/24
+LIMIT;10mbit;2mbit
+BLOCK;*.facebook.com
+
+GROUP;acesso_liberado
+MEMBER;10.0.0.0/8
+`
+	tmpFile := createTempRulesFile(t, content)
+	defer os.Remove(tmpFile)
+
+	rs := NewRuleSet(tmpFile)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	tests := []struct {
+		srcIP  string
+		want   RateLimit
+		wantOK bool
+	}{
+		{"192.168.1.50", RateLimit{DownBits: 1000000, UpBits: 256000}, true},   // LIMIT_IP wins
+		{"192.168.1.10", RateLimit{DownBits: 10000000, UpBits: 2000000}, true}, // group LIMIT
+		{"10.1.2.3", RateLimit{}, false},                                       // group without LIMIT
+		{"172.16.0.1", RateLimit{}, false},                                     // no group
+	}
+
+	for _, tt := range tests {
+		got, ok := rs.LimitFor(net.ParseIP(tt.srcIP))
+		if ok != tt.wantOK || got != tt.want {
+			t.Fatalf("LimitFor(%s)=%+v,%v want %+v,%v", tt.srcIP, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	// LIMIT must not change access decisions.
+	action, matched, group := rs.Match(net.ParseIP("192.168.1.10"), "www.facebook.com")
+	if action != RuleBlock || !matched || group != "acesso_restrito" {
+		t.Fatalf("got action=%s matched=%v group=%q; want BLOCK true acesso_restrito", action, matched, group)
+	}
+}
+
+func TestRuleSetLoad_LimitErrors(t *testing.T) {
+	tests := []string{
+		"LIMIT;1mbit;1mbit\n",              // before GROUP
+		"GROUP;g\nLIMIT;1mbit\n",           // missing UP
+		"GROUP;g\nLIMIT;fast;1mbit\n",      // bad rate
+		"LIMIT_IP;not-an-ip;1mbit;1mbit\n", // bad IP
+		"LIMIT_IP;192.168.1.1;1mbit\n",     // missing UP
+	}
+
+	for _, content := range tests {
+		tmpFile := createTempRulesFile(t, content)
+		rs := NewRuleSet(tmpFile)
+		if err := rs.Load(); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+		os.Remove(tmpFile)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{"2GB", 2 << 30, false},
+		{"500MB", 500 << 20, false},
+		{"1.5TB", 3 << 39, false},
+		{"10 GiB", 10 << 30, false},
+		{"512k", 512 << 10, false},
+		{"1048576", 1 << 20, false},
+		{"0", 0, true},
+		{"", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseSize(%q) error=%v wantErr=%v", tt.in, err, tt.wantErr)
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Fatalf("parseSize(%q)=%d want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRuleSetQuotasFor(t *testing.T) {
+	content := `GROUP;visitantes
+MEMBER;192.168.50.0/24
+QUOTA;daily;2GB
+QUOTA;monthly;20GB
+
+GROUP;funcionarios
+MEMBER;192.168.1.0/24
+`
+	tmpFile := createTempRulesFile(t, content)
+	defer os.Remove(tmpFile)
+
+	rs := NewRuleSet(tmpFile)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	group, quotas := rs.QuotasFor(net.ParseIP("192.168.50.7"))
+	want := []Quota{{Period: QuotaDaily, Bytes: 2 << 30}, {Period: QuotaMonthly, Bytes: 20 << 30}}
+	if group != "visitantes" || len(quotas) != 2 || quotas[0] != want[0] || quotas[1] != want[1] {
+		t.Fatalf("got group=%q quotas=%+v", group, quotas)
+	}
+
+	if group, quotas := rs.QuotasFor(net.ParseIP("192.168.1.7")); group != "funcionarios" || len(quotas) != 0 {
+		t.Fatalf("got group=%q quotas=%+v; want funcionarios without quotas", group, quotas)
+	}
+}
+
+func TestRuleSetLoad_QuotaErrors(t *testing.T) {
+	tests := []string{
+		"QUOTA;daily;2GB\n",                           // before GROUP
+		"GROUP;g\nQUOTA;weekly;2GB\n",                 // bad period
+		"GROUP;g\nQUOTA;daily;lots\n",                 // bad size
+		"GROUP;g\nQUOTA;daily\n",                      // missing size
+		"GROUP;g\nQUOTA;daily;1GB\nQUOTA;daily;2GB\n", // duplicate period
+	}
+
+	for _, content := range tests {
+		tmpFile := createTempRulesFile(t, content)
+		rs := NewRuleSet(tmpFile)
+		if err := rs.Load(); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+		os.Remove(tmpFile)
+	}
+}
+
+func TestRuleSetMatchCategory(t *testing.T) {
+	content := `GROUP;alunos
+MEMBER;10.0.0.0/8
+BLOCK;@category:ads
+BLOCK;@category:games
+ALLOW;*.ads.example.com
+`
+	tmpFile := createTempRulesFile(t, content)
+	defer os.Remove(tmpFile)
+
+	rs := NewRuleSet(tmpFile)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	srcIP := net.ParseIP("10.1.2.3")
+	tests := []struct {
+		hostname, category string
+		want               RuleType
+		matched            bool
+	}{
+		{"tracker.example.net", "ads", RuleBlock, true},
+		{"store.steampowered.com", "games", RuleBlock, true},
+		// Hostname rules beat category rules
+		{"cdn.ads.example.com", "ads", RuleAllow, true},
+		{"tracker.example.net", "", RuleAllow, false},
+		{"www.google.com", "search", RuleAllow, false},
+	}
+	for _, tt := range tests {
+		action, matched, group := rs.MatchCategory(srcIP, tt.hostname, tt.category)
+		if action != tt.want || matched != tt.matched || group != "alunos" {
+			t.Errorf("MatchCategory(%s, %s) = %s %v %q; want %s %v", tt.hostname, tt.category, action, matched, group, tt.want, tt.matched)
+		}
+	}
+	// Without a category the pattern never matches as a hostname
+	if _, matched, _ := rs.Match(srcIP, "@category:ads"); matched {
+		t.Error("category pattern matched as hostname")
+	}
+
+	if rs.GroupFor(srcIP) != "alunos" || !rs.HasCategoryRules(srcIP) {
+		t.Error("alunos has category rules")
+	}
+	if other := net.ParseIP("192.168.1.1"); rs.GroupFor(other) != "" || rs.HasCategoryRules(other) {
+		t.Error("IP outside the groups has no category rules")
+	}
+}
+
+func TestRuleSetLoad_CategoryErrors(t *testing.T) {
+	tests := []string{
+		"GROUP;g\nBLOCK;@category:\n",         // empty
+		"GROUP;g\nBLOCK;@category:Bad Name\n", // invalid name
+		"BLOCK;10.0.0.0/8;@category:games\n",  // legacy format
+	}
+
+	for _, content := range tests {
+		tmpFile := createTempRulesFile(t, content)
+		rs := NewRuleSet(tmpFile)
+		if err := rs.Load(); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+		os.Remove(tmpFile)
+	}
+}
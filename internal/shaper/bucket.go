@@ -0,0 +1,82 @@
+package shaper
+
+import (
+	"sync"
+	"time"
+)
+
+// minBurst keeps very low rates from degenerating into one-byte writes.
+const minBurst = 16 * 1024
+
+// Bucket is a token bucket measured in bytes.
+//
+// Reserve never blocks: it takes the tokens immediately (the bucket may go into
+// debt) and returns how long the caller must wait before sending. Callers that
+// share a bucket are therefore served in reservation order.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second; 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a bucket that refills at bytesPerSec (0 = unlimited).
+func NewBucket(bytesPerSec uint64) *Bucket {
+	b := &Bucket{}
+	b.SetRate(bytesPerSec)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the refill rate, keeping the current token balance.
+func (b *Bucket) SetRate(bytesPerSec uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(bytesPerSec)
+	// Allow roughly 250ms worth of traffic in a single burst.
+	b.burst = b.rate / 4
+	if b.burst < minBurst {
+		b.burst = minBurst
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate returns the refill rate in bytes per second (0 = unlimited).
+func (b *Bucket) Rate() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return uint64(b.rate)
+}
+
+// Reserve takes n bytes from the bucket and returns how long the caller must
+// wait before sending them. It returns 0 when the bucket is unlimited or has
+// enough tokens.
+func (b *Bucket) Reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	if b.last.IsZero() {
+		b.last = now
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
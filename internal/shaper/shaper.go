@@ -0,0 +1,127 @@
+// Package shaper enforces per-client bandwidth limits in the proxy relay loop.
+package shaper
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shaper keeps one pair of token buckets (download/upload) per client IP.
+// All connections of the same client share the same buckets.
+type Shaper struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+
+	throttledIn  atomic.Uint64
+	throttledOut atomic.Uint64
+}
+
+// Client is the shared limiter state of a single source IP.
+type Client struct {
+	srcIP  string
+	down   *Bucket
+	up     *Bucket
+	refs   int
+	shaper *Shaper
+}
+
+// Stats holds global shaping counters.
+type Stats struct {
+	Clients           int    `json:"shaped_clients"`
+	ThrottledBytesIn  uint64 `json:"throttled_bytes_in"`
+	ThrottledBytesOut uint64 `json:"throttled_bytes_out"`
+}
+
+// New creates an empty Shaper.
+func New() *Shaper {
+	return &Shaper{clients: make(map[string]*Client)}
+}
+
+// Acquire returns the limiter for srcIP, creating it if needed, and applies the
+// given rates (bytes per second, 0 = unlimited). The latest rates win, so a
+// rules reload takes effect for the client's existing connections as well.
+// Every Acquire must be paired with Release.
+func (s *Shaper) Acquire(srcIP string, downBytesPerSec, upBytesPerSec uint64) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.clients[srcIP]
+	if c == nil {
+		c = &Client{
+			srcIP:  srcIP,
+			down:   NewBucket(downBytesPerSec),
+			up:     NewBucket(upBytesPerSec),
+			shaper: s,
+		}
+		s.clients[srcIP] = c
+	} else {
+		if c.down.Rate() != downBytesPerSec {
+			c.down.SetRate(downBytesPerSec)
+		}
+		if c.up.Rate() != upBytesPerSec {
+			c.up.SetRate(upBytesPerSec)
+		}
+	}
+	c.refs++
+	return c
+}
+
+// Release drops a reference obtained with Acquire. The client state is
+// discarded when its last connection ends.
+func (s *Shaper) Release(c *Client) {
+	if c == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.refs--
+	if c.refs <= 0 && s.clients[c.srcIP] == c {
+		delete(s.clients, c.srcIP)
+	}
+}
+
+// Stats returns the global shaping counters.
+func (s *Shaper) Stats() Stats {
+	s.mu.Lock()
+	clients := len(s.clients)
+	s.mu.Unlock()
+
+	return Stats{
+		Clients:           clients,
+		ThrottledBytesIn:  s.throttledIn.Load(),
+		ThrottledBytesOut: s.throttledOut.Load(),
+	}
+}
+
+// Wait blocks until n bytes may be relayed in the given direction.
+// upload is client -> upstream; otherwise upstream -> client.
+// throttled reports whether the bytes had to be delayed.
+func (c *Client) Wait(ctx context.Context, n int, upload bool) (throttled bool, err error) {
+	bucket := c.down
+	if upload {
+		bucket = c.up
+	}
+
+	delay := bucket.Reserve(n, time.Now())
+	if delay <= 0 {
+		return false, nil
+	}
+
+	if upload {
+		c.shaper.throttledOut.Add(uint64(n))
+	} else {
+		c.shaper.throttledIn.Add(uint64(n))
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
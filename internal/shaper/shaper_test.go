@@ -0,0 +1,91 @@
+package shaper
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucket_ReserveWithinBurstDoesNotWait(t *testing.T) {
+	b := NewBucket(1000 * 1000) // burst = 250KB
+	now := time.Unix(1000, 0)
+
+	if d := b.Reserve(100*1024, now); d != 0 {
+		t.Fatalf("wait=%v, want 0", d)
+	}
+}
+
+func TestBucket_ReserveBeyondBurstWaitsProportionally(t *testing.T) {
+	b := NewBucket(40 * 1000) // 40KB/s, burst = minBurst (16KB)
+	now := time.Unix(1000, 0)
+
+	// Drain the burst, then 40KB more must take ~1s.
+	b.Reserve(minBurst, now)
+	d := b.Reserve(40*1000, now)
+	if d < 990*time.Millisecond || d > 1010*time.Millisecond {
+		t.Fatalf("wait=%v, want ~1s", d)
+	}
+
+	// Refill after the debt is paid.
+	if d := b.Reserve(1000, now.Add(2*time.Second)); d != 0 {
+		t.Fatalf("wait after refill=%v, want 0", d)
+	}
+}
+
+func TestBucket_UnlimitedNeverWaits(t *testing.T) {
+	b := NewBucket(0)
+	if d := b.Reserve(10*1024*1024, time.Now()); d != 0 {
+		t.Fatalf("wait=%v, want 0", d)
+	}
+}
+
+func TestShaper_SharedAcrossConnectionsOfSameIP(t *testing.T) {
+	s := New()
+	c1 := s.Acquire("192.168.1.10", 1000, 1000)
+	c2 := s.Acquire("192.168.1.10", 2000, 1000)
+	c3 := s.Acquire("192.168.1.11", 1000, 1000)
+
+	if c1 != c2 {
+		t.Fatal("connections from the same IP must share the limiter")
+	}
+	if c1 == c3 {
+		t.Fatal("different IPs must not share the limiter")
+	}
+	if c1.down.Rate() != 2000 {
+		t.Fatalf("latest rate must win, got %d", c1.down.Rate())
+	}
+	if got := s.Stats().Clients; got != 2 {
+		t.Fatalf("clients=%d, want 2", got)
+	}
+
+	s.Release(c1)
+	s.Release(c2)
+	s.Release(c3)
+	if got := s.Stats().Clients; got != 0 {
+		t.Fatalf("clients=%d after release, want 0", got)
+	}
+}
+
+func TestClient_WaitCountsThrottledBytes(t *testing.T) {
+	s := New()
+	c := s.Acquire("192.168.1.10", 0, 100*1000)
+	defer s.Release(c)
+
+	if throttled, err := c.Wait(context.Background(), 1000, false); throttled || err != nil {
+		t.Fatalf("unlimited download: throttled=%v err=%v", throttled, err)
+	}
+
+	// Exhaust the upload burst; the next chunk must be throttled.
+	c.Wait(context.Background(), minBurst, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	throttled, err := c.Wait(ctx, 50*1000, true)
+	if !throttled || err == nil {
+		t.Fatalf("throttled=%v err=%v, want throttled with context error", throttled, err)
+	}
+
+	st := s.Stats()
+	if st.ThrottledBytesOut != 50*1000 || st.ThrottledBytesIn != 0 {
+		t.Fatalf("stats=%+v", st)
+	}
+}
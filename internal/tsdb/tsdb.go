@@ -0,0 +1,560 @@
+// Package tsdb is a small embedded time-series store for traffic history.
+//
+// Bytes and connection counts are aggregated per IP, user, group and domain
+// in 5-minute and hourly buckets. Each series keeps a fixed window of buckets
+// per resolution (round-robin: a new bucket drops the ones older than the
+// retention), the number of keys is capped with LRU eviction, and each
+// resolution is persisted as one JSON file under the store directory.
+package tsdb
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dimension is what a series is keyed by.
+type Dimension string
+
+const (
+	DimIP     Dimension = "ip"
+	DimUser   Dimension = "user"
+	DimGroup  Dimension = "group"
+	DimDomain Dimension = "domain" // registrable domain, see BaseDomain
+)
+
+// Dimensions lists every dimension in a stable order.
+var Dimensions = []Dimension{DimIP, DimUser, DimGroup, DimDomain}
+
+// Resolution is a bucket size with its retention.
+type Resolution struct {
+	Name      string
+	Step      time.Duration
+	Retention time.Duration
+}
+
+var (
+	Res5m = Resolution{Name: "5m", Step: 5 * time.Minute, Retention: 48 * time.Hour}
+	Res1h = Resolution{Name: "1h", Step: time.Hour, Retention: 35 * 24 * time.Hour}
+)
+
+// Resolutions lists every resolution, finest first.
+var Resolutions = []Resolution{Res5m, Res1h}
+
+// ResolutionByName returns the resolution called name ("5m" or "1h").
+func ResolutionByName(name string) (Resolution, bool) {
+	for _, r := range Resolutions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Resolution{}, false
+}
+
+// ResolutionFor returns the finest resolution whose retention covers span.
+func ResolutionFor(span time.Duration) Resolution {
+	for _, r := range Resolutions {
+		if span <= r.Retention {
+			return r
+		}
+	}
+	return Resolutions[len(Resolutions)-1]
+}
+
+// ParseRange parses a chart range such as "24h", "7d" or "30d".
+func ParseRange(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid range: %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range: %q (expected e.g. 24h, 7d, 30d)", s)
+	}
+	return d, nil
+}
+
+// Point is one bucket of a series.
+type Point struct {
+	Start    int64  `json:"t"` // bucket start, unix seconds
+	BytesIn  uint64 `json:"in"`
+	BytesOut uint64 `json:"out"`
+	Conns    uint64 `json:"conns"`
+}
+
+// Total is the aggregate of a series over a time range.
+type Total struct {
+	Key      string `json:"key"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	Conns    uint64 `json:"conns"`
+}
+
+// Labels identifies the series a sample is added to. Empty fields are skipped.
+type Labels struct {
+	IP     string
+	User   string
+	Group  string
+	Domain string
+}
+
+func (l Labels) key(d Dimension) string {
+	switch d {
+	case DimIP:
+		return l.IP
+	case DimUser:
+		return l.User
+	case DimGroup:
+		return l.Group
+	case DimDomain:
+		return l.Domain
+	}
+	return ""
+}
+
+type seriesKey struct {
+	Dim Dimension
+	Key string
+}
+
+// series is a bounded window of buckets of one key, oldest first. It holds
+// at most slots(r) points: adding a bucket past the window drops the oldest
+// (round-robin).
+type series struct {
+	key    seriesKey
+	points []Point
+	elem   *list.Element // position in the LRU list of its dimension
+}
+
+// slots returns the number of buckets kept per series at resolution r.
+func slots(r Resolution) int {
+	return int(r.Retention / r.Step)
+}
+
+// add accumulates a sample into the bucket starting at start.
+func (ser *series) add(r Resolution, start int64, bytesIn, bytesOut, conns uint64) {
+	n := len(ser.points)
+	i := n
+	if n == 0 || ser.points[n-1].Start < start {
+		ser.points = append(ser.points, Point{Start: start})
+	} else {
+		// Same bucket, or an older one after a clock step
+		i = sort.Search(n, func(j int) bool { return ser.points[j].Start >= start })
+		if ser.points[i].Start != start {
+			ser.points = append(ser.points, Point{})
+			copy(ser.points[i+1:], ser.points[i:])
+			ser.points[i] = Point{Start: start}
+		}
+	}
+	p := &ser.points[i]
+	p.BytesIn += bytesIn
+	p.BytesOut += bytesOut
+	p.Conns += conns
+
+	ser.trim(r, ser.points[len(ser.points)-1].Start-int64(r.Retention/time.Second))
+}
+
+// trim drops the buckets starting at or before cutoff, and the oldest ones
+// beyond the slot count.
+func (ser *series) trim(r Resolution, cutoff int64) {
+	drop := sort.Search(len(ser.points), func(j int) bool { return ser.points[j].Start > cutoff })
+	if over := len(ser.points) - drop - slots(r); over > 0 {
+		drop += over
+	}
+	if drop > 0 {
+		ser.points = append(ser.points[:0], ser.points[drop:]...)
+	}
+}
+
+// resolutionData holds the series of one resolution.
+type resolutionData struct {
+	series map[seriesKey]*series
+	lru    map[Dimension]*list.List // front = most recently updated
+}
+
+// Options configures a Store.
+type Options struct {
+	// Dir holds one file per resolution. Empty keeps history in memory only.
+	Dir string
+	// MaxSeries caps the number of keys per dimension; a new key beyond it
+	// evicts the least recently updated one.
+	MaxSeries int
+}
+
+// Store is safe for concurrent use. Memory is bounded by MaxSeries keys per
+// dimension times the buckets of each resolution's window.
+type Store struct {
+	mu   sync.Mutex
+	opts Options
+	data map[string]*resolutionData // resolution name -> series
+
+	dirty     map[string]bool  // resolutions changed since the last save
+	loadError map[string]error // resolutions whose file could not be loaded nor moved aside
+}
+
+// New creates an empty Store.
+func New(opts Options) *Store {
+	if opts.MaxSeries <= 0 {
+		opts.MaxSeries = 2000
+	}
+	s := &Store{
+		opts:      opts,
+		data:      make(map[string]*resolutionData),
+		dirty:     make(map[string]bool),
+		loadError: make(map[string]error),
+	}
+	for _, r := range Resolutions {
+		rd := &resolutionData{series: make(map[seriesKey]*series), lru: make(map[Dimension]*list.List)}
+		for _, d := range Dimensions {
+			rd.lru[d] = list.New()
+		}
+		s.data[r.Name] = rd
+	}
+	return s
+}
+
+func bucketStart(t time.Time, step time.Duration) int64 {
+	return t.Truncate(step).Unix()
+}
+
+// Add records traffic for every non-empty label at now.
+func (s *Store) Add(l Labels, bytesIn, bytesOut, conns uint64, now time.Time) {
+	if bytesIn == 0 && bytesOut == 0 && conns == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range Resolutions {
+		start := bucketStart(now, r.Step)
+		for _, d := range Dimensions {
+			key := l.key(d)
+			if key == "" {
+				continue
+			}
+			s.seriesFor(r, seriesKey{Dim: d, Key: key}).add(r, start, bytesIn, bytesOut, conns)
+		}
+		s.dirty[r.Name] = true
+	}
+}
+
+// seriesFor returns the series for k, creating it if needed, and marks it
+// most recently updated. At MaxSeries keys, creating one evicts the least
+// recently updated key of the dimension. Caller must hold s.mu.
+func (s *Store) seriesFor(r Resolution, k seriesKey) *series {
+	rd := s.data[r.Name]
+	lru := rd.lru[k.Dim]
+	if ser := rd.series[k]; ser != nil {
+		lru.MoveToFront(ser.elem)
+		return ser
+	}
+	if lru.Len() >= s.opts.MaxSeries {
+		oldest := lru.Remove(lru.Back()).(*series)
+		delete(rd.series, oldest.key)
+	}
+	ser := &series{key: k}
+	ser.elem = lru.PushFront(ser)
+	rd.series[k] = ser
+	return ser
+}
+
+// Query returns one point per bucket in [from, to), zero-filled, oldest first.
+func (s *Store) Query(d Dimension, key string, r Resolution, from, to time.Time) []Point {
+	first := bucketStart(from, r.Step)
+	last := bucketStart(to.Add(-time.Nanosecond), r.Step)
+	step := int64(r.Step / time.Second)
+	if last < first {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var points []Point
+	if ser := s.data[r.Name].series[seriesKey{Dim: d, Key: key}]; ser != nil {
+		points = ser.points
+	}
+	out := make([]Point, 0, (last-first)/step+1)
+	i := sort.Search(len(points), func(j int) bool { return points[j].Start >= first })
+	for t := first; t <= last; t += step {
+		if i < len(points) && points[i].Start == t {
+			out = append(out, points[i])
+			i++
+		} else {
+			out = append(out, Point{Start: t})
+		}
+	}
+	return out
+}
+
+// Top returns the n keys of a dimension with the most bytes in [from, to).
+// n <= 0 returns every key.
+func (s *Store) Top(d Dimension, r Resolution, from, to time.Time, n int) []Total {
+	first := bucketStart(from, r.Step)
+	end := to.Unix()
+
+	s.mu.Lock()
+	out := make([]Total, 0)
+	for k, ser := range s.data[r.Name].series {
+		if k.Dim != d {
+			continue
+		}
+		tot := Total{Key: k.Key}
+		for _, p := range ser.points {
+			if p.Start >= first && p.Start < end {
+				tot.BytesIn += p.BytesIn
+				tot.BytesOut += p.BytesOut
+				tot.Conns += p.Conns
+			}
+		}
+		if tot.BytesIn+tot.BytesOut+tot.Conns > 0 {
+			out = append(out, tot)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		bi, bj := out[i].BytesIn+out[i].BytesOut, out[j].BytesIn+out[j].BytesOut
+		if bi != bj {
+			return bi > bj
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// GC drops buckets older than each resolution's retention, and empty series.
+func (s *Store) GC(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range Resolutions {
+		cutoff := bucketStart(now.Add(-r.Retention), r.Step) - 1
+		rd := s.data[r.Name]
+		for k, ser := range rd.series {
+			before := len(ser.points)
+			ser.trim(r, cutoff)
+			if len(ser.points) != before {
+				s.dirty[r.Name] = true
+			}
+			if len(ser.points) == 0 {
+				rd.lru[k.Dim].Remove(ser.elem)
+				delete(rd.series, k)
+			}
+		}
+	}
+}
+
+const fileVersion = 1
+
+type fileFormat struct {
+	Version     int          `json:"version"`
+	Resolution  string       `json:"resolution"`
+	StepSeconds int          `json:"step_seconds"`
+	Series      []fileSeries `json:"series"`
+}
+
+type fileSeries struct {
+	Dim    Dimension `json:"dim"`
+	Key    string    `json:"key"`
+	Points []Point   `json:"points"`
+}
+
+func (s *Store) path(r Resolution) string {
+	return filepath.Join(s.opts.Dir, "traffic-"+r.Name+".json")
+}
+
+// Load reads the resolution files from Dir. Missing files are not an error.
+// A file that cannot be decoded is renamed aside (".bad" suffix) so the
+// next Save does not overwrite it; if it cannot be moved, Save refuses to
+// write that resolution.
+func (s *Store) Load() error {
+	if s.opts.Dir == "" {
+		return nil
+	}
+	var errs []error
+	for _, r := range Resolutions {
+		if err := s.loadFile(r); err != nil {
+			path := s.path(r)
+			err = fmt.Errorf("%s: %w", path, err)
+			if rerr := os.Rename(path, path+".bad"); rerr == nil {
+				err = fmt.Errorf("%w (moved to %s.bad)", err, path)
+			} else {
+				s.mu.Lock()
+				s.loadError[r.Name] = err
+				s.mu.Unlock()
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) loadFile(r Resolution) error {
+	f, err := readFile(s.path(r))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.Resolution != r.Name {
+		return fmt.Errorf("resolution mismatch: %q", f.Resolution)
+	}
+
+	// Least recently updated first, so MaxSeries keeps the newest keys
+	lastStart := func(fs fileSeries) int64 {
+		if len(fs.Points) == 0 {
+			return 0
+		}
+		return fs.Points[len(fs.Points)-1].Start
+	}
+	for _, fs := range f.Series {
+		sort.Slice(fs.Points, func(i, j int) bool { return fs.Points[i].Start < fs.Points[j].Start })
+	}
+	sort.SliceStable(f.Series, func(i, j int) bool { return lastStart(f.Series[i]) < lastStart(f.Series[j]) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fs := range f.Series {
+		if len(fs.Points) == 0 {
+			continue
+		}
+		ser := s.seriesFor(r, seriesKey{Dim: fs.Dim, Key: fs.Key})
+		for _, p := range fs.Points {
+			ser.add(r, p.Start, p.BytesIn, p.BytesOut, p.Conns)
+		}
+	}
+	return nil
+}
+
+// readFile reads one resolution file written by Save.
+func readFile(path string) (*fileFormat, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f fileFormat
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != fileVersion {
+		return nil, fmt.Errorf("unsupported version %d", f.Version)
+	}
+	return &f, nil
+}
+
+// Open creates a Store and loads the files found in opts.Dir. The store is
+// usable even when an error is returned (see Load).
+func Open(opts Options) (*Store, error) {
+	s := New(opts)
+	return s, s.Load()
+}
+
+// Save writes each resolution changed since the last save to Dir via a temp
+// file + rename.
+func (s *Store) Save() error {
+	if s.opts.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.opts.Dir, 0o755); err != nil {
+		return err
+	}
+	for _, r := range Resolutions {
+		s.mu.Lock()
+		dirty, loadErr := s.dirty[r.Name], s.loadError[r.Name]
+		s.mu.Unlock()
+		if loadErr != nil {
+			return fmt.Errorf("not saving over a file that failed to load: %w", loadErr)
+		}
+		if !dirty {
+			continue
+		}
+
+		f := s.export(r)
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+
+		path := s.path(r)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, b, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export copies a resolution for Save and marks it clean.
+func (s *Store) export(r Resolution) fileFormat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rd := s.data[r.Name]
+	f := fileFormat{
+		Version:     fileVersion,
+		Resolution:  r.Name,
+		StepSeconds: int(r.Step / time.Second),
+		Series:      make([]fileSeries, 0, len(rd.series)),
+	}
+	for k, ser := range rd.series {
+		f.Series = append(f.Series, fileSeries{Dim: k.Dim, Key: k.Key, Points: append([]Point(nil), ser.points...)})
+	}
+	sort.Slice(f.Series, func(i, j int) bool {
+		if f.Series[i].Dim != f.Series[j].Dim {
+			return f.Series[i].Dim < f.Series[j].Dim
+		}
+		return f.Series[i].Key < f.Series[j].Key
+	})
+	s.dirty[r.Name] = false
+	return f
+}
+
+// twoLevelSuffixes are public suffixes under which names are registered one
+// level deeper (www.example.com.br -> example.com.br).
+var twoLevelSuffixes = map[string]bool{
+	"com.br": true, "net.br": true, "org.br": true, "gov.br": true, "edu.br": true, "art.br": true,
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true,
+	"com.au": true, "net.au": true, "org.au": true,
+	"com.ar": true, "com.mx": true, "com.pt": true, "co.jp": true, "co.nz": true, "co.za": true,
+	"com.cn": true, "com.tr": true, "co.in": true,
+}
+
+// BaseDomain reduces a hostname to its registrable domain
+// (www.facebook.com -> facebook.com, api.example.com.br -> example.com.br).
+// IP literals are returned unchanged.
+func BaseDomain(hostname string) string {
+	h := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if h == "" || strings.Trim(h, "0123456789.:") == "" {
+		return h
+	}
+	labels := strings.Split(h, ".")
+	if len(labels) <= 2 {
+		return h
+	}
+	n := 2
+	if twoLevelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
@@ -0,0 +1,214 @@
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_AddQueryBuckets(t *testing.T) {
+	s := New(Options{})
+	base := time.Unix(1700000000, 0).UTC().Truncate(time.Hour)
+	l := Labels{IP: "192.168.1.10", User: "maria", Group: "visitantes", Domain: "facebook.com"}
+
+	s.Add(l, 0, 0, 1, base.Add(1*time.Minute))
+	s.Add(l, 1000, 100, 0, base.Add(2*time.Minute))
+	s.Add(l, 500, 50, 0, base.Add(7*time.Minute)) // next 5m bucket
+
+	pts := s.Query(DimIP, "192.168.1.10", Res5m, base, base.Add(15*time.Minute))
+	if len(pts) != 3 {
+		t.Fatalf("got %d points, want 3", len(pts))
+	}
+	if pts[0].BytesIn != 1000 || pts[0].BytesOut != 100 || pts[0].Conns != 1 {
+		t.Fatalf("bucket 0 = %+v", pts[0])
+	}
+	if pts[1].BytesIn != 500 || pts[1].Start != base.Add(5*time.Minute).Unix() {
+		t.Fatalf("bucket 1 = %+v", pts[1])
+	}
+	if pts[2].BytesIn != 0 || pts[2].Start != base.Add(10*time.Minute).Unix() {
+		t.Fatalf("bucket 2 must be zero-filled, got %+v", pts[2])
+	}
+
+	// The hourly resolution aggregates both 5m buckets; every dimension is recorded.
+	for _, d := range Dimensions {
+		key := l.key(d)
+		hourly := s.Query(d, key, Res1h, base, base.Add(time.Hour))
+		if len(hourly) != 1 || hourly[0].BytesIn != 1500 || hourly[0].Conns != 1 {
+			t.Fatalf("%s/%s hourly = %+v", d, key, hourly)
+		}
+	}
+}
+
+func TestStore_Top(t *testing.T) {
+	s := New(Options{})
+	now := time.Unix(1700000000, 0).UTC()
+
+	s.Add(Labels{Domain: "netflix.com"}, 5000, 0, 1, now)
+	s.Add(Labels{Domain: "google.com"}, 100, 0, 1, now)
+	s.Add(Labels{Domain: "facebook.com"}, 900, 100, 1, now)
+	s.Add(Labels{Domain: "old.com"}, 99999, 0, 1, now.Add(-3*time.Hour))
+
+	top := s.Top(DimDomain, Res5m, now.Add(-time.Hour), now.Add(time.Minute), 2)
+	if len(top) != 2 || top[0].Key != "netflix.com" || top[1].Key != "facebook.com" {
+		t.Fatalf("top = %+v", top)
+	}
+	if all := s.Top(DimDomain, Res5m, now.Add(-time.Hour), now.Add(time.Minute), 0); len(all) != 3 {
+		t.Fatalf("got %d keys in range, want 3", len(all))
+	}
+}
+
+func TestStore_GCAndMaxSeries(t *testing.T) {
+	s := New(Options{MaxSeries: 2})
+	now := time.Unix(1700000000, 0).UTC()
+
+	s.Add(Labels{IP: "10.0.0.1"}, 1, 0, 0, now.Add(-72*time.Hour)) // beyond 5m retention
+	s.Add(Labels{IP: "10.0.0.2"}, 1, 0, 0, now)
+
+	s.GC(now)
+	if pts := s.Query(DimIP, "10.0.0.1", Res5m, now.Add(-72*time.Hour), now.Add(-71*time.Hour)); pts[0].BytesIn != 0 {
+		t.Fatal("5m bucket beyond retention must be dropped")
+	}
+	if pts := s.Query(DimIP, "10.0.0.1", Res1h, now.Add(-72*time.Hour), now.Add(-71*time.Hour)); pts[0].BytesIn != 1 {
+		t.Fatal("hourly bucket within retention must be kept")
+	}
+
+	// Over MaxSeries, the least recently updated key is evicted.
+	s.Add(Labels{IP: "10.0.0.1"}, 1, 0, 0, now)
+	s.Add(Labels{IP: "10.0.0.3"}, 1, 0, 0, now)
+	top := s.Top(DimIP, Res1h, now.Add(-96*time.Hour), now.Add(time.Minute), 0)
+	if len(top) != 2 || top[0].Key != "10.0.0.1" || top[1].Key != "10.0.0.3" {
+		t.Fatalf("top after eviction = %+v, want 10.0.0.1 and 10.0.0.3", top)
+	}
+}
+
+func TestStore_RoundRobinWindow(t *testing.T) {
+	s := New(Options{})
+	now := time.Unix(1700000000, 0).UTC()
+
+	// Three days of 5m buckets: only the last 48h are kept
+	for i := 0; i < 3*24*12; i++ {
+		s.Add(Labels{IP: "10.0.0.1"}, 1, 0, 0, now.Add(time.Duration(i)*5*time.Minute))
+	}
+	ser := s.data[Res5m.Name].series[seriesKey{Dim: DimIP, Key: "10.0.0.1"}]
+	if len(ser.points) != slots(Res5m) {
+		t.Fatalf("kept %d buckets, want %d", len(ser.points), slots(Res5m))
+	}
+
+	// A bucket from before a clock step lands in order
+	s.Add(Labels{IP: "10.0.0.1"}, 5, 0, 0, now.Add(3*24*time.Hour-time.Hour))
+	pts := s.Query(DimIP, "10.0.0.1", Res5m, now.Add(3*24*time.Hour-time.Hour), now.Add(3*24*time.Hour-time.Hour+time.Second))
+	if len(pts) != 1 || pts[0].BytesIn != 6 {
+		t.Fatalf("points = %+v", pts)
+	}
+}
+
+func TestStore_SaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1700000000, 0).UTC()
+
+	s := New(Options{Dir: dir})
+	s.Add(Labels{IP: "192.168.1.10", Domain: "youtube.com"}, 4096, 512, 2, now)
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, r := range Resolutions {
+		pts := restored.Query(DimDomain, "youtube.com", r, now, now.Add(time.Second))
+		if len(pts) != 1 || pts[0].BytesIn != 4096 || pts[0].BytesOut != 512 || pts[0].Conns != 2 {
+			t.Fatalf("%s: restored points = %+v", r.Name, pts)
+		}
+	}
+
+	// An empty directory is a fresh store.
+	if _, err := Open(Options{Dir: t.TempDir()}); err != nil {
+		t.Fatalf("open empty dir: %v", err)
+	}
+}
+
+func TestStore_CorruptFileMovedAside(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "traffic-1h.json")
+	if err := os.WriteFile(path, []byte("{truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(Options{Dir: dir})
+	if err == nil {
+		t.Fatal("expected a load error")
+	}
+	if b, err := os.ReadFile(path + ".bad"); err != nil || string(b) != "{truncated" {
+		t.Fatalf("corrupt file not kept aside: %q, %v", b, err)
+	}
+	s.Add(Labels{IP: "10.0.0.1"}, 1, 0, 0, time.Now())
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+}
+
+func TestStore_RefusesToSaveOverUnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	// A directory in place of the file: it cannot be read nor renamed over
+	path := filepath.Join(dir, "traffic-5m.json")
+	if err := os.MkdirAll(filepath.Join(path, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path+".bad", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := Open(Options{Dir: dir})
+	s.Add(Labels{IP: "10.0.0.1"}, 1, 0, 0, time.Now())
+	if err := s.Save(); err == nil {
+		t.Fatal("Save must refuse to overwrite a file that failed to load")
+	}
+}
+
+func TestParseRangeAndResolution(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		res  string
+	}{
+		{"24h", 24 * time.Hour, "5m"},
+		{"7d", 7 * 24 * time.Hour, "1h"},
+		{"30d", 30 * 24 * time.Hour, "1h"},
+		{"90m", 90 * time.Minute, "5m"},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.in)
+		if err != nil || got != tt.want {
+			t.Fatalf("ParseRange(%q)=%v,%v want %v", tt.in, got, err, tt.want)
+		}
+		if r := ResolutionFor(got); r.Name != tt.res {
+			t.Fatalf("ResolutionFor(%v)=%s want %s", got, r.Name, tt.res)
+		}
+	}
+	for _, bad := range []string{"", "0d", "xd", "-1h", "week"} {
+		if _, err := ParseRange(bad); err == nil {
+			t.Fatalf("ParseRange(%q) expected error", bad)
+		}
+	}
+}
+
+func TestBaseDomain(t *testing.T) {
+	tests := map[string]string{
+		"www.facebook.com":         "facebook.com",
+		"facebook.com":             "facebook.com",
+		"a.b.c.googlevideo.com":    "googlevideo.com",
+		"www.globo.com.br":         "globo.com.br",
+		"api.mercadolivre.com.br.": "mercadolivre.com.br",
+		"WWW.BBC.CO.UK":            "bbc.co.uk",
+		"192.168.1.1":              "192.168.1.1",
+		"localhost":                "localhost",
+	}
+	for in, want := range tests {
+		if got := BaseDomain(in); got != want {
+			t.Fatalf("BaseDomain(%q)=%q want %q", in, got, want)
+		}
+	}
+}
@@ -9,6 +9,8 @@
  * Format generated to /usr/local/etc/zid-proxy/appid_rules.txt:
  *   BLOCK_APP;group_name;app_name
  *   ALLOW_APP;group_name;app_name
+ *   BLOCK_CATEGORY;group_name;category (kept as written; edit the file to change them)
+ *   ALLOW_CATEGORY;group_name;category
  */
 
 require_once("guiconfig.inc");
@@ -159,7 +161,7 @@ function load_appid_rules() {
 		$group = trim($parts[1]);
 		$app = strtolower(trim($parts[2]));
 
-		if (!in_array($type, ['BLOCK_APP', 'ALLOW_APP'])) {
+		if (!in_array($type, ['BLOCK_APP', 'ALLOW_APP', 'BLOCK_CATEGORY', 'ALLOW_CATEGORY'])) {
 			continue;
 		}
 
@@ -189,10 +191,11 @@ function save_appid_rules($rules) {
 
 	file_put_contents(APPID_RULES_FILE, $content);
 
-	// Reload zid-appid if running
+	// Reload zid-appid if running; zid-proxy enforces the rules too
 	if (is_service_running('zid-appid')) {
 		exec('/bin/pkill -HUP -f zid-appid');
 	}
+	zidproxy_reload();
 }
 
 // Handle form submission
@@ -200,7 +203,13 @@ $input_errors = array();
 $savemsg = '';
 
 if ($_SERVER['REQUEST_METHOD'] === 'POST' && isset($_POST['save'])) {
+	// Category rules are not edited on this page: keep them
 	$new_rules = array();
+	foreach (load_appid_rules() as $key => $type) {
+		if (strpos($type, '_CATEGORY') !== false) {
+			$new_rules[$key] = $type;
+		}
+	}
 
 	foreach ($groups as $g) {
 		$group_name = $g['name'];
@@ -282,7 +282,7 @@ $section->addInput(new Form_Textarea(
 	'rules',
 	'Rules (one per line)',
 	$pconfig['rules_text'] ?? ''
-))->setHelp("Format: TYPE;HOSTNAME (e.g., BLOCK;*.facebook.com). Optional inline comment: # description");
+))->setHelp("Format: TYPE;HOSTNAME (e.g., BLOCK;*.facebook.com, or BLOCK;@category:games for a whole AppID category). Optional inline comment: # description");
 
 $form->add($section);
 print($form);
@@ -108,6 +108,7 @@ if ($_SERVER['REQUEST_METHOD'] === 'POST') {
 			// Checkboxes: absence means "off" only for this settings form.
 			$new['enable'] = isset($post['enable']) ? 'on' : 'off';
 			$new['enable_logging'] = isset($post['enable_logging']) ? 'on' : 'off';
+			$new['active_ips_persist'] = isset($post['active_ips_persist']) ? 'on' : 'off';
 
 			// Other fields: only override when present (avoid resetting to defaults unexpectedly).
 			if (isset($post['interface']) && trim((string)$post['interface']) !== '') {
@@ -155,6 +156,7 @@ if ($_SERVER['REQUEST_METHOD'] === 'POST') {
 		'log_retention_days' => $zidcfg['log_retention_days'] ?? '7',
 		'active_ips_timeout_seconds' => $zidcfg['active_ips_timeout_seconds'] ?? '300',
 		'active_ips_refresh_seconds' => $zidcfg['active_ips_refresh_seconds'] ?? '5',
+		'active_ips_persist' => $zidcfg['active_ips_persist'] ?? 'on',
 	];
 
 include("head.inc");
@@ -317,6 +319,13 @@ $section2->addInput(new Form_Input(
 		$pconfig['active_ips_refresh_seconds']
 	))->setHelp(gettext('Snapshot/UI refresh interval. Default: 5 (range 1-300).'));
 
+	$section2->addInput(new Form_Checkbox(
+		'active_ips_persist',
+		gettext('Keep Active IPs Across Restarts'),
+		gettext('Save the Active IPs byte counters to /var/db/zid-proxy/active_ips.state.json and restore them at startup'),
+		($pconfig['active_ips_persist'] === 'on')
+	));
+
 $form->add($section);
 $form->add($section2);
 
@@ -37,6 +37,7 @@ mkdir -p ${PREFIX}/etc/rc.d
 mkdir -p ${PREFIX}/sbin
 mkdir -p ${PREFIX}/etc/zid-proxy
 mkdir -p ${PREFIX}/share/pfSense-pkg-zid-proxy
+mkdir -p ${PREFIX}/share/zid-proxy
 mkdir -p /etc/inc/priv
 mkdir -p /var/log
 
@@ -64,6 +65,10 @@ cp -f ${FILES_DIR}/etc/inc/priv/zid-proxy.priv.inc /etc/inc/priv/
 echo "Installing package info..."
 cp -f ${FILES_DIR}${PREFIX}/share/pfSense-pkg-zid-proxy/info.xml ${PREFIX}/share/pfSense-pkg-zid-proxy/
 
+# Install AppID signatures (versioned, reloaded on SIGHUP)
+echo "Installing AppID signatures..."
+cp -f ${FILES_DIR}${PREFIX}/share/zid-proxy/appid_signatures.json ${PREFIX}/share/zid-proxy/
+
 # Install updater helper (so future updates don't require manual tar/scp)
 if [ -f "${PKG_DIR}/update-bootstrap.sh" ]; then
     echo "Installing updater helper..."
@@ -119,6 +124,17 @@ else
     echo "         You can still use ZID Proxy without daily log rotation."
 fi
 
+# Optional helper binary: zid-proxy-stats (traffic history for the GUI charts)
+STATS_BINARY_PATH="${PKG_DIR}/../build/zid-proxy-stats"
+if [ -f "${STATS_BINARY_PATH}" ]; then
+    echo "Installing zid-proxy-stats binary..."
+    TMP_BIN="${PREFIX}/sbin/.zid-proxy-stats.new.$$"
+    cp "${STATS_BINARY_PATH}" "${TMP_BIN}"
+    chmod 755 "${TMP_BIN}"
+    mv -f "${TMP_BIN}" "${PREFIX}/sbin/zid-proxy-stats"
+    chmod 755 ${PREFIX}/sbin/zid-proxy-stats
+fi
+
 # Optional helper binary: zid-appid
 APPID_BINARY_PATH="${PKG_DIR}/../build/zid-appid"
 if [ -f "${APPID_BINARY_PATH}" ]; then
@@ -133,6 +149,17 @@ else
     echo "         AppID features will use fallback hostname detection."
 fi
 
+# Optional helper binary: zid-appid-usage (app usage reports per user/IP)
+APPID_USAGE_BINARY_PATH="${PKG_DIR}/../build/zid-appid-usage"
+if [ -f "${APPID_USAGE_BINARY_PATH}" ]; then
+    echo "Installing zid-appid-usage binary..."
+    TMP_BIN="${PREFIX}/sbin/.zid-appid-usage.new.$$"
+    cp "${APPID_USAGE_BINARY_PATH}" "${TMP_BIN}"
+    chmod 755 "${TMP_BIN}"
+    mv -f "${TMP_BIN}" "${PREFIX}/sbin/zid-appid-usage"
+    chmod 755 ${PREFIX}/sbin/zid-appid-usage
+fi
+
 # Create default rules file
 if [ ! -f ${PREFIX}/etc/zid-proxy/access_rules.txt ]; then
     echo "Creating default rules file..."
@@ -70,6 +70,8 @@ fi
 echo "Removing binary..."
 rm -f /usr/local/sbin/zid-proxy
 rm -f /usr/local/sbin/zid-proxy-logrotate
+rm -f /usr/local/sbin/zid-proxy-stats
+rm -f /usr/local/sbin/zid-appid-usage
 rm -f /usr/local/sbin/zid-proxy-watchdog
 
 # Remove updater helper
@@ -7,6 +7,9 @@ SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 ROOT_DIR="$(cd "$SCRIPT_DIR/.." && pwd)"
 cd "$ROOT_DIR"
 
+# Release builds must embed the update public key (see Makefile).
+make -s check-release-key
+
 DOCKER_IMAGE="fyne-cross/base:latest"
 
 echo "============================================"
@@ -49,12 +49,24 @@ cp -f build/zid-proxy "${STAGE_DIR_PFSENSE}/build/zid-proxy"
 cp -f build/zid-proxy-logrotate "${STAGE_DIR_PFSENSE}/build/zid-proxy-logrotate"
 chmod 755 "${STAGE_DIR_PFSENSE}/build/zid-proxy" "${STAGE_DIR_PFSENSE}/build/zid-proxy-logrotate"
 
+# Include zid-proxy-stats if available
+if [ -f build/zid-proxy-stats ]; then
+	cp -f build/zid-proxy-stats "${STAGE_DIR_PFSENSE}/build/zid-proxy-stats"
+	chmod 755 "${STAGE_DIR_PFSENSE}/build/zid-proxy-stats"
+fi
+
 # Include zid-appid if available
 if [ -f build/zid-appid ]; then
 	cp -f build/zid-appid "${STAGE_DIR_PFSENSE}/build/zid-appid"
 	chmod 755 "${STAGE_DIR_PFSENSE}/build/zid-appid"
 fi
 
+# Include zid-appid-usage if available
+if [ -f build/zid-appid-usage ]; then
+	cp -f build/zid-appid-usage "${STAGE_DIR_PFSENSE}/build/zid-appid-usage"
+	chmod 755 "${STAGE_DIR_PFSENSE}/build/zid-appid-usage"
+fi
+
 cp -f build/zid-agent-linux-amd64 "${STAGE_DIR_AGENT_LINUX}/zid-agent-linux-amd64"
 chmod 755 "${STAGE_DIR_AGENT_LINUX}/zid-agent-linux-amd64"
 cp -f build/zid-agent-windows-amd64.exe "${STAGE_DIR_AGENT_WINDOWS}/zid-agent-windows-amd64.exe"